@@ -15,15 +15,22 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	http "github.com/uswitch/kiam/pkg/aws/metadata"
 	kiamserver "github.com/uswitch/kiam/pkg/server"
 )
 
+// selfTestTimeout bounds each step of the startup self-test.
+const selfTestTimeout = 5 * time.Second
+
 type agentCommand struct {
 	logOptions
 	telemetryOptions
@@ -35,6 +42,9 @@ type agentCommand struct {
 	iptablesRemove bool
 	hostIP         string
 	hostInterface  string
+	unixSocketMode string
+	selfTest       bool
+	metadataRoutes []string
 }
 
 func (cmd *agentCommand) Bind(parser parser) {
@@ -46,8 +56,43 @@ func (cmd *agentCommand) Bind(parser parser) {
 	cmd.ServerOptions = http.DefaultOptions()
 
 	parser.Flag("port", "HTTP port").Default("3100").IntVar(&cmd.ListenPort)
+	parser.Flag("unix-socket", "Also serve on a unix socket at this path. Clients identify themselves with the X-Kiam-Client-IP header. Only the socket is served when --port is 0.").Default("").StringVar(&cmd.UnixSocket)
+	parser.Flag("unix-socket-mode", "Permissions of the unix socket, in octal.").Default("0660").StringVar(&cmd.unixSocketMode)
+	parser.Flag("reuse-port", "Bind --port with SO_REUSEPORT so a replacement agent can start listening before this one stops. Linux only.").Default("false").BoolVar(&cmd.ReusePort)
+	parser.Flag("proxy-protocol", "Read client IPs from a PROXY protocol header on connections to --port. Only read from connections from a --trusted-proxy.").Default("false").BoolVar(&cmd.ProxyProtocol)
 	parser.Flag("allow-ip-query", "Allow client IP to be specified with ?ip. Development use only.").Default("false").BoolVar(&cmd.AllowIPQuery)
+	parser.Flag("trust-forwarded-for", "Derive the client IP from X-Forwarded-For when requests come from a trusted proxy.").Default("false").BoolVar(&cmd.TrustForwardedFor)
+	parser.Flag("client-ip-header", "Header trusted proxies set the client IP in, such as one set by the CNI, when --trust-forwarded-for is set. Formatted like X-Forwarded-For.").Default(http.DefaultClientIPHeader).StringVar(&cmd.ClientIPHeader)
+	parser.Flag("trusted-hops", "Number of proxies in front of the agent when --trust-forwarded-for is set. The client IP is taken from that many entries from the end of the header, and requests with fewer entries are rejected. When 0 the right-most entry that isn't a --trusted-proxy is used.").Default("0").IntVar(&cmd.TrustedHops)
+	parser.Flag("trusted-proxy", "CIDR of a proxy trusted to set X-Forwarded-For or send PROXY protocol headers. Can be repeated.").StringsVar(&cmd.TrustedProxies)
+	parser.Flag("rate-limit", "Requests per second permitted from each pod, exceeding this returns 429 Too Many Requests. 0 disables rate limiting.").Default("0").Float64Var(&cmd.RateLimit)
+	parser.Flag("rate-limit-burst", "Number of requests each pod may burst above the rate limit.").Default("10").IntVar(&cmd.RateLimitBurst)
+	parser.Flag("pod-not-found-retry-timeout", "Time requests are retried while the pod isn't yet known to the server. Requests for roles and credentials are given until the longer of the retry timeouts, plus 1s, to complete.").Default("5s").DurationVar(&cmd.PodNotFoundRetryTimeout)
+	parser.Flag("error-retry-timeout", "Time requests are retried after other errors from the server.").Default("5s").DurationVar(&cmd.ErrorRetryTimeout)
+	parser.Flag("credentials-cache-headers", "Set Cache-Control and Expires headers on credentials responses from the credentials' expiry.").Default("false").BoolVar(&cmd.CredentialsCacheHeaders)
+	parser.Flag("json-errors", "Return errors as JSON with a stable code, rather than plain text.").Default("false").BoolVar(&cmd.JSONErrors)
+	parser.Flag("proxy-metadata-endpoint", "URL of the metadata endpoint requests are proxied to. Defaults to the instance metadata service.").Default("").StringVar(&cmd.ProxyMetadataEndpoint)
+	parser.Flag("health-metadata-endpoint", "URL of the metadata endpoint requested by deep health checks. Defaults to the instance metadata service.").Default("").StringVar(&cmd.HealthMetadataEndpoint)
+	parser.Flag("disable-proxy", "Return 404 for metadata requests other than credentials, rather than proxying them to the metadata endpoint.").Default("false").BoolVar(&cmd.DisableProxy)
 	parser.Flag("whitelist-route-regexp", "Proxy routes matching this regular expression").Default("^$").RegexpVar(&cmd.WhitelistRouteRegexp)
+	parser.Flag("metadata-route", "How requests for a metadata path kiam doesn't serve itself are handled, as pattern=proxy, pattern=block or pattern=synthesize:body where pattern is a regular expression matching the path. Takes precedence over --whitelist-route-regexp. Can be repeated, the first matching route applies.").StringsVar(&cmd.metadataRoutes)
+	parser.Flag("allow-instance-role", "Proxy whitelisted requests for the node's instance role and its credentials, rather than blocking them with a 403. Pods can use them to bypass kiam.").Default("false").BoolVar(&cmd.AllowInstanceRole)
+	parser.Flag("node-role-fallback", "Proxy requests for the node's instance role and its credentials from pods the server permits it with --node-role-pods. Other pods are blocked with a 403.").Default("false").BoolVar(&cmd.NodeRoleFallback)
+	parser.Flag("role-arn-header", "Set the X-Kiam-Role-Arn header on credentials responses to the role ARN the server issued them for. For debugging, it reveals the role's account and path to clients.").Default("false").BoolVar(&cmd.RoleARNHeader)
+	parser.Flag("proxy-max-idle-conns", "Maximum idle connections kept to the metadata endpoint. 0 uses the default.").Default("0").IntVar(&cmd.ProxyMaxIdleConns)
+	parser.Flag("proxy-idle-conn-timeout", "Time idle connections to the metadata endpoint are kept open. 0 uses the default.").Default("0s").DurationVar(&cmd.ProxyIdleConnTimeout)
+	parser.Flag("proxy-keepalive", "TCP keepalive period for connections to the metadata endpoint. 0 uses the default.").Default("0s").DurationVar(&cmd.ProxyKeepAlive)
+	parser.Flag("proxy-timeout", "Maximum time a request proxied to the metadata endpoint may take, including reading the response. Slower requests fail with a 502. 0 is unbounded.").Default("0s").DurationVar(&cmd.ProxyTimeout)
+	parser.Flag("proxy-max-response-bytes", "Maximum size of responses proxied from the metadata endpoint. Larger responses fail with a 502. 0 is unbounded.").Default("0").Int64Var(&cmd.ProxyMaxResponseBytes)
+	parser.Flag("compress-proxy-responses", "Gzip responses proxied from the metadata endpoint, such as user-data, for clients that accept it.").Default("false").BoolVar(&cmd.CompressProxyResponses)
+	parser.Flag("proxy-strip-header", "Header removed from requests proxied to the metadata endpoint. Can be repeated, replacing the defaults.").Default(http.DefaultProxyStripHeaders...).StringsVar(&cmd.ProxyStripHeaders)
+	parser.Flag("ecs-credentials-uri", "Serve credentials in the ECS container credentials format at this relative URI (e.g. /v2/credentials). Disabled when empty.").Default("").StringVar(&cmd.ECSCredentialsURI)
+	parser.Flag("role-base-arn", "Base ARN used to resolve the RoleArn returned by the ECS credentials endpoint (e.g. arn:aws:iam::123456789012:role/).").Default("").StringVar(&cmd.RoleBaseARN)
+	parser.Flag("identity-document", "How the instance identity document is served: proxy it, synthesize it with only --identity-document-account-id and --identity-document-region, or disabled to return 404.").Default(http.IdentityDocumentProxy).EnumVar(&cmd.IdentityDocument, http.IdentityDocumentProxy, http.IdentityDocumentSynthesize, http.IdentityDocumentDisabled)
+	parser.Flag("identity-document-account-id", "Account ID in the synthesized instance identity document.").Default("").StringVar(&cmd.IdentityDocumentAccountID)
+	parser.Flag("identity-document-region", "Region in the synthesized instance identity document.").Default("").StringVar(&cmd.IdentityDocumentRegion)
+
+	parser.Flag("self-test", "Check the server can be reached over mTLS at startup, failing with a description of any certificate problems.").Default("false").BoolVar(&cmd.selfTest)
 
 	parser.Flag("iptables", "Add IPTables rules").Default("false").BoolVar(&cmd.iptables)
 	parser.Flag("iptables-remove", "Remove iptables rules at shutdown").Default("true").BoolVar(&cmd.iptablesRemove)
@@ -59,6 +104,28 @@ func (cmd *agentCommand) Bind(parser parser) {
 func (opts *agentCommand) run() error {
 	opts.configureLogger()
 
+	if err := opts.configureMetrics(); err != nil {
+		return err
+	}
+
+	if err := opts.tlsOptions.validate(); err != nil {
+		return err
+	}
+
+	mode, err := strconv.ParseUint(opts.unixSocketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid unix socket mode %q: %s", opts.unixSocketMode, err)
+	}
+	opts.UnixSocketMode = os.FileMode(mode)
+
+	for _, r := range opts.metadataRoutes {
+		route, err := http.ParseMetadataRoute(r)
+		if err != nil {
+			return err
+		}
+		opts.MetadataRoutes = append(opts.MetadataRoutes, route)
+	}
+
 	if opts.iptables {
 		log.Infof("configuring iptables")
 		rules := newIPTablesRules(opts.hostIP, opts.ListenPort, opts.hostInterface)
@@ -83,16 +150,33 @@ func (opts *agentCommand) run() error {
 	stopChan := make(chan os.Signal, 8)
 	signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM)
 
+	if opts.selfTest && !opts.insecure {
+		if err := opts.checkServerTLS(ctx); err != nil {
+			return err
+		}
+	}
+
 	ctxGateway, cancelCtxGateway := context.WithTimeout(context.Background(), opts.timeoutKiamGateway)
 	defer cancelCtxGateway()
 
-	gateway, err := kiamserver.NewGateway(ctxGateway, opts.serverAddress, opts.caPath, opts.certificatePath, opts.keyPath, opts.keepaliveParams)
+	gateway, err := opts.clientOptions.newGateway(ctxGateway, &opts.tlsOptions)
 	if err != nil {
 		log.Errorf("error creating server gateway: %s", err.Error())
 		return err
 	}
 	defer gateway.Close()
 
+	if opts.selfTest {
+		ctxHealth, cancelHealth := context.WithTimeout(ctx, selfTestTimeout)
+		defer cancelHealth()
+		health, err := gateway.Health(ctxHealth)
+		if err != nil {
+			log.Errorf("self-test failed, error checking server health: %s", err.Error())
+			return err
+		}
+		log.WithField("server.health", health).Infof("self-test passed")
+	}
+
 	server, err := http.NewWebServer(opts.ServerOptions, gateway)
 	if err != nil {
 		log.Errorf("error creating agent http server: %s", err.Error())
@@ -122,6 +206,24 @@ func (opts *agentCommand) run() error {
 	return nil
 }
 
+// checkServerTLS performs a TLS handshake with the server, logging whether a
+// failure is due to certificates or connectivity.
+func (opts *agentCommand) checkServerTLS(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	err := kiamserver.CheckServerTLS(ctx, opts.serverAddress, opts.caPath, opts.certificatePath, opts.keyPath)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, kiamserver.ErrServerUnreachable):
+		log.Errorf("self-test failed, server %s couldn't be reached. check the server address and network: %s", opts.serverAddress, err.Error())
+	default:
+		log.Errorf("self-test failed, tls handshake with the server was unsuccessful. check the agent and server certificates: %s", err.Error())
+	}
+	return err
+}
+
 func (opts *agentCommand) Run() {
 	if err := opts.run(); err != nil {
 		log.Fatalf("fatal error: %s", err.Error())
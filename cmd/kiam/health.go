@@ -19,7 +19,6 @@ import (
 
 	"github.com/cenkalti/backoff"
 	log "github.com/sirupsen/logrus"
-	kiamserver "github.com/uswitch/kiam/pkg/server"
 )
 
 type healthCommand struct {
@@ -40,10 +39,14 @@ func (cmd *healthCommand) Bind(parser parser) {
 func (opts *healthCommand) Run() {
 	opts.configureLogger()
 
+	if err := opts.tlsOptions.validate(); err != nil {
+		log.Fatal(err.Error())
+	}
+
 	ctxGateway, cancelCtxGateway := context.WithTimeout(context.Background(), opts.timeoutKiamGateway)
 	defer cancelCtxGateway()
 
-	gateway, err := kiamserver.NewGateway(ctxGateway, opts.serverAddress, opts.caPath, opts.certificatePath, opts.keyPath, opts.keepaliveParams)
+	gateway, err := opts.clientOptions.newGateway(ctxGateway, &opts.tlsOptions)
 	if err != nil {
 		log.Fatalf("error creating server gateway: %s", err.Error())
 	}
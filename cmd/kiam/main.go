@@ -29,6 +29,9 @@ func main() {
 	var health healthCommand
 	health.Bind(rootParser.Command("health", "run the health check"))
 
+	var validate validateCommand
+	validate.Bind(rootParser.Command("validate", "validate the server can assume roles, without starting it"))
+
 	switch kingpin.Parse() {
 	case "agent":
 		agent.Run()
@@ -36,6 +39,8 @@ func main() {
 		server.Run()
 	case "health":
 		health.Run()
+	case "validate":
+		validate.Run()
 	}
 }
 
@@ -18,20 +18,25 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc/keepalive"
+	"github.com/uswitch/kiam/pkg/logging"
 	"github.com/uswitch/kiam/pkg/pprof"
 	"github.com/uswitch/kiam/pkg/prometheus"
+	kiamserver "github.com/uswitch/kiam/pkg/server"
 	"github.com/uswitch/kiam/pkg/statsd"
+	"github.com/uswitch/kiam/pkg/tracing"
 	"time"
 )
 
 type logOptions struct {
-	jsonLog  bool
-	logLevel string
+	jsonLog         bool
+	logLevel        string
+	componentLevels map[string]string
 }
 
 func (o *logOptions) bind(parser parser) {
 	parser.Flag("json-log", "Output log in JSON").BoolVar(&o.jsonLog)
 	parser.Flag("level", "Log level: debug, info, warn, error.").Default("info").EnumVar(&o.logLevel, "debug", "info", "warn", "error")
+	parser.Flag("component-level", "Log level of a component, overriding --level, as component=level. Components are access, k8s, metadata, prefetch, server and sts. Can be repeated.").PlaceHolder("COMPONENT=LEVEL").StringMapVar(&o.componentLevels)
 }
 
 func (o *logOptions) configureLogger() {
@@ -49,6 +54,14 @@ func (o *logOptions) configureLogger() {
 	case "error":
 		log.SetLevel(log.ErrorLevel)
 	}
+
+	levels, err := logging.ParseLevels(o.componentLevels)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := logging.Configure(levels); err != nil {
+		log.Fatal(err.Error())
+	}
 }
 
 type telemetryOptions struct {
@@ -57,7 +70,9 @@ type telemetryOptions struct {
 	statsDPrefix     string
 	prometheusListen string
 	prometheusSync   time.Duration
+	prometheusNS     string
 	pprofListen      string
+	tracing          tracing.Config
 }
 
 func (o *telemetryOptions) bind(parser parser) {
@@ -67,8 +82,19 @@ func (o *telemetryOptions) bind(parser parser) {
 
 	parser.Flag("prometheus-listen-addr", "Prometheus HTTP listen address. e.g. localhost:9620").StringVar(&o.prometheusListen)
 	parser.Flag("prometheus-sync-interval", "How frequently to update Prometheus metrics").Default("5s").DurationVar(&o.prometheusSync)
+	parser.Flag("prometheus-namespace", "Namespace Prometheus metrics are exported with, to avoid collisions with other applications. Empty exports them without a namespace.").Default(prometheus.DefaultNamespace).StringVar(&o.prometheusNS)
+
+	parser.Flag("pprof-listen-addr", "Loopback address to serve pprof profiles at /debug/pprof/ on. e.g. localhost:9990").Default("").StringVar(&o.pprofListen)
 
-	parser.Flag("pprof-listen-addr", "Address to bind pprof HTTP server. e.g. localhost:9990").Default("").StringVar(&o.pprofListen)
+	parser.Flag("otlp-endpoint", "OTLP/HTTP collector address to export traces to. e.g. localhost:4318. Disabled when empty.").Default("").StringVar(&o.tracing.Endpoint)
+	parser.Flag("otlp-insecure", "Export traces over HTTP rather than HTTPS").Default("false").BoolVar(&o.tracing.Insecure)
+	parser.Flag("trace-sample-ratio", "Fraction of traces sampled when the caller hasn't already sampled the request").Default("1").Float64Var(&o.tracing.SampleRatio)
+}
+
+// configureMetrics registers kiam's Prometheus metrics under the configured
+// namespace. It must be called before anything records metrics.
+func (o telemetryOptions) configureMetrics() error {
+	return prometheus.SetNamespace(o.prometheusNS)
 }
 
 func (o telemetryOptions) start(ctx context.Context, identifier string) {
@@ -87,7 +113,19 @@ func (o telemetryOptions) start(ctx context.Context, identifier string) {
 		metrics.Listen(ctx)
 	}
 
+	shutdown, err := tracing.Start(ctx, fmt.Sprintf("kiam-%s", identifier), o.tracing)
+	if err != nil {
+		log.Fatalf("Error starting tracing: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		shutdown(context.Background())
+	}()
+
 	if o.pprofListen != "" {
+		if err := kiamserver.ValidateLoopbackAddress(o.pprofListen); err != nil {
+			log.Fatalf("Error starting pprof server: %v", err)
+		}
 		log.Infof("pprof listen address specified, will listen on %s", o.pprofListen)
 		server := pprof.NewServer(o.pprofListen)
 		go pprof.ListenAndWait(ctx, server)
@@ -98,12 +136,25 @@ type tlsOptions struct {
 	certificatePath string
 	keyPath         string
 	caPath          string
+	insecure        bool
 }
 
 func (o *tlsOptions) bind(parser parser) {
-	parser.Flag("cert", "Certificate path").Required().ExistingFileVar(&o.certificatePath)
-	parser.Flag("key", "Key path").Required().ExistingFileVar(&o.keyPath)
-	parser.Flag("ca", "CA certificate path").Required().ExistingFileVar(&o.caPath)
+	parser.Flag("cert", "Certificate path").ExistingFileVar(&o.certificatePath)
+	parser.Flag("key", "Key path").ExistingFileVar(&o.keyPath)
+	parser.Flag("ca", "CA certificate path").ExistingFileVar(&o.caPath)
+	parser.Flag("insecure", "Disable TLS between agents and servers. UNSAFE: credentials are sent in plain text, for local development only.").Default("false").BoolVar(&o.insecure)
+}
+
+// validate checks certificates are configured unless TLS is disabled.
+func (o *tlsOptions) validate() error {
+	if o.insecure {
+		return nil
+	}
+	if o.certificatePath == "" || o.keyPath == "" || o.caPath == "" {
+		return fmt.Errorf("--cert, --key and --ca are required unless --insecure is set")
+	}
+	return nil
 }
 
 type clientOptions struct {
@@ -111,12 +162,24 @@ type clientOptions struct {
 	serverAddressRefresh time.Duration
 	timeoutKiamGateway   time.Duration
 	keepaliveParams      keepalive.ClientParameters
+	messages             kiamserver.MessageConfig
+}
+
+// newGateway connects to the server, without TLS when it's disabled.
+func (o *clientOptions) newGateway(ctx context.Context, tls *tlsOptions) (*kiamserver.KiamGateway, error) {
+	if tls.insecure {
+		return kiamserver.NewInsecureGateway(ctx, o.serverAddress, o.keepaliveParams, o.messages)
+	}
+	return kiamserver.NewGateway(ctx, o.serverAddress, tls.caPath, tls.certificatePath, tls.keyPath, o.keepaliveParams, o.messages)
 }
 
 func (o *clientOptions) bind(parser parser) {
 	parser.Flag("grpc-keepalive-time-ms", "gRPC keepalive time").Default("10s").DurationVar(&o.keepaliveParams.Time)
 	parser.Flag("grpc-keepalive-timeout-ms", "gRPC keepalive timeout").Default("2s").DurationVar(&o.keepaliveParams.Timeout)
 	parser.Flag("grpc-keepalive-permit-without-stream", "gRPC keepalive ping even with no RPC").BoolVar(&o.keepaliveParams.PermitWithoutStream)
+	parser.Flag("grpc-max-recv-msg-size", "Maximum size in bytes of gRPC messages received from the server. 0 uses gRPC's default of 4MiB.").Default("0").IntVar(&o.messages.MaxRecvMsgSize)
+	parser.Flag("grpc-max-send-msg-size", "Maximum size in bytes of gRPC messages sent to the server. 0 uses gRPC's default.").Default("0").IntVar(&o.messages.MaxSendMsgSize)
+	parser.Flag("grpc-compression", "Gzip gRPC messages sent to the server.").Default("false").BoolVar(&o.messages.Compression)
 	parser.Flag("server-address", "gRPC address to Kiam server service").Default("localhost:9610").StringVar(&o.serverAddress)
 	parser.Flag("server-address-refresh", "Interval to refresh server service endpoints ( deprecated )").Default("0s").DurationVar(&o.serverAddressRefresh)
 	parser.Flag("gateway-timeout-creation", "Timeout to create the kiam gateway ").Default("1s").DurationVar(&o.timeoutKiamGateway)
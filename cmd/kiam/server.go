@@ -15,12 +15,17 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/uswitch/kiam/pkg/aws/sts"
+	"github.com/uswitch/kiam/pkg/k8s"
 	serv "github.com/uswitch/kiam/pkg/server"
 )
 
@@ -45,24 +50,123 @@ type serverOptions struct {
 	*serv.Config
 }
 
+// roleDurations parses repeated role=duration flags.
+type roleDurations map[string]time.Duration
+
+func (d roleDurations) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected role=duration, got %q", value)
+	}
+	duration, err := time.ParseDuration(parts[1])
+	if err != nil {
+		return err
+	}
+	d[parts[0]] = duration
+	return nil
+}
+
+func (d roleDurations) String() string {
+	return ""
+}
+
+func (d roleDurations) IsCumulative() bool {
+	return true
+}
+
 func (o *serverOptions) bind(parser parser) {
 	parser.Flag("fetchers", "Number of parallel fetcher go routines").Default("8").IntVar(&o.ParallelFetcherProcesses)
+	parser.Flag("wait-for-initial-prefetch", "Report the server unhealthy, and agents not ready, until credentials for the roles of pods running at startup have been prefetched.").Default("false").BoolVar(&o.WaitForInitialPrefetch)
 	parser.Flag("prefetch-buffer-size", "How many Pod events to hold in memory between the Pod watcher and Prefetch manager.").Default("1000").IntVar(&o.PrefetchBufferSize)
+	parser.Flag("prefetch-selector", "Label selector restricting the pods credentials are prefetched and refreshed for, e.g. kiam-prefetch=true. Other pods are issued credentials when they request them.").Default("").StringVar(&o.PrefetchSelector)
 	parser.Flag("bind", "gRPC bind address").Default("localhost:9610").StringVar(&o.BindAddress)
 	parser.Flag("kubeconfig", "Path to .kube/config (or empty for in-cluster)").Default("").StringVar(&o.KubeConfig)
 	parser.Flag("sync", "Pod cache sync interval").Default("1m").DurationVar(&o.PodSyncInterval)
+	parser.Flag("sync-jitter", "Maximum factor by which the pod cache sync interval is randomly extended, spreading syncs across replicas.").Default("0.1").Float64Var(&o.PodSyncJitter)
+	o.PodWatchBackoff = k8s.DefaultWatchBackoff()
+	parser.Flag("pod-watch-backoff", "Delay before listing or watching pods again after the api server fails, doubling with each consecutive failure. 0 disables backoff.").Default(o.PodWatchBackoff.Initial.String()).DurationVar(&o.PodWatchBackoff.Initial)
+	parser.Flag("pod-watch-backoff-max", "Maximum delay between attempts to list or watch pods while the api server is unavailable.").Default(o.PodWatchBackoff.Max.String()).DurationVar(&o.PodWatchBackoff.Max)
+	parser.Flag("pod-watch-backoff-jitter", "Maximum factor by which each pod watch backoff delay is randomly extended, spreading reconnects across replicas.").Default(fmt.Sprint(o.PodWatchBackoff.Jitter)).Float64Var(&o.PodWatchBackoff.Jitter)
+	parser.Flag("network-attachment-ips", "Also identify pods by the IPs of network attachments in their k8s.v1.cni.cncf.io/network-status annotation. The annotation isn't trusted for IPs assigned to another pod.").BoolVar(&o.NetworkAttachmentIPs)
+	parser.Flag("deleted-pod-grace-period", "Time deleted pods can still request credentials, so shutdown tasks of terminating pods succeed. 0 disables the grace period.").Default("0s").DurationVar(&o.DeletedPodGracePeriod)
 	parser.Flag("role-base-arn", "Base ARN for roles. e.g. arn:aws:iam::123456789:role/").StringVar(&o.RoleBaseARN)
+	parser.Flag("partition", "AWS partition roles are in (aws, aws-cn or aws-us-gov). Role ARNs and the STS endpoint must match. Inferred from --region, or --role-base-arn, when empty.").Default("").StringVar(&o.Partition)
+	parser.Flag("allowed-role", "Regular expression matching roles the server may assume, regardless of pod annotations. Can be repeated, all roles are allowed when unset.").StringsVar(&o.AllowedRoles)
+	parser.Flag("deny-namespace", "Namespace whose pods are never issued credentials, regardless of annotations. Can be repeated.").StringsVar(&o.DeniedNamespaces)
+	parser.Flag("node-role-pods", "Pods permitted the node's own instance role by agents run with --node-role-fallback, as namespace/selector, e.g. kube-system/app=node-exporter. Can be repeated.").PlaceHolder("NAMESPACE/SELECTOR").StringsVar(&o.NodeRolePods)
+	parser.Flag("allow-wildcard-permitted-patterns", "Allow namespaces' iam.amazonaws.com/permitted-patterns annotation to include patterns without a literal prefix, such as * or ?*, which can permit every role. They're ignored otherwise.").Default("false").BoolVar(&o.AllowWildcardPermittedPatterns)
+	parser.Flag("role-label", "Label specifying a pod's role, in addition to the role annotation. Disabled when empty.").Default("").StringVar(&o.RoleSource.Label)
+	parser.Flag("ignore-role-annotation", "Only read a pod's role from the role label.").Default("false").BoolVar(&o.RoleSource.IgnoreAnnotation)
+	parser.Flag("prefer-role-label", "Use the role label rather than the annotation when a pod has both.").Default("false").BoolVar(&o.RoleSource.PreferLabel)
+	parser.Flag("reject-role-conflicts", "Treat pods whose role annotation and label differ as having no role, rather than using the preferred one.").Default("false").BoolVar(&o.RoleSource.RejectConflicts)
+	parser.Flag("service-account-roles", "Use the role annotated on a pod's ServiceAccount when the pod isn't annotated. Requires permission to watch serviceaccounts.").Default("false").BoolVar(&o.ServiceAccountRoles)
+	parser.Flag("session-policy-configmaps", "Read session policies referenced by a pod's iam.amazonaws.com/session-policy-configmap annotation from ConfigMaps in its namespace. Requires permission to watch configmaps.").Default("false").BoolVar(&o.SessionPolicyConfigMaps)
+	parser.Flag("source-identity", "Set the pod's namespace and service account as the source identity of sessions. Role trust policies must permit sts:SetSourceIdentity.").Default("false").BoolVar(&o.SourceIdentity)
+	parser.Flag("request-log-level", "Level successful requests are logged at: info, debug or off. Errors are always logged.").Default(serv.RequestLogInfo).EnumVar(&o.RequestLogLevel, serv.RequestLogInfo, serv.RequestLogDebug, serv.RequestLogOff)
+	parser.Flag("admin-listen-addr", "Loopback address to serve read-only diagnostics of cached credentials, e.g. localhost:9630. Disabled when empty.").Default("").StringVar(&o.AdminAddress)
+	parser.Flag("default-role", "Role used for pods without a role annotation, subject to namespace restrictions. Disabled when empty.").Default("").StringVar(&o.DefaultRole)
+	parser.Flag("max-role-length", "Longest role, including any ARN prefix and path, accepted from pods. Pods with longer roles, or roles containing characters IAM doesn't permit, have no role.").Default(strconv.Itoa(k8s.DefaultMaxRoleLength)).IntVar(&o.MaxRoleLength)
+	parser.Flag("namespace-role-base-arn", "Base ARN for the roles of pods in a namespace, overriding --role-base-arn, as namespace=arn. Can be repeated.").PlaceHolder("NAMESPACE=ARN").StringMapVar(&o.NamespaceRoleBaseARNs)
 	parser.Flag("role-base-arn-autodetect", "Use EC2 metadata service to detect ARN prefix.").BoolVar(&o.AutoDetectBaseARN)
 	parser.Flag("session", "Session name used when creating STS Tokens.").Default("kiam").StringVar(&o.SessionName)
 	parser.Flag("session-duration", "Requested session duration for STS Tokens.").Default("15m").DurationVar(&o.SessionDuration)
+	parser.Flag("max-session-duration", "Longest session duration requested from STS, by --session-duration or a pod's iam.amazonaws.com/session-duration annotation. Longer durations are clamped to it. Defaults to the 12h AWS maximum when 0.").Default("0s").DurationVar(&o.MaxSessionDuration)
+	parser.Flag("sts-breaker-failures", "Consecutive STS failures after which assume role calls fail fast until the cool down elapses. 0 disables the circuit breaker.").Default("0").IntVar(&o.STSBreakerFailures)
+	parser.Flag("sts-breaker-cool-down", "Time the STS circuit breaker stays open before probing STS again.").Default("30s").DurationVar(&o.STSBreakerCoolDown)
+	parser.Flag("sts-http-timeout", "Timeout of each HTTP request to STS. 0 disables the timeout.").Default("0s").DurationVar(&o.STSHTTPTimeout)
+	parser.Flag("sts-max-retries", "Maximum retries of failed STS calls by the AWS SDK. 0 disables retries, -1 uses the SDK default.").Default("-1").IntVar(&o.STSMaxRetries)
+	parser.Flag("sts-max-idle-conns", "Maximum idle connections kept open to STS.").Default(strconv.Itoa(sts.DefaultMaxIdleConns)).IntVar(&o.STSMaxIdleConns)
+	parser.Flag("sts-max-idle-conns-per-host", "Maximum idle connections kept open to each STS endpoint.").Default(strconv.Itoa(sts.DefaultMaxIdleConnsPerHost)).IntVar(&o.STSMaxIdleConnsPerHost)
+	parser.Flag("sts-idle-conn-timeout", "Time idle connections to STS are kept open before being closed.").Default(sts.DefaultIdleConnTimeout.String()).DurationVar(&o.STSIdleConnTimeout)
+	parser.Flag("cache-max-entries", "Maximum number of role credentials to cache, least recently used entries are evicted beyond this. 0 is unbounded.").Default("0").IntVar(&o.CacheMaxEntries)
+	parser.Flag("cache-min-ttl", "Minimum time credentials are cached before being refreshed, even when issued with a shorter validity. Credentials are never cached beyond their expiry.").Default("0s").DurationVar(&o.CacheMinTTL)
+	parser.Flag("disable-stale-credentials", "Return errors when refreshing credentials fails because STS is unavailable, rather than serving the previously issued credentials until they expire.").Default("false").BoolVar(&o.DisableStaleCredentials)
+	parser.Flag("cache-persist-path", "File cached credentials are saved to, encrypted, when the server stops and restored from when it starts, avoiding requesting every role at once after a restart. Disabled when empty.").Default("").StringVar(&o.CachePersistPath)
+	parser.Flag("cache-persist-key-file", "File containing the base64 encoded 32 byte AES-256 key used to encrypt --cache-persist-path, e.g. mounted from a Secret.").Default("").StringVar(&o.CachePersistKeyFile)
 	parser.Flag("session-refresh", "How soon STS Tokens should be refreshed before their expiration.").Default("5m").DurationVar(&o.SessionRefresh)
+	parser.Flag("expiration-skew", "Amount the Expiration reported to clients is brought forward, so they refresh early despite clock skew. Must be less than --session-refresh.").Default("0s").DurationVar(&o.ExpirationSkew)
+	parser.Flag("expiration-jitter", "Maximum amount the Expiration reported to each pod is further brought forward, consistently for the pod, spreading the refreshes of clients sharing a role. With --expiration-skew it must be less than --session-refresh.").Default("0s").DurationVar(&o.ExpirationJitter)
+	o.RoleSessionRefresh = make(map[string]time.Duration)
+	parser.Flag("role-session-refresh", "How soon STS Tokens for a role should be refreshed before their expiration, overriding --session-refresh, as role=duration. Roles are names or ARNs. Can be repeated.").PlaceHolder("ROLE=DURATION").SetValue(roleDurations(o.RoleSessionRefresh))
+	parser.Flag("session-refresh-jitter", "Maximum random amount STS Tokens are refreshed earlier than --session-refresh, spreading the refresh of many roles.").Default("30s").DurationVar(&o.SessionRefreshJitter)
 	parser.Flag("assume-role-arn", "IAM Role to assume before processing requests").Default("").StringVar(&o.AssumeRoleArn)
+	parser.Flag("assume-role-chain-arn", "IAM Role assumed after --assume-role-arn, using its credentials, before processing requests. Can be repeated to chain further roles. Chained sessions are limited to 1 hour by AWS.").StringsVar(&o.AssumeRoleChain)
 	parser.Flag("region", "AWS Region to use for regional STS calls (e.g. us-west-2). Defaults to the global endpoint.").Default("").StringVar(&o.Region)
+	parser.Flag("sts-failover-region", "AWS Region whose STS endpoint is used when STS calls fail because the endpoint for --region is unavailable. Access denied and other client errors don't fail over.").Default("").StringVar(&o.STSFailoverRegion)
+	parser.Flag("sts-credentials-profile", "Profile in the shared credentials file the server calls STS with, rather than the default credential chain.").Default("").StringVar(&o.STSCredentials.Profile)
+	parser.Flag("sts-credentials-file", "Shared credentials file read for --sts-credentials-profile. Defaults to the AWS SDK's location.").Default("").StringVar(&o.STSCredentials.File)
+	parser.Flag("sts-access-key-id", "Static access key id the server calls STS with. For local development only.").Default("").StringVar(&o.STSCredentials.AccessKeyID)
+	parser.Flag("sts-secret-access-key", "Static secret access key the server calls STS with. For local development only.").Default("").Envar("KIAM_STS_SECRET_ACCESS_KEY").StringVar(&o.STSCredentials.SecretAccessKey)
+	parser.Flag("sts-web-identity-role-arn", "Role the server assumes with --sts-web-identity-token-file and calls STS with.").Default("").StringVar(&o.STSCredentials.WebIdentityRoleARN)
+	parser.Flag("sts-web-identity-token-file", "OIDC token file used to assume --sts-web-identity-role-arn.").Default("").StringVar(&o.STSCredentials.WebIdentityTokenFile)
+	parser.Flag("sts-ca-bundle", "Path to PEM encoded CA certificates trusted for STS requests, in addition to the system roots.").Default("").StringVar(&o.STSCABundle)
+	parser.Flag("sts-ca-bundle-replace", "Trust only the --sts-ca-bundle certificates for STS requests, rather than adding them to the system roots.").Default("false").BoolVar(&o.STSCABundleReplace)
+	parser.Flag("sts-http-proxy", "HTTP proxy URL used for STS requests. Defaults to the proxy environment variables.").Default("").StringVar(&o.HTTPProxy)
+
+	parser.Flag("tls-min-version", "Minimum TLS version accepted by the gRPC server, 1.2 or 1.3.").Default(serv.DefaultTLSMinVersion).StringVar(&o.TLS.MinVersion)
+	parser.Flag("tls-cipher-suite", "TLS 1.2 cipher suite the gRPC server may negotiate, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Can be repeated, defaults to Go's secure suites.").StringsVar(&o.TLS.CipherSuites)
+
+	o.Keepalive = serv.DefaultKeepaliveConfig()
+	parser.Flag("grpc-keepalive-time", "Interval after which the server pings idle client connections.").Default(o.Keepalive.Time.String()).DurationVar(&o.Keepalive.Time)
+	parser.Flag("grpc-keepalive-timeout", "How long the server waits for a ping response before closing the connection.").Default(o.Keepalive.Timeout.String()).DurationVar(&o.Keepalive.Timeout)
+	parser.Flag("grpc-keepalive-min-time", "Minimum interval clients are permitted to ping, clients pinging more frequently are disconnected.").Default(o.Keepalive.MinTime.String()).DurationVar(&o.Keepalive.MinTime)
+	parser.Flag("grpc-keepalive-permit-without-stream", "Permit clients to ping when there are no active RPCs.").Default("true").BoolVar(&o.Keepalive.PermitWithoutStream)
+	parser.Flag("grpc-max-recv-msg-size", "Maximum size in bytes of gRPC messages received from agents. 0 uses gRPC's default of 4MiB.").Default("0").IntVar(&o.Messages.MaxRecvMsgSize)
+	parser.Flag("grpc-max-send-msg-size", "Maximum size in bytes of gRPC messages sent to agents. 0 uses gRPC's default.").Default("0").IntVar(&o.Messages.MaxSendMsgSize)
+	parser.Flag("grpc-compression", "Gzip gRPC responses to agents that support it.").Default("false").BoolVar(&o.Messages.Compression)
 }
 
 func (opts *serverCommand) Run() {
 	opts.configureLogger()
 
+	if err := opts.configureMetrics(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if err := opts.tlsOptions.validate(); err != nil {
+		log.Fatal(err.Error())
+	}
+
 	if !opts.AutoDetectBaseARN && opts.RoleBaseARN == "" {
 		log.Fatal("role-base-arn not specified and not auto-detected. please specify or use --role-base-arn-autodetect")
 	}
@@ -71,6 +175,31 @@ func (opts *serverCommand) Run() {
 		log.Fatal("session-duration should be at least 15 minutes")
 	}
 
+	if opts.SessionRefresh+opts.SessionRefreshJitter >= opts.SessionDuration {
+		log.Fatal("session-refresh and session-refresh-jitter should be less than session-duration")
+	}
+
+	if opts.MaxSessionDuration > 0 && opts.SessionRefresh+opts.SessionRefreshJitter >= opts.MaxSessionDuration {
+		log.Fatal("session-refresh and session-refresh-jitter should be less than max-session-duration")
+	}
+
+	for role, refresh := range opts.RoleSessionRefresh {
+		if refresh <= opts.ExpirationSkew+opts.ExpirationJitter || refresh+opts.SessionRefreshJitter >= opts.SessionDuration {
+			log.Fatalf("role-session-refresh for %s should be greater than expiration-skew with expiration-jitter, and with session-refresh-jitter less than session-duration", role)
+		}
+	}
+
+	if opts.CachePersistPath != "" && opts.CachePersistKeyFile == "" {
+		log.Fatal("cache-persist-path requires cache-persist-key-file")
+	}
+
+	if opts.ExpirationSkew < 0 || opts.ExpirationSkew >= opts.SessionRefresh {
+		log.Fatal("expiration-skew should not be negative and should be less than session-refresh")
+	}
+	if opts.ExpirationJitter < 0 || opts.ExpirationSkew+opts.ExpirationJitter >= opts.SessionRefresh {
+		log.Fatal("expiration-jitter should not be negative and with expiration-skew should be less than session-refresh")
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	opts.telemetryOptions.start(ctx, "server")
@@ -80,7 +209,10 @@ func (opts *serverCommand) Run() {
 	signal.Notify(stopChan, os.Interrupt)
 	signal.Notify(stopChan, syscall.SIGTERM)
 
-	opts.Config.TLS = serv.TLSConfig{ServerCert: opts.certificatePath, ServerKey: opts.keyPath, CA: opts.caPath}
+	opts.Config.TLS.ServerCert = opts.certificatePath
+	opts.Config.TLS.ServerKey = opts.keyPath
+	opts.Config.TLS.CA = opts.caPath
+	opts.Config.Insecure = opts.insecure
 	server, err := serv.NewServer(&opts.Config)
 	if err != nil {
 		log.Fatal("error creating listener: ", err.Error())
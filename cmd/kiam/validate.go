@@ -0,0 +1,67 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	serv "github.com/uswitch/kiam/pkg/server"
+)
+
+type validateCommand struct {
+	logOptions
+
+	serv.Config
+	roles   []string
+	timeout time.Duration
+}
+
+func (cmd *validateCommand) Bind(parser parser) {
+	cmd.logOptions.bind(parser)
+
+	serverOpts := serverOptions{&cmd.Config}
+	serverOpts.bind(parser)
+
+	parser.Flag("role", "Role name or ARN to validate the server can assume. Can be repeated.").Required().StringsVar(&cmd.roles)
+	parser.Flag("timeout", "Timeout for validating all roles").Default("30s").DurationVar(&cmd.timeout)
+}
+
+func (opts *validateCommand) Run() {
+	opts.configureLogger()
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+
+	results, err := serv.ValidateRoles(ctx, &opts.Config, opts.roles)
+	if err != nil {
+		log.Fatalf("error validating roles: %s", err.Error())
+	}
+
+	failed := 0
+	for _, result := range results {
+		logger := log.WithField("pod.iam.role", result.Role).WithField("pod.iam.roleArn", result.RoleARN)
+		if result.Err != nil {
+			failed++
+			logger.Errorf("unable to assume role: %s", result.Err.Error())
+			continue
+		}
+		logger.Infof("assumed role")
+	}
+
+	if failed > 0 {
+		log.Fatalf("unable to assume %d/%d roles", failed, len(results))
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metadata
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultClientIPHeader is the header trusted proxies set the client IP in
+// unless another is configured.
+const DefaultClientIPHeader = "X-Forwarded-For"
+
+// parseTrustedProxies parses the CIDRs of proxies trusted to set the
+// client IP header.
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy cidr %q: %s", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isTrustedProxy(ip net.IP, trusted []*net.IPNet) bool {
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientIP returns a clientIPFunc that uses the right-most entry
+// of header, formatted like X-Forwarded-For, that isn't a trusted proxy,
+// but only when the request was received from a trusted proxy. Otherwise
+// the header is ignored and the remote address is used.
+//
+// When hops is positive the entry hops from the right is used instead,
+// as each of that many proxies appends the address it received the
+// request from. Entries further left are set by the client and ignored,
+// and requests with fewer entries are rejected.
+func forwardedClientIP(remote clientIPFunc, header string, trusted []*net.IPNet, hops int) clientIPFunc {
+	return func(req *http.Request) (string, error) {
+		addr, err := remote(req)
+		if err != nil {
+			return "", err
+		}
+
+		remoteIP := net.ParseIP(strings.Trim(addr, "[]"))
+		if remoteIP == nil || !isTrustedProxy(remoteIP, trusted) {
+			return addr, nil
+		}
+
+		var entries []string
+		for _, value := range req.Header[http.CanonicalHeaderKey(header)] {
+			entries = append(entries, strings.Split(value, ",")...)
+		}
+
+		if hops > 0 && len(entries) < hops {
+			return "", fmt.Errorf("%s has %d entries, expected at least %d", header, len(entries), hops)
+		}
+
+		for i := len(entries) - 1; i >= 0; i-- {
+			entry := strings.TrimSpace(entries[i])
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return "", fmt.Errorf("malformed %s entry: %q", header, entry)
+			}
+			if hops > 0 {
+				if i == len(entries)-hops {
+					return ip.String(), nil
+				}
+				continue
+			}
+			if !isTrustedProxy(ip, trusted) {
+				return ip.String(), nil
+			}
+		}
+
+		return addr, nil
+	}
+}
+
+// SocketClientIPHeader identifies the client for requests received over the
+// unix socket, which have no remote address.
+const SocketClientIPHeader = "X-Kiam-Client-IP"
+
+// socketClientIP returns a clientIPFunc that uses the SocketClientIPHeader
+// for requests received over a unix socket, and remote otherwise.
+func socketClientIP(remote clientIPFunc) clientIPFunc {
+	return func(req *http.Request) (string, error) {
+		addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		if !ok || addr.Network() != "unix" {
+			return remote(req)
+		}
+
+		header := strings.TrimSpace(req.Header.Get(SocketClientIPHeader))
+		ip := net.ParseIP(header)
+		if ip == nil {
+			return "", fmt.Errorf("requests over the unix socket require a valid %s header, was: %q", SocketClientIPHeader, header)
+		}
+		return ip.String(), nil
+	}
+}
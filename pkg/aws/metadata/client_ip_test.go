@@ -1,6 +1,8 @@
 package metadata
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"testing"
 )
@@ -16,6 +18,202 @@ func TestParseAddress(t *testing.T) {
 	}
 }
 
+func forwardedRequest(remoteAddr string, forwardedFor ...string) *http.Request {
+	req, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+	req.RemoteAddr = remoteAddr
+	for _, header := range forwardedFor {
+		req.Header.Add("X-Forwarded-For", header)
+	}
+	return req
+}
+
+func forwardedClientIPFunc(t *testing.T) clientIPFunc {
+	getClientIP, err := buildClientIP(&ServerOptions{TrustForwardedFor: true, TrustedProxies: []string{"127.0.0.1/32", "10.0.0.0/24"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return getClientIP
+}
+
+func TestForwardedForFromTrustedProxy(t *testing.T) {
+	getClientIP := forwardedClientIPFunc(t)
+
+	ip, err := getClientIP(forwardedRequest("127.0.0.1:9000", "1.2.3.4, 192.168.0.1, 10.0.0.5"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ip != "192.168.0.1" {
+		t.Error("expected right-most untrusted entry, was", ip)
+	}
+
+	ip, _ = getClientIP(forwardedRequest("127.0.0.1:9000", "1.2.3.4", "192.168.0.2"))
+	if ip != "192.168.0.2" {
+		t.Error("expected entry from last header, was", ip)
+	}
+
+	ip, _ = getClientIP(forwardedRequest("127.0.0.1:9000"))
+	if ip != "127.0.0.1" {
+		t.Error("expected remote address without header, was", ip)
+	}
+}
+
+func TestForwardedForFromUntrustedSource(t *testing.T) {
+	getClientIP := forwardedClientIPFunc(t)
+
+	ip, err := getClientIP(forwardedRequest("192.168.0.1:9000", "1.2.3.4"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ip != "192.168.0.1" {
+		t.Error("expected header to be ignored, was", ip)
+	}
+
+	ip, _ = getClientIP(forwardedRequest("192.168.0.1:9000", "not-an-ip"))
+	if ip != "192.168.0.1" {
+		t.Error("expected malformed header to be ignored, was", ip)
+	}
+}
+
+func TestMalformedForwardedFor(t *testing.T) {
+	getClientIP := forwardedClientIPFunc(t)
+
+	_, err := getClientIP(forwardedRequest("127.0.0.1:9000", "1.2.3.4, not-an-ip"))
+	if err == nil {
+		t.Error("expected error for malformed header")
+	}
+}
+
+func TestForwardedForRequiresTrustedProxies(t *testing.T) {
+	_, err := buildClientIP(&ServerOptions{TrustForwardedFor: true})
+	if err == nil {
+		t.Error("expected error without trusted proxies")
+	}
+
+	_, err = buildClientIP(&ServerOptions{TrustForwardedFor: true, TrustedProxies: []string{"127.0.0.1"}})
+	if err == nil {
+		t.Error("expected error for invalid cidr")
+	}
+}
+
+func TestForwardedForAtTrustedHopDepth(t *testing.T) {
+	getClientIP, err := buildClientIP(&ServerOptions{TrustForwardedFor: true, TrustedProxies: []string{"10.0.0.0/24"}, TrustedHops: 2})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, tc := range []struct {
+		name         string
+		forwardedFor []string
+		expected     string
+	}{
+		{"exact chain", []string{"192.168.0.1, 172.16.0.1"}, "192.168.0.1"},
+		{"across headers", []string{"192.168.0.1", "172.16.0.1"}, "192.168.0.1"},
+		{"spoofed entries", []string{"1.2.3.4, 10.0.0.9, 192.168.0.1, 172.16.0.1"}, "192.168.0.1"},
+		{"malformed spoofed entry", []string{"not-an-ip, 192.168.0.1, 172.16.0.1"}, "192.168.0.1"},
+		{"trusted client", []string{"10.0.0.9, 172.16.0.1"}, "10.0.0.9"},
+	} {
+		ip, err := getClientIP(forwardedRequest("10.0.0.1:9000", tc.forwardedFor...))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+			continue
+		}
+		if ip != tc.expected {
+			t.Errorf("%s: expected %s, was %s", tc.name, tc.expected, ip)
+		}
+	}
+
+	for _, tc := range []struct {
+		name         string
+		forwardedFor []string
+	}{
+		{"no header", nil},
+		{"short chain", []string{"192.168.0.1"}},
+		{"malformed proxy entry", []string{"192.168.0.1, not-an-ip"}},
+	} {
+		_, err := getClientIP(forwardedRequest("10.0.0.1:9000", tc.forwardedFor...))
+		if err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+
+	ip, _ := getClientIP(forwardedRequest("192.168.0.2:9000", "192.168.0.1"))
+	if ip != "192.168.0.2" {
+		t.Error("expected header from untrusted source to be ignored, was", ip)
+	}
+}
+
+func TestTrustedHopsMustNotBeNegative(t *testing.T) {
+	_, err := buildClientIP(&ServerOptions{TrustForwardedFor: true, TrustedProxies: []string{"10.0.0.0/24"}, TrustedHops: -1})
+	if err == nil {
+		t.Error("expected error for negative trusted hops")
+	}
+}
+
+func TestClientIPHeaderFromTrustedProxy(t *testing.T) {
+	getClientIP, err := buildClientIP(&ServerOptions{TrustForwardedFor: true, TrustedProxies: []string{"10.0.0.0/24"}, ClientIPHeader: "X-Pod-IP"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req := forwardedRequest("10.0.0.1:9000", "1.2.3.4")
+	req.Header.Set("X-Pod-IP", "192.168.0.1")
+	ip, err := getClientIP(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ip != "192.168.0.1" {
+		t.Error("expected configured header, was", ip)
+	}
+
+	req = forwardedRequest("192.168.0.2:9000")
+	req.Header.Set("X-Pod-IP", "192.168.0.1")
+	ip, _ = getClientIP(req)
+	if ip != "192.168.0.2" {
+		t.Error("expected header from untrusted source to be ignored, was", ip)
+	}
+}
+
 func getBlankClientIP(_ *http.Request) (string, error) {
 	return "", nil
 }
+
+func socketRequest(clientIP string) *http.Request {
+	req, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+	ctx := context.WithValue(req.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/var/run/kiam.sock", Net: "unix"})
+	if clientIP != "" {
+		req.Header.Set(SocketClientIPHeader, clientIP)
+	}
+	return req.WithContext(ctx)
+}
+
+func TestSocketClientIPFromHeader(t *testing.T) {
+	getClientIP, err := buildClientIP(&ServerOptions{UnixSocket: "/var/run/kiam.sock"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ip, err := getClientIP(socketRequest("10.0.0.5"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ip != "10.0.0.5" {
+		t.Error("expected ip from header, was", ip)
+	}
+
+	_, err = getClientIP(socketRequest(""))
+	if err == nil {
+		t.Error("expected error without header")
+	}
+
+	_, err = getClientIP(socketRequest("not-an-ip"))
+	if err == nil {
+		t.Error("expected error with malformed header")
+	}
+
+	req := forwardedRequest("127.0.0.1:9000")
+	req.Header.Set(SocketClientIPHeader, "10.0.0.5")
+	ip, _ = getClientIP(req)
+	if ip != "127.0.0.1" {
+		t.Error("expected header to be ignored over tcp, was", ip)
+	}
+}
@@ -1,9 +1,93 @@
 package metadata
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+
+	"github.com/uswitch/kiam/pkg/aws/sts"
+	"github.com/uswitch/kiam/pkg/server"
 )
 
 var (
 	EmptyRoleError = fmt.Errorf("empty role")
 )
+
+// ErrorCode identifies the cause of an error in JSON error responses
+type ErrorCode string
+
+const (
+	ErrorCodePodNotFound ErrorCode = "PodNotFound"
+	ErrorCodeForbidden   ErrorCode = "Forbidden"
+	ErrorCodeEmptyRole   ErrorCode = "EmptyRole"
+	ErrorCodeAmbiguousIP ErrorCode = "AmbiguousPodIP"
+	ErrorCodeThrottled   ErrorCode = "Throttled"
+	ErrorCodeUnavailable ErrorCode = "Unavailable"
+	ErrorCodeTimeout     ErrorCode = "Timeout"
+	ErrorCodeWarmingUp   ErrorCode = "WarmingUp"
+	ErrorCodeNotFound    ErrorCode = "NotFound"
+	ErrorCodeInternal    ErrorCode = "InternalError"
+)
+
+func errorCode(err error, status int) ErrorCode {
+	switch {
+	case errors.Is(err, server.ErrPodNotFound):
+		return ErrorCodePodNotFound
+	case errors.Is(err, server.ErrPolicyForbidden), errors.Is(err, server.ErrNamespaceDenied), errors.Is(err, ErrInstanceRoleBlocked):
+		return ErrorCodeForbidden
+	case errors.Is(err, server.ErrAmbiguousPodIP):
+		return ErrorCodeAmbiguousIP
+	case errors.Is(err, EmptyRoleError):
+		return ErrorCodeEmptyRole
+	case errors.Is(err, ErrRateLimited):
+		return ErrorCodeThrottled
+	case errors.Is(err, sts.ErrUpstreamUnavailable):
+		return ErrorCodeUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorCodeTimeout
+	case errors.Is(err, ErrWarmingUp):
+		return ErrorCodeWarmingUp
+	}
+
+	switch status {
+	case http.StatusTooManyRequests:
+		return ErrorCodeThrottled
+	case http.StatusServiceUnavailable:
+		return ErrorCodeUnavailable
+	case http.StatusNotFound:
+		return ErrorCodeNotFound
+	}
+	return ErrorCodeInternal
+}
+
+type errorResponse struct {
+	Error string    `json:"error"`
+	Code  ErrorCode `json:"code"`
+}
+
+type jsonErrorsKey struct{}
+
+// withJSONErrors configures handlers to write errors as JSON rather than
+// plain text
+func withJSONErrors(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), jsonErrorsKey{}, true)
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// writeError writes err as the response, as JSON with a stable code when
+// the request was served with withJSONErrors and otherwise as plain text.
+func writeError(w http.ResponseWriter, req *http.Request, err error, status int) {
+	if enabled, _ := req.Context().Value(jsonErrorsKey{}).(bool); !enabled {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&errorResponse{Error: err.Error(), Code: errorCode(err, status)})
+}
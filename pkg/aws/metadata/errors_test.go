@@ -0,0 +1,91 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/uswitch/kiam/pkg/server"
+	st "github.com/uswitch/kiam/pkg/testutil/server"
+)
+
+func performForbiddenRequest(jsonErrors bool) *httptest.ResponseRecorder {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/role", nil)
+	rr := httptest.NewRecorder()
+
+	client := st.NewStubClient().WithCredentials(st.GetCredentialsResult{Credentials: nil, Error: server.ErrPolicyForbidden})
+	handler := newCredentialsHandler(client, getBlankClientIP, testRetryTimeouts, nil, false)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	var h http.Handler = router
+	if jsonErrors {
+		h = withJSONErrors(h)
+	}
+	h.ServeHTTP(rr, r.WithContext(ctx))
+
+	return rr
+}
+
+func TestReturnsPlainTextErrorsByDefault(t *testing.T) {
+	rr := performForbiddenRequest(false)
+
+	if content := rr.Header().Get("Content-Type"); !strings.HasPrefix(content, "text/plain") {
+		t.Error("expected plain text error, was", content)
+	}
+	if !strings.Contains(rr.Body.String(), "forbidden by policy") {
+		t.Error("unexpected error", rr.Body.String())
+	}
+}
+
+func TestReturnsJSONErrors(t *testing.T) {
+	rr := performForbiddenRequest(true)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Error("unexpected status", rr.Code)
+	}
+	if content := rr.Header().Get("Content-Type"); content != "application/json" {
+		t.Error("expected json error, was", content)
+	}
+
+	var body errorResponse
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatal(err.Error())
+	}
+	if body.Code != ErrorCodeForbidden {
+		t.Error("unexpected code, was", body.Code)
+	}
+	if !strings.Contains(body.Error, "forbidden by policy") {
+		t.Error("unexpected error, was", body.Error)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	errTest := fmt.Errorf("error fetching credentials: %w", fmt.Errorf("rpc error"))
+	cases := []struct {
+		err    error
+		status int
+		code   ErrorCode
+	}{
+		{fmt.Errorf("error fetching credentials: %w", server.ErrPodNotFound), http.StatusInternalServerError, ErrorCodePodNotFound},
+		{EmptyRoleError, http.StatusNotFound, ErrorCodeEmptyRole},
+		{context.DeadlineExceeded, http.StatusInternalServerError, ErrorCodeTimeout},
+		{errTest, http.StatusTooManyRequests, ErrorCodeThrottled},
+		{errTest, http.StatusInternalServerError, ErrorCodeInternal},
+	}
+
+	for _, c := range cases {
+		if code := errorCode(c.err, c.status); code != c.code {
+			t.Error("expected", c.code, "for", c.err, "was", code)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package metadata
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/cenkalti/backoff"
 	"github.com/gorilla/mux"
@@ -24,15 +25,27 @@ import (
 	"github.com/uswitch/kiam/pkg/server"
 	"github.com/uswitch/kiam/pkg/statsd"
 	"net/http"
+	"time"
 )
 
 type credentialsHandler struct {
 	client      server.Client
 	getClientIP clientIPFunc
+	retry       retryTimeouts
+	readiness   *serverReadiness
+	// cacheHeaders sets Cache-Control and Expires from the credentials'
+	// expiry
+	cacheHeaders bool
+	// roleARNHeader sets RoleARNHeader to the role the credentials were
+	// issued for
+	roleARNHeader bool
 }
 
+// RoleARNHeader reports the role credentials were issued for, for debugging.
+const RoleARNHeader = "X-Kiam-Role-Arn"
+
 func (c *credentialsHandler) Install(router *mux.Router) {
-	router.Handle("/{version}/meta-data/iam/security-credentials/{role:.*}", adapt(withMeter("credentials", c)))
+	router.Handle("/{version}/meta-data/iam/security-credentials/{role:.*}", adaptWithDeadline(withMeter("credentials", c), c.retry.deadline()))
 }
 
 func (c *credentialsHandler) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) (int, error) {
@@ -53,30 +66,55 @@ func (c *credentialsHandler) Handle(ctx context.Context, w http.ResponseWriter,
 	}
 
 	requestedRole := mux.Vars(req)["role"]
-	credentials, err := c.fetchCredentials(ctx, ip, requestedRole)
+	credentials, err := fetchCredentials(ctx, c.client, ip, requestedRole, c.retry)
+	if errors.Is(err, server.ErrPodNotFound) {
+		if !c.readiness.isReady() {
+			return warmingUp(w)
+		}
+		return http.StatusNotFound, err
+	}
+	if err == server.ErrNamespaceDenied {
+		namespaceDenied.WithLabelValues("credentials").Inc()
+		return http.StatusForbidden, err
+	}
+	if err == server.ErrAmbiguousPodIP {
+		return http.StatusConflict, err
+	}
+	if err == server.ErrPolicyForbidden {
+		countPolicyDenied(ctx, c.client, "credentials", ip, requestedRole)
+		return http.StatusInternalServerError, fmt.Errorf("error fetching credentials: %w", err)
+	}
 	if err != nil {
 		credentialFetchError.WithLabelValues("credentials").Inc()
-		return http.StatusInternalServerError, fmt.Errorf("error fetching credentials: %s", err)
+		return http.StatusInternalServerError, fmt.Errorf("error fetching credentials: %w", err)
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	if c.cacheHeaders {
+		setCacheHeaders(w, credentials)
+	}
+	if c.roleARNHeader && credentials.RoleARN != "" {
+		w.Header().Set(RoleARNHeader, credentials.RoleARN)
+	}
+	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(credentials)
 	if err != nil {
 		credentialEncodeError.WithLabelValues("credentials").Inc()
 		return http.StatusInternalServerError, fmt.Errorf("error encoding credentials: %s", err.Error())
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	observeCredentialsAge("credentials", credentials)
 	success.WithLabelValues("credentials").Inc()
 	return http.StatusOK, nil
 }
 
-func (c *credentialsHandler) fetchCredentials(ctx context.Context, ip, requestedRole string) (*sts.Credentials, error) {
+func fetchCredentials(ctx context.Context, client server.Client, ip, requestedRole string, retry retryTimeouts) (*sts.Credentials, error) {
 	var creds *sts.Credentials
 	op := func() error {
 		var err error
-		creds, err = c.client.GetCredentials(ctx, ip, requestedRole)
+		creds, err = client.GetCredentials(ctx, ip, requestedRole)
 		if err != nil {
-			if err == server.ErrPolicyForbidden {
+			if err == server.ErrPolicyForbidden || err == server.ErrNamespaceDenied || err == server.ErrAmbiguousPodIP {
 				return backoff.Permanent(err)
 			}
 			return err
@@ -84,19 +122,54 @@ func (c *credentialsHandler) fetchCredentials(ctx context.Context, ip, requested
 		return nil
 	}
 
-	strategy := backoff.NewExponentialBackOff()
-	strategy.InitialInterval = retryInterval
-
-	err := backoff.Retry(op, backoff.WithContext(strategy, ctx))
+	err := retry.retry(ctx, op)
 	if err != nil {
 		return nil, err
 	}
 	return creds, nil
 }
 
-func newCredentialsHandler(client server.Client, getClientIP clientIPFunc) *credentialsHandler {
+// countPolicyDenied records a request the server's policy forbade,
+// counting it as a role mismatch when the pod's role is another role so
+// misconfigured or malicious pods can be alerted on.
+func countPolicyDenied(ctx context.Context, client server.Client, handler, ip, requestedRole string) {
+	role, err := client.GetRole(ctx, ip)
+	if err == nil && role != "" && role != requestedRole && sts.RoleName(role) != requestedRole {
+		roleMismatch.WithLabelValues(handler).Inc()
+		return
+	}
+	policyDenied.WithLabelValues(handler).Inc()
+}
+
+// observeCredentialsAge records how old credentials served by handler are.
+func observeCredentialsAge(handler string, credentials *sts.Credentials) {
+	if age, err := credentials.Age(); err == nil {
+		credentialsAge.WithLabelValues(handler).Observe(age.Seconds())
+	}
+}
+
+// setCacheHeaders lets caches hold credentials until they expire. They're
+// private so they aren't shared between clients.
+func setCacheHeaders(w http.ResponseWriter, credentials *sts.Credentials) {
+	expiry, err := credentials.ExpiresAt()
+	if err != nil {
+		return
+	}
+
+	maxAge := int(time.Until(expiry).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	w.Header().Set("Expires", expiry.UTC().Format(http.TimeFormat))
+}
+
+func newCredentialsHandler(client server.Client, getClientIP clientIPFunc, retry retryTimeouts, readiness *serverReadiness, cacheHeaders bool) *credentialsHandler {
 	return &credentialsHandler{
-		client:      client,
-		getClientIP: getClientIP,
+		client:       client,
+		getClientIP:  getClientIP,
+		retry:        retry,
+		readiness:    readiness,
+		cacheHeaders: cacheHeaders,
 	}
 }
@@ -3,8 +3,11 @@ package metadata
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/fortytw2/leaktest"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/uswitch/kiam/pkg/aws/sts"
 	"github.com/uswitch/kiam/pkg/server"
 	"github.com/uswitch/kiam/pkg/statsd"
@@ -29,7 +32,7 @@ func TestReturnsCredentials(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	client := st.NewStubClient().WithRoles(st.GetRoleResult{"role", nil}).WithCredentials(st.GetCredentialsResult{&sts.Credentials{AccessKeyId: "A1", SecretAccessKey: "S1"}, nil})
-	handler := newCredentialsHandler(client, getBlankClientIP)
+	handler := newCredentialsHandler(client, getBlankClientIP, testRetryTimeouts, nil, false)
 	router := mux.NewRouter()
 	handler.Install(router)
 
@@ -59,6 +62,82 @@ func TestReturnsCredentials(t *testing.T) {
 	}
 }
 
+func histogramSamples(o prometheus.Observer) (uint64, float64) {
+	m := &dto.Metric{}
+	o.(prometheus.Metric).Write(m)
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestRecordsServedCredentialsAge(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	defer leaktest.Check(t)()
+
+	lastUpdated := time.Now().UTC().Add(-90 * time.Second).Format("2006-01-02T15:04:05Z")
+	client := st.NewStubClient().WithRoles(st.GetRoleResult{"role", nil}).WithCredentials(st.GetCredentialsResult{&sts.Credentials{AccessKeyId: "A1", LastUpdated: lastUpdated}, nil})
+	handler := newCredentialsHandler(client, getBlankClientIP, testRetryTimeouts, nil, false)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	count, sum := histogramSamples(credentialsAge.WithLabelValues("credentials"))
+
+	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/role", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, r.WithContext(ctx))
+	if rr.Code != http.StatusOK {
+		t.Fatal("unexpected status, was", rr.Code)
+	}
+
+	newCount, newSum := histogramSamples(credentialsAge.WithLabelValues("credentials"))
+	if newCount != count+1 {
+		t.Error("expected one age observation, was", newCount-count)
+	}
+	if age := newSum - sum; age < 90 || age > 120 {
+		t.Error("expected age of around 90s, was", age)
+	}
+}
+
+func TestSendsJSONContentType(t *testing.T) {
+	client := st.NewStubClient().WithRoles(st.GetRoleResult{"role", nil}).WithCredentials(st.GetCredentialsResult{&sts.Credentials{AccessKeyId: "A1", SecretAccessKey: "S1"}, nil})
+	handler := newCredentialsHandler(client, getBlankClientIP, testRetryTimeouts, nil, false)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/latest/meta-data/iam/security-credentials/role")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Error("unexpected status, was", resp.StatusCode)
+	}
+
+	content := resp.Header.Get("Content-Type")
+	if content != "application/json" {
+		t.Error("expected json content type to be sent, was", content)
+	}
+}
+
+func TestReturnsConflictWhenPodIPIsAmbiguous(t *testing.T) {
+	client := st.NewStubClient().WithCredentials(st.GetCredentialsResult{nil, server.ErrAmbiguousPodIP})
+	handler := newCredentialsHandler(client, getBlankClientIP, retryTimeouts{podNotFound: time.Second, errors: time.Second}, nil, false)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/role", nil))
+	if rr.Code != http.StatusConflict {
+		t.Error("expected conflict, was", rr.Code)
+	}
+	if calls := len(client.RequestedRoles()); calls != 1 {
+		t.Error("expected no retries, was", calls)
+	}
+}
+
 func TestReturnsErrorWithNoPod(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
@@ -68,16 +147,16 @@ func TestReturnsErrorWithNoPod(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	client := st.NewStubClient().WithCredentials(st.GetCredentialsResult{nil, server.ErrPodNotFound})
-	handler := newCredentialsHandler(client, getBlankClientIP)
+	handler := newCredentialsHandler(client, getBlankClientIP, testRetryTimeouts, nil, false)
 	router := mux.NewRouter()
 	handler.Install(router)
 
 	router.ServeHTTP(rr, r.WithContext(ctx))
 
-	if rr.Code != http.StatusInternalServerError {
+	if rr.Code != http.StatusNotFound {
 		t.Error("unexpected status", rr.Code)
 	}
-	if !strings.Contains(rr.Body.String(), "error fetching credentials: no pod found") {
+	if !strings.Contains(rr.Body.String(), "no pod found") {
 		t.Error("unexpected error", rr.Body.String())
 	}
 }
@@ -93,7 +172,7 @@ func TestReturnsCredentialsWithRetryAfterError(t *testing.T) {
 	valid := st.GetCredentialsResult{&sts.Credentials{}, nil}
 	e := st.GetCredentialsResult{nil, server.ErrPodNotFound}
 	client := st.NewStubClient().WithRoles(st.GetRoleResult{"role", nil}).WithCredentials(e, valid)
-	handler := newCredentialsHandler(client, getBlankClientIP)
+	handler := newCredentialsHandler(client, getBlankClientIP, testRetryTimeouts, nil, false)
 	router := mux.NewRouter()
 	handler.Install(router)
 
@@ -115,7 +194,7 @@ func TestForbiddenRole(t *testing.T) {
 	valid := st.GetCredentialsResult{&sts.Credentials{}, nil}
 	e := st.GetCredentialsResult{nil, server.ErrPolicyForbidden}
 	client := st.NewStubClient().WithRoles(st.GetRoleResult{"role", nil}).WithCredentials(e, valid)
-	handler := newCredentialsHandler(client, getBlankClientIP)
+	handler := newCredentialsHandler(client, getBlankClientIP, testRetryTimeouts, nil, false)
 	router := mux.NewRouter()
 	handler.Install(router)
 
@@ -129,3 +208,147 @@ func TestForbiddenRole(t *testing.T) {
 		t.Error("unexpected error", rr.Body.String())
 	}
 }
+
+func TestCountsRoleMismatchesSeparately(t *testing.T) {
+	forbidden := st.GetCredentialsResult{nil, server.ErrPolicyForbidden}
+	tests := []struct {
+		podRole  string
+		mismatch bool
+	}{
+		{"other-role", true},
+		{"role", false},
+		{"arn:aws:iam::123456789012:role/role", false},
+	}
+
+	for _, test := range tests {
+		mismatches := metricValue(roleMismatch.WithLabelValues("credentials"))
+		denied := metricValue(policyDenied.WithLabelValues("credentials"))
+		fetchErrors := metricValue(credentialFetchError.WithLabelValues("credentials"))
+
+		r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/role", nil)
+		client := st.NewStubClient().WithRoles(st.GetRoleResult{test.podRole, nil}).WithCredentials(forbidden)
+		handler := newCredentialsHandler(client, getBlankClientIP, testRetryTimeouts, nil, false)
+		router := mux.NewRouter()
+		handler.Install(router)
+		router.ServeHTTP(httptest.NewRecorder(), r)
+
+		expectedMismatches, expectedDenied := mismatches, denied+1
+		if test.mismatch {
+			expectedMismatches, expectedDenied = mismatches+1, denied
+		}
+		if v := metricValue(roleMismatch.WithLabelValues("credentials")); v != expectedMismatches {
+			t.Errorf("expected %v role mismatches for pod role %s, was %v", expectedMismatches, test.podRole, v)
+		}
+		if v := metricValue(policyDenied.WithLabelValues("credentials")); v != expectedDenied {
+			t.Errorf("expected %v policy denials for pod role %s, was %v", expectedDenied, test.podRole, v)
+		}
+		if v := metricValue(credentialFetchError.WithLabelValues("credentials")); v != fetchErrors {
+			t.Error("expected denials not to be counted as fetch errors")
+		}
+	}
+}
+
+func TestCredentialsWaitForPodNotFound(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/role", nil)
+	rr := httptest.NewRecorder()
+
+	client := st.NewStubClient().WithCredentials(
+		st.GetCredentialsResult{nil, server.ErrPodNotFound},
+		st.GetCredentialsResult{&sts.Credentials{AccessKeyId: "A1", SecretAccessKey: "S1"}, nil},
+	)
+	handler := newCredentialsHandler(client, getBlankClientIP, retryTimeouts{podNotFound: time.Second, errors: 0}, nil, false)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	router.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Error("expected credentials once pod was found, was", rr.Code)
+	}
+}
+
+func TestCredentialsErrorRetryTimeout(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/role", nil)
+	rr := httptest.NewRecorder()
+
+	client := st.NewStubClient().WithCredentials(
+		st.GetCredentialsResult{nil, fmt.Errorf("unexpected error")},
+		st.GetCredentialsResult{&sts.Credentials{AccessKeyId: "A1", SecretAccessKey: "S1"}, nil},
+	)
+	handler := newCredentialsHandler(client, getBlankClientIP, retryTimeouts{podNotFound: time.Second, errors: 0}, nil, false)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	router.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Error("expected error without retry, was", rr.Code)
+	}
+}
+
+func TestSetsCacheHeadersFromExpiry(t *testing.T) {
+	expiry := time.Now().Add(10 * time.Minute).UTC()
+	creds := sts.NewCredentials("A1", "S1", "T1", expiry)
+
+	for _, enabled := range []bool{false, true} {
+		r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/role", nil)
+		rr := httptest.NewRecorder()
+
+		client := st.NewStubClient().WithCredentials(st.GetCredentialsResult{creds, nil})
+		handler := newCredentialsHandler(client, getBlankClientIP, testRetryTimeouts, nil, enabled)
+		router := mux.NewRouter()
+		handler.Install(router)
+
+		router.ServeHTTP(rr, r)
+
+		cacheControl := rr.Header().Get("Cache-Control")
+		expires := rr.Header().Get("Expires")
+		if !enabled {
+			if cacheControl != "" || expires != "" {
+				t.Error("expected no cache headers when disabled, was", cacheControl, expires)
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(cacheControl, "private, max-age=") {
+			t.Error("unexpected Cache-Control, was", cacheControl)
+		}
+		var maxAge int
+		fmt.Sscanf(cacheControl, "private, max-age=%d", &maxAge)
+		if maxAge < 590 || maxAge > 600 {
+			t.Error("expected max-age aligned with expiry, was", maxAge)
+		}
+		if expires != expiry.Format(http.TimeFormat) {
+			t.Error("expected Expires aligned with expiry, was", expires)
+		}
+	}
+}
+
+func TestSetsRoleARNHeaderWhenEnabled(t *testing.T) {
+	creds := sts.NewCredentials("A1", "S1", "T1", time.Now().Add(10*time.Minute))
+	creds.RoleARN = "arn:aws:iam::123456789012:role/team/role"
+
+	for _, enabled := range []bool{false, true} {
+		r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/role", nil)
+		rr := httptest.NewRecorder()
+
+		client := st.NewStubClient().WithCredentials(st.GetCredentialsResult{creds, nil})
+		handler := newCredentialsHandler(client, getBlankClientIP, testRetryTimeouts, nil, false)
+		handler.roleARNHeader = enabled
+		router := mux.NewRouter()
+		handler.Install(router)
+
+		router.ServeHTTP(rr, r)
+
+		header := rr.Header().Get(RoleARNHeader)
+		if enabled && header != creds.RoleARN {
+			t.Error("expected role ARN header, was", header)
+		}
+		if !enabled && header != "" {
+			t.Error("expected no role ARN header when disabled, was", header)
+		}
+		if strings.Contains(rr.Body.String(), "team/role") {
+			t.Error("expected role ARN to be omitted from the body, was", rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uswitch/kiam/pkg/aws/sts"
+	"github.com/uswitch/kiam/pkg/server"
+	"github.com/uswitch/kiam/pkg/statsd"
+	"net/http"
+)
+
+// ecsCredentials is the response format of the ECS container credentials
+// endpoint, used by SDKs configured with AWS_CONTAINER_CREDENTIALS_RELATIVE_URI.
+type ecsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      string
+	RoleArn         string
+}
+
+type ecsCredentialsHandler struct {
+	client      server.Client
+	getClientIP clientIPFunc
+	uri         string
+	arnResolver sts.ARNResolver
+	retry       retryTimeouts
+	roles       *roleLookups
+	readiness   *serverReadiness
+}
+
+func (c *ecsCredentialsHandler) Install(router *mux.Router) {
+	router.Handle(c.uri, adaptWithDeadline(withMeter("ecsCredentials", c), c.retry.deadline()))
+}
+
+func (c *ecsCredentialsHandler) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) (int, error) {
+	timer := prometheus.NewTimer(handlerTimer.WithLabelValues("ecsCredentials"))
+	defer timer.ObserveDuration()
+	if statsd.Enabled {
+		defer statsd.Client.NewTiming().Send("handler.ecs_credentials")
+	}
+
+	err := req.ParseForm()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	ip, err := c.getClientIP(req)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	role, err := c.roles.find(ctx, ip)
+	if errors.Is(err, server.ErrPodNotFound) {
+		if !c.readiness.isReady() {
+			return warmingUp(w)
+		}
+		return http.StatusNotFound, err
+	}
+	if err == server.ErrNamespaceDenied {
+		namespaceDenied.WithLabelValues("ecsCredentials").Inc()
+		return http.StatusForbidden, err
+	}
+	if err == server.ErrAmbiguousPodIP {
+		return http.StatusConflict, err
+	}
+	if err != nil {
+		findRoleError.WithLabelValues("ecsCredentials").Inc()
+		return http.StatusInternalServerError, err
+	}
+
+	if role == "" {
+		if !c.readiness.isReady() {
+			return warmingUp(w)
+		}
+		emptyRole.WithLabelValues("ecsCredentials").Inc()
+		return http.StatusNotFound, EmptyRoleError
+	}
+
+	credentials, err := fetchCredentials(ctx, c.client, ip, role, c.retry)
+	if err == server.ErrPolicyForbidden {
+		// the pod's own role is requested so it can't be a mismatch
+		policyDenied.WithLabelValues("ecsCredentials").Inc()
+		return http.StatusInternalServerError, fmt.Errorf("error fetching credentials: %w", err)
+	}
+	if err == server.ErrAmbiguousPodIP {
+		return http.StatusConflict, err
+	}
+	if err != nil {
+		credentialFetchError.WithLabelValues("ecsCredentials").Inc()
+		return http.StatusInternalServerError, fmt.Errorf("error fetching credentials: %w", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&ecsCredentials{
+		AccessKeyId:     credentials.AccessKeyId,
+		SecretAccessKey: credentials.SecretAccessKey,
+		Token:           credentials.Token,
+		Expiration:      credentials.Expiration,
+		RoleArn:         c.arnResolver.Resolve(role),
+	})
+	if err != nil {
+		credentialEncodeError.WithLabelValues("ecsCredentials").Inc()
+		return http.StatusInternalServerError, fmt.Errorf("error encoding credentials: %s", err.Error())
+	}
+
+	observeCredentialsAge("ecsCredentials", credentials)
+	success.WithLabelValues("ecsCredentials").Inc()
+	return http.StatusOK, nil
+}
+
+func newECSCredentialsHandler(client server.Client, getClientIP clientIPFunc, uri string, arnResolver sts.ARNResolver, retry retryTimeouts, readiness *serverReadiness) *ecsCredentialsHandler {
+	return &ecsCredentialsHandler{
+		client:      client,
+		getClientIP: getClientIP,
+		uri:         uri,
+		arnResolver: arnResolver,
+		retry:       retry,
+		roles:       newRoleLookups(client, retry),
+		readiness:   readiness,
+	}
+}
@@ -0,0 +1,108 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/fortytw2/leaktest"
+	"github.com/gorilla/mux"
+	"github.com/uswitch/kiam/pkg/aws/sts"
+	st "github.com/uswitch/kiam/pkg/testutil/server"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReturnsECSCredentials(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	defer leaktest.Check(t)()
+
+	r, _ := http.NewRequest("GET", "/v2/credentials", nil)
+	rr := httptest.NewRecorder()
+
+	creds := sts.NewCredentials("A1", "S1", "T1", time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	client := st.NewStubClient().WithRoles(st.GetRoleResult{"role", nil}).WithCredentials(st.GetCredentialsResult{creds, nil})
+	handler := newECSCredentialsHandler(client, getBlankClientIP, "/v2/credentials", sts.DefaultResolver("arn:aws:iam::123456789012:role/"), testRetryTimeouts, nil)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	router.ServeHTTP(rr, r.WithContext(ctx))
+
+	if rr.Code != http.StatusOK {
+		t.Error("unexpected status, was", rr.Code)
+	}
+
+	content := rr.Header().Get("Content-Type")
+	if content != "application/json" {
+		t.Error("expected json result", content)
+	}
+
+	var response map[string]string
+	err := json.NewDecoder(rr.Body).Decode(&response)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := map[string]string{
+		"AccessKeyId":     "A1",
+		"SecretAccessKey": "S1",
+		"Token":           "T1",
+		"Expiration":      "2018-01-01T00:00:00Z",
+		"RoleArn":         "arn:aws:iam::123456789012:role/role",
+	}
+	if len(response) != len(expected) {
+		t.Error("unexpected fields in response", response)
+	}
+	for k, v := range expected {
+		if response[k] != v {
+			t.Errorf("unexpected %s, was %s", k, response[k])
+		}
+	}
+}
+
+func TestReturnsNotFoundForECSCredentialsWithoutRole(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	defer leaktest.Check(t)()
+
+	r, _ := http.NewRequest("GET", "/v2/credentials", nil)
+	rr := httptest.NewRecorder()
+
+	client := st.NewStubClient().WithRoles(st.GetRoleResult{"", nil})
+	handler := newECSCredentialsHandler(client, getBlankClientIP, "/v2/credentials", sts.DefaultResolver(""), testRetryTimeouts, nil)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	router.ServeHTTP(rr, r.WithContext(ctx))
+
+	if rr.Code != http.StatusNotFound {
+		t.Error("unexpected status, was", rr.Code)
+	}
+}
+
+func TestSendsECSJSONContentType(t *testing.T) {
+	creds := sts.NewCredentials("A1", "S1", "T1", time.Now().Add(time.Hour))
+	client := st.NewStubClient().WithRoles(st.GetRoleResult{"role", nil}).WithCredentials(st.GetCredentialsResult{creds, nil})
+	handler := newECSCredentialsHandler(client, getBlankClientIP, "/v2/credentials", sts.DefaultResolver(""), testRetryTimeouts, nil)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v2/credentials")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Error("unexpected status, was", resp.StatusCode)
+	}
+
+	content := resp.Header.Get("Content-Type")
+	if content != "application/json" {
+		t.Error("expected json content type to be sent, was", content)
+	}
+}
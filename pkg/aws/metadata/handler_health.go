@@ -91,6 +91,50 @@ func findServerHealth(ctx context.Context, client server.Client) (string, error)
 	return health, nil
 }
 
+// livenessHandler reports the agent is running, it doesn't depend on the
+// server so agents aren't restarted when the server is unavailable.
+type livenessHandler struct{}
+
+func (h *livenessHandler) Install(router *mux.Router) {
+	router.Handle("/livez", adapt(withMeter("livez", h)))
+}
+
+func (h *livenessHandler) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) (int, error) {
+	fmt.Fprint(w, "ok")
+	return http.StatusOK, nil
+}
+
+// readinessHandler reports whether the agent can serve credentials: the
+// server is reachable, its caches have synced and it can reach STS.
+type readinessHandler struct {
+	client    server.Client
+	readiness *serverReadiness
+}
+
+func (h *readinessHandler) Install(router *mux.Router) {
+	router.Handle("/readyz", adapt(withMeter("readyz", h)))
+}
+
+func (h *readinessHandler) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) (int, error) {
+	health, err := h.client.Health(ctx)
+	if err != nil {
+		return http.StatusServiceUnavailable, fmt.Errorf("server unavailable: %s", err)
+	}
+	if health != "ok" {
+		return http.StatusServiceUnavailable, fmt.Errorf("server not ready: %s", health)
+	}
+
+	if h.readiness != nil {
+		h.readiness.markReady()
+	}
+	fmt.Fprint(w, "ok")
+	return http.StatusOK, nil
+}
+
+func newReadinessHandler(client server.Client, readiness *serverReadiness) *readinessHandler {
+	return &readinessHandler{client: client, readiness: readiness}
+}
+
 func newHealthHandler(client server.Client, endpoint string) *healthHandler {
 	return &healthHandler{
 		client:   client,
@@ -89,3 +89,39 @@ func TestDeepHealthReturn(t *testing.T) {
 		t.Error("instance-id not returned correctly")
 	}
 }
+
+func TestLivenessDoesntCheckServer(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/livez", nil)
+	rr := httptest.NewRecorder()
+	handler := &livenessHandler{}
+	router := mux.NewRouter()
+	handler.Install(router)
+	router.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Error("expected 200 response, was", rr.Code)
+	}
+}
+
+func TestReadinessReflectsServerHealth(t *testing.T) {
+	for health, expected := range map[string]int{
+		"ok":                              http.StatusOK,
+		"caches not synced":               http.StatusServiceUnavailable,
+		"sts unreachable: RequestTimeout": http.StatusServiceUnavailable,
+	} {
+		readiness := newServerReadiness(nil)
+		r, _ := http.NewRequest("GET", "/readyz", nil)
+		rr := httptest.NewRecorder()
+		handler := newReadinessHandler(st.NewStubClient().WithHealth(health), readiness)
+		router := mux.NewRouter()
+		handler.Install(router)
+		router.ServeHTTP(rr, r)
+
+		if rr.Code != expected {
+			t.Errorf("expected %d for server health %q, was %d", expected, health, rr.Code)
+		}
+		if readiness.isReady() != (expected == http.StatusOK) {
+			t.Errorf("unexpected agent readiness for server health %q", health)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+// Ways the instance identity document can be served.
+const (
+	// IdentityDocumentProxy proxies requests for the identity document
+	// like any other metadata request.
+	IdentityDocumentProxy = "proxy"
+	// IdentityDocumentSynthesize serves a document with only the
+	// configured account and region.
+	IdentityDocumentSynthesize = "synthesize"
+	// IdentityDocumentDisabled returns 404 for the identity document.
+	IdentityDocumentDisabled = "disabled"
+)
+
+// identityDocumentVersion is the version of the document format AWS
+// currently returns.
+const identityDocumentVersion = "2017-09-30"
+
+var accountIDPattern = regexp.MustCompile(`^\d{12}$`)
+
+// identityDocument is the subset of the instance identity document that
+// isn't specific to the node.
+type identityDocument struct {
+	AccountID string `json:"accountId"`
+	Region    string `json:"region"`
+	Version   string `json:"version"`
+}
+
+// identityDocumentHandler serves the instance identity document without
+// revealing the node's identity: synthesized from the configured account
+// and region, or not at all when document is nil. The document's
+// signatures are never served as they'd sign the node's document.
+type identityDocumentHandler struct {
+	document *identityDocument
+}
+
+func newIdentityDocumentHandler(mode, accountID, region string) (*identityDocumentHandler, error) {
+	switch mode {
+	case IdentityDocumentDisabled:
+		return &identityDocumentHandler{}, nil
+	case IdentityDocumentSynthesize:
+		if !accountIDPattern.MatchString(accountID) {
+			return nil, fmt.Errorf("identity document account id must be 12 digits, was %q", accountID)
+		}
+		if region == "" {
+			return nil, fmt.Errorf("identity document region is required")
+		}
+		return &identityDocumentHandler{document: &identityDocument{AccountID: accountID, Region: region, Version: identityDocumentVersion}}, nil
+	}
+	return nil, fmt.Errorf("invalid identity document mode %q, expected %s, %s or %s", mode, IdentityDocumentProxy, IdentityDocumentSynthesize, IdentityDocumentDisabled)
+}
+
+func (h *identityDocumentHandler) Install(router *mux.Router) {
+	handler := adapt(withMeter("identityDocument", h))
+	router.PathPrefix("/{version}/dynamic/instance-identity/").Handler(handler)
+}
+
+func (h *identityDocumentHandler) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) (int, error) {
+	if h.document == nil || req.URL.Path != fmt.Sprintf("/%s/dynamic/instance-identity/document", mux.Vars(req)["version"]) {
+		return http.StatusNotFound, fmt.Errorf("instance identity not available: %s", req.URL.Path)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(h.document); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error encoding identity document: %s", err.Error())
+	}
+
+	success.WithLabelValues("identityDocument").Inc()
+	return http.StatusOK, nil
+}
@@ -0,0 +1,105 @@
+package metadata
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/gorilla/mux"
+	st "github.com/uswitch/kiam/pkg/testutil/server"
+)
+
+func identityDocumentRouter(t *testing.T, mode, accountID, region string) *mux.Router {
+	handler, err := newIdentityDocumentHandler(mode, accountID, region)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	handler.Install(router)
+	return router
+}
+
+func TestSynthesizesIdentityDocument(t *testing.T) {
+	router := identityDocumentRouter(t, IdentityDocumentSynthesize, "123456789012", "eu-west-1")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/dynamic/instance-identity/document", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatal("expected identity document, was", rr.Code)
+	}
+
+	var document map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &document); err != nil {
+		t.Fatal("expected json document:", err)
+	}
+	expected := map[string]string{"accountId": "123456789012", "region": "eu-west-1", "version": identityDocumentVersion}
+	if len(document) != len(expected) {
+		t.Error("expected only account, region and version, was", document)
+	}
+	for key, value := range expected {
+		if document[key] != value {
+			t.Errorf("expected %s to be %s, was %v", key, value, document[key])
+		}
+	}
+}
+
+func TestDoesntServeIdentityDocumentSignatures(t *testing.T) {
+	router := identityDocumentRouter(t, IdentityDocumentSynthesize, "123456789012", "eu-west-1")
+
+	for _, path := range []string{"/latest/dynamic/instance-identity/pkcs7", "/latest/dynamic/instance-identity/signature"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected 404 for %s, was %d", path, rr.Code)
+		}
+	}
+}
+
+func TestDisabledIdentityDocumentNotFound(t *testing.T) {
+	router := identityDocumentRouter(t, IdentityDocumentDisabled, "", "")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/dynamic/instance-identity/document", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Error("expected 404 when disabled, was", rr.Code)
+	}
+}
+
+func TestRejectsInvalidIdentityDocumentConfig(t *testing.T) {
+	cases := []struct {
+		mode, accountID, region string
+	}{
+		{IdentityDocumentSynthesize, "1234", "eu-west-1"},
+		{IdentityDocumentSynthesize, "123456789012", ""},
+		{"unknown", "", ""},
+	}
+	for _, c := range cases {
+		if _, err := newIdentityDocumentHandler(c.mode, c.accountID, c.region); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
+
+func TestIdentityDocumentTakesPrecedenceOverProxy(t *testing.T) {
+	proxied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"accountId":"210987654321","instanceId":"i-node"}`))
+	}))
+	defer proxied.Close()
+
+	config := DefaultOptions()
+	config.ProxyMetadataEndpoint = proxied.URL
+	config.WhitelistRouteRegexp = regexp.MustCompile("^/latest/dynamic/instance-identity/document$")
+	config.IdentityDocument = IdentityDocumentDisabled
+	server, err := buildHTTPServer(config, st.NewStubClient(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/dynamic/instance-identity/document", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Error("expected the node's document not to be proxied, was", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/uswitch/kiam/pkg/server"
+)
+
+// ErrInstanceRoleBlocked is returned for requests for the node's own
+// instance role, which would let pods bypass the role kiam assigns them.
+var ErrInstanceRoleBlocked = fmt.Errorf("access to the node's instance role is blocked")
+
+// instanceRoleHandler blocks the metadata paths that reveal the node's
+// instance role, or credentials for it, that aren't served by kiam's own
+// handlers. It's installed before the proxy so they're blocked however
+// broad the whitelist is.
+//
+// When backingService is set, pods the server permits the node's role are
+// proxied to it instead, regardless of the whitelist.
+type instanceRoleHandler struct {
+	client         server.Client
+	getClientIP    clientIPFunc
+	backingService http.Handler
+}
+
+func (h *instanceRoleHandler) Install(router *mux.Router) {
+	handler := adapt(withMeter("instanceRole", h))
+	router.PathPrefix("/{version}/meta-data/iam/").Handler(handler)
+	router.PathPrefix("/{version}/meta-data/identity-credentials/").Handler(handler)
+}
+
+func (h *instanceRoleHandler) Handle(ctx context.Context, w http.ResponseWriter, req *http.Request) (int, error) {
+	if h.backingService != nil {
+		ip, err := h.getClientIP(req)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		allowed, err := h.client.IsAllowedNodeRole(ctx, ip)
+		if err != nil && err != server.ErrPodNotFound {
+			return http.StatusInternalServerError, fmt.Errorf("error checking pod is permitted node role: %s", err)
+		}
+		if allowed {
+			instanceRoleProxied.Inc()
+			return proxyRequest(h.backingService, "instanceRole", w, req), nil
+		}
+	}
+
+	instanceRoleDenies.Inc()
+	return http.StatusForbidden, fmt.Errorf("%w: %s", ErrInstanceRoleBlocked, req.URL.Path)
+}
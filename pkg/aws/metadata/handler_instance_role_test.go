@@ -0,0 +1,141 @@
+package metadata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/uswitch/kiam/pkg/aws/sts"
+	st "github.com/uswitch/kiam/pkg/testutil/server"
+)
+
+func buildInstanceRoleServer(t *testing.T, allow bool) http.Handler {
+	proxied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied"))
+	}))
+	t.Cleanup(proxied.Close)
+
+	config := DefaultOptions()
+	config.MetadataEndpoint = proxied.URL
+	config.WhitelistRouteRegexp = regexp.MustCompile(".*")
+	config.AllowInstanceRole = allow
+	server, err := buildHTTPServer(config, st.NewStubClient().WithCredentials(st.GetCredentialsResult{&sts.Credentials{AccessKeyId: "A1"}, nil}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server.Handler
+}
+
+var instanceRolePaths = []string{
+	"/latest/meta-data/iam/info",
+	"/latest/meta-data/iam/info/",
+	"/2016-09-02/meta-data/iam/info",
+	"/latest/meta-data/identity-credentials/ec2/security-credentials/ec2-instance",
+}
+
+func TestBlocksInstanceRoleByDefault(t *testing.T) {
+	handler := buildInstanceRoleServer(t, false)
+	blocked := metricValue(instanceRoleDenies)
+
+	for _, path := range instanceRolePaths {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected %s to be forbidden, was %d %q", path, rr.Code, rr.Body.String())
+		}
+	}
+	if v := metricValue(instanceRoleDenies); v != blocked+float64(len(instanceRolePaths)) {
+		t.Error("expected blocked requests to be counted, was", v-blocked)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/role", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "A1") {
+		t.Errorf("expected kiam to serve the pod's credentials, was %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/meta-data/hostname", nil))
+	if rr.Body.String() != "proxied" {
+		t.Error("expected other requests to be proxied, was", rr.Body.String())
+	}
+}
+
+func TestProxiesInstanceRoleWhenAllowed(t *testing.T) {
+	handler := buildInstanceRoleServer(t, true)
+
+	for _, path := range instanceRolePaths {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Body.String() != "proxied" {
+			t.Errorf("expected %s to be proxied, was %d %q", path, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func buildNodeRoleFallbackServer(t *testing.T, client *st.StubClient) http.Handler {
+	proxied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("node credentials"))
+	}))
+	t.Cleanup(proxied.Close)
+
+	config := DefaultOptions()
+	config.MetadataEndpoint = proxied.URL
+	config.NodeRoleFallback = true
+	server, err := buildHTTPServer(config, client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server.Handler
+}
+
+func TestProxiesInstanceRoleForPermittedPods(t *testing.T) {
+	handler := buildNodeRoleFallbackServer(t, st.NewStubClient().WithNodeRoleAllowed(true))
+	proxied := metricValue(instanceRoleProxied)
+
+	for _, path := range instanceRolePaths {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != "node credentials" {
+			t.Errorf("expected %s to be proxied, was %d %q", path, rr.Code, rr.Body.String())
+		}
+	}
+	if v := metricValue(instanceRoleProxied); v != proxied+float64(len(instanceRolePaths)) {
+		t.Error("expected proxied requests to be counted, was", v-proxied)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/meta-data/hostname", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Error("expected other paths to remain subject to the whitelist, was", rr.Code)
+	}
+}
+
+func TestBlocksInstanceRoleForOtherPods(t *testing.T) {
+	handler := buildNodeRoleFallbackServer(t, st.NewStubClient().WithCredentials(st.GetCredentialsResult{&sts.Credentials{AccessKeyId: "A1"}, nil}))
+
+	for _, path := range instanceRolePaths {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected %s to be forbidden, was %d %q", path, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/meta-data/iam/security-credentials/role", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "A1") {
+		t.Errorf("expected kiam to serve the pod's credentials, was %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestNodeRoleFallbackRequiresProxy(t *testing.T) {
+	config := DefaultOptions()
+	config.NodeRoleFallback = true
+	config.DisableProxy = true
+	if _, err := buildHTTPServer(config, st.NewStubClient(), nil); err == nil {
+		t.Error("expected error when the proxy is disabled")
+	}
+}
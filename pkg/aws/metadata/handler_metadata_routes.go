@@ -0,0 +1,122 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Actions metadata routes can take.
+const (
+	// MetadataRouteProxy proxies requests to the metadata endpoint, even
+	// when they aren't whitelisted.
+	MetadataRouteProxy = "proxy"
+	// MetadataRouteBlock returns 404, even when requests are whitelisted.
+	MetadataRouteBlock = "block"
+	// MetadataRouteSynthesize responds with the route's configured body.
+	MetadataRouteSynthesize = "synthesize"
+)
+
+// MetadataRoute sets how requests for metadata paths matching Pattern,
+// that kiam doesn't serve itself, are handled.
+type MetadataRoute struct {
+	Pattern *regexp.Regexp
+	Action  string
+	// Body is the response to synthesized requests
+	Body string
+}
+
+// ParseMetadataRoute parses a route of the form pattern=action, or
+// pattern=synthesize:body, where pattern is a regular expression matching
+// request paths.
+func ParseMetadataRoute(route string) (*MetadataRoute, error) {
+	parts := strings.SplitN(route, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid metadata route %q, expected pattern=action", route)
+	}
+
+	pattern, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata route pattern %q: %s", parts[0], err)
+	}
+
+	action := parts[1]
+	switch {
+	case action == MetadataRouteProxy, action == MetadataRouteBlock:
+		return &MetadataRoute{Pattern: pattern, Action: action}, nil
+	case strings.HasPrefix(action, MetadataRouteSynthesize+":"):
+		body := strings.TrimPrefix(action, MetadataRouteSynthesize+":")
+		return &MetadataRoute{Pattern: pattern, Action: MetadataRouteSynthesize, Body: body}, nil
+	}
+	return nil, fmt.Errorf("invalid metadata route action %q, expected %s, %s or %s:<body>", action, MetadataRouteProxy, MetadataRouteBlock, MetadataRouteSynthesize)
+}
+
+// metadataRoutesHandler serves requests matching one of the routes with
+// the first matching route's action, ahead of the whitelist.
+type metadataRoutesHandler struct {
+	routes         []*MetadataRoute
+	backingService http.Handler
+}
+
+func newMetadataRoutesHandler(routes []*MetadataRoute, backingService http.Handler) (*metadataRoutesHandler, error) {
+	for _, route := range routes {
+		switch route.Action {
+		case MetadataRouteProxy:
+			if backingService == nil {
+				return nil, fmt.Errorf("metadata route %q can't proxy when the proxy is disabled", route.Pattern)
+			}
+		case MetadataRouteBlock, MetadataRouteSynthesize:
+		default:
+			return nil, fmt.Errorf("invalid metadata route action %q", route.Action)
+		}
+	}
+	return &metadataRoutesHandler{routes: routes, backingService: backingService}, nil
+}
+
+func (h *metadataRoutesHandler) Install(router *mux.Router) {
+	router.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		return h.match(r.URL.Path) != nil
+	}).Handler(adapt(withMeter("metadataRoute", h)))
+}
+
+func (h *metadataRoutesHandler) match(path string) *MetadataRoute {
+	for _, route := range h.routes {
+		if route.Pattern.MatchString(path) {
+			return route
+		}
+	}
+	return nil
+}
+
+func (h *metadataRoutesHandler) Handle(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	route := h.match(r.URL.Path)
+	switch route.Action {
+	case MetadataRouteProxy:
+		return proxyRequest(h.backingService, "metadataRoute", w, r), nil
+	case MetadataRouteSynthesize:
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, route.Body)
+		success.WithLabelValues("metadataRoute").Inc()
+		return http.StatusOK, nil
+	}
+
+	proxyDenies.Inc()
+	return http.StatusNotFound, fmt.Errorf("request blocked by metadata route %q: %s", route.Pattern, r.URL.Path)
+}
@@ -0,0 +1,133 @@
+package metadata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	st "github.com/uswitch/kiam/pkg/testutil/server"
+)
+
+func buildMetadataRoutesServer(t *testing.T, config *ServerOptions, routes ...string) (http.Handler, *int) {
+	hits := 0
+	proxied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte("proxied"))
+	}))
+	t.Cleanup(proxied.Close)
+
+	config.MetadataEndpoint = proxied.URL
+	for _, r := range routes {
+		route, err := ParseMetadataRoute(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.MetadataRoutes = append(config.MetadataRoutes, route)
+	}
+	server, err := buildHTTPServer(config, st.NewStubClient(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server.Handler, &hits
+}
+
+func TestMetadataRouteProxiesPathsNotWhitelisted(t *testing.T) {
+	handler, hits := buildMetadataRoutesServer(t, DefaultOptions(), "^/latest/meta-data/placement/=proxy")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/meta-data/placement/availability-zone", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "proxied" {
+		t.Errorf("expected request to be proxied, was %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/meta-data/hostname", nil))
+	if rr.Code != http.StatusNotFound || *hits != 1 {
+		t.Errorf("expected other paths to be blocked by the whitelist, was %d", rr.Code)
+	}
+}
+
+func TestMetadataRouteBlocksWhitelistedPaths(t *testing.T) {
+	config := DefaultOptions()
+	config.WhitelistRouteRegexp = regexp.MustCompile(".*")
+	handler, hits := buildMetadataRoutesServer(t, config, "^/latest/user-data=block")
+	blocked := metricValue(proxyDenies)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/user-data", nil))
+	if rr.Code != http.StatusNotFound || *hits != 0 {
+		t.Errorf("expected request to be blocked, was %d %q", rr.Code, rr.Body.String())
+	}
+	if metricValue(proxyDenies) != blocked+1 {
+		t.Error("expected blocked request to be counted")
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/meta-data/hostname", nil))
+	if rr.Body.String() != "proxied" {
+		t.Error("expected other whitelisted paths to be proxied, was", rr.Body.String())
+	}
+}
+
+func TestMetadataRouteSynthesizesResponses(t *testing.T) {
+	handler, hits := buildMetadataRoutesServer(t, DefaultOptions(), "^/latest/meta-data/placement/region$=synthesize:eu-west-1")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/meta-data/placement/region", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "eu-west-1" || *hits != 0 {
+		t.Errorf("expected synthesized response, was %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestMetadataRoutesApplyFirstMatch(t *testing.T) {
+	handler, _ := buildMetadataRoutesServer(t, DefaultOptions(), "^/latest/meta-data/placement/region$=synthesize:eu-west-1", "^/latest/meta-data/placement/=block")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/meta-data/placement/region", nil))
+	if rr.Body.String() != "eu-west-1" {
+		t.Error("expected the first matching route to apply, was", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/meta-data/placement/availability-zone", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Error("expected the later route to apply, was", rr.Code)
+	}
+}
+
+func TestMetadataRoutesDontOverrideKiam(t *testing.T) {
+	handler, hits := buildMetadataRoutesServer(t, DefaultOptions(), "^/latest/meta-data/iam/=proxy")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/meta-data/iam/info", nil))
+	if rr.Code != http.StatusForbidden || *hits != 0 {
+		t.Errorf("expected the instance role to remain blocked, was %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestMetadataRouteProxyRequiresProxy(t *testing.T) {
+	route, _ := ParseMetadataRoute("^/latest/=proxy")
+	config := DefaultOptions()
+	config.DisableProxy = true
+	config.MetadataRoutes = []*MetadataRoute{route}
+	if _, err := buildHTTPServer(config, st.NewStubClient(), nil); err == nil {
+		t.Error("expected error proxying with the proxy disabled")
+	}
+}
+
+func TestParsesMetadataRoutes(t *testing.T) {
+	route, err := ParseMetadataRoute("^/latest/meta-data/tags/instance/Name$=synthesize:name=web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Action != MetadataRouteSynthesize || route.Body != "name=web" || route.Pattern.String() != "^/latest/meta-data/tags/instance/Name$" {
+		t.Error("unexpected route", route)
+	}
+
+	for _, invalid := range []string{"^/latest/", "=proxy", "^/latest/=allow", "^/latest/=synthesize", "[=block"} {
+		if _, err := ParseMetadataRoute(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
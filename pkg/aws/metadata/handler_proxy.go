@@ -14,10 +14,14 @@
 package metadata
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"regexp"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -29,6 +33,24 @@ type proxyHandler struct {
 
 var tokenRouteRegexp = regexp.MustCompile("^/?[^/]+/api/token$")
 
+const tokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+
+// DefaultProxyStripHeaders are removed from requests before they're proxied
+// to the metadata endpoint: trace context and forwarding headers kiam handles
+// itself, the client IP sent over the unix socket, and the session token ttl
+// which is only sent when requesting a token.
+var DefaultProxyStripHeaders = []string{
+	"traceparent",
+	"tracestate",
+	"baggage",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+	SocketClientIPHeader,
+	tokenTTLHeader,
+}
+
 func (p *proxyHandler) Install(router *mux.Router) {
 	router.PathPrefix("/").Handler(adapt(withMeter("proxy", p)))
 }
@@ -47,22 +69,28 @@ func (p *proxyHandler) Handle(ctx context.Context, w http.ResponseWriter, r *htt
 	if p.whitelistRouteRegexp.MatchString(r.URL.Path) ||
 		// Always proxy through requests to pick up a session token
 		(r.Method == http.MethodPut && tokenRouteRegexp.MatchString(r.URL.Path)) {
-		writer := &teeWriter{w, http.StatusOK}
-		// Passing the request through with no RemoteAddr prevents the backing service adding an X-Forwarded-For header.
-		// This is important, because v2 of the EC2 Instance Metadata API blocks all requests containing such a header
-		r.RemoteAddr = ""
-		p.backingService.ServeHTTP(writer, r)
-
-		if writer.status == http.StatusOK {
-			success.WithLabelValues("proxy").Inc()
-		}
-		return writer.status, nil
+		return proxyRequest(p.backingService, "proxy", w, r), nil
 	}
 
 	proxyDenies.Inc()
 	return http.StatusNotFound, fmt.Errorf("request blocked by whitelist-route-regexp %q: %s", p.whitelistRouteRegexp, r.URL.Path)
 }
 
+// proxyRequest passes the request to the backing service, returning the
+// response's status.
+func proxyRequest(backingService http.Handler, handler string, w http.ResponseWriter, r *http.Request) int {
+	writer := &teeWriter{w, http.StatusOK}
+	// Passing the request through with no RemoteAddr prevents the backing service adding an X-Forwarded-For header.
+	// This is important, because v2 of the EC2 Instance Metadata API blocks all requests containing such a header
+	r.RemoteAddr = ""
+	backingService.ServeHTTP(writer, r)
+
+	if writer.status == http.StatusOK {
+		success.WithLabelValues(handler).Inc()
+	}
+	return writer.status
+}
+
 func newProxyHandler(backingService http.Handler, whitelistRouteRegexp *regexp.Regexp) *proxyHandler {
 	if whitelistRouteRegexp.String() == "" {
 		whitelistRouteRegexp = regexp.MustCompile("^$")
@@ -72,3 +100,98 @@ func newProxyHandler(backingService http.Handler, whitelistRouteRegexp *regexp.R
 		whitelistRouteRegexp: whitelistRouteRegexp,
 	}
 }
+
+// stripHeaders wraps director so the headers are removed from requests
+// before they're proxied. The session token ttl is kept on requests for a
+// session token.
+func stripHeaders(director func(*http.Request), headers []string) func(*http.Request) {
+	return func(r *http.Request) {
+		director(r)
+		isTokenRequest := r.Method == http.MethodPut && tokenRouteRegexp.MatchString(r.URL.Path)
+		for _, header := range headers {
+			if isTokenRequest && http.CanonicalHeaderKey(header) == http.CanonicalHeaderKey(tokenTTLHeader) {
+				continue
+			}
+			r.Header.Del(header)
+		}
+	}
+}
+
+// boundedTransport fails proxied requests that take longer than timeout,
+// or whose response is larger than maxBytes, so the reverse proxy answers
+// them with a 502. Bounded responses are read in full before they're
+// returned so the limit is enforced before anything is written to the
+// client.
+type boundedTransport struct {
+	next     http.RoundTripper
+	timeout  time.Duration
+	maxBytes int64
+}
+
+func newBoundedTransport(next http.RoundTripper, timeout time.Duration, maxBytes int64) *boundedTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &boundedTransport{next: next, timeout: timeout, maxBytes: maxBytes}
+}
+
+func (t *boundedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cancel := func() {}
+	if t.timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), t.timeout)
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if t.maxBytes <= 0 {
+		resp.Body = &cancelOnClose{resp.Body, cancel}
+		return resp, nil
+	}
+
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.ContentLength > t.maxBytes {
+		return nil, fmt.Errorf("proxied response of %d bytes exceeds limit of %d", resp.ContentLength, t.maxBytes)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, t.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > t.maxBytes {
+		return nil, fmt.Errorf("proxied response exceeds limit of %d bytes", t.maxBytes)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp, nil
+}
+
+// cancelOnClose releases the request's timeout once its response has
+// been read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// disabledProxyHandler answers requests kiam doesn't handle itself with a
+// 404, rather than proxying them to the metadata endpoint.
+type disabledProxyHandler struct{}
+
+func (p *disabledProxyHandler) Install(router *mux.Router) {
+	router.PathPrefix("/").Handler(adapt(withMeter("proxy", p)))
+}
+
+func (p *disabledProxyHandler) Handle(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	proxyDenies.Inc()
+	return http.StatusNotFound, fmt.Errorf("request blocked, metadata proxy is disabled: %s", r.URL.Path)
+}
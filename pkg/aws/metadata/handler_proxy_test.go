@@ -14,7 +14,9 @@
 package metadata
 
 import (
+	"compress/gzip"
 	"context"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
@@ -160,3 +162,240 @@ func TestErrorReturned(t *testing.T) {
 		t.Error("unexpected status", rr.Code)
 	}
 }
+
+func TestProxyTransportDefaultsWhenUnset(t *testing.T) {
+	if transport := buildProxyTransport(DefaultOptions()); transport != nil {
+		t.Error("expected default transport to be used")
+	}
+}
+
+func TestProxyTransportTuning(t *testing.T) {
+	options := DefaultOptions()
+	options.ProxyMaxIdleConns = 50
+	options.ProxyIdleConnTimeout = time.Minute
+	options.ProxyKeepAlive = 15 * time.Second
+
+	transport := buildProxyTransport(options)
+	if transport.MaxIdleConns != 50 || transport.MaxIdleConnsPerHost != 50 {
+		t.Error("unexpected idle connections", transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+	}
+	if transport.IdleConnTimeout != time.Minute {
+		t.Error("unexpected idle timeout", transport.IdleConnTimeout)
+	}
+	if transport.TLSHandshakeTimeout == 0 {
+		t.Error("expected default transport settings to be retained")
+	}
+}
+
+func TestDisableProxy(t *testing.T) {
+	backingService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("i-12345"))
+	}))
+	defer backingService.Close()
+
+	for _, disabled := range []bool{false, true} {
+		config := DefaultOptions()
+		config.MetadataEndpoint = backingService.URL
+		config.WhitelistRouteRegexp = regexp.MustCompile("^/latest/meta-data/instance-id$")
+		config.DisableProxy = disabled
+		server, err := buildHTTPServer(config, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, _ := http.NewRequest("GET", "/latest/meta-data/instance-id", nil)
+		rr := httptest.NewRecorder()
+		server.Handler.ServeHTTP(rr, r)
+
+		if disabled && rr.Code != http.StatusNotFound {
+			t.Error("expected 404 with proxy disabled, was", rr.Code)
+		}
+		if !disabled && (rr.Code != http.StatusOK || rr.Body.String() != "i-12345") {
+			t.Error("expected request to be proxied, was", rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestProxyDirectorStripsHeaders(t *testing.T) {
+	director := stripHeaders(func(*http.Request) {}, DefaultProxyStripHeaders)
+
+	r, _ := http.NewRequest("GET", "/latest/meta-data/instance-id", nil)
+	r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	r.Header.Set(SocketClientIPHeader, "10.0.0.1")
+	r.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	r.Header.Set("X-aws-ec2-metadata-token", "token")
+	director(r)
+
+	for _, header := range []string{"traceparent", "X-Forwarded-For", SocketClientIPHeader, "X-aws-ec2-metadata-token-ttl-seconds"} {
+		if r.Header.Get(header) != "" {
+			t.Error("expected header to be stripped:", header)
+		}
+	}
+	if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+		t.Error("expected session token to be forwarded")
+	}
+
+	r, _ = http.NewRequest("PUT", "/latest/api/token", nil)
+	r.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	director(r)
+
+	if r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") != "21600" {
+		t.Error("expected token ttl to be forwarded when requesting a token")
+	}
+}
+
+func TestProxyDirectorStripsConfiguredHeaders(t *testing.T) {
+	director := stripHeaders(func(*http.Request) {}, []string{"X-Custom"})
+
+	r, _ := http.NewRequest("GET", "/latest/meta-data/instance-id", nil)
+	r.Header.Set("X-Custom", "value")
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	director(r)
+
+	if r.Header.Get("X-Custom") != "" {
+		t.Error("expected configured header to be stripped")
+	}
+	if r.Header.Get("X-Forwarded-For") != "10.0.0.1" {
+		t.Error("expected only configured headers to be stripped")
+	}
+}
+
+func TestCompressesProxiedResponses(t *testing.T) {
+	userData := strings.Repeat("#!/bin/bash\necho hello\n", 100)
+	backingService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(userData))
+	}))
+	defer backingService.Close()
+
+	config := DefaultOptions()
+	config.MetadataEndpoint = backingService.URL
+	config.WhitelistRouteRegexp = regexp.MustCompile("^/latest/user-data$")
+	config.CompressProxyResponses = true
+	server, err := buildHTTPServer(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("GET", "/latest/user-data", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rr, r)
+
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("expected response to be gzipped, headers were", rr.Header())
+	}
+	if rr.Body.Len() >= len(userData) {
+		t.Error("expected compressed response to be smaller, was", rr.Body.Len())
+	}
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(gz)
+	if string(body) != userData {
+		t.Error("unexpected decompressed response", string(body))
+	}
+
+	r, _ = http.NewRequest("GET", "/latest/user-data", nil)
+	rr = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rr, r)
+	if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != userData {
+		t.Error("expected uncompressed response when client doesn't accept gzip")
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"deflate, gzip":     true,
+		"gzip;q=0.5, br":    true,
+		"gzip;q=0":          false,
+		"deflate, identity": false,
+	}
+	for header, expected := range cases {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if header != "" {
+			r.Header.Set("Accept-Encoding", header)
+		}
+		if acceptsGzip(r) != expected {
+			t.Errorf("expected %v for %q", expected, header)
+		}
+	}
+}
+
+func boundedProxyServer(t *testing.T, endpoint string, timeout time.Duration, maxBytes int64) *http.Server {
+	config := DefaultOptions()
+	config.MetadataEndpoint = endpoint
+	config.WhitelistRouteRegexp = regexp.MustCompile("^/latest/user-data$")
+	config.ProxyTimeout = timeout
+	config.ProxyMaxResponseBytes = maxBytes
+	server, err := buildHTTPServer(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func proxyUserData(server *http.Server) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "/latest/user-data", nil)
+	rr := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rr, r)
+	return rr
+}
+
+func TestRejectsProxiedResponsesOverLimit(t *testing.T) {
+	backingService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("stream") == "" {
+			w.Write([]byte(strings.Repeat("a", 2048)))
+			return
+		}
+		// streamed without a content length
+		for i := 0; i < 16; i++ {
+			w.Write([]byte(strings.Repeat("a", 256)))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backingService.Close()
+
+	rr := proxyUserData(boundedProxyServer(t, backingService.URL, 0, 1024))
+	if rr.Code != http.StatusBadGateway {
+		t.Error("expected bad gateway for response over limit, was", rr.Code)
+	}
+
+	rr = proxyUserData(boundedProxyServer(t, backingService.URL+"?stream=true", 0, 1024))
+	if rr.Code != http.StatusBadGateway || rr.Body.Len() > 1024 {
+		t.Error("expected bad gateway for streamed response over limit, was", rr.Code, rr.Body.Len())
+	}
+
+	rr = proxyUserData(boundedProxyServer(t, backingService.URL, 0, 4096))
+	if rr.Code != http.StatusOK || rr.Body.Len() != 2048 {
+		t.Error("expected response under limit to be proxied, was", rr.Code, rr.Body.Len())
+	}
+}
+
+func TestRejectsProxiedRequestsOverTimeout(t *testing.T) {
+	backingService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("body") != "" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	}))
+	defer backingService.Close()
+
+	start := time.Now()
+	rr := proxyUserData(boundedProxyServer(t, backingService.URL, 50*time.Millisecond, 0))
+	if rr.Code != http.StatusBadGateway {
+		t.Error("expected bad gateway for hanging upstream, was", rr.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("expected request to time out, took", elapsed)
+	}
+
+	rr = proxyUserData(boundedProxyServer(t, backingService.URL+"?body=true", 50*time.Millisecond, 1024))
+	if rr.Code != http.StatusBadGateway {
+		t.Error("expected bad gateway for upstream hanging while sending the body, was", rr.Code)
+	}
+}
@@ -15,21 +15,22 @@ package metadata
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/cenkalti/backoff"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
-	log "github.com/sirupsen/logrus"
+	"github.com/uswitch/kiam/pkg/aws/sts"
 	"github.com/uswitch/kiam/pkg/server"
 	"github.com/uswitch/kiam/pkg/statsd"
 	"net/http"
 	"net/url"
-	"time"
 )
 
 type roleHandler struct {
-	client      server.Client
+	roles       *roleLookups
 	getClientIP clientIPFunc
+	readiness   *serverReadiness
 }
 
 func trailingSlashSuffixRedirectHandler(rw http.ResponseWriter, req *http.Request) {
@@ -45,7 +46,7 @@ func trailingSlashSuffixRedirectHandler(rw http.ResponseWriter, req *http.Reques
 }
 
 func (h *roleHandler) Install(router *mux.Router) {
-	handler := adapt(withMeter("roleName", h))
+	handler := adaptWithDeadline(withMeter("roleName", h), h.roles.retry.deadline())
 	router.Handle("/{version}/meta-data/iam/security-credentials/", handler)
 	router.HandleFunc("/{version}/meta-data/iam/security-credentials", trailingSlashSuffixRedirectHandler)
 }
@@ -67,7 +68,20 @@ func (h *roleHandler) Handle(ctx context.Context, w http.ResponseWriter, req *ht
 		return http.StatusInternalServerError, err
 	}
 
-	role, err := findRole(ctx, h.client, ip)
+	role, err := h.roles.find(ctx, ip)
+	if errors.Is(err, server.ErrPodNotFound) {
+		if !h.readiness.isReady() {
+			return warmingUp(w)
+		}
+		return http.StatusNotFound, err
+	}
+	if err == server.ErrNamespaceDenied {
+		namespaceDenied.WithLabelValues("roleName").Inc()
+		return http.StatusForbidden, err
+	}
+	if err == server.ErrAmbiguousPodIP {
+		return http.StatusConflict, err
+	}
 
 	if err != nil {
 		findRoleError.WithLabelValues("roleName").Inc()
@@ -75,21 +89,22 @@ func (h *roleHandler) Handle(ctx context.Context, w http.ResponseWriter, req *ht
 	}
 
 	if role == "" {
+		if !h.readiness.isReady() {
+			return warmingUp(w)
+		}
 		emptyRole.WithLabelValues("roleName").Inc()
 		return http.StatusNotFound, EmptyRoleError
 	}
 
-	fmt.Fprint(w, role)
+	// credentials are requested with the listed role, so it's listed by
+	// name as the metadata API does, rather than as annotated
+	fmt.Fprint(w, sts.RoleName(role))
 	success.WithLabelValues("roleName").Inc()
 
 	return http.StatusOK, nil
 }
 
-const (
-	retryInterval = time.Millisecond * 5
-)
-
-func findRole(ctx context.Context, client server.Client, ip string) (string, error) {
+func findRole(ctx context.Context, client server.Client, ip string, retry retryTimeouts) (string, error) {
 	logger := log.WithField("pod.ip", ip)
 
 	var role string
@@ -98,15 +113,15 @@ func findRole(ctx context.Context, client server.Client, ip string) (string, err
 		role, err = client.GetRole(ctx, ip)
 		if err != nil {
 			logger.Warnf("error finding role for pod: %s", err.Error())
+			if err == server.ErrNamespaceDenied || err == server.ErrAmbiguousPodIP {
+				return backoff.Permanent(err)
+			}
 			return err
 		}
 		return nil
 	}
 
-	strategy := backoff.NewExponentialBackOff()
-	strategy.InitialInterval = retryInterval
-
-	err := backoff.Retry(op, backoff.WithContext(strategy, ctx))
+	err := retry.retry(ctx, op)
 	if err != nil {
 		return "", err
 	}
@@ -114,9 +129,10 @@ func findRole(ctx context.Context, client server.Client, ip string) (string, err
 	return role, nil
 }
 
-func newRoleHandler(client server.Client, getClientIP clientIPFunc) *roleHandler {
+func newRoleHandler(client server.Client, getClientIP clientIPFunc, retry retryTimeouts, readiness *serverReadiness) *roleHandler {
 	return &roleHandler{
-		client:      client,
+		roles:       newRoleLookups(client, retry),
 		getClientIP: getClientIP,
+		readiness:   readiness,
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/fortytw2/leaktest"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uswitch/kiam/pkg/aws/sts"
 	"github.com/uswitch/kiam/pkg/server"
 	st "github.com/uswitch/kiam/pkg/testutil/server"
 	"net/http"
@@ -20,7 +21,7 @@ func TestRedirectsToCanonicalPath(t *testing.T) {
 	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials", nil)
 	rr := httptest.NewRecorder()
 
-	handler := newRoleHandler(nil, nil)
+	handler := newRoleHandler(nil, nil, testRetryTimeouts, nil)
 	router := mux.NewRouter()
 	handler.Install(router)
 
@@ -31,23 +32,26 @@ func TestRedirectsToCanonicalPath(t *testing.T) {
 	}
 }
 
+// readPrometheusCounterValue sums the counters with the label, across
+// their other labels
 func readPrometheusCounterValue(name, labelName, labelValue string) float64 {
 	metrics, err := prometheus.DefaultGatherer.Gather()
 	if err != nil {
 		panic(err)
 	}
+	var value float64
 	for _, m := range metrics {
 		if m.GetName() == name {
 			for _, metric := range m.Metric {
 				for _, label := range metric.Label {
 					if label.GetName() == labelName && label.GetValue() == labelValue {
-						return metric.Counter.GetValue()
+						value += metric.Counter.GetValue()
 					}
 				}
 			}
 		}
 	}
-	return 0
+	return value
 }
 
 func TestIncrementsPrometheusCounter(t *testing.T) {
@@ -56,7 +60,7 @@ func TestIncrementsPrometheusCounter(t *testing.T) {
 	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
 	rr := httptest.NewRecorder()
 
-	handler := newRoleHandler(st.NewStubClient().WithRoles(st.GetRoleResult{"foo_role", nil}), getBlankClientIP)
+	handler := newRoleHandler(st.NewStubClient().WithRoles(st.GetRoleResult{"foo_role", nil}), getBlankClientIP, testRetryTimeouts, nil)
 	router := mux.NewRouter()
 	handler.Install(router)
 
@@ -77,7 +81,7 @@ func TestReturnRoleWhenClientResponds(t *testing.T) {
 
 	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
 	rr := httptest.NewRecorder()
-	handler := newRoleHandler(st.NewStubClient().WithRoles(st.GetRoleResult{"foo_role", nil}), getBlankClientIP)
+	handler := newRoleHandler(st.NewStubClient().WithRoles(st.GetRoleResult{"foo_role", nil}), getBlankClientIP, testRetryTimeouts, nil)
 	router := mux.NewRouter()
 	handler.Install(router)
 
@@ -93,12 +97,41 @@ func TestReturnRoleWhenClientResponds(t *testing.T) {
 	}
 }
 
+func TestListedRoleIsAcceptedByCredentialsEndpoint(t *testing.T) {
+	for _, annotated := range []string{"foo_role", "arn:aws:iam::123456789012:role/team/foo_role"} {
+		client := st.NewStubClient().
+			WithRoles(st.GetRoleResult{annotated, nil}).
+			WithCredentials(st.GetCredentialsResult{&sts.Credentials{AccessKeyId: "A1"}, nil})
+		router := mux.NewRouter()
+		newRoleHandler(client, getBlankClientIP, testRetryTimeouts, nil).Install(router)
+		newCredentialsHandler(client, getBlankClientIP, testRetryTimeouts, nil, false).Install(router)
+
+		r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, r)
+		listed := rr.Body.String()
+		if listed != "foo_role" {
+			t.Errorf("expected %s to be listed by name, was %s", annotated, listed)
+		}
+
+		r, _ = http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/"+listed, nil)
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, r)
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected credentials for %s, was %d", annotated, rr.Code)
+		}
+		if requested := client.RequestedRoles(); len(requested) != 1 || requested[0] != listed {
+			t.Error("expected credentials to be requested for the listed role, was", requested)
+		}
+	}
+}
+
 func TestReturnRoleWhenRetryingFollowingError(t *testing.T) {
 	defer leaktest.Check(t)()
 
 	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
 	rr := httptest.NewRecorder()
-	handler := newRoleHandler(st.NewStubClient().WithRoles(st.GetRoleResult{"", fmt.Errorf("unexpected error")}, st.GetRoleResult{"foo_role", nil}), getBlankClientIP)
+	handler := newRoleHandler(st.NewStubClient().WithRoles(st.GetRoleResult{"", fmt.Errorf("unexpected error")}, st.GetRoleResult{"foo_role", nil}), getBlankClientIP, testRetryTimeouts, nil)
 	router := mux.NewRouter()
 	handler.Install(router)
 
@@ -119,7 +152,7 @@ func TestReturnsEmptyRoleWhenClientSucceedsWithEmptyRole(t *testing.T) {
 
 	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
 	rr := httptest.NewRecorder()
-	handler := newRoleHandler(st.NewStubClient().WithRoles(st.GetRoleResult{"", nil}), getBlankClientIP)
+	handler := newRoleHandler(st.NewStubClient().WithRoles(st.GetRoleResult{"", nil}), getBlankClientIP, testRetryTimeouts, nil)
 	router := mux.NewRouter()
 	handler.Install(router)
 
@@ -138,13 +171,64 @@ func TestReturnErrorWhenPodNotFoundWithinTimeout(t *testing.T) {
 
 	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
 	rr := httptest.NewRecorder()
-	handler := newRoleHandler(st.NewStubClient().WithRoles(st.GetRoleResult{"", server.ErrPodNotFound}), getBlankClientIP)
+	handler := newRoleHandler(st.NewStubClient().WithRoles(st.GetRoleResult{"", server.ErrPodNotFound}), getBlankClientIP, testRetryTimeouts, nil)
 	router := mux.NewRouter()
 	handler.Install(router)
 
 	router.ServeHTTP(rr, r.WithContext(ctx))
 
-	if rr.Code != http.StatusInternalServerError {
-		t.Error("expected internal server error, was:", rr.Code)
+	if rr.Code != http.StatusNotFound {
+		t.Error("expected not found, was:", rr.Code)
+	}
+}
+
+// scheduledRoleClient returns ErrPodNotFound until the pod is scheduled
+type scheduledRoleClient struct {
+	*st.StubClient
+	scheduled time.Time
+}
+
+func (c *scheduledRoleClient) GetRole(ctx context.Context, ip string) (string, error) {
+	if time.Now().Before(c.scheduled) {
+		return "", server.ErrPodNotFound
+	}
+	return "foo_role", nil
+}
+
+func TestFindsPodScheduledAfterDefaultDeadline(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	client := &scheduledRoleClient{StubClient: st.NewStubClient(), scheduled: time.Now().Add(handlerMaxDuration + 500*time.Millisecond)}
+	retry := retryTimeouts{podNotFound: 2 * handlerMaxDuration, errors: handlerMaxDuration}
+	router := mux.NewRouter()
+	newRoleHandler(client, getBlankClientIP, retry, nil).Install(router)
+
+	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusOK {
+		t.Error("expected 200 response, was", rr.Code)
+	}
+	if body := rr.Body.String(); body != "foo_role" {
+		t.Error("expected foo_role in body, was", body)
+	}
+}
+
+func TestReturnsForbiddenWhenNamespaceDenied(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+	rr := httptest.NewRecorder()
+	handler := newRoleHandler(st.NewStubClient().WithRoles(st.GetRoleResult{"", server.ErrNamespaceDenied}), getBlankClientIP, testRetryTimeouts, nil)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	router.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusForbidden {
+		t.Error("expected forbidden, was", rr.Code)
+	}
+	denied := readPrometheusCounterValue("kiam_metadata_namespace_denied_total", "handler", "roleName")
+	if denied != 1 {
+		t.Error("expected namespace_denied_total to be 1, was", denied)
 	}
 }
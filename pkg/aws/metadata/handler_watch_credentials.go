@@ -0,0 +1,100 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/uswitch/kiam/pkg/aws/sts"
+	"github.com/uswitch/kiam/pkg/server"
+	"net/http"
+)
+
+// watchCredentialsHandler streams credentials to the client as Server-Sent
+// Events, sending the current credentials and again each time they're
+// refreshed. It doesn't use the handler adapter as streams outlive the
+// handler timeout.
+type watchCredentialsHandler struct {
+	client      server.Client
+	getClientIP clientIPFunc
+}
+
+func (h *watchCredentialsHandler) Install(router *mux.Router) {
+	router.Handle("/kiam/watch/security-credentials/{role}", h)
+}
+
+func (h *watchCredentialsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	logger := log.WithFields(requestFields(req))
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, req, fmt.Errorf("streaming unsupported"), http.StatusInternalServerError)
+		return
+	}
+
+	err := req.ParseForm()
+	if err != nil {
+		writeError(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	ip, err := h.getClientIP(req)
+	if err != nil {
+		writeError(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	started := false
+	send := func(credentials *sts.Credentials) error {
+		data, err := json.Marshal(credentials)
+		if err != nil {
+			credentialEncodeError.WithLabelValues("watchCredentials").Inc()
+			return fmt.Errorf("error encoding credentials: %s", err.Error())
+		}
+
+		started = true
+		fmt.Fprintf(w, "event: credentials\ndata: %s\n\n", data)
+		flusher.Flush()
+		success.WithLabelValues("watchCredentials").Inc()
+		return nil
+	}
+
+	ctx := req.Context()
+	err = h.client.WatchCredentials(ctx, ip, mux.Vars(req)["role"], send)
+	if err == nil || ctx.Err() != nil {
+		// the client disconnected
+		return
+	}
+
+	credentialFetchError.WithLabelValues("watchCredentials").Inc()
+	logger.Errorf("error watching credentials: %s", err.Error())
+	if !started {
+		status := http.StatusInternalServerError
+		if err == server.ErrAmbiguousPodIP {
+			status = http.StatusConflict
+		}
+		writeError(w, req, fmt.Errorf("error watching credentials: %w", err), status)
+	}
+}
+
+func newWatchCredentialsHandler(client server.Client, getClientIP clientIPFunc) *watchCredentialsHandler {
+	return &watchCredentialsHandler{
+		client:      client,
+		getClientIP: getClientIP,
+	}
+}
@@ -0,0 +1,75 @@
+package metadata
+
+import (
+	"context"
+	"github.com/fortytw2/leaktest"
+	"github.com/gorilla/mux"
+	"github.com/uswitch/kiam/pkg/aws/sts"
+	"github.com/uswitch/kiam/pkg/server"
+	st "github.com/uswitch/kiam/pkg/testutil/server"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamsCredentialsAsEvents(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	r, _ := http.NewRequest("GET", "/kiam/watch/security-credentials/role", nil)
+	rr := httptest.NewRecorder()
+
+	client := st.NewStubClient().WithCredentials(
+		st.GetCredentialsResult{&sts.Credentials{AccessKeyId: "A1"}, nil},
+		st.GetCredentialsResult{&sts.Credentials{AccessKeyId: "A2"}, nil},
+	)
+	handler := newWatchCredentialsHandler(client, getBlankClientIP)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	// served through the logging handler, as the agent does, to check it streams
+	loggingHandler(router).ServeHTTP(rr, r.WithContext(ctx))
+
+	if rr.Code != http.StatusOK {
+		t.Error("unexpected status, was", rr.Code)
+	}
+
+	if content := rr.Header().Get("Content-Type"); content != "text/event-stream" {
+		t.Error("expected event stream, was", content)
+	}
+
+	events := strings.Split(strings.TrimSpace(rr.Body.String()), "\n\n")
+	if len(events) != 2 {
+		t.Fatal("expected 2 events, was", rr.Body.String())
+	}
+	if !strings.HasPrefix(events[0], "event: credentials\ndata: ") || !strings.Contains(events[0], `"AccessKeyId":"A1"`) {
+		t.Error("unexpected first event", events[0])
+	}
+	if !strings.Contains(events[1], `"AccessKeyId":"A2"`) {
+		t.Error("unexpected second event", events[1])
+	}
+}
+
+func TestReturnsErrorWhenWatchFails(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	r, _ := http.NewRequest("GET", "/kiam/watch/security-credentials/role", nil)
+	rr := httptest.NewRecorder()
+
+	client := st.NewStubClient().WithCredentials(st.GetCredentialsResult{nil, server.ErrPolicyForbidden})
+	handler := newWatchCredentialsHandler(client, getBlankClientIP)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	router.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Error("unexpected status, was", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "forbidden by policy") {
+		t.Error("unexpected error", rr.Body.String())
+	}
+}
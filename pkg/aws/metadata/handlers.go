@@ -15,12 +15,17 @@ package metadata
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	log "github.com/sirupsen/logrus"
+	"github.com/uswitch/kiam/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // interface for request handlers
@@ -36,25 +41,31 @@ const (
 	handlerMaxDuration = time.Second * 5 //
 )
 
-// adapts between handler and http.Handler
+// adapts between handler and http.Handler, bounding each request by
+// maxDuration
 type handlerAdapter struct {
-	h handler
+	h           handler
+	maxDuration time.Duration
 }
 
 func (a *handlerAdapter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	ctx, cancel := context.WithTimeout(req.Context(), handlerMaxDuration)
+	ctx, cancel := context.WithTimeout(req.Context(), a.maxDuration)
 	defer cancel()
 
 	status, err := a.h.Handle(ctx, w, req)
 
 	if err != nil {
 		log.WithFields(requestFields(req)).WithField("status", status).Errorf("error processing request: %s", err.Error())
-		http.Error(w, err.Error(), status)
+		writeError(w, req, err, status)
 	}
 }
 
 func adapt(h handler) *handlerAdapter {
-	return &handlerAdapter{h: h}
+	return adaptWithDeadline(h, handlerMaxDuration)
+}
+
+func adaptWithDeadline(h handler, maxDuration time.Duration) *handlerAdapter {
+	return &handlerAdapter{h: h, maxDuration: maxDuration}
 }
 
 // uses a meter to record error statuses
@@ -66,7 +77,7 @@ type metricHandler struct {
 func withMeter(name string, h handler) handler {
 	return &metricHandler{
 		name: name,
-		h:    h,
+		h:    withSpan(name, h),
 	}
 }
 
@@ -75,3 +86,48 @@ func (m *metricHandler) Handle(ctx context.Context, w http.ResponseWriter, r *ht
 	responses.With(prometheus.Labels{"code": strconv.Itoa(status), "handler": m.name}).Inc()
 	return status, err
 }
+
+// creates a span for each request, continuing any trace the caller
+// propagated in the request headers
+type tracedHandler struct {
+	name string
+	h    handler
+}
+
+func withSpan(name string, h handler) handler {
+	return &tracedHandler{
+		name: name,
+		h:    h,
+	}
+}
+
+func (t *tracedHandler) Handle(ctx context.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Tracer().Start(ctx, fmt.Sprintf("metadata.%s", t.name),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.method", r.Method)),
+	)
+
+	status, err := t.h.Handle(ctx, w, r)
+	span.SetAttributes(attribute.Int("http.status_code", status))
+	tracing.End(span, err)
+	return status, err
+}
+
+// withInFlight tracks the number of requests being served, and counts those
+// completed once draining is closed.
+func withInFlight(next http.Handler, draining <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		inFlightRequests.Inc()
+		defer func() {
+			inFlightRequests.Dec()
+			select {
+			case <-draining:
+				drainedRequests.Inc()
+			default:
+			}
+		}()
+
+		next.ServeHTTP(w, req)
+	})
+}
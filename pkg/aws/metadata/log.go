@@ -17,7 +17,15 @@ import (
 	"net/http"
 	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
+	"github.com/uswitch/kiam/pkg/logging"
+)
+
+var (
+	log = logging.Component("metadata")
+	// accessLog logs each request served, separately from the handlers so
+	// it can be quietened
+	accessLog = logging.Component("access")
 )
 
 type statusWriter struct {
@@ -34,8 +42,15 @@ func (s *statusWriter) WriteHeader(code int) {
 	s.ResponseWriter.WriteHeader(code)
 }
 
-func requestFields(req *http.Request) log.Fields {
-	return log.Fields{
+// Flush supports streaming responses through the logging handler
+func (s *statusWriter) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func requestFields(req *http.Request) logrus.Fields {
+	return logrus.Fields{
 		"method": req.Method,
 		"path":   req.URL.Path,
 		"addr":   req.RemoteAddr,
@@ -47,12 +62,12 @@ func loggingHandler(handler http.Handler) http.Handler {
 		requestTimer := time.Now()
 		statusWriter := newStatusWriter(w)
 		handler.ServeHTTP(statusWriter, req)
-		fields := log.Fields{
+		fields := logrus.Fields{
 			"headers":  w.Header(),
 			"status":   statusWriter.statusCode,
 			"duration": float64(time.Since(requestTimer) / time.Millisecond),
 		}
-		logger := log.WithFields(requestFields(req)).WithFields(fields)
+		logger := accessLog.WithFields(requestFields(req)).WithFields(fields)
 		if statusWriter.statusCode < 400 {
 			logger.Debug("processed request")
 		} else {
@@ -2,12 +2,35 @@ package metadata
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
+	telemetry "github.com/uswitch/kiam/pkg/prometheus"
 )
 
 var (
+	handlerTimer          *prometheus.HistogramVec
+	credentialsAge        *prometheus.HistogramVec
+	credentialFetchError  *prometheus.CounterVec
+	credentialEncodeError *prometheus.CounterVec
+	findRoleError         *prometheus.CounterVec
+	namespaceDenied       *prometheus.CounterVec
+	policyDenied          *prometheus.CounterVec
+	roleMismatch          *prometheus.CounterVec
+	emptyRole             *prometheus.CounterVec
+	success               *prometheus.CounterVec
+	responses             *prometheus.CounterVec
+	proxyDenies           prometheus.Counter
+	instanceRoleDenies    prometheus.Counter
+	instanceRoleProxied   prometheus.Counter
+	rateLimited           prometheus.Counter
+	inFlightRequests      prometheus.Gauge
+	drainedRequests       prometheus.Counter
+	coalescedRoleLookups  prometheus.Counter
+	rateLimiterClients    prometheus.Gauge
+)
+
+func newMetrics(namespace string) []prometheus.Collector {
 	handlerTimer = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "metadata",
 			Name:      "handler_latency_seconds",
 			Help:      "Bucketed histogram of handler timings",
@@ -18,9 +41,22 @@ var (
 		[]string{"handler"},
 	)
 
+	credentialsAge = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "metadata",
+			Name:      "credentials_age_seconds",
+			Help:      "Bucketed histogram of how long ago credentials were issued by STS when they're served",
+
+			// 1s to ~9h
+			Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+		},
+		[]string{"handler"},
+	)
+
 	credentialFetchError = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "metadata",
 			Name:      "credential_fetch_errors_total",
 			Help:      "Number of errors fetching the credentials for a pod",
@@ -30,7 +66,7 @@ var (
 
 	credentialEncodeError = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "metadata",
 			Name:      "credential_encode_errors_total",
 			Help:      "Number of errors encoding credentials for a pod",
@@ -40,7 +76,7 @@ var (
 
 	findRoleError = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "metadata",
 			Name:      "find_role_errors_total",
 			Help:      "Number of errors finding the role for a pod",
@@ -48,9 +84,39 @@ var (
 		[]string{"handler"},
 	)
 
+	namespaceDenied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "metadata",
+			Name:      "namespace_denied_total",
+			Help:      "Number of requests denied because the pod's namespace is in the server's deny-list",
+		},
+		[]string{"handler"},
+	)
+
+	policyDenied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "metadata",
+			Name:      "policy_denied_total",
+			Help:      "Number of credential requests forbidden by the server's policy, other than role mismatches",
+		},
+		[]string{"handler"},
+	)
+
+	roleMismatch = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "metadata",
+			Name:      "role_mismatch_total",
+			Help:      "Number of credential requests forbidden because the pod requested a role other than its own",
+		},
+		[]string{"handler"},
+	)
+
 	emptyRole = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "metadata",
 			Name:      "empty_role_total",
 			Help:      "Number of empty roles returned",
@@ -60,7 +126,7 @@ var (
 
 	success = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "metadata",
 			Name:      "success_total",
 			Help:      "Number of successful responses from a handler",
@@ -70,7 +136,7 @@ var (
 
 	responses = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "metadata",
 			Name:      "responses_total",
 			Help:      "Responses from mocked out metadata handlers",
@@ -80,21 +146,99 @@ var (
 
 	proxyDenies = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "metadata",
 			Name:      "proxy_requests_blocked_total",
 			Help:      "Number of access requests to the proxy handler that were blocked by the regexp",
 		},
 	)
-)
+
+	instanceRoleDenies = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "metadata",
+			Name:      "instance_role_requests_blocked_total",
+			Help:      "Number of requests for the node's instance role that were blocked",
+		},
+	)
+
+	instanceRoleProxied = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "metadata",
+			Name:      "instance_role_requests_proxied_total",
+			Help:      "Number of requests for the node's instance role proxied for pods the server permits it",
+		},
+	)
+
+	rateLimited = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "metadata",
+			Name:      "rate_limited_requests_total",
+			Help:      "Number of requests rejected because the client exceeded its rate limit",
+		},
+	)
+
+	inFlightRequests = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "metadata",
+			Name:      "in_flight_requests",
+			Help:      "Number of requests currently being served",
+		},
+	)
+
+	drainedRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "metadata",
+			Name:      "drained_requests_total",
+			Help:      "Number of requests completed after the server started shutting down",
+		},
+	)
+
+	coalescedRoleLookups = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "metadata",
+			Name:      "coalesced_role_lookups_total",
+			Help:      "Number of role lookups that waited for a lookup already in progress for the same IP",
+		},
+	)
+
+	rateLimiterClients = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "metadata",
+			Name:      "rate_limiter_clients",
+			Help:      "Number of client IPs tracked by the rate limiter",
+		},
+	)
+
+	return []prometheus.Collector{
+		handlerTimer,
+		findRoleError,
+		coalescedRoleLookups,
+		credentialFetchError,
+		credentialsAge,
+		credentialEncodeError,
+		emptyRole,
+		namespaceDenied,
+		policyDenied,
+		roleMismatch,
+		success,
+		responses,
+		proxyDenies,
+		instanceRoleDenies,
+		instanceRoleProxied,
+		rateLimited,
+		rateLimiterClients,
+		inFlightRequests,
+		drainedRequests,
+	}
+}
 
 func init() {
-	prometheus.MustRegister(handlerTimer)
-	prometheus.MustRegister(findRoleError)
-	prometheus.MustRegister(credentialFetchError)
-	prometheus.MustRegister(credentialEncodeError)
-	prometheus.MustRegister(emptyRole)
-	prometheus.MustRegister(success)
-	prometheus.MustRegister(responses)
-	prometheus.MustRegister(proxyDenies)
+	telemetry.MustRegister(newMetrics)
 }
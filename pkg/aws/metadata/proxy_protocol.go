@@ -0,0 +1,224 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a connection has to send its PROXY
+// protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyProtocolListener wraps connections accepted from trusted proxies so
+// their RemoteAddr is the client address in the PROXY protocol header sent
+// by the proxy. Anyone able to send a header can claim any address, so
+// connections from elsewhere are returned unwrapped and any header they
+// send is treated as part of the request.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func newProxyProtocolListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyProtocolListener{Listener: l, trusted: trusted}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !isTrustedProxy(addr.IP, l.trusted) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header on first use rather
+// than in Accept, so a slow client doesn't hold up the listener.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.reader, c.Conn.RemoteAddr())
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("error reading proxy protocol header from %s: %v", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the header. When the header
+// is invalid the proxy's address is returned but Read fails, so no request
+// is served from the connection.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header, returning
+// the source address it carries. local is returned for headers the proxy
+// sends on its own behalf, such as health checks.
+func readProxyHeader(r *bufio.Reader, local net.Addr) (net.Addr, error) {
+	peek, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(peek, proxyV1Prefix) {
+		return readProxyV1Header(r, local)
+	}
+
+	peek, err = r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(peek, proxyV2Signature) {
+		return readProxyV2Header(r, local)
+	}
+	return nil, fmt.Errorf("missing proxy protocol header")
+}
+
+// proxyV1MaxLength is the longest header allowed by the spec, including
+// the trailing CRLF.
+const proxyV1MaxLength = 107
+
+func readProxyV1Header(r *bufio.Reader, local net.Addr) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, fmt.Errorf("v1 header longer than %d bytes", proxyV1MaxLength)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return local, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed v1 header: %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid v1 source address: %q", fields[2])
+	}
+	switch fields[1] {
+	case "TCP4":
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("v1 TCP4 header with non IPv4 source address: %s", ip)
+		}
+	case "TCP6":
+		if ip.To4() != nil {
+			return nil, fmt.Errorf("v1 TCP6 header with non IPv6 source address: %s", ip)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported v1 protocol: %q", fields[1])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port: %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+const (
+	proxyV2Version     = 0x20
+	proxyV2CommandMask = 0x0f
+	proxyV2Local       = 0x00
+	proxyV2Proxy       = 0x01
+	proxyV2TCP4        = 0x11
+	proxyV2TCP6        = 0x21
+)
+
+func readProxyV2Header(r *bufio.Reader, local net.Addr) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+
+	addresses := make([]byte, length)
+	if _, err := io.ReadFull(r, addresses); err != nil {
+		return nil, err
+	}
+
+	if versionCommand&^proxyV2CommandMask != proxyV2Version {
+		return nil, fmt.Errorf("unsupported v2 version: %#x", versionCommand>>4)
+	}
+	switch versionCommand & proxyV2CommandMask {
+	case proxyV2Local:
+		return local, nil
+	case proxyV2Proxy:
+	default:
+		return nil, fmt.Errorf("unsupported v2 command: %#x", versionCommand&proxyV2CommandMask)
+	}
+
+	var ipLength int
+	switch family {
+	case proxyV2TCP4:
+		ipLength = net.IPv4len
+	case proxyV2TCP6:
+		ipLength = net.IPv6len
+	default:
+		return nil, fmt.Errorf("unsupported v2 address family: %#x", family)
+	}
+	// source and destination addresses followed by their ports
+	if len(addresses) < 2*ipLength+4 {
+		return nil, fmt.Errorf("v2 addresses too short: %d bytes", len(addresses))
+	}
+	ip := net.IP(append([]byte(nil), addresses[:ipLength]...))
+	port := binary.BigEndian.Uint16(addresses[2*ipLength:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,209 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	st "github.com/uswitch/kiam/pkg/testutil/server"
+)
+
+// recordingRoleClient records the IPs roles are requested for
+type recordingRoleClient struct {
+	*st.StubClient
+	mu  sync.Mutex
+	ips []string
+}
+
+func (c *recordingRoleClient) GetRole(ctx context.Context, ip string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ips = append(c.ips, ip)
+	return "role", nil
+}
+
+func loopbackProxies(t *testing.T) []*net.IPNet {
+	proxies, err := parseTrustedProxies([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxies
+}
+
+func TestUsesProxyProtocolClientIPForPodLookup(t *testing.T) {
+	client := &recordingRoleClient{StubClient: st.NewStubClient()}
+	server, err := NewWebServer(DefaultOptions(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.server.Serve(newProxyProtocolListener(listener, loopbackProxies(t)))
+	defer server.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 80\r\n"))
+	conn.Write([]byte("GET /latest/meta-data/iam/security-credentials/ HTTP/1.1\r\nHost: kiam\r\nConnection: close\r\n\r\n"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "role" {
+		t.Fatalf("expected role, was %d %q", resp.StatusCode, body)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.ips) != 1 || client.ips[0] != "192.168.0.1" {
+		t.Error("expected role lookup for the header's source address, was", client.ips)
+	}
+}
+
+func TestRejectsConnectionsWithoutProxyProtocolHeader(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener = newProxyProtocolListener(listener, loopbackProxies(t))
+	defer listener.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: kiam\r\n\r\n"))
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected reading a connection without a header to fail")
+	}
+}
+
+func TestIgnoresProxyProtocolHeaderFromUntrustedPeer(t *testing.T) {
+	client := &recordingRoleClient{StubClient: st.NewStubClient()}
+	server, err := NewWebServer(DefaultOptions(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.server.Serve(newProxyProtocolListener(listener, proxies))
+	defer server.Stop(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 80\r\n"))
+	conn.Write([]byte("GET /latest/meta-data/iam/security-credentials/ HTTP/1.1\r\nHost: kiam\r\nConnection: close\r\n\r\n"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("expected the header to be treated as a malformed request, was", resp.StatusCode)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.ips) != 0 {
+		t.Error("expected no role lookup for the claimed address, was", client.ips)
+	}
+}
+
+func TestRequiresTrustedProxiesForProxyProtocol(t *testing.T) {
+	options := DefaultOptions()
+	options.ProxyProtocol = true
+	if _, err := NewWebServer(options, st.NewStubClient()); err == nil {
+		t.Error("expected error enabling proxy protocol without trusted proxies")
+	}
+
+	options.TrustedProxies = []string{"10.0.0.0/8"}
+	server, err := NewWebServer(options, st.NewStubClient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Stop(context.Background())
+}
+
+func TestReadsProxyProtocolHeaders(t *testing.T) {
+	local := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}
+	v2 := func(command, family byte, addresses ...byte) string {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x20|command, family, 0, byte(len(addresses)))
+		return string(append(header, addresses...))
+	}
+	v2TCP4 := []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0, 80}
+	v2TCP6 := append(append(net.ParseIP("fd00::1").To16(), net.ParseIP("fd00::2").To16()...), 0xdc, 0x04, 0, 80)
+
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"PROXY TCP4 192.168.0.1 10.0.0.1 56324 80\r\n", "192.168.0.1:56324"},
+		{"PROXY TCP6 fd00::1 fd00::2 56324 80\r\n", "[fd00::1]:56324"},
+		{"PROXY UNKNOWN\r\n", "10.0.0.1:80"},
+		{v2(proxyV2Proxy, proxyV2TCP4, v2TCP4...), "192.168.0.1:56324"},
+		{v2(proxyV2Proxy, proxyV2TCP6, v2TCP6...), "[fd00::1]:56324"},
+		{v2(proxyV2Local, 0), "10.0.0.1:80"},
+		{"PROXY TCP4 fd00::1 10.0.0.1 56324 80\r\n", ""},
+		{"PROXY TCP4 192.168.0.1 10.0.0.1\r\n", ""},
+		{"PROXY UDP4 192.168.0.1 10.0.0.1 56324 80\r\n", ""},
+		{"PROXY TCP4 192.168.0.1 10.0.0.1 56324 80" + strings.Repeat(" ", 100) + "\r\n", ""},
+		{v2(proxyV2Proxy, proxyV2TCP4, v2TCP4[:8]...), ""},
+		{"GET / HTTP/1.1\r\n", ""},
+	}
+
+	for _, test := range tests {
+		addr, err := readProxyHeader(bufio.NewReader(bytes.NewBufferString(test.header+"GET")), local)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("expected error reading %q, was %s", test.header, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error reading %q: %s", test.header, err)
+			continue
+		}
+		if addr.String() != test.expected {
+			t.Errorf("expected %s reading %q, was %s", test.expected, test.header, addr)
+		}
+	}
+}
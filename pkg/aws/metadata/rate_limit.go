@@ -0,0 +1,134 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metadata
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// rateLimiterIdleTimeout is how long a client is tracked after its last request
+	rateLimiterIdleTimeout = 5 * time.Minute
+	// rateLimiterMaxClients bounds the number of clients tracked, the least
+	// recently seen client is evicted beyond this
+	rateLimiterMaxClients = 4096
+)
+
+// ErrRateLimited is returned when a client exceeds its request rate
+var ErrRateLimited = fmt.Errorf("rate limit exceeded")
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// clientRateLimiter maintains a token bucket for each client IP so that a
+// single client can't starve the others.
+type clientRateLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newClientRateLimiter(limit float64, burst int) *clientRateLimiter {
+	return &clientRateLimiter{
+		limit:   rate.Limit(limit),
+		burst:   burst,
+		clients: make(map[string]*clientLimiter),
+		now:     time.Now,
+	}
+}
+
+// allow returns whether the client is permitted to make a request now
+func (l *clientRateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.evictIdle(now)
+
+	client, ok := l.clients[ip]
+	if !ok {
+		if len(l.clients) >= rateLimiterMaxClients {
+			l.evictLeastRecentlySeen()
+		}
+		client = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = client
+		rateLimiterClients.Set(float64(len(l.clients)))
+	}
+	client.lastSeen = now
+
+	return client.limiter.AllowN(now, 1)
+}
+
+// evictIdle removes clients that haven't made a request recently, at most
+// once per idle timeout.
+func (l *clientRateLimiter) evictIdle(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimiterIdleTimeout {
+		return
+	}
+	l.lastSweep = now
+
+	for ip, client := range l.clients {
+		if now.Sub(client.lastSeen) >= rateLimiterIdleTimeout {
+			delete(l.clients, ip)
+		}
+	}
+	rateLimiterClients.Set(float64(len(l.clients)))
+}
+
+func (l *clientRateLimiter) evictLeastRecentlySeen() {
+	var oldestIP string
+	var oldest time.Time
+	for ip, client := range l.clients {
+		if oldestIP == "" || client.lastSeen.Before(oldest) {
+			oldestIP, oldest = ip, client.lastSeen
+		}
+	}
+	delete(l.clients, oldestIP)
+}
+
+// withRateLimit responds with 429 Too Many Requests to clients that exceed
+// the limiter's rate
+func withRateLimit(handler http.Handler, limiter *clientRateLimiter, getClientIP clientIPFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			writeError(w, req, err, http.StatusBadRequest)
+			return
+		}
+
+		ip, err := getClientIP(req)
+		if err != nil {
+			writeError(w, req, err, http.StatusInternalServerError)
+			return
+		}
+
+		if !limiter.allow(ip) {
+			rateLimited.Inc()
+			log.WithFields(requestFields(req)).WithField("pod.ip", ip).Warnf("client exceeded rate limit")
+			writeError(w, req, ErrRateLimited, http.StatusTooManyRequests)
+			return
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
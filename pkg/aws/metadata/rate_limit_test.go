@@ -0,0 +1,72 @@
+package metadata
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func rateLimitedHandler(limiter *clientRateLimiter) http.Handler {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	remote := func(req *http.Request) (string, error) { return ParseClientIP(req.RemoteAddr) }
+	return withRateLimit(ok, limiter, remote)
+}
+
+func requestFrom(handler http.Handler, remoteAddr string) int {
+	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+	r.RemoteAddr = remoteAddr
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	return rr.Code
+}
+
+func TestRateLimitIsPerClient(t *testing.T) {
+	handler := rateLimitedHandler(newClientRateLimiter(1, 3))
+
+	for i := 0; i < 3; i++ {
+		if code := requestFrom(handler, "192.168.0.1:9000"); code != http.StatusOK {
+			t.Fatal("expected burst to be permitted, was", code)
+		}
+	}
+
+	if code := requestFrom(handler, "192.168.0.1:9000"); code != http.StatusTooManyRequests {
+		t.Error("expected noisy client to be limited, was", code)
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := requestFrom(handler, "192.168.0.2:9000"); code != http.StatusOK {
+			t.Error("expected other client not to be limited, was", code)
+		}
+	}
+}
+
+func TestRateLimiterEvictsIdleClients(t *testing.T) {
+	now := time.Now()
+	limiter := newClientRateLimiter(1, 1)
+	limiter.now = func() time.Time { return now }
+
+	limiter.allow("192.168.0.1")
+	now = now.Add(rateLimiterIdleTimeout)
+	limiter.allow("192.168.0.2")
+
+	if _, ok := limiter.clients["192.168.0.1"]; ok {
+		t.Error("expected idle client to be evicted")
+	}
+	if len(limiter.clients) != 1 {
+		t.Error("expected one client to be tracked, was", len(limiter.clients))
+	}
+}
+
+func TestRateLimiterBoundsClients(t *testing.T) {
+	limiter := newClientRateLimiter(1, 1)
+
+	for i := 0; i < rateLimiterMaxClients+10; i++ {
+		limiter.allow(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+
+	if len(limiter.clients) != rateLimiterMaxClients {
+		t.Error("expected clients to be bounded, was", len(limiter.clients))
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metadata
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/uswitch/kiam/pkg/server"
+)
+
+const (
+	retryInterval = time.Millisecond * 5
+	// retryDeadlineMargin is the time requests have after retries stop to
+	// complete the last attempt and respond
+	retryDeadlineMargin = time.Second
+)
+
+// retryTimeouts bound how long requests to the server are retried, separately
+// for pods that aren't yet in the server's cache and for other errors.
+type retryTimeouts struct {
+	podNotFound time.Duration
+	errors      time.Duration
+}
+
+// deadline returns how long requests retried with the timeouts may take,
+// never less than handlerMaxDuration.
+func (t retryTimeouts) deadline() time.Duration {
+	longest := t.podNotFound
+	if t.errors > longest {
+		longest = t.errors
+	}
+	if longest+retryDeadlineMargin < handlerMaxDuration {
+		return handlerMaxDuration
+	}
+	return longest + retryDeadlineMargin
+}
+
+// retry calls op until it succeeds, returns a permanent error, or has been
+// retried for longer than the timeout for the error it returned.
+func (t retryTimeouts) retry(ctx context.Context, op func() error) error {
+	start := time.Now()
+	bounded := func() error {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*backoff.PermanentError); ok {
+			return err
+		}
+
+		timeout := t.errors
+		if errors.Is(err, server.ErrPodNotFound) {
+			timeout = t.podNotFound
+		}
+		if time.Since(start) >= timeout {
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+
+	strategy := backoff.NewExponentialBackOff()
+	strategy.InitialInterval = retryInterval
+	strategy.MaxElapsedTime = 0
+
+	return backoff.Retry(bounded, backoff.WithContext(strategy, ctx))
+}
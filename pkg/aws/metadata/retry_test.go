@@ -0,0 +1,79 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/uswitch/kiam/pkg/server"
+)
+
+var testRetryTimeouts = retryTimeouts{podNotFound: handlerMaxDuration, errors: handlerMaxDuration}
+
+func retryUntil(timeouts retryTimeouts, errs func(attempt int) error) (int, time.Duration, error) {
+	attempts := 0
+	start := time.Now()
+	err := timeouts.retry(context.Background(), func() error {
+		attempts++
+		return errs(attempts)
+	})
+	return attempts, time.Since(start), err
+}
+
+func TestRetriesPodNotFoundUntilPodNotFoundTimeout(t *testing.T) {
+	timeouts := retryTimeouts{podNotFound: 200 * time.Millisecond, errors: 0}
+
+	attempts, _, err := retryUntil(timeouts, func(int) error { return server.ErrPodNotFound })
+	if err != server.ErrPodNotFound {
+		t.Error("expected pod not found, was", err)
+	}
+	if attempts < 2 {
+		t.Error("expected pod not found to be retried, attempts:", attempts)
+	}
+
+	attempts, _, err = retryUntil(timeouts, func(attempt int) error {
+		if attempt < 3 {
+			return server.ErrPodNotFound
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Error("expected success once pod was found, was", err, attempts)
+	}
+}
+
+func TestRetriesErrorsUntilErrorTimeout(t *testing.T) {
+	timeouts := retryTimeouts{podNotFound: time.Minute, errors: 50 * time.Millisecond}
+	unexpected := fmt.Errorf("unexpected error")
+
+	attempts, elapsed, err := retryUntil(timeouts, func(int) error { return unexpected })
+	if err != unexpected {
+		t.Error("expected unexpected error, was", err)
+	}
+	if attempts < 2 {
+		t.Error("expected error to be retried, attempts:", attempts)
+	}
+	if elapsed > time.Second {
+		t.Error("expected error timeout to apply rather than pod not found timeout, took", elapsed)
+	}
+}
+
+func TestPodNotFoundTimeoutDoesNotExtendErrorRetries(t *testing.T) {
+	timeouts := retryTimeouts{podNotFound: time.Minute, errors: 0}
+	unexpected := fmt.Errorf("unexpected error")
+
+	attempts, _, err := retryUntil(timeouts, func(int) error { return unexpected })
+	if err != unexpected || attempts != 1 {
+		t.Error("expected error without retry, was", err, attempts)
+	}
+}
+
+func TestRetryDeadlineCoversLongestTimeout(t *testing.T) {
+	if d := (retryTimeouts{podNotFound: time.Second, errors: time.Second}).deadline(); d != handlerMaxDuration {
+		t.Error("expected short timeouts to keep the default deadline, was", d)
+	}
+	if d := (retryTimeouts{podNotFound: 30 * time.Second, errors: 10 * time.Second}).deadline(); d != 30*time.Second+retryDeadlineMargin {
+		t.Error("expected deadline after the longest timeout, was", d)
+	}
+}
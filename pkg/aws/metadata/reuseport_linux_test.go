@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package metadata
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReusePortListenersShareAPort(t *testing.T) {
+	first, err := listenTCP("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	addr := first.Addr().String()
+	second, err := listenTCP(addr, true)
+	if err != nil {
+		t.Fatalf("expected a second listener to bind %s: %s", addr, err)
+	}
+	defer second.Close()
+
+	first.Close()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("expected the second listener to accept connections once the first closed: %s", err)
+	}
+	conn.Close()
+}
+
+func TestListenersWithoutReusePortConflict(t *testing.T) {
+	first, err := listenTCP("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	second, err := listenTCP(first.Addr().String(), true)
+	if err == nil {
+		second.Close()
+		t.Fatal("expected an error binding a port held without SO_REUSEPORT")
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metadata
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/uswitch/kiam/pkg/server"
+	"github.com/uswitch/kiam/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// roleLookups coalesces concurrent lookups of the role for the same IP, so
+// a burst of requests from a starting pod share a single lookup, and its
+// retries, rather than each polling the server.
+type roleLookups struct {
+	client server.Client
+	retry  retryTimeouts
+
+	mu       sync.Mutex
+	inflight map[string]*roleLookup
+}
+
+type roleLookup struct {
+	done     chan struct{}
+	deadline time.Time
+	// link is to the span of the request that started the lookup, the
+	// lookup isn't part of its trace as other requests share it
+	link trace.Link
+	role string
+	err  error
+}
+
+func newRoleLookups(client server.Client, retry retryTimeouts) *roleLookups {
+	return &roleLookups{client: client, retry: retry, inflight: make(map[string]*roleLookup)}
+}
+
+// find returns the role for the IP, waiting for a lookup already in
+// progress when there is one.
+func (l *roleLookups) find(ctx context.Context, ip string) (string, error) {
+	l.mu.Lock()
+	lookup, ok := l.inflight[ip]
+	if ok {
+		coalescedRoleLookups.Inc()
+	} else {
+		lookup = &roleLookup{done: make(chan struct{})}
+		lookup.deadline, _ = ctx.Deadline()
+		lookup.link = trace.LinkFromContext(ctx)
+		l.inflight[ip] = lookup
+		go l.resolve(ip, lookup)
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-lookup.done:
+	case <-ctx.Done():
+		// once the lookup's deadline has also passed it's about to
+		// complete, and its result is more useful than the deadline
+		deadline, ok := ctx.Deadline()
+		if ctx.Err() != context.DeadlineExceeded || !ok || lookup.deadline.IsZero() || deadline.Before(lookup.deadline) {
+			return "", ctx.Err()
+		}
+		<-lookup.done
+	}
+	return lookup.role, lookup.err
+}
+
+func (l *roleLookups) resolve(ip string, lookup *roleLookup) {
+	defer close(lookup.done)
+
+	ctx, cancel := lookupContext(lookup.deadline)
+	defer cancel()
+	ctx, span := tracing.Tracer().Start(ctx, "metadata.FindRole", trace.WithLinks(lookup.link))
+	lookup.role, lookup.err = findRole(ctx, l.client, ip, l.retry)
+	tracing.End(span, lookup.err)
+
+	l.mu.Lock()
+	delete(l.inflight, ip)
+	l.mu.Unlock()
+}
+
+// lookupContext is used by a lookup shared between requests, so it isn't
+// cancelled with the request that started it. It keeps the request's
+// deadline.
+func lookupContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if !deadline.IsZero() {
+		return context.WithDeadline(context.Background(), deadline)
+	}
+	return context.WithCancel(context.Background())
+}
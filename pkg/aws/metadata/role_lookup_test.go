@@ -0,0 +1,110 @@
+package metadata
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	st "github.com/uswitch/kiam/pkg/testutil/server"
+	"github.com/uswitch/kiam/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// blockingRoleClient counts role lookups, blocking them until released
+type blockingRoleClient struct {
+	*st.StubClient
+	lookups int32
+	release chan struct{}
+}
+
+func (c *blockingRoleClient) GetRole(ctx context.Context, ip string) (string, error) {
+	atomic.AddInt32(&c.lookups, 1)
+	<-c.release
+	return "role", nil
+}
+
+func TestCoalescesConcurrentRoleLookups(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	client := &blockingRoleClient{StubClient: st.NewStubClient(), release: make(chan struct{})}
+	lookups := newRoleLookups(client, testRetryTimeouts)
+	coalesced := metricValue(coalescedRoleLookups)
+
+	const requests = 10
+	var wg sync.WaitGroup
+	roles := make(chan string, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			role, err := lookups.find(ctx, "192.168.0.1")
+			if err != nil {
+				t.Error("unexpected error", err)
+			}
+			roles <- role
+		}()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for metricValue(coalescedRoleLookups) < coalesced+requests-1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(client.release)
+	wg.Wait()
+	close(roles)
+
+	for role := range roles {
+		if role != "role" {
+			t.Error("expected every lookup to receive the role, was", role)
+		}
+	}
+	if n := atomic.LoadInt32(&client.lookups); n != 1 {
+		t.Error("expected a single lookup, was", n)
+	}
+}
+
+func TestLookupsAfterCompletionResolveAgain(t *testing.T) {
+	client := &blockingRoleClient{StubClient: st.NewStubClient(), release: make(chan struct{})}
+	close(client.release)
+	lookups := newRoleLookups(client, testRetryTimeouts)
+
+	for i := 0; i < 2; i++ {
+		if _, err := lookups.find(context.Background(), "192.168.0.1"); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+	if n := atomic.LoadInt32(&client.lookups); n != 2 {
+		t.Error("expected completed lookups not to be reused, was", n)
+	}
+}
+
+func TestSharedRoleLookupLinksToRequestSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	ctx, request := tracing.Tracer().Start(context.Background(), "request")
+	defer request.End()
+
+	client := &blockingRoleClient{StubClient: st.NewStubClient(), release: make(chan struct{})}
+	close(client.release)
+	lookups := newRoleLookups(client, testRetryTimeouts)
+	if _, err := lookups.find(ctx, "192.168.0.1"); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "metadata.FindRole" {
+		t.Fatal("expected role lookup span, was", spans)
+	}
+	links := spans[0].Links()
+	if len(links) != 1 || links[0].SpanContext.SpanID() != request.SpanContext().SpanID() {
+		t.Error("expected lookup to link to the request's span, was", links)
+	}
+}
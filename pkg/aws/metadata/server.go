@@ -4,7 +4,7 @@
 // you may not use this file except in compliance with the License.
 // You may obtain a copy of the License at
 //
-//     http://www.apache.org/licenses/LICENSE-2.0
+//	http://www.apache.org/licenses/LICENSE-2.0
 //
 // Unless required by applicable law or agreed to in writing, software
 // distributed under the License is distributed on an "AS IS" BASIS,
@@ -16,77 +16,349 @@ package metadata
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	log "github.com/sirupsen/logrus"
+	"github.com/uswitch/kiam/pkg/aws/sts"
 	"github.com/uswitch/kiam/pkg/server"
 )
 
 type Server struct {
-	cfg    *ServerOptions
-	server *http.Server
+	cfg       *ServerOptions
+	server    *http.Server
+	readiness *serverReadiness
+	ctx       context.Context
+	cancel    context.CancelFunc
+	// proxies are the networks PROXY protocol headers are read from
+	proxies []*net.IPNet
 }
 
 type ServerOptions struct {
-	ListenPort           int
+	ListenPort int
+	// UnixSocket is the path of a unix socket served alongside ListenPort,
+	// created with UnixSocketMode permissions. Clients identify themselves
+	// with the SocketClientIPHeader. Only the socket is served when it's set
+	// and ListenPort is 0.
+	UnixSocket     string
+	UnixSocketMode os.FileMode
+	// ReusePort binds ListenPort with SO_REUSEPORT so a new agent can
+	// start listening before the one it replaces stops. Linux only.
+	ReusePort bool
+	// ProxyProtocol reads the client IP from a PROXY protocol header sent at
+	// the start of each connection to ListenPort from one of the
+	// TrustedProxies CIDRs. Connections from other addresses are served
+	// without reading a header.
+	ProxyProtocol        bool
 	MetadataEndpoint     string
 	AllowIPQuery         bool
 	WhitelistRouteRegexp *regexp.Regexp
+	// DisableProxy returns 404 for requests kiam doesn't handle, rather
+	// than proxying them to the metadata endpoint.
+	DisableProxy bool
+	// ProxyMetadataEndpoint and HealthMetadataEndpoint override the
+	// MetadataEndpoint requests are proxied to, and deep health checks
+	// request, when they're set.
+	ProxyMetadataEndpoint  string
+	HealthMetadataEndpoint string
+	// CompressProxyResponses gzips responses proxied from the metadata
+	// endpoint for clients that accept it. Responses kiam serves itself
+	// are small and never compressed.
+	CompressProxyResponses bool
+	// TrustForwardedFor derives the client IP from X-Forwarded-For when
+	// requests are received from one of the TrustedProxies CIDRs. They're
+	// also the proxies PROXY protocol headers are read from.
+	TrustForwardedFor bool
+	TrustedProxies    []string
+	// ClientIPHeader is the header trusted proxies set the client IP in,
+	// X-Forwarded-For when empty.
+	ClientIPHeader string
+	// TrustedHops is the number of proxies in front of the agent. When
+	// set the client IP is the entry that many from the right of
+	// ClientIPHeader, rather than the right-most untrusted entry.
+	TrustedHops int
+	// ECSCredentialsURI is the relative URI the ECS container credentials
+	// endpoint is served at, it's disabled when empty.
+	ECSCredentialsURI string
+	// RoleBaseARN is used to resolve the RoleArn returned by the ECS
+	// container credentials endpoint for roles that aren't absolute ARNs.
+	RoleBaseARN string
+	// IdentityDocument is how the instance identity document is served:
+	// proxied (the default), synthesized from IdentityDocumentAccountID
+	// and IdentityDocumentRegion without node specific fields, or disabled.
+	IdentityDocument          string
+	IdentityDocumentAccountID string
+	IdentityDocumentRegion    string
+	// ProxyMaxIdleConns, ProxyIdleConnTimeout and ProxyKeepAlive tune the
+	// connections proxied to the metadata endpoint, the default transport
+	// is used when they're all unset.
+	ProxyMaxIdleConns    int
+	ProxyIdleConnTimeout time.Duration
+	ProxyKeepAlive       time.Duration
+	// ProxyStripHeaders are removed from requests before they're proxied
+	// to the metadata endpoint.
+	ProxyStripHeaders []string
+	// ProxyTimeout bounds how long a proxied request, including reading
+	// the response, may take. ProxyMaxResponseBytes bounds the size of
+	// proxied responses. Requests exceeding either fail with a 502, they're
+	// unbounded when 0.
+	ProxyTimeout          time.Duration
+	ProxyMaxResponseBytes int64
+	// PodNotFoundRetryTimeout is how long requests are retried while the
+	// pod isn't yet in the server's cache, and ErrorRetryTimeout how long
+	// they're retried after other errors. Requests for roles and
+	// credentials are given until the longer of them to complete.
+	PodNotFoundRetryTimeout time.Duration
+	ErrorRetryTimeout       time.Duration
+	// CredentialsCacheHeaders sets Cache-Control and Expires headers on
+	// credentials responses, aligned with the credentials' expiry.
+	CredentialsCacheHeaders bool
+	// JSONErrors returns errors as JSON with a stable code, rather than
+	// plain text.
+	JSONErrors bool
+	// RateLimit is the number of requests per second permitted from each
+	// client IP, with bursts of up to RateLimitBurst. 0 disables limiting.
+	RateLimit      float64
+	RateLimitBurst int
+	// AllowInstanceRole proxies requests for the node's instance role
+	// and its credentials when they're whitelisted. They're blocked with
+	// a 403 by default as they'd let pods bypass kiam.
+	AllowInstanceRole bool
+	// MetadataRoutes set how requests for metadata paths kiam doesn't
+	// serve itself are handled, ahead of the whitelist. The first route
+	// matching the path applies.
+	MetadataRoutes []*MetadataRoute
+	// NodeRoleFallback asks the server whether pods requesting the node's
+	// instance role are permitted it, and proxies their requests when
+	// they are. Others are blocked as usual.
+	NodeRoleFallback bool
+	// RoleARNHeader sets the X-Kiam-Role-Arn header on credentials
+	// responses to the role the server issued them for, for debugging.
+	RoleARNHeader bool
 }
 
 func DefaultOptions() *ServerOptions {
 	return &ServerOptions{
-		MetadataEndpoint:     "http://169.254.169.254",
-		ListenPort:           3100,
-		AllowIPQuery:         false,
-		WhitelistRouteRegexp: regexp.MustCompile("^$"),
+		MetadataEndpoint:        "http://169.254.169.254",
+		ListenPort:              3100,
+		UnixSocketMode:          0660,
+		PodNotFoundRetryTimeout: handlerMaxDuration,
+		ErrorRetryTimeout:       handlerMaxDuration,
+		AllowIPQuery:            false,
+		WhitelistRouteRegexp:    regexp.MustCompile("^$"),
+		ProxyStripHeaders:       DefaultProxyStripHeaders,
+		ClientIPHeader:          DefaultClientIPHeader,
+		IdentityDocument:        IdentityDocumentProxy,
 	}
 }
 
 func NewWebServer(config *ServerOptions, client server.Client) (*Server, error) {
-	http, err := buildHTTPServer(config, client)
+	readiness := newServerReadiness(client)
+	http, err := buildHTTPServer(config, client, readiness)
 	if err != nil {
 		return nil, err
 	}
-	return &Server{cfg: config, server: http}, nil
+	proxies, err := buildProxyProtocol(config)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	// the context is cancelled when the server starts shutting down
+	http.Handler = withInFlight(http.Handler, ctx.Done())
+	return &Server{cfg: config, server: http, readiness: readiness, ctx: ctx, cancel: cancel, proxies: proxies}, nil
 }
 
-func buildHTTPServer(config *ServerOptions, client server.Client) (*http.Server, error) {
+func buildHTTPServer(config *ServerOptions, client server.Client, readiness *serverReadiness) (*http.Server, error) {
+	clientIP, err := buildClientIP(config)
+	if err != nil {
+		return nil, err
+	}
+
 	router := mux.NewRouter()
 	router.Handle("/ping", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "pong") }))
 
-	h := newHealthHandler(client, config.MetadataEndpoint)
+	healthURL, err := parseMetadataEndpoint(config.HealthMetadataEndpoint, config.MetadataEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	proxyURL, err := parseMetadataEndpoint(config.ProxyMetadataEndpoint, config.MetadataEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	h := newHealthHandler(client, healthURL.String())
 	h.Install(router)
 
-	r := newRoleHandler(client, buildClientIP(config))
+	live := &livenessHandler{}
+	live.Install(router)
+
+	ready := newReadinessHandler(client, readiness)
+	ready.Install(router)
+
+	retry := retryTimeouts{podNotFound: config.PodNotFoundRetryTimeout, errors: config.ErrorRetryTimeout}
+
+	r := newRoleHandler(client, clientIP, retry, readiness)
 	r.Install(router)
 
-	c := newCredentialsHandler(client, buildClientIP(config))
+	c := newCredentialsHandler(client, clientIP, retry, readiness, config.CredentialsCacheHeaders)
+	c.roleARNHeader = config.RoleARNHeader
 	c.Install(router)
 
-	metadataURL, err := url.Parse(config.MetadataEndpoint)
+	wc := newWatchCredentialsHandler(client, clientIP)
+	wc.Install(router)
+
+	if config.ECSCredentialsURI != "" {
+		e := newECSCredentialsHandler(client, clientIP, config.ECSCredentialsURI, sts.DefaultResolver(config.RoleBaseARN), retry, readiness)
+		e.Install(router)
+	}
+
+	if config.IdentityDocument != "" && config.IdentityDocument != IdentityDocumentProxy {
+		d, err := newIdentityDocumentHandler(config.IdentityDocument, config.IdentityDocumentAccountID, config.IdentityDocumentRegion)
+		if err != nil {
+			return nil, err
+		}
+		d.Install(router)
+	}
+
+	var backingService http.Handler
+	if !config.DisableProxy {
+		proxy := httputil.NewSingleHostReverseProxy(proxyURL)
+		if transport := buildProxyTransport(config); transport != nil {
+			proxy.Transport = transport
+		}
+		if config.ProxyTimeout > 0 || config.ProxyMaxResponseBytes > 0 {
+			proxy.Transport = newBoundedTransport(proxy.Transport, config.ProxyTimeout, config.ProxyMaxResponseBytes)
+		}
+		proxy.Director = stripHeaders(proxy.Director, config.ProxyStripHeaders)
+		backingService = proxy
+		if config.CompressProxyResponses {
+			backingService = withGzip(backingService)
+		}
+	}
+
+	if !config.AllowInstanceRole {
+		i := &instanceRoleHandler{}
+		if config.NodeRoleFallback {
+			if backingService == nil {
+				return nil, fmt.Errorf("node role fallback requires the proxy to be enabled")
+			}
+			i = &instanceRoleHandler{client: client, getClientIP: clientIP, backingService: backingService}
+		}
+		i.Install(router)
+	}
+
+	if len(config.MetadataRoutes) > 0 {
+		m, err := newMetadataRoutesHandler(config.MetadataRoutes, backingService)
+		if err != nil {
+			return nil, err
+		}
+		m.Install(router)
+	}
+
+	if config.DisableProxy {
+		p := &disabledProxyHandler{}
+		p.Install(router)
+	} else {
+		p := newProxyHandler(backingService, config.WhitelistRouteRegexp)
+		p.Install(router)
+	}
+
+	var handler http.Handler = router
+	if config.RateLimit > 0 {
+		handler = withRateLimit(handler, newClientRateLimiter(config.RateLimit, config.RateLimitBurst), clientIP)
+	}
+	if config.JSONErrors {
+		handler = withJSONErrors(handler)
+	}
+
+	listen := fmt.Sprintf(":%d", config.ListenPort)
+	return &http.Server{Addr: listen, Handler: loggingHandler(handler)}, nil
+}
+
+// parseMetadataEndpoint parses endpoint, or fallback when it's empty, as an
+// absolute URL.
+func parseMetadataEndpoint(endpoint, fallback string) (*url.URL, error) {
+	if endpoint == "" {
+		endpoint = fallback
+	}
+	u, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, err
 	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("metadata endpoint should be an absolute url, was %q", endpoint)
+	}
+	return u, nil
+}
 
-	p := newProxyHandler(httputil.NewSingleHostReverseProxy(metadataURL), config.WhitelistRouteRegexp)
-	p.Install(router)
+// buildProxyTransport returns the transport used to proxy requests to the
+// metadata endpoint, or nil when the default transport should be used.
+func buildProxyTransport(config *ServerOptions) *http.Transport {
+	if config.ProxyMaxIdleConns == 0 && config.ProxyIdleConnTimeout == 0 && config.ProxyKeepAlive == 0 {
+		return nil
+	}
 
-	listen := fmt.Sprintf(":%d", config.ListenPort)
-	return &http.Server{Addr: listen, Handler: loggingHandler(router)}, nil
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.ProxyMaxIdleConns > 0 {
+		// all requests go to the same host so it can use every idle connection
+		transport.MaxIdleConns = config.ProxyMaxIdleConns
+		transport.MaxIdleConnsPerHost = config.ProxyMaxIdleConns
+	}
+	if config.ProxyIdleConnTimeout > 0 {
+		transport.IdleConnTimeout = config.ProxyIdleConnTimeout
+	}
+	if config.ProxyKeepAlive > 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: config.ProxyKeepAlive}
+		transport.DialContext = dialer.DialContext
+	}
+	return transport
+}
+
+// buildProxyProtocol returns the networks PROXY protocol headers are read
+// from when it's enabled.
+func buildProxyProtocol(config *ServerOptions) ([]*net.IPNet, error) {
+	if !config.ProxyProtocol {
+		return nil, nil
+	}
+	if len(config.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("proxy protocol requires at least one trusted proxy cidr")
+	}
+	return parseTrustedProxies(config.TrustedProxies)
 }
 
-func buildClientIP(config *ServerOptions) clientIPFunc {
-	remote := func(req *http.Request) (string, error) {
+func buildClientIP(config *ServerOptions) (clientIPFunc, error) {
+	var remote clientIPFunc = func(req *http.Request) (string, error) {
 		return ParseClientIP(req.RemoteAddr)
 	}
 
+	if config.TrustForwardedFor {
+		if len(config.TrustedProxies) == 0 {
+			return nil, fmt.Errorf("trusting X-Forwarded-For requires at least one trusted proxy cidr")
+		}
+		trusted, err := parseTrustedProxies(config.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+		if config.TrustedHops < 0 {
+			return nil, fmt.Errorf("trusted hops must not be negative, was %d", config.TrustedHops)
+		}
+		header := config.ClientIPHeader
+		if header == "" {
+			header = DefaultClientIPHeader
+		}
+		remote = forwardedClientIP(remote, header, trusted, config.TrustedHops)
+	}
+
+	if config.UnixSocket != "" {
+		remote = socketClientIP(remote)
+	}
+
 	if config.AllowIPQuery {
 		return func(req *http.Request) (string, error) {
 			ip := req.Form.Get("ip")
@@ -94,18 +366,81 @@ func buildClientIP(config *ServerOptions) clientIPFunc {
 				return ip, nil
 			}
 			return remote(req)
-		}
+		}, nil
 	}
 
-	return remote
+	return remote, nil
 }
 
 func (s *Server) Serve() error {
+	go s.readiness.wait(s.ctx)
+
+	if s.cfg.UnixSocket == "" {
+		return s.serveTCP()
+	}
+
+	listener, err := listenUnix(s.cfg.UnixSocket, s.cfg.UnixSocketMode)
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 2)
+	go func() {
+		log.Infof("listening %s", s.cfg.UnixSocket)
+		errCh <- s.server.Serve(listener)
+	}()
+	if s.cfg.ListenPort != 0 {
+		go func() {
+			errCh <- s.serveTCP()
+		}()
+	}
+	return <-errCh
+}
+
+func (s *Server) serveTCP() error {
+	listener, err := listenTCP(s.server.Addr, s.cfg.ReusePort)
+	if err != nil {
+		return err
+	}
+	if s.cfg.ProxyProtocol {
+		listener = newProxyProtocolListener(listener, s.proxies)
+	}
 	log.Infof("listening :%d", s.cfg.ListenPort)
-	return s.server.ListenAndServe()
+	return s.server.Serve(listener)
+}
+
+// listenTCP listens on addr, setting SO_REUSEPORT on the socket when
+// reusePort is set so it can be bound by more than one process.
+func listenTCP(addr string, reusePort bool) (net.Listener, error) {
+	if !reusePort {
+		return net.Listen("tcp", addr)
+	}
+	config := net.ListenConfig{Control: controlReusePort}
+	return config.Listen(context.Background(), "tcp", addr)
+}
+
+// listenUnix listens on a unix socket at path, replacing any socket left
+// behind by a previous process.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("error removing stale unix socket %s: %s", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error setting unix socket permissions: %s", err)
+	}
+	return listener, nil
 }
 
 func (s *Server) Stop(ctx context.Context) error {
+	s.cancel()
 	c, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 	return s.server.Shutdown(c)
@@ -0,0 +1,172 @@
+package metadata
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	st "github.com/uswitch/kiam/pkg/testutil/server"
+)
+
+func TestServesUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kiam-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := DefaultOptions()
+	config.ListenPort = 0
+	config.UnixSocket = filepath.Join(dir, "kiam.sock")
+	config.UnixSocketMode = 0600
+	server, err := NewWebServer(config, st.NewStubClient().WithHealth("ok"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Stop(context.Background())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", config.UnixSocket)
+		},
+	}}
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = client.Get("http://kiam/ping")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("expected 200, was", resp.StatusCode)
+	}
+
+	info, err := os.Stat(config.UnixSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Error("unexpected socket permissions", info.Mode().Perm())
+	}
+}
+
+func TestDoesntServePprof(t *testing.T) {
+	config := DefaultOptions()
+	server, err := buildHTTPServer(config, st.NewStubClient().WithHealth("ok"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rr.Code == http.StatusOK {
+		t.Error("expected pprof not to be served on the metadata port")
+	}
+}
+
+func metricValue(c prometheus.Metric) float64 {
+	m := &dto.Metric{}
+	c.Write(m)
+	if m.Gauge != nil {
+		return m.GetGauge().GetValue()
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestTracksInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+	})
+	draining := make(chan struct{})
+	tracked := withInFlight(handler, draining)
+
+	before := metricValue(inFlightRequests)
+	drained := metricValue(drainedRequests)
+	done := make(chan struct{})
+	go func() {
+		tracked.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ping", nil))
+		close(done)
+	}()
+
+	<-started
+	if inFlight := metricValue(inFlightRequests); inFlight != before+1 {
+		t.Error("expected request to be in flight, was", inFlight)
+	}
+
+	close(draining)
+	close(release)
+	<-done
+	if inFlight := metricValue(inFlightRequests); inFlight != before {
+		t.Error("expected no requests in flight, was", inFlight)
+	}
+	if count := metricValue(drainedRequests); count != drained+1 {
+		t.Error("expected request to be counted as drained, was", count)
+	}
+}
+
+func TestProxiesAndChecksHealthAgainstSeparateEndpoints(t *testing.T) {
+	proxied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied"))
+	}))
+	defer proxied.Close()
+	health := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("i-health"))
+	}))
+	defer health.Close()
+
+	config := DefaultOptions()
+	config.ProxyMetadataEndpoint = proxied.URL
+	config.HealthMetadataEndpoint = health.URL
+	config.WhitelistRouteRegexp = regexp.MustCompile("^/latest/meta-data/hostname$")
+	server, err := buildHTTPServer(config, st.NewStubClient().WithHealth("ok"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rr, httptest.NewRequest("GET", "/latest/meta-data/hostname", nil))
+	if rr.Body.String() != "proxied" {
+		t.Error("expected request to be proxied to the proxy endpoint, was", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	server.Handler.ServeHTTP(rr, httptest.NewRequest("GET", "/health?deep=true", nil))
+	if rr.Body.String() != "i-health" {
+		t.Error("expected health check against the health endpoint, was", rr.Body.String())
+	}
+}
+
+func TestRejectsInvalidMetadataEndpoints(t *testing.T) {
+	for _, endpoint := range []string{"169.254.169.254", "http://%zz"} {
+		config := DefaultOptions()
+		config.ProxyMetadataEndpoint = endpoint
+		if _, err := buildHTTPServer(config, nil, nil); err == nil {
+			t.Errorf("expected error for proxy endpoint %q", endpoint)
+		}
+
+		config = DefaultOptions()
+		config.HealthMetadataEndpoint = endpoint
+		if _, err := buildHTTPServer(config, nil, nil); err == nil {
+			t.Errorf("expected error for health endpoint %q", endpoint)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/cenkalti/backoff"
+	"github.com/uswitch/kiam/pkg/server"
+)
+
+const (
+	// warmupRetryAfter is the Retry-After, in seconds, sent while warming up
+	warmupRetryAfter = 1
+)
+
+// ErrWarmingUp is returned for pods that can't be found before the server
+// has reported it's healthy, its caches may not have synced yet.
+var ErrWarmingUp = fmt.Errorf("server warming up")
+
+// serverReadiness tracks whether the server has reported it's healthy. A
+// nil serverReadiness is always ready.
+type serverReadiness struct {
+	client server.Client
+	ready  int32
+}
+
+func newServerReadiness(client server.Client) *serverReadiness {
+	return &serverReadiness{client: client}
+}
+
+func (r *serverReadiness) isReady() bool {
+	return r == nil || atomic.LoadInt32(&r.ready) == 1
+}
+
+func (r *serverReadiness) markReady() {
+	atomic.StoreInt32(&r.ready, 1)
+}
+
+// wait checks the server's health until it reports ok, then marks it ready.
+func (r *serverReadiness) wait(ctx context.Context) {
+	op := func() error {
+		health, err := r.client.Health(ctx)
+		if err != nil {
+			return err
+		}
+		if health != "ok" {
+			return fmt.Errorf("server health: %s", health)
+		}
+		return nil
+	}
+
+	strategy := backoff.NewExponentialBackOff()
+	strategy.InitialInterval = retryInterval
+	strategy.MaxElapsedTime = 0
+
+	err := backoff.Retry(op, backoff.WithContext(strategy, ctx))
+	if err != nil {
+		log.Warnf("server didn't become ready: %s", err.Error())
+		return
+	}
+	log.Infof("server ready")
+	r.markReady()
+}
+
+// warmingUp asks clients to retry rather than treat the pod as having no
+// role, which many SDKs won't retry.
+func warmingUp(w http.ResponseWriter) (int, error) {
+	w.Header().Set("Retry-After", strconv.Itoa(warmupRetryAfter))
+	return http.StatusServiceUnavailable, ErrWarmingUp
+}
@@ -0,0 +1,84 @@
+package metadata
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/uswitch/kiam/pkg/server"
+	st "github.com/uswitch/kiam/pkg/testutil/server"
+)
+
+func TestRoleReturnsServiceUnavailableUntilServerReady(t *testing.T) {
+	readiness := newServerReadiness(nil)
+	handler := newRoleHandler(st.NewStubClient().WithRoles(st.GetRoleResult{"", nil}), getBlankClientIP, testRetryTimeouts, readiness)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Error("expected service unavailable while warming up, was", rr.Code)
+	}
+	if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "1" {
+		t.Error("expected Retry-After, was", retryAfter)
+	}
+
+	readiness.markReady()
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusNotFound {
+		t.Error("expected not found once ready, was", rr.Code)
+	}
+	if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "" {
+		t.Error("expected no Retry-After once ready, was", retryAfter)
+	}
+}
+
+func TestCredentialsReturnServiceUnavailableForMissingPodUntilServerReady(t *testing.T) {
+	readiness := newServerReadiness(nil)
+	client := st.NewStubClient().WithCredentials(st.GetCredentialsResult{nil, server.ErrPodNotFound})
+	handler := newCredentialsHandler(client, getBlankClientIP, retryTimeouts{}, readiness, false)
+	router := mux.NewRouter()
+	handler.Install(router)
+
+	r, _ := http.NewRequest("GET", "/latest/meta-data/iam/security-credentials/role", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Error("expected service unavailable while warming up, was", rr.Code)
+	}
+
+	readiness.markReady()
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusNotFound {
+		t.Error("expected pod not found error once ready, was", rr.Code)
+	}
+}
+
+func TestReadyOnceServerHealthy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	readiness := newServerReadiness(st.NewStubClient().WithHealth("ok"))
+	if readiness.isReady() {
+		t.Error("expected not ready before server health checked")
+	}
+
+	readiness.wait(ctx)
+
+	if !readiness.isReady() {
+		t.Error("expected ready once server healthy")
+	}
+}
@@ -15,6 +15,7 @@ package sts
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 )
 
@@ -44,3 +45,67 @@ func (r *Resolver) Resolve(role string) string {
 
 	return fmt.Sprintf("%s%s", r.prefix, role)
 }
+
+// roleARNPattern matches role ARNs, capturing the partition, account id and
+// the role name without its path.
+var roleARNPattern = regexp.MustCompile(`^arn:([a-z-]+):iam::(\d{12}):role/(?:[\w+=,.@-]+/)*([\w+=,.@-]+)$`)
+
+// SameRole returns whether the resolved role ARNs identify the same role. Role
+// names are unique within an account so ARNs are compared by partition,
+// account and name, ignoring any path.
+func SameRole(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	matchA := roleARNPattern.FindStringSubmatch(a)
+	matchB := roleARNPattern.FindStringSubmatch(b)
+	if matchA == nil || matchB == nil {
+		return false
+	}
+
+	for i := 1; i < len(matchA); i++ {
+		if matchA[i] != matchB[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// RoleName returns the name of the role, without any ARN prefix or path, as
+// the metadata API lists it.
+func RoleName(role string) string {
+	if match := roleARNPattern.FindStringSubmatch(role); match != nil {
+		return match[3]
+	}
+	return role[strings.LastIndex(role, "/")+1:]
+}
+
+// IsRoleName returns whether role is a bare role name, without an ARN
+// prefix or path.
+func IsRoleName(role string) bool {
+	return role != "" && !strings.Contains(role, "/")
+}
+
+// baseARNPattern matches role ARN prefixes, optionally including a path:
+// arn:<partition>:iam::<account-id>:role/[path/]
+var baseARNPattern = regexp.MustCompile(`^arn:[a-z-]+:iam::\d{12}:role/([\w+=,.@-]+/)*$`)
+
+// ValidateBaseARN returns a descriptive error if arn isn't a role ARN
+// prefix that role names can be appended to.
+func ValidateBaseARN(arn string) error {
+	if baseARNPattern.MatchString(arn) {
+		return nil
+	}
+
+	if strings.HasPrefix(arn, "arn:") && !strings.HasSuffix(arn, "/") {
+		return fmt.Errorf("invalid base arn %q: must end with a trailing slash, e.g. arn:aws:iam::123456789012:role/", arn)
+	}
+
+	return fmt.Errorf("invalid base arn %q: expected arn:<partition>:iam::<12 digit account id>:role/", arn)
+}
+
+// BaseARN constructs the role ARN prefix for the account in partition
+func BaseARN(partition, accountID string) string {
+	return fmt.Sprintf("arn:%s:iam::%s:role/", partition, accountID)
+}
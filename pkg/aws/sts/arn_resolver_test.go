@@ -80,3 +80,88 @@ func TestExtractsBaseFromInstanceArn(t *testing.T) {
 		t.Error("unexpected prefix, was: ", prefix)
 	}
 }
+
+func TestValidatesBaseARN(t *testing.T) {
+	valid := []string{
+		"arn:aws:iam::123456789012:role/",
+		"arn:aws:iam::123456789012:role/kiam/",
+		"arn:aws-us-gov:iam::123456789012:role/",
+	}
+	for _, arn := range valid {
+		if err := ValidateBaseARN(arn); err != nil {
+			t.Error("unexpected error:", err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"arn:aws:iam::123456789012:role",
+		"arn:aws:iam::123456789012:role/kiam",
+		"arn:aws:iam::account-id:role/",
+		"arn:aws:iam::123456789012:user/",
+		"arn:aws:sts::123456789012:role/",
+		"123456789012",
+	}
+	for _, arn := range invalid {
+		if err := ValidateBaseARN(arn); err == nil {
+			t.Error("expected error for", arn)
+		}
+	}
+}
+
+func TestBaseARNIncludesPartition(t *testing.T) {
+	arn := BaseARN("aws-cn", "123456789012")
+	if arn != "arn:aws-cn:iam::123456789012:role/" {
+		t.Error("unexpected arn, was:", arn)
+	}
+	if err := ValidateBaseARN(arn); err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestSameRoleIgnoresPath(t *testing.T) {
+	resolver := DefaultResolver("arn:aws:iam::123456789012:role/")
+
+	same := [][2]string{
+		{"myrole", "myrole"},
+		{"myrole", "arn:aws:iam::123456789012:role/myrole"},
+		{"myrole", "arn:aws:iam::123456789012:role/team/myrole"},
+		{"/team/myrole", "arn:aws:iam::123456789012:role/myrole"},
+	}
+	for _, roles := range same {
+		if !SameRole(resolver.Resolve(roles[0]), resolver.Resolve(roles[1])) {
+			t.Errorf("expected %s and %s to be the same role", roles[0], roles[1])
+		}
+	}
+
+	different := [][2]string{
+		{"myrole", "otherrole"},
+		{"myrole", "arn:aws:iam::210987654321:role/myrole"},
+		{"myrole", "arn:aws-cn:iam::123456789012:role/myrole"},
+		{"myrole", ""},
+	}
+	for _, roles := range different {
+		if SameRole(resolver.Resolve(roles[0]), resolver.Resolve(roles[1])) {
+			t.Errorf("expected %s and %s to be different roles", roles[0], roles[1])
+		}
+	}
+}
+
+func TestRoleName(t *testing.T) {
+	names := map[string]string{
+		"myrole":                                "myrole",
+		"team/myrole":                           "myrole",
+		"/team/myrole":                          "myrole",
+		"arn:aws:iam::123456789012:role/myrole": "myrole",
+		"arn:aws:iam::123456789012:role/team/myrole":   "myrole",
+		"arn:aws-cn:iam::210987654321:role/a/b/myrole": "myrole",
+	}
+	for role, expected := range names {
+		if name := RoleName(role); name != expected {
+			t.Errorf("expected name of %s to be %s, was %s", role, expected, name)
+		}
+		if !IsRoleName(RoleName(role)) {
+			t.Errorf("expected %s to be a role name", RoleName(role))
+		}
+	}
+}
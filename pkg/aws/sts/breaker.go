@@ -0,0 +1,178 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// ErrUpstreamUnavailable is returned without calling STS while the circuit
+// breaker is open.
+var ErrUpstreamUnavailable = fmt.Errorf("sts unavailable, circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker opens after threshold consecutive failures, rejecting calls
+// until coolDown has elapsed. It then half-opens, permitting a single probe
+// call that either closes the breaker or opens it again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	threshold int
+	coolDown  time.Duration
+	now       func() time.Time
+}
+
+// newCircuitBreaker returns nil, which never rejects calls, when threshold
+// is 0.
+func newCircuitBreaker(threshold int, coolDown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{threshold: threshold, coolDown: coolDown, now: time.Now}
+}
+
+// allow returns whether a call should be made to STS.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && b.now().Sub(b.openedAt) >= b.coolDown {
+		b.setState(breakerHalfOpen)
+	}
+
+	switch b.state {
+	case breakerOpen:
+		breakerRejected.Inc()
+		return false
+	case breakerHalfOpen:
+		if b.probing {
+			breakerRejected.Inc()
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// isOpen returns whether calls are currently being rejected, without
+// permitting a probe call.
+func (b *circuitBreaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state == breakerOpen && b.now().Sub(b.openedAt) < b.coolDown
+}
+
+// record updates the breaker with the result of a call permitted by allow.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	// a cancelled call says nothing about STS, so it neither counts as a
+	// failure nor closes the breaker
+	if isCanceled(err) {
+		return
+	}
+
+	if !isUpstreamFailure(err) {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	if b.state != state {
+		log.WithField("sts.breaker.failures", b.failures).Warnf("sts circuit breaker %s", state)
+	}
+	b.state = state
+	breakerStateGauge.Set(float64(state))
+}
+
+// isCanceled returns whether err is the result of the caller cancelling the
+// request. Requests that ran out of time aren't cancelled, they're failures.
+func isCanceled(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+		return !errors.Is(aerr.OrigErr(), context.DeadlineExceeded)
+	}
+	return false
+}
+
+// isUpstreamFailure returns whether err indicates STS is degraded, rather
+// than a problem with the request. Requests that exceed their deadline are
+// failures, cancelled requests aren't.
+func isUpstreamFailure(err error) bool {
+	if err == nil || isCanceled(err) {
+		return false
+	}
+	if request.IsErrorThrottle(err) {
+		return true
+	}
+	if failure, ok := err.(awserr.RequestFailure); ok {
+		return failure.StatusCode() >= http.StatusInternalServerError || failure.StatusCode() == 0
+	}
+	return true
+}
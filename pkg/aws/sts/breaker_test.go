@@ -0,0 +1,165 @@
+package sts
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func newTestBreaker(threshold int) (*circuitBreaker, *time.Time) {
+	now := time.Now()
+	b := newCircuitBreaker(threshold, time.Minute)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+var errUpstream = fmt.Errorf("connection refused")
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b, _ := newTestBreaker(3)
+
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatal("expected closed breaker to allow calls")
+		}
+		b.record(errUpstream)
+	}
+
+	b.allow()
+	b.record(nil)
+	if b.failures != 0 {
+		t.Error("expected success to reset failures, was", b.failures)
+	}
+
+	for i := 0; i < 3; i++ {
+		b.allow()
+		b.record(errUpstream)
+	}
+
+	if b.state != breakerOpen {
+		t.Error("expected breaker to be open, was", b.state)
+	}
+	if b.allow() {
+		t.Error("expected open breaker to reject calls")
+	}
+}
+
+func TestBreakerHalfOpensAfterCoolDown(t *testing.T) {
+	b, now := newTestBreaker(1)
+
+	b.allow()
+	b.record(errUpstream)
+	if b.allow() {
+		t.Fatal("expected open breaker to reject calls")
+	}
+
+	*now = now.Add(time.Minute)
+	if !b.allow() {
+		t.Fatal("expected half-open breaker to allow a probe")
+	}
+	if b.state != breakerHalfOpen {
+		t.Error("expected breaker to be half-open, was", b.state)
+	}
+	if b.allow() {
+		t.Error("expected half-open breaker to reject calls while probing")
+	}
+
+	b.record(errUpstream)
+	if b.state != breakerOpen {
+		t.Error("expected failed probe to reopen breaker, was", b.state)
+	}
+
+	*now = now.Add(time.Minute)
+	b.allow()
+	b.record(nil)
+	if b.state != breakerClosed {
+		t.Error("expected successful probe to close breaker, was", b.state)
+	}
+	if !b.allow() {
+		t.Error("expected closed breaker to allow calls")
+	}
+}
+
+func TestBreakerIgnoresRequestErrors(t *testing.T) {
+	b, _ := newTestBreaker(1)
+
+	accessDenied := awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "id")
+	for _, err := range []error{accessDenied, context.Canceled} {
+		b.allow()
+		b.record(err)
+	}
+
+	if b.state != breakerClosed {
+		t.Error("expected request errors not to open breaker, was", b.state)
+	}
+
+	b.allow()
+	b.record(awserr.NewRequestFailure(awserr.New("Throttling", "rate exceeded", nil), 400, "id"))
+	if b.state != breakerOpen {
+		t.Error("expected throttling to open breaker, was", b.state)
+	}
+}
+
+func TestBreakerOpensAfterTimeouts(t *testing.T) {
+	b, _ := newTestBreaker(2)
+
+	timeouts := []error{
+		context.DeadlineExceeded,
+		awserr.New(request.CanceledErrorCode, "request context canceled", context.DeadlineExceeded),
+	}
+	for _, err := range timeouts {
+		b.allow()
+		b.record(err)
+	}
+
+	if b.state != breakerOpen {
+		t.Error("expected timeouts to open breaker, was", b.state)
+	}
+}
+
+func TestBreakerIgnoresCancelledCalls(t *testing.T) {
+	b, now := newTestBreaker(2)
+
+	b.allow()
+	b.record(errUpstream)
+
+	cancelled := []error{
+		context.Canceled,
+		awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled),
+	}
+	for _, err := range cancelled {
+		b.allow()
+		b.record(err)
+	}
+	if b.failures != 1 {
+		t.Error("expected cancelled calls not to reset failures, was", b.failures)
+	}
+
+	b.allow()
+	b.record(errUpstream)
+	if b.state != breakerOpen {
+		t.Fatal("expected breaker to be open, was", b.state)
+	}
+
+	*now = now.Add(time.Minute)
+	b.allow()
+	b.record(context.Canceled)
+	if b.state != breakerHalfOpen {
+		t.Error("expected cancelled probe to leave breaker half-open, was", b.state)
+	}
+	if !b.allow() {
+		t.Error("expected another probe after a cancelled probe")
+	}
+}
+
+func TestDisabledBreakerAllowsCalls(t *testing.T) {
+	b := newCircuitBreaker(0, time.Minute)
+	b.record(errUpstream)
+	if !b.allow() {
+		t.Error("expected disabled breaker to allow calls")
+	}
+}
@@ -16,11 +16,12 @@ package sts
 import (
 	"context"
 	"fmt"
+	"math/rand"
+	"sort"
 	"time"
 
 	"github.com/patrickmn/go-cache"
-	"github.com/prometheus/client_golang/prometheus"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 	"github.com/uswitch/kiam/pkg/future"
 )
 
@@ -28,58 +29,131 @@ type credentialsCache struct {
 	arnResolver     ARNResolver
 	baseARN         string
 	cache           *cache.Cache
+	stale           *cache.Cache
 	expiring        chan *RoleCredentials
 	sessionName     string
 	sessionDuration time.Duration
+	maxDuration     time.Duration
+	sessionRefresh  time.Duration
+	refreshJitter   time.Duration
+	roleRefresh     map[string]time.Duration
+	serveStale      bool
 	cacheTTL        time.Duration
+	minCacheTTL     time.Duration
 	gateway         STSGateway
+	maxEntries      int
+	entries         *lruIndex
+	watchers        *credentialsWatchers
 }
 
 type RoleCredentials struct {
 	Role        string
+	Identity    *RoleIdentity
 	Credentials *Credentials
 }
 
+// cachedCredentials is stored in the cache, the identity is retained so
+// that expiring credentials can be refreshed with the same session policy.
+type cachedCredentials struct {
+	identity *RoleIdentity
+	future   *future.Future
+}
+
 const (
 	DefaultPurgeInterval = 1 * time.Minute
+
+	// minIssuedValidity is how long newly issued credentials must remain
+	// valid for, anything less suggests the clock is skewed from STS.
+	minIssuedValidity = 1 * time.Minute
+	// maxIssueAttempts bounds how many times credentials are requested when
+	// they're issued expired.
+	maxIssueAttempts = 2
 )
 
+// errSuperseded is returned by requests abandoned because another request
+// for the same identity was cached first, it's never returned to callers.
+var errSuperseded = fmt.Errorf("superseded by concurrent request")
+
+// ErrIssuedExpired is returned when STS repeatedly issues credentials that
+// have expired, or are about to, by the local clock.
+var ErrIssuedExpired = fmt.Errorf("credentials issued expired, check for clock skew with sts")
+
+// DefaultCache creates a cache that requests credentials from gateway and
+// refreshes them sessionRefresh before they expire, plus a random amount of up
+// to refreshJitter so many roles aren't refreshed at once. Credentials are
+// cached for at least minCacheTTL, even when issued with a shorter validity,
+// but never beyond their expiry. 0 disables the minimum.
 func DefaultCache(
 	gateway STSGateway,
 	sessionName string,
 	sessionDuration time.Duration,
 	sessionRefresh time.Duration,
 	resolver ARNResolver,
+	maxEntries int,
+	minCacheTTL time.Duration,
+	refreshJitter time.Duration,
 ) *credentialsCache {
 	c := &credentialsCache{
 		arnResolver:     resolver,
 		expiring:        make(chan *RoleCredentials, 1),
 		sessionName:     fmt.Sprintf("kiam-%s", sessionName),
 		sessionDuration: sessionDuration,
+		sessionRefresh:  sessionRefresh,
+		refreshJitter:   refreshJitter,
+		roleRefresh:     make(map[string]time.Duration),
+		serveStale:      true,
 		cacheTTL:        sessionDuration - sessionRefresh,
+		minCacheTTL:     minCacheTTL,
 		gateway:         gateway,
+		maxEntries:      maxEntries,
+		entries:         newLRUIndex(),
+		watchers:        newCredentialsWatchers(),
 	}
 	c.cache = cache.New(c.cacheTTL, DefaultPurgeInterval)
 	c.cache.OnEvicted(c.evicted)
-
-	// TODO: Not do this inline
-	cacheSize := prometheus.NewCounterFunc(
-		prometheus.CounterOpts{
-			Namespace: "kiam",
-			Subsystem: "sts",
-			Name:      "cacheSize",
-			Help:      "Current size of the metadata cache",
-		},
-		func() float64 { return float64(c.cache.ItemCount()) },
-	)
-	prometheus.MustRegister(cacheSize)
+	c.stale = cache.New(cache.NoExpiration, DefaultPurgeInterval)
 
 	return c
 }
 
-func (c *credentialsCache) evicted(role string, item interface{}) {
-	f := item.(*future.Future)
-	obj, err := f.Get(context.Background())
+// SetRoleRefresh refreshes credentials for role refresh before they expire,
+// rather than sessionRefresh. It must be called before credentials are
+// requested.
+func (c *credentialsCache) SetRoleRefresh(role string, refresh time.Duration) {
+	c.roleRefresh[c.arnResolver.Resolve(role)] = refresh
+}
+
+// SetMaxSessionDuration clamps the session duration identities request to
+// max, or AWSMaxSessionDuration when it's 0, before credentials are
+// requested from STS. It must be called before credentials are requested.
+func (c *credentialsCache) SetMaxSessionDuration(max time.Duration) {
+	c.maxDuration = max
+}
+
+// SetServeStale sets whether credentials that are due to be refreshed, but
+// haven't expired, are served when STS is unavailable. It's enabled by
+// default and must be called before credentials are requested.
+func (c *credentialsCache) SetServeStale(enabled bool) {
+	c.serveStale = enabled
+}
+
+func (c *credentialsCache) evicted(key string, item interface{}) {
+	defer c.updateSize()
+
+	// entries evicted to bound the cache size have already been removed
+	// from the index and shouldn't be refreshed
+	if !c.entries.remove(key) {
+		return
+	}
+
+	cached := item.(*cachedCredentials)
+	role := cached.identity.Role
+
+	// don't block on requests that are still in-flight, there's nothing to refresh
+	if !cached.future.Done() {
+		return
+	}
+	obj, err := cached.future.Get(context.Background())
 
 	if err != nil {
 		log.WithField("pod.iam.role", role).Debugf("evicted credentials future had error: %s", err.Error())
@@ -87,8 +161,10 @@ func (c *credentialsCache) evicted(role string, item interface{}) {
 	}
 
 	creds := obj.(*Credentials)
+	c.retainUntilExpiry(key, creds)
+
 	select {
-	case c.expiring <- &RoleCredentials{Role: role, Credentials: creds}:
+	case c.expiring <- &RoleCredentials{Role: role, Identity: cached.identity, Credentials: creds}:
 		log.WithFields(CredentialsFields(creds, role)).Infof("notified credentials expire soon")
 		return
 	default:
@@ -100,30 +176,67 @@ func (c *credentialsCache) Expiring() chan *RoleCredentials {
 	return c.expiring
 }
 
-func (c *credentialsCache) CredentialsForRole(ctx context.Context, role string) (*Credentials, error) {
-	logger := log.WithFields(log.Fields{"pod.iam.role": role})
-	item, found := c.cache.Get(role)
+func (c *credentialsCache) CredentialsForRole(ctx context.Context, identity *RoleIdentity) (*Credentials, error) {
+	role := identity.Role
+	logger := log.WithFields(logrus.Fields{"pod.iam.role": role})
+
+	if err := ValidateSessionPolicy(identity.Policy); err != nil {
+		logger.Errorf("invalid session policy: %s", err.Error())
+		return nil, err
+	}
+	if err := ValidatePolicyARNs(identity.PolicyARNs); err != nil {
+		logger.Errorf("invalid session policy arns: %s", err.Error())
+		return nil, err
+	}
+
+	key := identity.Key()
+	item, found := c.cache.Get(key)
 
 	if found {
-		future, _ := item.(*future.Future)
-		val, err := future.Get(ctx)
+		cached, _ := item.(*cachedCredentials)
+		val, err := cached.future.Get(ctx)
 
 		if err != nil {
 			logger.Errorf("error retrieving credentials in cache from future: %s. will delete", err.Error())
-			c.cache.Delete(role)
+			c.cache.Delete(key)
+			if stale, ok := c.staleOnFailure(key, err, logger); ok {
+				return stale, nil
+			}
 			return nil, err
 		}
 
-		cacheHit.Inc()
+		if creds := val.(*Credentials); !expired(creds) {
+			c.entries.touch(key)
+			cacheHit.Inc()
 
-		return val.(*Credentials), nil
-	}
+			return creds, nil
+		}
 
-	cacheMiss.Inc()
+		logger.Warnf("cached credentials have expired, will request new credentials")
+		c.cache.Delete(key)
+	}
 
+	cached := &cachedCredentials{identity: identity}
+	// the ttl is updated once credentials are issued, so wait for the entry
+	// to be added. superseded is set when another request added an entry
+	// first, this request then waits for its credentials instead.
+	ready := make(chan struct{})
+	superseded := false
 	issue := func() (interface{}, error) {
-		arn := c.arnResolver.Resolve(role)
-		credentials, err := c.gateway.Issue(ctx, arn, c.sessionName, c.sessionDuration)
+		<-ready
+		if superseded {
+			return nil, errSuperseded
+		}
+		duration := c.identityDuration(identity)
+		request := &AssumeRoleRequest{
+			RoleARN:         c.arnResolver.Resolve(role),
+			SessionName:     c.sessionName,
+			SessionDuration: duration,
+			Policy:          identity.Policy,
+			PolicyARNs:      identity.PolicyARNs,
+			SourceIdentity:  identity.SourceIdentity,
+		}
+		credentials, err := c.issueUnexpired(ctx, request, logger)
 		if err != nil {
 			errorIssuing.Inc()
 			logger.Errorf("error requesting credentials: %s", err.Error())
@@ -131,16 +244,253 @@ func (c *credentialsCache) CredentialsForRole(ctx context.Context, role string)
 		}
 
 		log.WithFields(CredentialsFields(credentials, role)).Infof("requested new credentials")
+		c.updateTTL(key, cached, credentials, duration)
+		c.watchers.notify(key, credentials)
 		return credentials, err
 	}
 	f := future.New(issue)
-	c.cache.Set(role, f, c.cacheTTL)
+	cached.future = f
+	if !c.add(key, cached) {
+		superseded = true
+		close(ready)
+		return c.CredentialsForRole(ctx, identity)
+	}
+	close(ready)
+	cacheMiss.Inc()
 
 	val, err := f.Get(ctx)
 	if err != nil {
-		c.cache.Delete(role)
+		c.cache.Delete(key)
+		if stale, ok := c.staleOnFailure(key, err, logger); ok {
+			return stale, nil
+		}
 		return nil, err
 	}
 
 	return val.(*Credentials), nil
 }
+
+// staleOnFailure returns the previously issued credentials for key when
+// they're still valid and err indicates STS is unavailable.
+func (c *credentialsCache) staleOnFailure(key string, err error, logger *logrus.Entry) (*Credentials, bool) {
+	if !c.serveStale || !isUpstreamFailure(err) {
+		return nil, false
+	}
+	stale, found := c.stale.Get(key)
+	if !found {
+		return nil, false
+	}
+	logger.Warnf("sts unavailable, serving previously issued credentials: %s", err.Error())
+	staleServed.Inc()
+	return stale.(*Credentials), true
+}
+
+// issueUnexpired requests credentials from the gateway, requesting them again
+// when they're issued expired or about to expire. Credentials whose
+// expiration can't be parsed are returned as issued.
+func (c *credentialsCache) issueUnexpired(ctx context.Context, request *AssumeRoleRequest, logger *logrus.Entry) (*Credentials, error) {
+	for attempt := 1; ; attempt++ {
+		credentials, err := c.gateway.Issue(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+
+		expiry, err := credentials.ExpiresAt()
+		if err != nil {
+			return credentials, nil
+		}
+		remaining := time.Until(expiry)
+		if remaining >= minIssuedValidity {
+			return credentials, nil
+		}
+
+		issuedExpired.Inc()
+		logger.WithFields(logrus.Fields{
+			"credentials.expiration": credentials.Expiration,
+			"credentials.remaining":  remaining.String(),
+		}).Warnf("credentials issued expired or about to expire, clock may be skewed from sts")
+		if attempt >= maxIssueAttempts {
+			return nil, ErrIssuedExpired
+		}
+	}
+}
+
+// identityDuration returns the session duration credentials for identity
+// are requested for: the duration it overrides, clamped to the permitted
+// range, or the cache's session duration.
+func (c *credentialsCache) identityDuration(identity *RoleIdentity) time.Duration {
+	if identity.SessionDuration == 0 {
+		return c.sessionDuration
+	}
+	return ClampSessionDuration(identity.SessionDuration, c.maxDuration)
+}
+
+// ttl returns how long credentials are cached before they're refreshed: until
+// the role's refresh window before they expire, but no less than the minimum
+// and never beyond their expiry.
+func (c *credentialsCache) ttl(role string, duration time.Duration, creds *Credentials) time.Duration {
+	lead := c.refreshLead(role)
+	maxTTL := duration - lead
+
+	expiry, err := time.Parse(timeLayout, creds.Expiration)
+	if err != nil {
+		return maxTTL
+	}
+
+	untilExpiry := time.Until(expiry)
+	ttl := untilExpiry - lead
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if ttl < c.minCacheTTL {
+		ttl = c.minCacheTTL
+	}
+	if ttl <= 0 || ttl > untilExpiry {
+		ttl = untilExpiry
+	}
+	if ttl <= 0 {
+		// already expired, the next request will replace them
+		return c.cacheTTL
+	}
+	return ttl
+}
+
+// refreshLead returns how long before expiry credentials for role are
+// refreshed, the role's refresh window extended by a random jitter.
+func (c *credentialsCache) refreshLead(role string) time.Duration {
+	refresh, ok := c.roleRefresh[c.arnResolver.Resolve(role)]
+	if !ok {
+		refresh = c.sessionRefresh
+	}
+	if c.refreshJitter <= 0 {
+		return refresh
+	}
+	return refresh + time.Duration(rand.Int63n(int64(c.refreshJitter)+1))
+}
+
+// updateTTL caches credentials issued for duration for their ttl, provided
+// the entry hasn't since been replaced.
+func (c *credentialsCache) updateTTL(key string, cached *cachedCredentials, creds *Credentials, duration time.Duration) {
+	if item, found := c.cache.Get(key); found && item == cached {
+		c.cache.Replace(key, cached, c.ttl(cached.identity.Role, duration, creds))
+	}
+}
+
+// expired returns true when creds have passed their expiration.
+func expired(creds *Credentials) bool {
+	expiry, err := time.Parse(timeLayout, creds.Expiration)
+	if err != nil {
+		return false
+	}
+	return !time.Now().Before(expiry)
+}
+
+// retainUntilExpiry keeps credentials evicted for refresh until they expire,
+// so they can still be served while STS is unavailable.
+func (c *credentialsCache) retainUntilExpiry(key string, creds *Credentials) {
+	expiry, err := time.Parse(timeLayout, creds.Expiration)
+	if err != nil {
+		return
+	}
+	if ttl := time.Until(expiry); ttl > 0 {
+		c.stale.Set(key, creds, ttl)
+	}
+}
+
+// CachedRole describes credentials held in the cache. It never includes
+// the secret access key or session token.
+type CachedRole struct {
+	Role           string
+	SessionPolicy  bool
+	SourceIdentity string
+	// Pending is true while credentials are still being requested
+	Pending     bool
+	Expiration  string
+	LastUpdated string
+}
+
+// CachedRoles returns the roles with credentials currently cached, ordered
+// by role.
+func (c *credentialsCache) CachedRoles() []*CachedRole {
+	items := c.cache.Items()
+	roles := make([]*CachedRole, 0, len(items))
+	for _, item := range items {
+		cached := item.Object.(*cachedCredentials)
+		role := &CachedRole{
+			Role:           cached.identity.Role,
+			SessionPolicy:  cached.identity.Policy != "" || len(cached.identity.PolicyARNs) > 0,
+			SourceIdentity: cached.identity.SourceIdentity,
+			Pending:        !cached.future.Done(),
+		}
+		if !role.Pending {
+			obj, err := cached.future.Get(context.Background())
+			if err != nil {
+				continue
+			}
+			creds := obj.(*Credentials)
+			role.Expiration = creds.Expiration
+			role.LastUpdated = creds.LastUpdated
+		}
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Role < roles[j].Role })
+	return roles
+}
+
+// Watch returns a channel that receives credentials each time they're issued
+// for identity, until ctx is done.
+func (c *credentialsCache) Watch(ctx context.Context, identity *RoleIdentity) <-chan *Credentials {
+	return c.watchers.watch(ctx, identity.Key())
+}
+
+// add caches credentials unless the key is already cached, so concurrent
+// requests for the same identity share a single request to STS. It returns
+// false when the key was already cached.
+func (c *credentialsCache) add(key string, cached *cachedCredentials) bool {
+	if err := c.cache.Add(key, cached, c.cacheTTL); err != nil {
+		return false
+	}
+	c.entries.touch(key)
+	c.evictLeastRecentlyUsed()
+	c.updateSize()
+	return true
+}
+
+func (c *credentialsCache) set(key string, cached *cachedCredentials) {
+	c.cache.Set(key, cached, c.cacheTTL)
+	c.entries.touch(key)
+	c.evictLeastRecentlyUsed()
+	c.updateSize()
+}
+
+// evictLeastRecentlyUsed removes entries until the cache is within its
+// maximum size. Entries with requests still in-flight are never evicted.
+func (c *credentialsCache) evictLeastRecentlyUsed() {
+	if c.maxEntries <= 0 {
+		return
+	}
+
+	evictable := func(key string) bool {
+		item, found := c.cache.Get(key)
+		if !found {
+			return true
+		}
+		return item.(*cachedCredentials).future.Done()
+	}
+
+	for c.entries.len() > c.maxEntries {
+		key, ok := c.entries.removeOldest(evictable)
+		if !ok {
+			return
+		}
+		log.WithField("cache.key", key).Debugf("evicting least recently used credentials")
+		c.cache.Delete(key)
+		cacheEvictions.Inc()
+	}
+}
+
+func (c *credentialsCache) updateSize() {
+	size := float64(c.cache.ItemCount())
+	cacheSize.Set(size)
+	deprecatedCacheSize.Set(size)
+}
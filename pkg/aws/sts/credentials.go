@@ -25,6 +25,9 @@ type Credentials struct {
 	Token           string
 	Expiration      string
 	LastUpdated     string
+	// RoleARN is the role the credentials were issued for, when the
+	// server reports it. It isn't part of the metadata API's response.
+	RoleARN string `json:"-"`
 }
 
 const (
@@ -36,10 +39,25 @@ func NewCredentials(accessKey, secretKey, token string, expiry time.Time) *Crede
 	return &Credentials{
 		Code:            "Success",
 		Type:            "AWS-HMAC",
-		LastUpdated:     time.Now().Format(timeLayout),
+		LastUpdated:     time.Now().UTC().Format(timeLayout),
 		AccessKeyId:     accessKey,
 		SecretAccessKey: secretKey,
 		Token:           token,
 		Expiration:      expiry.Format(timeLayout),
 	}
 }
+
+// ExpiresAt parses the credentials' Expiration.
+func (c *Credentials) ExpiresAt() (time.Time, error) {
+	return time.Parse(timeLayout, c.Expiration)
+}
+
+// Age is how long ago the credentials were issued by STS, according to
+// their LastUpdated time.
+func (c *Credentials) Age() (time.Duration, error) {
+	updated, err := time.Parse(timeLayout, c.LastUpdated)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(updated), nil
+}
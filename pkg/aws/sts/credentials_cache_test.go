@@ -15,33 +15,49 @@ package sts
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsrequest "github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 type stubGateway struct {
-	c             *Credentials
-	issueCount    int
-	requestedRole string
+	c               *Credentials
+	issueCount      int
+	requestedRole   string
+	requestedPolicy string
+	requestedARNs   []string
+	requestedSource string
+	requestedTime   time.Duration
 }
 
-func (s *stubGateway) Issue(ctx context.Context, roleARN, sessionName string, expiry time.Duration) (*Credentials, error) {
+func (s *stubGateway) Issue(ctx context.Context, request *AssumeRoleRequest) (*Credentials, error) {
 	s.issueCount = s.issueCount + 1
-	s.requestedRole = roleARN
+	s.requestedRole = request.RoleARN
+	s.requestedPolicy = request.Policy
+	s.requestedARNs = request.PolicyARNs
+	s.requestedSource = request.SourceIdentity
+	s.requestedTime = request.SessionDuration
 	return s.c, nil
 }
 
 func TestRequestsCredentialsFromGatewayWithEmptyCache(t *testing.T) {
 	stubGateway := &stubGateway{c: &Credentials{Code: "foo"}}
-	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"))
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
 	ctx := context.Background()
 
-	creds, _ := cache.CredentialsForRole(ctx, "role")
+	creds, _ := cache.CredentialsForRole(ctx, NewRoleIdentity("role"))
 	if creds.Code != "foo" {
 		t.Error("didnt return expected credentials code, was", creds.Code)
 	}
 
-	cache.CredentialsForRole(ctx, "role")
+	cache.CredentialsForRole(ctx, NewRoleIdentity("role"))
 	if stubGateway.issueCount != 1 {
 		t.Error("expected creds to be cached")
 	}
@@ -50,3 +66,588 @@ func TestRequestsCredentialsFromGatewayWithEmptyCache(t *testing.T) {
 		t.Error("unexpected role, was:", stubGateway.requestedRole)
 	}
 }
+
+func TestCachesCredentialsBySessionPolicy(t *testing.T) {
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo"}}
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	ctx := context.Background()
+
+	policy := `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"*"}]}`
+	cache.CredentialsForRole(ctx, &RoleIdentity{Role: "role", Policy: policy})
+	if stubGateway.requestedPolicy != policy {
+		t.Error("expected session policy to be requested, was:", stubGateway.requestedPolicy)
+	}
+
+	cache.CredentialsForRole(ctx, &RoleIdentity{Role: "role", Policy: policy})
+	if stubGateway.issueCount != 1 {
+		t.Error("expected creds to be cached for the same policy")
+	}
+
+	cache.CredentialsForRole(ctx, NewRoleIdentity("role"))
+	if stubGateway.issueCount != 2 {
+		t.Error("expected creds without a policy to be cached separately")
+	}
+}
+
+func TestCachesCredentialsByPolicyARNs(t *testing.T) {
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo"}}
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	ctx := context.Background()
+
+	arns := []string{"arn:aws:iam::123456789012:policy/read-only", "arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess"}
+	cache.CredentialsForRole(ctx, &RoleIdentity{Role: "role", PolicyARNs: arns})
+	if len(stubGateway.requestedARNs) != 2 || stubGateway.requestedARNs[0] != arns[0] || stubGateway.requestedARNs[1] != arns[1] {
+		t.Error("expected policy arns to be requested, was:", stubGateway.requestedARNs)
+	}
+
+	cache.CredentialsForRole(ctx, &RoleIdentity{Role: "role", PolicyARNs: []string{arns[1], arns[0]}})
+	if stubGateway.issueCount != 1 {
+		t.Error("expected creds to be cached for the same policy arns in any order")
+	}
+
+	cache.CredentialsForRole(ctx, &RoleIdentity{Role: "role", PolicyARNs: arns[:1]})
+	if stubGateway.issueCount != 2 {
+		t.Error("expected creds for other policy arns to be cached separately")
+	}
+
+	cache.CredentialsForRole(ctx, NewRoleIdentity("role"))
+	if stubGateway.issueCount != 3 {
+		t.Error("expected creds without policy arns to be cached separately")
+	}
+}
+
+func TestRejectsInvalidPolicyARNs(t *testing.T) {
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo"}}
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	ctx := context.Background()
+
+	for _, arn := range []string{"read-only", "arn:aws:iam::123456789012:role/role", "arn:aws:iam::1234:policy/read-only", "arn:aws:s3:::bucket"} {
+		if _, err := cache.CredentialsForRole(ctx, &RoleIdentity{Role: "role", PolicyARNs: []string{arn}}); err == nil {
+			t.Errorf("expected %s to be rejected", arn)
+		}
+	}
+
+	arns := make([]string, MaxSessionPolicyARNs+1)
+	for i := range arns {
+		arns[i] = fmt.Sprintf("arn:aws:iam::123456789012:policy/path/policy-%d", i)
+	}
+	if _, err := cache.CredentialsForRole(ctx, &RoleIdentity{Role: "role", PolicyARNs: arns}); err != ErrTooManyPolicyARNs {
+		t.Error("expected too many policy arns error, was:", err)
+	}
+	if err := ValidatePolicyARNs(arns[:MaxSessionPolicyARNs]); err != nil {
+		t.Error("expected the maximum number of policy arns to be valid, was:", err)
+	}
+
+	if stubGateway.issueCount != 0 {
+		t.Error("expected no credentials to be issued for invalid policy arns")
+	}
+}
+
+func TestCachesCredentialsBySourceIdentity(t *testing.T) {
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo"}}
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	ctx := context.Background()
+
+	cache.CredentialsForRole(ctx, &RoleIdentity{Role: "role", SourceIdentity: "ns.app"})
+	if stubGateway.requestedSource != "ns.app" {
+		t.Error("expected source identity to be requested, was:", stubGateway.requestedSource)
+	}
+
+	cache.CredentialsForRole(ctx, &RoleIdentity{Role: "role", SourceIdentity: "ns.app"})
+	if stubGateway.issueCount != 1 {
+		t.Error("expected creds to be cached for the same source identity")
+	}
+
+	cache.CredentialsForRole(ctx, &RoleIdentity{Role: "role", SourceIdentity: "ns.other"})
+	if stubGateway.issueCount != 2 {
+		t.Error("expected creds for other source identities to be cached separately")
+	}
+}
+
+func TestClampsIdentitySessionDuration(t *testing.T) {
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo"}}
+	cache := DefaultCache(stubGateway, "session", 30*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	cache.SetMaxSessionDuration(2 * time.Hour)
+	ctx := context.Background()
+
+	cases := []struct {
+		requested time.Duration
+		expected  time.Duration
+	}{
+		{0, 30 * time.Minute},
+		{time.Hour, time.Hour},
+		{12 * time.Hour, 2 * time.Hour},
+		{5 * time.Minute, AWSMinSessionDuration},
+	}
+	for _, c := range cases {
+		cache.CredentialsForRole(ctx, &RoleIdentity{Role: "role", SessionDuration: c.requested})
+		if stubGateway.requestedTime != c.expected {
+			t.Errorf("expected %s requested for %s, was %s", c.expected, c.requested, stubGateway.requestedTime)
+		}
+	}
+	if stubGateway.issueCount != len(cases) {
+		t.Error("expected creds for each session duration to be cached separately")
+	}
+}
+
+func TestSourceIdentityForServiceAccount(t *testing.T) {
+	if identity := SourceIdentityForServiceAccount("ns", "app"); identity != "ns.app" {
+		t.Error("unexpected identity, was", identity)
+	}
+	if identity := SourceIdentityForServiceAccount("ns", ""); identity != "ns.default" {
+		t.Error("expected default service account, was", identity)
+	}
+
+	long := SourceIdentityForServiceAccount("ns", strings.Repeat("a", 80))
+	other := SourceIdentityForServiceAccount("ns", strings.Repeat("a", 81))
+	if len(long) != MaxSourceIdentityLength {
+		t.Error("expected identity to be truncated, was", len(long))
+	}
+	if long == other {
+		t.Error("expected truncated identities to remain unique")
+	}
+}
+
+func TestRejectsInvalidSessionPolicy(t *testing.T) {
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo"}}
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	ctx := context.Background()
+
+	_, err := cache.CredentialsForRole(ctx, &RoleIdentity{Role: "role", Policy: "{not json"})
+	if err != ErrSessionPolicyInvalid {
+		t.Error("expected invalid policy error, was:", err)
+	}
+
+	_, err = cache.CredentialsForRole(ctx, &RoleIdentity{Role: "role", Policy: fmt.Sprintf(`{"Sid":"%s"}`, strings.Repeat("a", MaxSessionPolicySize))})
+	if err != ErrSessionPolicyTooLarge {
+		t.Error("expected policy too large error, was:", err)
+	}
+
+	if stubGateway.issueCount != 0 {
+		t.Error("expected no credentials to be issued for invalid policies")
+	}
+}
+
+type blockingGateway struct {
+	release chan struct{}
+}
+
+func (g *blockingGateway) Issue(ctx context.Context, request *AssumeRoleRequest) (*Credentials, error) {
+	<-g.release
+	return &Credentials{Code: request.RoleARN}, nil
+}
+
+func cacheSizeValue(t *testing.T) float64 {
+	m := &dto.Metric{}
+	if err := cacheSize.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestEvictsLeastRecentlyUsedBeyondMaxEntries(t *testing.T) {
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo"}}
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 2, 0, 0)
+	ctx := context.Background()
+
+	cache.CredentialsForRole(ctx, NewRoleIdentity("role1"))
+	cache.CredentialsForRole(ctx, NewRoleIdentity("role2"))
+	if cacheSizeValue(t) != 2 {
+		t.Error("expected cache size of 2, was", cacheSizeValue(t))
+	}
+
+	// role1 is now more recently used than role2
+	cache.CredentialsForRole(ctx, NewRoleIdentity("role1"))
+	cache.CredentialsForRole(ctx, NewRoleIdentity("role3"))
+
+	if cacheSizeValue(t) != 2 {
+		t.Error("expected cache size of 2 after eviction, was", cacheSizeValue(t))
+	}
+	deprecated := &dto.Metric{}
+	deprecatedCacheSize.Write(deprecated)
+	if deprecated.GetGauge().GetValue() != 2 {
+		t.Error("expected deprecated cache size of 2, was", deprecated.GetGauge().GetValue())
+	}
+	if _, found := cache.cache.Get("role2"); found {
+		t.Error("expected least recently used role2 to be evicted")
+	}
+	if _, found := cache.cache.Get("role1"); !found {
+		t.Error("expected role1 to be retained")
+	}
+
+	select {
+	case <-cache.Expiring():
+		t.Error("evicted credentials shouldn't be refreshed")
+	default:
+	}
+
+	issued := stubGateway.issueCount
+	cache.CredentialsForRole(ctx, NewRoleIdentity("role2"))
+	if stubGateway.issueCount != issued+1 {
+		t.Error("expected evicted credentials to be issued again")
+	}
+}
+
+func TestDoesntEvictInFlightEntries(t *testing.T) {
+	gateway := &blockingGateway{release: make(chan struct{})}
+	cache := DefaultCache(gateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 1, 0, 0)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		creds, err := cache.CredentialsForRole(context.Background(), NewRoleIdentity("role1"))
+		if err != nil || creds.Code != "prefix:role1" {
+			t.Error("unexpected credentials", creds, err)
+		}
+	}()
+
+	for cache.entries.len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	cache.CredentialsForRole(ctx, NewRoleIdentity("role2"))
+
+	if _, found := cache.cache.Get("role1"); !found {
+		t.Error("expected in-flight role1 to be retained")
+	}
+
+	close(gateway.release)
+	<-done
+}
+
+func TestWatchReceivesIssuedCredentials(t *testing.T) {
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo"}}
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	updates := cache.Watch(ctx, NewRoleIdentity("role"))
+	cache.CredentialsForRole(context.Background(), NewRoleIdentity("other"))
+	cache.CredentialsForRole(context.Background(), NewRoleIdentity("role"))
+
+	select {
+	case creds := <-updates:
+		if creds.Code != "foo" {
+			t.Error("unexpected credentials", creds)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected credentials to be notified")
+	}
+
+	select {
+	case creds := <-updates:
+		t.Error("unexpected notification for another role", creds)
+	default:
+	}
+
+	cancel()
+	if _, ok := <-updates; ok {
+		t.Error("expected channel to be closed")
+	}
+}
+
+// unavailableGateway issues credentials until it's made unavailable, then
+// fails with the unavailable error.
+type unavailableGateway struct {
+	c           *Credentials
+	unavailable error
+	// block waits until the request's context is done, as the SDK does for
+	// requests to an unresponsive endpoint
+	block bool
+}
+
+func (g *unavailableGateway) Issue(ctx context.Context, request *AssumeRoleRequest) (*Credentials, error) {
+	if g.block {
+		<-ctx.Done()
+		return nil, awserr.New(awsrequest.CanceledErrorCode, "request context canceled", ctx.Err())
+	}
+	if g.unavailable != nil {
+		return nil, g.unavailable
+	}
+	return g.c, nil
+}
+
+func TestServesValidCredentialsWhileUpstreamUnavailable(t *testing.T) {
+	issued := NewCredentials("A1", "S1", "T1", time.Now().Add(time.Hour))
+	gateway := &unavailableGateway{c: issued}
+	cache := DefaultCache(gateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	ctx := context.Background()
+
+	identity := NewRoleIdentity("role")
+	cache.CredentialsForRole(ctx, identity)
+
+	// expire the entry so it must be refreshed
+	cache.cache.Delete(identity.Key())
+	gateway.unavailable = ErrUpstreamUnavailable
+
+	creds, err := cache.CredentialsForRole(ctx, identity)
+	if err != nil {
+		t.Fatal("expected previously issued credentials, was error:", err)
+	}
+	if creds.AccessKeyId != "A1" {
+		t.Error("unexpected credentials, was", creds.AccessKeyId)
+	}
+
+	_, err = cache.CredentialsForRole(ctx, NewRoleIdentity("other"))
+	if err != ErrUpstreamUnavailable {
+		t.Error("expected upstream unavailable without previous credentials, was", err)
+	}
+}
+
+func TestServesStaleCredentialsOnlyForUpstreamFailures(t *testing.T) {
+	cases := []struct {
+		name       string
+		err        error
+		serveStale bool
+		expectErr  bool
+	}{
+		{"server error", awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), 503, "id"), true, false},
+		{"throttled", awserr.New("Throttling", "rate exceeded", nil), true, false},
+		{"access denied", awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "id"), true, true},
+		{"disabled", awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), 503, "id"), false, true},
+	}
+
+	for _, c := range cases {
+		gateway := &unavailableGateway{c: NewCredentials("A1", "S1", "T1", time.Now().Add(time.Hour))}
+		cache := DefaultCache(gateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+		cache.SetServeStale(c.serveStale)
+		identity := NewRoleIdentity("role")
+		cache.CredentialsForRole(context.Background(), identity)
+		cache.cache.Delete(identity.Key())
+		gateway.unavailable = c.err
+
+		before := counterValue(staleServed)
+		creds, err := cache.CredentialsForRole(context.Background(), identity)
+		served := counterValue(staleServed) - before
+		if c.expectErr && (err == nil || served != 0) {
+			t.Errorf("%s: expected error without serving stale credentials, was %v", c.name, creds)
+		}
+		if !c.expectErr && (err != nil || creds.AccessKeyId != "A1" || served != 1) {
+			t.Errorf("%s: expected stale credentials to be served and recorded, was %v %v", c.name, err, served)
+		}
+	}
+}
+
+func TestServesStaleCredentialsWhenUpstreamTimesOut(t *testing.T) {
+	gateway := &unavailableGateway{c: NewCredentials("A1", "S1", "T1", time.Now().Add(time.Hour))}
+	cache := DefaultCache(gateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	cache.SetServeStale(true)
+	identity := NewRoleIdentity("role")
+	cache.CredentialsForRole(context.Background(), identity)
+	cache.cache.Delete(identity.Key())
+	gateway.block = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	before := counterValue(staleServed)
+	creds, err := cache.CredentialsForRole(ctx, identity)
+	if err != nil {
+		t.Fatal("expected stale credentials when sts times out, was", err)
+	}
+	if creds.AccessKeyId != "A1" || counterValue(staleServed)-before != 1 {
+		t.Error("expected stale credentials to be served and recorded, was", creds.AccessKeyId)
+	}
+}
+
+func TestDoesntServeStaleCredentialsWhenCancelled(t *testing.T) {
+	gateway := &unavailableGateway{c: NewCredentials("A1", "S1", "T1", time.Now().Add(time.Hour))}
+	cache := DefaultCache(gateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	cache.SetServeStale(true)
+	identity := NewRoleIdentity("role")
+	cache.CredentialsForRole(context.Background(), identity)
+	cache.cache.Delete(identity.Key())
+	gateway.block = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := cache.CredentialsForRole(ctx, identity); err == nil {
+		t.Error("expected cancelled request to fail")
+	}
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	c.Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func cachedFor(cache *credentialsCache, identity *RoleIdentity) time.Duration {
+	_, expiry, _ := cache.cache.GetWithExpiration(identity.Key())
+	return time.Until(expiry)
+}
+
+// countingGateway counts requests, issuing credentials once released.
+type countingGateway struct {
+	mu      sync.Mutex
+	issued  int
+	release chan struct{}
+}
+
+func (g *countingGateway) Issue(ctx context.Context, request *AssumeRoleRequest) (*Credentials, error) {
+	g.mu.Lock()
+	g.issued++
+	g.mu.Unlock()
+	<-g.release
+	return &Credentials{Code: "shared", Expiration: time.Now().Add(15 * time.Minute).UTC().Format(timeLayout)}, nil
+}
+
+func TestConcurrentRequestsShareOneIssue(t *testing.T) {
+	gateway := &countingGateway{release: make(chan struct{})}
+	cache := DefaultCache(gateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+
+	const requests = 50
+	var wg sync.WaitGroup
+	results := make(chan *Credentials, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			creds, err := cache.CredentialsForRole(context.Background(), NewRoleIdentity("role"))
+			if err != nil {
+				t.Error("unexpected error", err)
+				return
+			}
+			results <- creds
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(gateway.release)
+	wg.Wait()
+	close(results)
+
+	for creds := range results {
+		if creds.Code != "shared" {
+			t.Error("expected shared credentials, was", creds.Code)
+		}
+	}
+	if gateway.issued != 1 {
+		t.Error("expected concurrent requests to share one issue, issued", gateway.issued)
+	}
+}
+
+func TestCachesShortLivedCredentialsForMinimumTTL(t *testing.T) {
+	expiry := time.Now().Add(6 * time.Minute).UTC().Format(timeLayout)
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo", Expiration: expiry}}
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 3*time.Minute, 0)
+	identity := NewRoleIdentity("role")
+
+	cache.CredentialsForRole(context.Background(), identity)
+
+	// refreshing 5m before expiry would cache for only 1m
+	if ttl := cachedFor(cache, identity); ttl < 2*time.Minute || ttl > 3*time.Minute {
+		t.Error("expected credentials to be cached for the minimum ttl, was", ttl)
+	}
+}
+
+func TestMinimumTTLDoesntExtendBeyondExpiry(t *testing.T) {
+	expiry := time.Now().Add(2 * time.Minute).UTC().Format(timeLayout)
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo", Expiration: expiry}}
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 10*time.Minute, 0)
+	identity := NewRoleIdentity("role")
+
+	cache.CredentialsForRole(context.Background(), identity)
+
+	if ttl := cachedFor(cache, identity); ttl > 2*time.Minute {
+		t.Error("expected credentials to be cached until they expire, was", ttl)
+	}
+}
+
+func TestDoesntServeExpiredCredentials(t *testing.T) {
+	expiry := time.Now().Add(-time.Minute).UTC().Format(timeLayout)
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo", Expiration: expiry}}
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	ctx := context.Background()
+
+	_, err := cache.CredentialsForRole(ctx, NewRoleIdentity("role"))
+	if err != ErrIssuedExpired {
+		t.Error("expected credentials issued expired to be rejected, was", err)
+	}
+	cache.CredentialsForRole(ctx, NewRoleIdentity("role"))
+
+	if stubGateway.issueCount != 2*maxIssueAttempts {
+		t.Error("expected expired credentials to be requested again, issued", stubGateway.issueCount)
+	}
+}
+
+type skewedGateway struct {
+	issued []*Credentials
+}
+
+func (s *skewedGateway) Issue(ctx context.Context, request *AssumeRoleRequest) (*Credentials, error) {
+	creds := s.issued[0]
+	s.issued = s.issued[1:]
+	return creds, nil
+}
+
+func TestRequestsAgainWhenCredentialsIssuedAboutToExpire(t *testing.T) {
+	aboutToExpire := time.Now().Add(10 * time.Second).UTC().Format(timeLayout)
+	valid := time.Now().Add(15 * time.Minute).UTC().Format(timeLayout)
+	gateway := &skewedGateway{issued: []*Credentials{
+		{Code: "skewed", Expiration: aboutToExpire},
+		{Code: "valid", Expiration: valid},
+	}}
+	cache := DefaultCache(gateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+
+	creds, err := cache.CredentialsForRole(context.Background(), NewRoleIdentity("role"))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if creds.Code != "valid" {
+		t.Error("expected credentials to be requested again, was", creds.Code)
+	}
+}
+
+func TestRefreshesCredentialsAtConfiguredLeadTime(t *testing.T) {
+	expiry := time.Now().Add(15 * time.Minute).UTC().Format(timeLayout)
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo", Expiration: expiry}}
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 2*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	identity := NewRoleIdentity("role")
+
+	cache.CredentialsForRole(context.Background(), identity)
+
+	if ttl := cachedFor(cache, identity); ttl < 12*time.Minute || ttl > 13*time.Minute {
+		t.Error("expected credentials to be refreshed 2m before expiry, cached for", ttl)
+	}
+}
+
+func TestRefreshesRoleAtItsOwnLeadTime(t *testing.T) {
+	expiry := time.Now().Add(15 * time.Minute).UTC().Format(timeLayout)
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo", Expiration: expiry}}
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 2*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	cache.SetRoleRefresh("hot", 10*time.Minute)
+	hot := NewRoleIdentity("hot")
+	cold := NewRoleIdentity("cold")
+
+	cache.CredentialsForRole(context.Background(), hot)
+	cache.CredentialsForRole(context.Background(), cold)
+
+	if ttl := cachedFor(cache, hot); ttl < 4*time.Minute || ttl > 5*time.Minute {
+		t.Error("expected hot role to be refreshed 10m before expiry, cached for", ttl)
+	}
+	if ttl := cachedFor(cache, cold); ttl < 12*time.Minute || ttl > 13*time.Minute {
+		t.Error("expected other roles to be refreshed 2m before expiry, cached for", ttl)
+	}
+}
+
+func TestJittersRefreshLeadTime(t *testing.T) {
+	expiry := time.Now().Add(15 * time.Minute).UTC().Format(timeLayout)
+	stubGateway := &stubGateway{c: &Credentials{Code: "foo", Expiration: expiry}}
+	cache := DefaultCache(stubGateway, "session", 15*time.Minute, 2*time.Minute, DefaultResolver("prefix:"), 0, 0, time.Minute)
+
+	ttls := make(map[time.Duration]bool)
+	for i := 0; i < 10; i++ {
+		identity := NewRoleIdentity(fmt.Sprintf("role-%d", i))
+		cache.CredentialsForRole(context.Background(), identity)
+
+		ttl := cachedFor(cache, identity)
+		if ttl < 11*time.Minute || ttl > 13*time.Minute {
+			t.Error("expected credentials to be refreshed 2-3m before expiry, cached for", ttl)
+		}
+		ttls[ttl.Round(time.Second)] = true
+	}
+
+	if len(ttls) < 2 {
+		t.Error("expected refreshes to be spread by jitter")
+	}
+}
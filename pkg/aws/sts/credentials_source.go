@@ -0,0 +1,88 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sts
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// webIdentitySessionName names the session of the server's own web
+// identity role.
+const webIdentitySessionName = "kiam-server"
+
+// CredentialsSource selects the credentials the gateway calls STS with, at
+// most one kind can be set. The SDK's default credential chain, such as
+// the instance profile, is used when it's empty.
+type CredentialsSource struct {
+	// Profile is a profile in the shared credentials file at File, or the
+	// SDK's default location when File is empty.
+	Profile string
+	File    string
+	// AccessKeyID and SecretAccessKey are static credentials, intended
+	// for local development.
+	AccessKeyID     string
+	SecretAccessKey string
+	// WebIdentityRoleARN is assumed with the OIDC token read from
+	// WebIdentityTokenFile.
+	WebIdentityRoleARN   string
+	WebIdentityTokenFile string
+}
+
+// Validate returns an error unless a single, complete kind of credentials
+// is configured, or none are.
+func (s CredentialsSource) Validate(partition *Partition) error {
+	kinds := 0
+	if s.Profile != "" || s.File != "" {
+		kinds++
+	}
+	if s.AccessKeyID != "" || s.SecretAccessKey != "" {
+		kinds++
+		if s.AccessKeyID == "" || s.SecretAccessKey == "" {
+			return fmt.Errorf("static sts credentials require both an access key id and secret access key")
+		}
+	}
+	if s.WebIdentityRoleARN != "" || s.WebIdentityTokenFile != "" {
+		kinds++
+		if s.WebIdentityRoleARN == "" || s.WebIdentityTokenFile == "" {
+			return fmt.Errorf("web identity sts credentials require both a role arn and token file")
+		}
+		if err := partition.ValidateARN(s.WebIdentityRoleARN); err != nil {
+			return err
+		}
+	}
+	if kinds > 1 {
+		return fmt.Errorf("only one of a profile, static keys or web identity can be used for sts credentials")
+	}
+	return nil
+}
+
+// credentials returns the configured credentials, using config for
+// calls to STS, or nil when the default chain should be used.
+func (s CredentialsSource) credentials(config *aws.Config) *credentials.Credentials {
+	switch {
+	case s.Profile != "" || s.File != "":
+		return credentials.NewSharedCredentials(s.File, s.Profile)
+	case s.AccessKeyID != "":
+		return credentials.NewStaticCredentials(s.AccessKeyID, s.SecretAccessKey, "")
+	case s.WebIdentityRoleARN != "":
+		sess := session.Must(session.NewSession(config))
+		return stscreds.NewWebIdentityCredentials(sess, s.WebIdentityRoleARN, webIdentitySessionName, s.WebIdentityTokenFile)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sts
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestValidatesCredentialsSource(t *testing.T) {
+	valid := []CredentialsSource{
+		{},
+		{Profile: "dev"},
+		{Profile: "dev", File: "/home/kiam/.aws/credentials"},
+		{AccessKeyID: "AKID", SecretAccessKey: "secret"},
+		{WebIdentityRoleARN: "arn:aws:iam::123456789012:role/kiam", WebIdentityTokenFile: "/var/run/secrets/token"},
+	}
+	for _, source := range valid {
+		if err := source.Validate(mustPartition()); err != nil {
+			t.Errorf("expected %+v to be valid: %s", source, err)
+		}
+	}
+
+	invalid := []CredentialsSource{
+		{AccessKeyID: "AKID"},
+		{SecretAccessKey: "secret"},
+		{WebIdentityRoleARN: "arn:aws:iam::123456789012:role/kiam"},
+		{WebIdentityTokenFile: "/var/run/secrets/token"},
+		{WebIdentityRoleARN: "arn:aws-cn:iam::123456789012:role/kiam", WebIdentityTokenFile: "/var/run/secrets/token"},
+		{Profile: "dev", AccessKeyID: "AKID", SecretAccessKey: "secret"},
+	}
+	for _, source := range invalid {
+		if err := source.Validate(mustPartition()); err == nil {
+			t.Errorf("expected error for %+v", source)
+		}
+	}
+}
+
+func TestGatewayUsesStaticCredentials(t *testing.T) {
+	gateway, err := DefaultGateway(&GatewayConfig{Credentials: CredentialsSource{AccessKeyID: "AKID", SecretAccessKey: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := gateway.session.Config.Credentials.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "AKID" || value.SecretAccessKey != "secret" {
+		t.Error("expected static credentials, was", value.AccessKeyID)
+	}
+
+	if _, err := DefaultGateway(&GatewayConfig{Credentials: CredentialsSource{AccessKeyID: "AKID"}}); err == nil {
+		t.Error("expected error for incomplete static credentials")
+	}
+}
+
+func TestGatewayUsesProfileCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kiam-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "credentials")
+	contents := "[default]\naws_access_key_id = default\naws_secret_access_key = secret\n\n[dev]\naws_access_key_id = dev\naws_secret_access_key = secret\n"
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	gateway, err := DefaultGateway(&GatewayConfig{Credentials: CredentialsSource{Profile: "dev", File: file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := gateway.session.Config.Credentials.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "dev" {
+		t.Error("expected credentials of the profile, was", value.AccessKeyID)
+	}
+}
+
+// webIdentitySTS answers AssumeRoleWithWebIdentity, recording the token.
+type webIdentitySTS struct {
+	token string
+}
+
+func (s *webIdentitySTS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	s.token = req.Form.Get("WebIdentityToken")
+	fmt.Fprint(w, `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>web</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>token</SessionToken><Expiration>2099-01-01T00:00:00Z</Expiration>
+</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`)
+}
+
+func TestWebIdentityCredentials(t *testing.T) {
+	stub := &webIdentitySTS{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kiam-web-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("oidc-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	source := CredentialsSource{WebIdentityRoleARN: "arn:aws:iam::123456789012:role/kiam", WebIdentityTokenFile: tokenFile}
+	creds := source.credentials(aws.NewConfig().WithEndpoint(server.URL).WithRegion("us-east-1").WithMaxRetries(0))
+
+	value, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "web" {
+		t.Error("expected web identity role credentials, was", value.AccessKeyID)
+	}
+	if stub.token != "oidc-token" {
+		t.Error("expected token from file to be sent, was", stub.token)
+	}
+}
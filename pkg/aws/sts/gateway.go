@@ -16,21 +16,42 @@ package sts
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
+	awsrequest "github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/uswitch/kiam/pkg/statsd"
+	"github.com/uswitch/kiam/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type STSGateway interface {
-	Issue(ctx context.Context, role, session string, expiry time.Duration) (*Credentials, error)
+	Issue(ctx context.Context, request *AssumeRoleRequest) (*Credentials, error)
+}
+
+// AssumeRoleRequest holds the parameters used when calling AssumeRole
+type AssumeRoleRequest struct {
+	RoleARN         string
+	SessionName     string
+	SessionDuration time.Duration
+	// Policy is an optional inline session policy
+	Policy string
+	// PolicyARNs are optional managed session policies
+	PolicyARNs []string
+	// SourceIdentity is optionally set on the session, the role's trust
+	// policy must permit sts:SetSourceIdentity
+	SourceIdentity string
 }
 
 type regionalResolver struct {
@@ -80,49 +101,289 @@ func newRegionalResolver(region string) (endpoints.Resolver, error) {
 }
 
 type DefaultSTSGateway struct {
-	session  *session.Session
-	resolver endpoints.Resolver
+	session   *session.Session
+	resolver  endpoints.Resolver
+	partition *Partition
+	breaker   *circuitBreaker
+	region    string
+	// failover is used when STS in the primary region is failing, it's nil
+	// when no failover region is configured
+	failover       *session.Session
+	failoverRegion string
+}
+
+// globalRegion labels roles assumed with the global STS endpoint
+const globalRegion = "global"
+
+// GatewayConfig controls how the gateway communicates with STS
+type GatewayConfig struct {
+	// AssumeRoleArn is an optional role assumed before issuing credentials
+	AssumeRoleArn string
+	// AssumeRoleChain are optional roles assumed in order after
+	// AssumeRoleArn, each with the credentials of the previous role, for
+	// when the server's identity can't assume pods' roles directly
+	AssumeRoleChain []string
+	// Region is used for regional STS calls, defaults to the global endpoint
+	Region string
+	// CABundle is an optional path to PEM encoded certificates that are
+	// trusted in addition to the system roots
+	CABundle string
+	// CABundleReplacesSystemRoots trusts only the CABundle certificates
+	CABundleReplacesSystemRoots bool
+	// HTTPProxy is an optional proxy URL used for requests to STS
+	HTTPProxy string
+	// Partition is the AWS partition roles are assumed in. When it's empty
+	// it's inferred from Region or RoleBaseARN, defaulting to aws
+	Partition   string
+	RoleBaseARN string
+	// BreakerFailures is the number of consecutive failures after which
+	// calls to STS are short-circuited for BreakerCoolDown, 0 disables
+	// the circuit breaker
+	BreakerFailures int
+	BreakerCoolDown time.Duration
+	// HTTPTimeout limits each HTTP request to STS, 0 disables the timeout
+	HTTPTimeout time.Duration
+	// MaxRetries limits the SDK's retries of failed STS calls,
+	// aws.UseServiceDefaultRetries (-1) keeps the SDK default
+	MaxRetries int
+	// FailoverRegion is an optional region whose STS endpoint is used when
+	// calls to the primary region fail because STS is unavailable
+	FailoverRegion string
+	// Credentials are the gateway's own credentials, the SDK's default
+	// chain is used when it's empty
+	Credentials CredentialsSource
+	// MaxIdleConns, MaxIdleConnsPerHost and IdleConnTimeout size the pool
+	// of connections kept open to STS, 0 keeps the net/http default
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
 }
 
-func DefaultGateway(assumeRoleArn, region string) (*DefaultSTSGateway, error) {
-	config := aws.NewConfig().WithCredentialsChainVerboseErrors(true)
-	if assumeRoleArn != "" {
-		config.WithCredentials(stscreds.NewCredentials(session.Must(session.NewSession()), assumeRoleArn))
+func DefaultGateway(gatewayConfig *GatewayConfig) (*DefaultSTSGateway, error) {
+	if gatewayConfig.HTTPTimeout < 0 {
+		return nil, fmt.Errorf("sts http timeout must not be negative, was %s", gatewayConfig.HTTPTimeout)
+	}
+	if gatewayConfig.MaxIdleConns < 0 || gatewayConfig.MaxIdleConnsPerHost < 0 || gatewayConfig.IdleConnTimeout < 0 {
+		return nil, fmt.Errorf("sts connection pool settings must not be negative")
+	}
+	if gatewayConfig.MaxRetries < aws.UseServiceDefaultRetries {
+		return nil, fmt.Errorf("sts max retries must not be negative, was %d", gatewayConfig.MaxRetries)
+	}
+
+	config := aws.NewConfig().WithCredentialsChainVerboseErrors(true).WithMaxRetries(gatewayConfig.MaxRetries)
+
+	partition, err := ResolvePartition(gatewayConfig.Partition, gatewayConfig.Region, gatewayConfig.RoleBaseARN)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := newHTTPClient(gatewayConfig)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		config.WithHTTPClient(httpClient)
+	}
+
+	if err := gatewayConfig.Credentials.Validate(partition); err != nil {
+		return nil, err
+	}
+	source := gatewayConfig.Credentials.credentials(aws.NewConfig().WithHTTPClient(httpClient).WithMaxRetries(gatewayConfig.MaxRetries))
+	if source != nil {
+		config.WithCredentials(source)
 	}
 
-	if region != "" {
-		resolver, err := newRegionalResolver(region)
+	var chain []string
+	if gatewayConfig.AssumeRoleArn != "" {
+		chain = append(chain, gatewayConfig.AssumeRoleArn)
+	}
+	chain = append(chain, gatewayConfig.AssumeRoleChain...)
+	for _, arn := range chain {
+		if err := partition.ValidateARN(arn); err != nil {
+			return nil, err
+		}
+	}
+	if len(chain) > 0 {
+		config.WithCredentials(chainCredentials(aws.NewConfig().WithHTTPClient(httpClient).WithMaxRetries(gatewayConfig.MaxRetries).WithCredentials(source), chain))
+	}
+
+	region := gatewayConfig.Region
+	if region == "" {
+		region = partition.DefaultRegion()
+	}
+
+	if gatewayConfig.FailoverRegion != "" && gatewayConfig.FailoverRegion == region {
+		return nil, fmt.Errorf("sts failover region must differ from the region, was %s", region)
+	}
+
+	primary, err := regionalConfig(config, partition, region)
+	if err != nil {
+		return nil, err
+	}
+
+	gateway := &DefaultSTSGateway{
+		session:   newSession(primary),
+		partition: partition,
+		breaker:   newCircuitBreaker(gatewayConfig.BreakerFailures, gatewayConfig.BreakerCoolDown),
+		region:    region,
+	}
+	if region == "" {
+		gateway.region = globalRegion
+	}
+
+	if failoverRegion := gatewayConfig.FailoverRegion; failoverRegion != "" {
+		failover, err := regionalConfig(config, partition, failoverRegion)
 		if err != nil {
 			return nil, err
 		}
+		gateway.failover = newSession(failover)
+		gateway.failoverRegion = failoverRegion
+	}
+
+	return gateway, nil
+}
 
-		config.WithRegion(region).WithEndpointResolver(resolver)
+// newSession creates a session with config that observes the latency of
+// each HTTP request it makes to STS, including retries.
+func newSession(config *aws.Config) *session.Session {
+	sess := session.Must(session.NewSession(config))
+	sess.Handlers.Send.PushBack(func(r *awsrequest.Request) {
+		stsRequest.WithLabelValues(r.Operation.Name).Observe(time.Since(r.AttemptTime).Seconds())
+	})
+	return sess
+}
+
+// regionalConfig returns a copy of config that calls STS in region, or the
+// global endpoint when region is empty.
+func regionalConfig(config *aws.Config, partition *Partition, region string) (*aws.Config, error) {
+	config = config.Copy()
+	if region == "" {
+		return config, nil
+	}
+
+	if err := partition.ValidateRegion(region); err != nil {
+		return nil, err
 	}
 
-	session := session.Must(session.NewSession(config))
-	return &DefaultSTSGateway{session: session}, nil
+	resolver, err := newRegionalResolver(region)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.WithRegion(region).WithEndpointResolver(resolver), nil
 }
 
-func (g *DefaultSTSGateway) Issue(ctx context.Context, roleARN, sessionName string, expiry time.Duration) (*Credentials, error) {
+// chainExpiryWindow is how long before they expire the credentials of
+// intermediate roles are refreshed.
+const chainExpiryWindow = 1 * time.Minute
+
+// chainCredentials returns the credentials of the last role in roleARNs,
+// each role is assumed with the credentials of the previous role, the first
+// with config's credentials. Credentials of each role are cached until
+// shortly before they expire.
+func chainCredentials(config *aws.Config, roleARNs []string) *credentials.Credentials {
+	creds := config.Credentials
+	for _, arn := range roleARNs {
+		sess := newSession(config.Copy().WithCredentials(creds))
+		creds = stscreds.NewCredentials(sess, arn, func(p *stscreds.AssumeRoleProvider) {
+			p.ExpiryWindow = chainExpiryWindow
+		})
+	}
+	return creds
+}
+
+func (g *DefaultSTSGateway) Issue(ctx context.Context, request *AssumeRoleRequest) (_ *Credentials, err error) {
 	timer := prometheus.NewTimer(assumeRole)
 	defer timer.ObserveDuration()
 	if statsd.Enabled {
 		defer statsd.Client.NewTiming().Send("aws.assume_role")
 	}
+	ctx, span := tracing.Tracer().Start(ctx, "sts.AssumeRole",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("aws.iam.role_arn", request.RoleARN)),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	if err := g.partition.ValidateARN(request.RoleARN); err != nil {
+		return nil, err
+	}
+
+	if !g.breaker.allow() {
+		return nil, ErrUpstreamUnavailable
+	}
 
 	assumeRoleExecuting.Inc()
 	defer assumeRoleExecuting.Dec()
 
-	svc := sts.New(g.session)
-	in := &sts.AssumeRoleInput{
-		DurationSeconds: aws.Int64(int64(expiry.Seconds())),
-		RoleArn:         aws.String(roleARN),
-		RoleSessionName: aws.String(sessionName),
+	region := g.region
+	resp, err := assumeRoleIn(ctx, g.session, request)
+	if err != nil && g.failover != nil && isUpstreamFailure(err) && ctx.Err() == nil {
+		log.WithField("sts.region", g.failoverRegion).Warnf("error assuming role in %s, failing over: %s", g.region, err.Error())
+		region = g.failoverRegion
+		resp, err = assumeRoleIn(ctx, g.failover, request)
 	}
-	resp, err := svc.AssumeRoleWithContext(ctx, in)
+	g.breaker.record(err)
 	if err != nil {
 		return nil, err
 	}
+	assumeRoleRegion.WithLabelValues(region).Inc()
 
 	return NewCredentials(*resp.Credentials.AccessKeyId, *resp.Credentials.SecretAccessKey, *resp.Credentials.SessionToken, *resp.Credentials.Expiration), nil
 }
+
+func assumeRoleIn(ctx context.Context, session *session.Session, request *AssumeRoleRequest) (*sts.AssumeRoleOutput, error) {
+	svc := sts.New(session)
+	in := &sts.AssumeRoleInput{
+		DurationSeconds: aws.Int64(int64(request.SessionDuration.Seconds())),
+		RoleArn:         aws.String(request.RoleARN),
+		RoleSessionName: aws.String(request.SessionName),
+	}
+	if request.Policy != "" {
+		in.Policy = aws.String(request.Policy)
+	}
+	for _, arn := range request.PolicyARNs {
+		in.PolicyArns = append(in.PolicyArns, &sts.PolicyDescriptorType{Arn: aws.String(arn)})
+	}
+	req, resp := svc.AssumeRoleRequest(in)
+	req.SetContext(ctx)
+	if request.SourceIdentity != "" {
+		req.Handlers.Build.PushBack(setSourceIdentity(request.SourceIdentity))
+	}
+	return resp, req.Send()
+}
+
+// CheckReachable calls GetCallerIdentity, which requires no permissions, to
+// check STS can be reached with the gateway's credentials.
+func (g *DefaultSTSGateway) CheckReachable(ctx context.Context) error {
+	if g.breaker.isOpen() {
+		return ErrUpstreamUnavailable
+	}
+
+	svc := sts.New(g.session)
+	_, err := svc.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	return err
+}
+
+// setSourceIdentity adds the SourceIdentity parameter to the AssumeRole
+// request body. The SDK version used predates the parameter so it's added
+// once the request has been built, before it's signed.
+func setSourceIdentity(sourceIdentity string) func(*awsrequest.Request) {
+	return func(r *awsrequest.Request) {
+		if r.Error != nil {
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			r.Error = err
+			return
+		}
+		params, err := url.ParseQuery(string(body))
+		if err != nil {
+			r.Error = err
+			return
+		}
+		params.Set("SourceIdentity", sourceIdentity)
+		r.SetBufferBody([]byte(params.Encode()))
+	}
+}
@@ -14,13 +14,27 @@
 package sts
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestRegionalGateway(t *testing.T) {
-	gateway, err := DefaultGateway("", "us-west-2")
+	gateway, err := DefaultGateway(&GatewayConfig{Region: "us-west-2"})
 	if err != nil {
 		t.Error(err)
 	}
@@ -37,7 +51,7 @@ func TestRegionalGateway(t *testing.T) {
 }
 
 func TestRegionalGatewayCn(t *testing.T) {
-	gateway, err := DefaultGateway("", "cn-north-1")
+	gateway, err := DefaultGateway(&GatewayConfig{Region: "cn-north-1"})
 	if err != nil {
 		t.Error(err)
 	}
@@ -54,7 +68,7 @@ func TestRegionalGatewayCn(t *testing.T) {
 }
 
 func TestRegionalGatewayFips(t *testing.T) {
-	gateway, err := DefaultGateway("", "us-east-1-fips")
+	gateway, err := DefaultGateway(&GatewayConfig{Region: "us-east-1-fips"})
 	if err != nil {
 		t.Error(err)
 	}
@@ -71,7 +85,7 @@ func TestRegionalGatewayFips(t *testing.T) {
 }
 
 func TestDefaultGlobalGateway(t *testing.T) {
-	gateway, err := DefaultGateway("", "")
+	gateway, err := DefaultGateway(&GatewayConfig{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -86,3 +100,261 @@ func TestDefaultGlobalGateway(t *testing.T) {
 		t.Error("Unexpected regional endpoint. Endpoint was: ", config.Endpoint)
 	}
 }
+
+func TestGatewayLimitsRetries(t *testing.T) {
+	gateway, err := DefaultGateway(&GatewayConfig{MaxRetries: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retries := aws.IntValue(gateway.session.Config.MaxRetries); retries != 0 {
+		t.Error("expected retries to be disabled, was", retries)
+	}
+
+	if _, err := DefaultGateway(&GatewayConfig{MaxRetries: -2}); err == nil {
+		t.Error("expected error for negative retries")
+	}
+	if _, err := DefaultGateway(&GatewayConfig{HTTPTimeout: -time.Second}); err == nil {
+		t.Error("expected error for negative timeout")
+	}
+}
+
+func TestSetsSourceIdentity(t *testing.T) {
+	sess := session.Must(session.NewSession(aws.NewConfig().WithRegion("us-east-1").WithCredentials(credentials.AnonymousCredentials)))
+	req, _ := sts.New(sess).AssumeRoleRequest(&sts.AssumeRoleInput{
+		RoleArn:         aws.String("arn:aws:iam::123456789012:role/role"),
+		RoleSessionName: aws.String("kiam-session"),
+	})
+	req.Handlers.Build.PushBack(setSourceIdentity("ns.app"))
+
+	if err := req.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	params, err := url.ParseQuery(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Get("SourceIdentity") != "ns.app" {
+		t.Error("expected source identity parameter, was", params.Get("SourceIdentity"))
+	}
+	if params.Get("RoleArn") != "arn:aws:iam::123456789012:role/role" {
+		t.Error("expected request parameters to be retained, was", params)
+	}
+}
+
+var credentialPattern = regexp.MustCompile(`Credential=([^/]+)/`)
+
+// chainSTS responds to AssumeRole with credentials whose access key is
+// the role name, recording the access key each role was assumed with.
+type chainSTS struct {
+	mu        sync.Mutex
+	assumedBy map[string]string
+	calls     int
+}
+
+func (s *chainSTS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	arn := req.Form.Get("RoleArn")
+	role := arn[len("arn:aws:iam::123456789012:role/"):]
+
+	s.mu.Lock()
+	s.assumedBy[role] = credentialPattern.FindStringSubmatch(req.Header.Get("Authorization"))[1]
+	s.calls++
+	s.mu.Unlock()
+
+	fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>%s</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>%s/session</Arn>
+      <AssumedRoleId>ID:session</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`, role, arn)
+}
+
+func TestChainsRoleCredentials(t *testing.T) {
+	stub := &chainSTS{assumedBy: map[string]string{}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	config := aws.NewConfig().
+		WithEndpoint(server.URL).
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("base", "secret", ""))
+	creds := chainCredentials(config, []string{
+		"arn:aws:iam::123456789012:role/hop1",
+		"arn:aws:iam::123456789012:role/hop2",
+	})
+
+	for i := 0; i < 2; i++ {
+		value, err := creds.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value.AccessKeyID != "hop2" {
+			t.Error("expected credentials of the last role, was", value.AccessKeyID)
+		}
+	}
+
+	if stub.assumedBy["hop1"] != "base" {
+		t.Error("expected first role to be assumed with base credentials, was", stub.assumedBy["hop1"])
+	}
+	if stub.assumedBy["hop2"] != "hop1" {
+		t.Error("expected second role to be assumed with the first role's credentials, was", stub.assumedBy["hop2"])
+	}
+	if stub.calls != 2 {
+		t.Error("expected each role's credentials to be cached, assume role called", stub.calls)
+	}
+}
+
+// failingSTS responds to every request with status, counting the calls.
+type failingSTS struct {
+	status int
+	calls  int
+}
+
+func (s *failingSTS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.calls++
+	w.WriteHeader(s.status)
+	fmt.Fprint(w, `<ErrorResponse><Error><Code>Failure</Code><Message>failed</Message></Error></ErrorResponse>`)
+}
+
+func stubSession(url string) *session.Session {
+	return session.Must(session.NewSession(aws.NewConfig().
+		WithEndpoint(url).
+		WithRegion("us-east-1").
+		WithMaxRetries(0).
+		WithCredentials(credentials.NewStaticCredentials("base", "secret", ""))))
+}
+
+func failoverGateway(primary, failover string) *DefaultSTSGateway {
+	return &DefaultSTSGateway{
+		session:        stubSession(primary),
+		region:         "eu-west-1",
+		failover:       stubSession(failover),
+		failoverRegion: "eu-central-1",
+		partition:      mustPartition(),
+	}
+}
+
+func mustPartition() *Partition {
+	partition, err := NewPartition("")
+	if err != nil {
+		panic(err)
+	}
+	return partition
+}
+
+func regionCount(region string) float64 {
+	m := &dto.Metric{}
+	assumeRoleRegion.WithLabelValues(region).Write(m)
+	return m.GetCounter().GetValue()
+}
+
+var failoverRequest = &AssumeRoleRequest{
+	RoleARN:         "arn:aws:iam::123456789012:role/role",
+	SessionName:     "kiam-session",
+	SessionDuration: 15 * time.Minute,
+}
+
+func TestFailsOverWhenPrimaryRegionUnavailable(t *testing.T) {
+	primary := httptest.NewServer(&failingSTS{status: http.StatusServiceUnavailable})
+	defer primary.Close()
+	failover := httptest.NewServer(&chainSTS{assumedBy: map[string]string{}})
+	defer failover.Close()
+
+	before := regionCount("eu-central-1")
+	creds, err := failoverGateway(primary.URL, failover.URL).Issue(context.Background(), failoverRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyId != "role" {
+		t.Error("expected credentials from failover region, was", creds.AccessKeyId)
+	}
+	if served := regionCount("eu-central-1") - before; served != 1 {
+		t.Error("expected failover region to be recorded, was", served)
+	}
+}
+
+func TestFailsWhenBothRegionsUnavailable(t *testing.T) {
+	primaryStub := &failingSTS{status: http.StatusServiceUnavailable}
+	primary := httptest.NewServer(primaryStub)
+	defer primary.Close()
+	failoverStub := &failingSTS{status: http.StatusInternalServerError}
+	failover := httptest.NewServer(failoverStub)
+	defer failover.Close()
+
+	_, err := failoverGateway(primary.URL, failover.URL).Issue(context.Background(), failoverRequest)
+	if err == nil {
+		t.Fatal("expected error when both regions fail")
+	}
+	if primaryStub.calls != 1 || failoverStub.calls != 1 {
+		t.Error("expected one call to each region, was", primaryStub.calls, failoverStub.calls)
+	}
+}
+
+func TestDoesntFailOverWhenAccessDenied(t *testing.T) {
+	primary := httptest.NewServer(&failingSTS{status: http.StatusForbidden})
+	defer primary.Close()
+	failoverStub := &chainSTS{assumedBy: map[string]string{}}
+	failover := httptest.NewServer(failoverStub)
+	defer failover.Close()
+
+	if _, err := failoverGateway(primary.URL, failover.URL).Issue(context.Background(), failoverRequest); err == nil {
+		t.Fatal("expected access denied error")
+	}
+	if failoverStub.calls != 0 {
+		t.Error("expected failover region not to be called, was", failoverStub.calls)
+	}
+}
+
+func TestRejectsFailoverToSameRegion(t *testing.T) {
+	if _, err := DefaultGateway(&GatewayConfig{Region: "us-east-1", FailoverRegion: "us-east-1"}); err == nil {
+		t.Error("expected error for failover to the same region")
+	}
+}
+
+func TestGatewayAppliesConnectionPool(t *testing.T) {
+	gateway, err := DefaultGateway(&GatewayConfig{MaxIdleConns: 50, MaxIdleConnsPerHost: 20, IdleConnTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := gateway.session.Config.HTTPClient.Transport.(*http.Transport)
+	if transport.MaxIdleConns != 50 || transport.MaxIdleConnsPerHost != 20 || transport.IdleConnTimeout != time.Minute {
+		t.Error("expected connection pool to be configured, was", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+
+	if _, err := DefaultGateway(&GatewayConfig{MaxIdleConnsPerHost: -1}); err == nil {
+		t.Error("expected error for negative idle connections")
+	}
+}
+
+func TestObservesSTSRequestLatency(t *testing.T) {
+	stub := httptest.NewServer(&chainSTS{assumedBy: map[string]string{}})
+	defer stub.Close()
+
+	requests := func() uint64 {
+		m := &dto.Metric{}
+		stsRequest.WithLabelValues("AssumeRole").(prometheus.Metric).Write(m)
+		return m.GetHistogram().GetSampleCount()
+	}
+	before := requests()
+
+	gateway := &DefaultSTSGateway{
+		session:   newSession(stubSession(stub.URL).Config),
+		partition: mustPartition(),
+	}
+	if _, err := gateway.Issue(context.Background(), failoverRequest); err != nil {
+		t.Fatal(err)
+	}
+	if observed := requests() - before; observed != 1 {
+		t.Error("expected one request to be observed, was", observed)
+	}
+}
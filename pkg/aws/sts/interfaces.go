@@ -17,16 +17,50 @@ import (
 	"context"
 )
 
+// CredentialsProvider issues credentials for the role and session policy of
+// an identity. The server requests credentials each time a pod asks for
+// them, so implementations should cache credentials until they're close to
+// expiry. Errors are returned to the agent, ErrUpstreamUnavailable when the
+// provider can't currently be reached.
+//
+// Providers may also implement CredentialsCache to have credentials
+// prefetched for running pods, CredentialsWatcher to notify agents of
+// refreshed credentials, and CredentialsInspector to list cached roles.
 type CredentialsProvider interface {
-	CredentialsForRole(ctx context.Context, role string) (*Credentials, error)
+	// CredentialsForRole returns credentials for identity, it's called
+	// concurrently and should respect cancellation of ctx.
+	CredentialsForRole(ctx context.Context, identity *RoleIdentity) (*Credentials, error)
 }
 
 type CredentialsCache interface {
-	CredentialsForRole(ctx context.Context, role string) (*Credentials, error)
+	CredentialsForRole(ctx context.Context, identity *RoleIdentity) (*Credentials, error)
 	Expiring() chan *RoleCredentials
 }
 
+// CredentialsWatcher notifies when new credentials are issued for an identity
+type CredentialsWatcher interface {
+	Watch(ctx context.Context, identity *RoleIdentity) <-chan *Credentials
+}
+
+// ReachabilityChecker checks whether STS can be reached, without issuing
+// credentials
+type ReachabilityChecker interface {
+	CheckReachable(ctx context.Context) error
+}
+
 // ARNResolver encapsulates resolution of roles into ARNs.
 type ARNResolver interface {
 	Resolve(role string) string
 }
+
+// CredentialsInspector lists the credentials held by a cache, for diagnostics
+type CredentialsInspector interface {
+	CachedRoles() []*CachedRole
+}
+
+// CredentialsPersister snapshots cached credentials so they can be restored
+// after a restart.
+type CredentialsPersister interface {
+	Snapshot() []*PersistedCredentials
+	Restore(persisted []*PersistedCredentials) int
+}
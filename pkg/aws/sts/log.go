@@ -14,11 +14,14 @@
 package sts
 
 import (
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
+	"github.com/uswitch/kiam/pkg/logging"
 )
 
-func CredentialsFields(creds *Credentials, role string) log.Fields {
-	return log.Fields{
+var log = logging.Component("sts")
+
+func CredentialsFields(creds *Credentials, role string) logrus.Fields {
+	return logrus.Fields{
 		"credentials.access.key": creds.AccessKeyId,
 		"credentials.expiration": creds.Expiration,
 		"credentials.role":       role,
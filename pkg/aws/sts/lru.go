@@ -0,0 +1,84 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sts
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruIndex tracks the order in which cache keys were last used so that the
+// least recently used entries can be evicted when the cache is bounded.
+type lruIndex struct {
+	mu       sync.Mutex
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newLRUIndex() *lruIndex {
+	return &lruIndex{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// touch marks key as the most recently used
+func (l *lruIndex) touch(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.elements[key]; ok {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.elements[key] = l.order.PushFront(key)
+}
+
+// remove drops key from the index, returning false if it wasn't present
+func (l *lruIndex) remove(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.elements[key]
+	if !ok {
+		return false
+	}
+	l.order.Remove(e)
+	delete(l.elements, key)
+	return true
+}
+
+func (l *lruIndex) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+// removeOldest drops the least recently used key that evictable accepts.
+// It returns false if no key could be evicted.
+func (l *lruIndex) removeOldest(evictable func(key string) bool) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for e := l.order.Back(); e != nil; e = e.Prev() {
+		key := e.Value.(string)
+		if !evictable(key) {
+			continue
+		}
+		l.order.Remove(e)
+		delete(l.elements, key)
+		return key, true
+	}
+	return "", false
+}
@@ -1,11 +1,31 @@
 package sts
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	telemetry "github.com/uswitch/kiam/pkg/prometheus"
+)
 
 var (
+	cacheHit            prometheus.Counter
+	cacheMiss           prometheus.Counter
+	cacheSize           prometheus.Gauge
+	deprecatedCacheSize prometheus.Gauge
+	staleServed         prometheus.Counter
+	cacheEvictions      prometheus.Counter
+	errorIssuing        prometheus.Counter
+	issuedExpired       prometheus.Counter
+	assumeRole          prometheus.Histogram
+	assumeRoleRegion    *prometheus.CounterVec
+	stsRequest          *prometheus.HistogramVec
+	breakerStateGauge   prometheus.Gauge
+	breakerRejected     prometheus.Counter
+	assumeRoleExecuting prometheus.Gauge
+)
+
+func newMetrics(namespace string) []prometheus.Collector {
 	cacheHit = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "sts",
 			Name:      "cache_hit_total",
 			Help:      "Number of cache hits to the metadata cache",
@@ -14,25 +34,72 @@ var (
 
 	cacheMiss = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "sts",
 			Name:      "cache_miss_total",
 			Help:      "Number of cache misses to the metadata cache",
 		},
 	)
 
+	cacheSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "sts",
+			Name:      "cache_size",
+			Help:      "Current number of entries in the metadata cache",
+		},
+	)
+
+	// deprecatedCacheSize is the cache size under the name reported before
+	// kiam_sts_cache_size, kept so existing dashboards continue to work.
+	deprecatedCacheSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "sts",
+			Name:      "cacheSize",
+			Help:      "Current size of the metadata cache. Deprecated, use kiam_sts_cache_size",
+		},
+	)
+
+	staleServed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sts",
+			Name:      "stale_credentials_served_total",
+			Help:      "Number of previously issued credentials served because refreshing them failed while STS was unavailable",
+		},
+	)
+
+	cacheEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sts",
+			Name:      "cache_evictions_total",
+			Help:      "Number of least recently used entries evicted from the metadata cache",
+		},
+	)
+
 	errorIssuing = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "sts",
 			Name:      "issuing_errors_total",
 			Help:      "Number of errors issuing credentials",
 		},
 	)
 
+	issuedExpired = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sts",
+			Name:      "issued_expired_total",
+			Help:      "Number of credentials rejected because they were issued expired or about to expire, usually due to clock skew",
+		},
+	)
+
 	assumeRole = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "sts",
 			Name:      "assumerole_timing_seconds",
 			Help:      "Bucketed histogram of assumeRole timings",
@@ -42,20 +109,74 @@ var (
 		},
 	)
 
+	assumeRoleRegion = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sts",
+			Name:      "assumerole_region_total",
+			Help:      "Number of roles assumed, by the STS region that issued the credentials",
+		},
+		[]string{"region"},
+	)
+
+	stsRequest = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "sts",
+			Name:      "request_duration_seconds",
+			Help:      "Bucketed histogram of the latency of HTTP requests to STS, by operation",
+
+			// 1ms to 4s
+			Buckets: prometheus.ExponentialBuckets(.001, 2, 13),
+		},
+		[]string{"operation"},
+	)
+
+	breakerStateGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "sts",
+			Name:      "circuit_breaker_state",
+			Help:      "State of the STS circuit breaker: 0 closed, 1 open, 2 half-open",
+		},
+	)
+
+	breakerRejected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "sts",
+			Name:      "circuit_breaker_rejected_total",
+			Help:      "Number of assume role calls rejected by the open STS circuit breaker",
+		},
+	)
+
 	assumeRoleExecuting = prometheus.NewGauge(
 		prometheus.GaugeOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "sts",
 			Name:      "assumerole_current",
 			Help:      "Number of assume role calls currently executing",
 		},
 	)
-)
+
+	return []prometheus.Collector{
+		cacheHit,
+		cacheMiss,
+		cacheSize,
+		deprecatedCacheSize,
+		cacheEvictions,
+		staleServed,
+		errorIssuing,
+		issuedExpired,
+		assumeRole,
+		assumeRoleExecuting,
+		assumeRoleRegion,
+		stsRequest,
+		breakerStateGauge,
+		breakerRejected,
+	}
+}
 
 func init() {
-	prometheus.MustRegister(cacheHit)
-	prometheus.MustRegister(cacheMiss)
-	prometheus.MustRegister(errorIssuing)
-	prometheus.MustRegister(assumeRole)
-	prometheus.MustRegister(assumeRoleExecuting)
+	telemetry.MustRegister(newMetrics)
 }
@@ -0,0 +1,104 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sts
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+const (
+	// DefaultPartition is the commercial AWS partition
+	DefaultPartition = "aws"
+)
+
+// partitionRegions holds the region used to sign STS requests for partitions
+// that don't have a global STS endpoint.
+var partitionRegions = map[string]string{
+	endpoints.AwsPartitionID:      "",
+	endpoints.AwsCnPartitionID:    "cn-north-1",
+	endpoints.AwsUsGovPartitionID: "us-gov-west-1",
+}
+
+// Partition identifies the AWS partition (e.g. aws, aws-cn, aws-us-gov) that
+// roles are in and STS requests are made to.
+type Partition struct {
+	ID string
+}
+
+// NewPartition returns the partition with the given id, defaulting to the
+// commercial partition when id is empty.
+func NewPartition(id string) (*Partition, error) {
+	if id == "" {
+		id = DefaultPartition
+	}
+
+	if _, ok := partitionRegions[id]; !ok {
+		return nil, fmt.Errorf("unknown partition: %s", id)
+	}
+
+	return &Partition{ID: id}, nil
+}
+
+// ResolvePartition returns the partition with the given id. When id is empty
+// the partition is inferred from region, or from arn when there's no region,
+// defaulting to the commercial partition.
+func ResolvePartition(id, region, arn string) (*Partition, error) {
+	if id == "" {
+		id = inferPartition(region, arn)
+	}
+	return NewPartition(id)
+}
+
+func inferPartition(region, arn string) string {
+	if region != "" {
+		if partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), strings.TrimSuffix(region, "-fips")); ok {
+			return partition.ID()
+		}
+	}
+
+	parts := strings.SplitN(arn, ":", 3)
+	if len(parts) == 3 && parts[0] == "arn" {
+		if _, ok := partitionRegions[parts[1]]; ok {
+			return parts[1]
+		}
+	}
+
+	return DefaultPartition
+}
+
+// DefaultRegion returns the region to use for STS when none is configured,
+// empty when the partition has a global endpoint.
+func (p *Partition) DefaultRegion() string {
+	return partitionRegions[p.ID]
+}
+
+// ValidateARN returns an error if arn doesn't belong to the partition
+func (p *Partition) ValidateARN(arn string) error {
+	if !strings.HasPrefix(arn, fmt.Sprintf("arn:%s:", p.ID)) {
+		return fmt.Errorf("arn %s is not in partition %s", arn, p.ID)
+	}
+	return nil
+}
+
+// ValidateRegion returns an error if region doesn't belong to the partition
+func (p *Partition) ValidateRegion(region string) error {
+	partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), strings.TrimSuffix(region, "-fips"))
+	if !ok || partition.ID() != p.ID {
+		return fmt.Errorf("region %s is not in partition %s", region, p.ID)
+	}
+	return nil
+}
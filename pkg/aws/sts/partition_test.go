@@ -0,0 +1,110 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sts
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDefaultsToCommercialPartition(t *testing.T) {
+	partition, err := NewPartition("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if partition.ID != "aws" {
+		t.Error("unexpected partition, was:", partition.ID)
+	}
+
+	if partition.DefaultRegion() != "" {
+		t.Error("expected global endpoint for commercial partition, was:", partition.DefaultRegion())
+	}
+}
+
+func TestInfersPartitionFromRegionOrARN(t *testing.T) {
+	cases := []struct {
+		region, arn, expected string
+	}{
+		{"cn-north-1", "", "aws-cn"},
+		{"us-gov-east-1-fips", "", "aws-us-gov"},
+		{"", "arn:aws-us-gov:iam::123456789012:role/", "aws-us-gov"},
+		{"cn-northwest-1", "arn:aws:iam::123456789012:role/", "aws-cn"},
+		{"", "", "aws"},
+	}
+
+	for _, c := range cases {
+		partition, err := ResolvePartition("", c.region, c.arn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if partition.ID != c.expected {
+			t.Errorf("expected %s for region %q and arn %q, was: %s", c.expected, c.region, c.arn, partition.ID)
+		}
+	}
+}
+
+func TestGatewayRejectsRegionConflictingWithPartition(t *testing.T) {
+	_, err := DefaultGateway(&GatewayConfig{Partition: "aws", Region: "cn-north-1"})
+	if err == nil {
+		t.Error("expected error for region outside the configured partition")
+	}
+}
+
+func TestRejectsUnknownPartition(t *testing.T) {
+	_, err := NewPartition("aws-moon")
+	if err == nil {
+		t.Error("expected error for unknown partition")
+	}
+}
+
+func TestValidatesARNPartition(t *testing.T) {
+	partition, _ := NewPartition("aws-us-gov")
+
+	if err := partition.ValidateARN("arn:aws-us-gov:iam::123456789012:role/myrole"); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	if err := partition.ValidateARN("arn:aws:iam::123456789012:role/myrole"); err == nil {
+		t.Error("expected error for arn in another partition")
+	}
+
+	if partition.DefaultRegion() != "us-gov-west-1" {
+		t.Error("unexpected default region, was:", partition.DefaultRegion())
+	}
+}
+
+func TestValidatesRegionPartition(t *testing.T) {
+	partition, _ := NewPartition("aws-cn")
+
+	if err := partition.ValidateRegion("cn-northwest-1"); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	if err := partition.ValidateRegion("us-west-2"); err == nil {
+		t.Error("expected error for region in another partition")
+	}
+}
+
+func TestGatewayRejectsRoleInAnotherPartition(t *testing.T) {
+	gateway, err := DefaultGateway(&GatewayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = gateway.Issue(context.Background(), &AssumeRoleRequest{RoleARN: "arn:aws-cn:iam::123456789012:role/myrole"})
+	if err == nil {
+		t.Error("expected error issuing credentials for role in another partition")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sts
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/uswitch/kiam/pkg/future"
+)
+
+// PersistKeySize is the size in bytes of the AES-256 key persisted
+// credentials are encrypted with.
+const PersistKeySize = 32
+
+// PersistedCredentials are cached credentials saved across restarts.
+type PersistedCredentials struct {
+	Identity    *RoleIdentity
+	Credentials *Credentials
+}
+
+// ReadPersistKey reads the base64 encoded key persisted credentials are
+// encrypted with from path.
+func ReadPersistKey(path string) ([]byte, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding persist key: %w", err)
+	}
+	if len(key) != PersistKeySize {
+		return nil, fmt.Errorf("persist key should be %d bytes, was %d", PersistKeySize, len(key))
+	}
+	return key, nil
+}
+
+// SaveCredentials encrypts the credentials cached by persister with key and
+// writes them to path, replacing any previously saved.
+func SaveCredentials(path string, key []byte, persister CredentialsPersister) error {
+	plaintext, err := json.Marshal(persister.Snapshot())
+	if err != nil {
+		return err
+	}
+	aead, err := newPersistCipher(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+
+	// write to a temporary file first so a failed save doesn't leave a
+	// truncated file behind
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(sealed); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadCredentials decrypts the credentials saved at path with key and
+// restores them to persister, returning the number restored.
+func LoadCredentials(path string, key []byte, persister CredentialsPersister) (int, error) {
+	sealed, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	aead, err := newPersistCipher(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return 0, fmt.Errorf("persisted credentials are truncated")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error decrypting persisted credentials: %w", err)
+	}
+
+	var persisted []*PersistedCredentials
+	if err := json.Unmarshal(plaintext, &persisted); err != nil {
+		return 0, err
+	}
+	return persister.Restore(persisted), nil
+}
+
+func newPersistCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Snapshot returns the credentials currently cached, excluding those still
+// being requested.
+func (c *credentialsCache) Snapshot() []*PersistedCredentials {
+	items := c.cache.Items()
+	persisted := make([]*PersistedCredentials, 0, len(items))
+	for _, item := range items {
+		cached := item.Object.(*cachedCredentials)
+		if !cached.future.Done() {
+			continue
+		}
+		obj, err := cached.future.Get(context.Background())
+		if err != nil {
+			continue
+		}
+		persisted = append(persisted, &PersistedCredentials{Identity: cached.identity, Credentials: obj.(*Credentials)})
+	}
+	return persisted
+}
+
+// Restore caches previously persisted credentials, discarding those that
+// have expired or are about to. It returns the number restored.
+func (c *credentialsCache) Restore(persisted []*PersistedCredentials) int {
+	restored := 0
+	for _, p := range persisted {
+		if p.Identity == nil || p.Credentials == nil {
+			continue
+		}
+		expiry, err := p.Credentials.ExpiresAt()
+		if err != nil || time.Until(expiry) < minIssuedValidity {
+			continue
+		}
+
+		key := p.Identity.Key()
+		cached := &cachedCredentials{identity: p.Identity, future: future.Resolved(p.Credentials)}
+		c.set(key, cached)
+		c.updateTTL(key, cached, p.Credentials, c.identityDuration(p.Identity))
+		restored++
+	}
+	return restored
+}
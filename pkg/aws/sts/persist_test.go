@@ -0,0 +1,121 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sts
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/uswitch/kiam/pkg/future"
+)
+
+var persistKey = bytes.Repeat([]byte{1}, PersistKeySize)
+
+func TestRestoresPersistedCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kiam-persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials")
+
+	valid := time.Now().Add(15 * time.Minute).UTC().Format(timeLayout)
+	expiring := time.Now().Add(10 * time.Second).UTC().Format(timeLayout)
+	saved := DefaultCache(&stubGateway{}, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	saved.Restore([]*PersistedCredentials{
+		{Identity: NewRoleIdentity("role"), Credentials: &Credentials{AccessKeyId: "persisted", SecretAccessKey: "secret", Expiration: valid}},
+	})
+	saved.cache.Set(NewRoleIdentity("expiring").Key(), &cachedCredentials{
+		identity: NewRoleIdentity("expiring"),
+		future:   future.Resolved(&Credentials{Expiration: expiring}),
+	}, time.Minute)
+
+	if err := SaveCredentials(path, persistKey, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, _ := ioutil.ReadFile(path)
+	if bytes.Contains(contents, []byte("secret")) {
+		t.Error("expected credentials to be encrypted at rest")
+	}
+
+	gateway := &stubGateway{c: &Credentials{AccessKeyId: "issued", Expiration: valid}}
+	restored := DefaultCache(gateway, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	n, err := LoadCredentials(path, persistKey, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Error("expected expiring credentials to be discarded, restored", n)
+	}
+
+	creds, err := restored.CredentialsForRole(context.Background(), NewRoleIdentity("role"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyId != "persisted" || gateway.issueCount != 0 {
+		t.Error("expected persisted credentials to be served without issuing, was", creds.AccessKeyId)
+	}
+	if ttl := cachedFor(restored, NewRoleIdentity("role")); ttl > 10*time.Minute {
+		t.Error("expected restored credentials to be refreshed before expiry, cached for", ttl)
+	}
+}
+
+func TestDoesntLoadCredentialsWithWrongKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kiam-persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials")
+
+	cache := DefaultCache(&stubGateway{}, "session", 15*time.Minute, 5*time.Minute, DefaultResolver("prefix:"), 0, 0, 0)
+	if err := SaveCredentials(path, persistKey, cache); err != nil {
+		t.Fatal(err)
+	}
+
+	wrongKey := bytes.Repeat([]byte{2}, PersistKeySize)
+	if _, err := LoadCredentials(path, wrongKey, cache); err == nil {
+		t.Error("expected error decrypting with the wrong key")
+	}
+}
+
+func TestReadsPersistKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kiam-persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "key")
+	ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(persistKey)+"\n"), 0600)
+	key, err := ReadPersistKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, persistKey) {
+		t.Error("unexpected key", key)
+	}
+
+	ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString([]byte("short"))), 0600)
+	if _, err := ReadPersistKey(path); err == nil {
+		t.Error("expected error for short key")
+	}
+}
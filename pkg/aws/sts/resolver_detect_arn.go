@@ -61,9 +61,11 @@ func BaseArn(instanceProfileArn string) (string, error) {
 	// so we use the instance-profile prefix as the prefix for our roles
 
 	parts := strings.Split(instanceProfileArn, ":")
-	accountPrefix := strings.Join(parts[0:5], ":")
+	if len(parts) < 6 {
+		return "", fmt.Errorf("invalid instance profile arn: %s", instanceProfileArn)
+	}
 
-	return fmt.Sprintf("%s:role/", accountPrefix), nil
+	return BaseARN(parts[1], parts[4]), nil
 }
 
 // DetectARNPrefix uses the EC2 metadata API to determine the
@@ -0,0 +1,156 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sts
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RoleIdentity identifies the role that credentials are requested for along
+// with any restrictions that should be applied to the issued session.
+type RoleIdentity struct {
+	// Role is the role name (or absolute ARN) to assume
+	Role string
+	// Policy is an optional inline session policy. When set the issued
+	// credentials are restricted to the intersection of the role's
+	// policies and the session policy.
+	Policy string
+	// PolicyARNs are optional managed policies that restrict the issued
+	// credentials as the inline Policy does.
+	PolicyARNs []string
+	// SourceIdentity is optionally recorded by CloudTrail as the immutable
+	// identity that originated the session
+	SourceIdentity string
+	// SessionDuration optionally overrides the session duration the
+	// credentials are requested for
+	SessionDuration time.Duration
+}
+
+// NewRoleIdentity creates a RoleIdentity for the role without any
+// session restrictions.
+func NewRoleIdentity(role string) *RoleIdentity {
+	return &RoleIdentity{Role: role}
+}
+
+// Key returns the key used to store credentials for the identity. Roles
+// requested with different session policies, source identities or session
+// durations must not share credentials so a hash of the policy, the policy
+// ARNs regardless of their order, the source identity and the duration are
+// included.
+func (i *RoleIdentity) Key() string {
+	key := i.Role
+	if i.Policy != "" {
+		key = fmt.Sprintf("%s|%x", key, sha256.Sum256([]byte(i.Policy)))
+	}
+	if len(i.PolicyARNs) > 0 {
+		arns := append([]string(nil), i.PolicyARNs...)
+		sort.Strings(arns)
+		key = fmt.Sprintf("%s|arns:%x", key, sha256.Sum256([]byte(strings.Join(arns, ","))))
+	}
+	if i.SourceIdentity != "" {
+		key = fmt.Sprintf("%s|source:%s", key, i.SourceIdentity)
+	}
+	if i.SessionDuration != 0 {
+		key = fmt.Sprintf("%s|duration:%s", key, i.SessionDuration)
+	}
+	return key
+}
+
+const (
+	// MaxSourceIdentityLength is the maximum length of a source identity
+	// accepted by AssumeRole.
+	MaxSourceIdentityLength = 64
+	// defaultServiceAccount is used by pods that don't specify one
+	defaultServiceAccount = "default"
+)
+
+// SourceIdentityForServiceAccount derives the source identity for pods
+// running as the service account: namespace.name. Namespaces can't contain
+// dots so the identity is unambiguous. Identities longer than AWS permits are
+// truncated with a hash suffix so they remain unique.
+func SourceIdentityForServiceAccount(namespace, name string) string {
+	if name == "" {
+		name = defaultServiceAccount
+	}
+
+	identity := fmt.Sprintf("%s.%s", namespace, name)
+	if len(identity) <= MaxSourceIdentityLength {
+		return identity
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(identity)))[:8]
+	return fmt.Sprintf("%s-%s", identity[:MaxSourceIdentityLength-len(hash)-1], hash)
+}
+
+const (
+	// MaxSessionPolicySize is the maximum size, in characters, of an inline
+	// session policy accepted by AssumeRole.
+	MaxSessionPolicySize = 2048
+	// MaxSessionPolicyARNs is the maximum number of managed session
+	// policies accepted by AssumeRole.
+	MaxSessionPolicyARNs = 10
+)
+
+// policyARNPattern matches managed policy ARNs, in the account or AWS
+// managed.
+var policyARNPattern = regexp.MustCompile(`^arn:[a-z-]+:iam::(\d{12}|aws):policy/(?:[\w+=,.@-]+/)*[\w+=,.@-]+$`)
+
+var (
+	// ErrSessionPolicyTooLarge is returned when a session policy exceeds MaxSessionPolicySize
+	ErrSessionPolicyTooLarge = fmt.Errorf("session policy exceeds %d characters", MaxSessionPolicySize)
+	// ErrSessionPolicyInvalid is returned when a session policy isn't a valid JSON document
+	ErrSessionPolicyInvalid = fmt.Errorf("session policy is not valid json")
+	// ErrTooManyPolicyARNs is returned when more than MaxSessionPolicyARNs
+	// managed session policies are requested
+	ErrTooManyPolicyARNs = fmt.Errorf("more than %d session policy arns", MaxSessionPolicyARNs)
+)
+
+// ValidateSessionPolicy checks the policy can be passed to AssumeRole. An
+// empty policy is valid.
+func ValidateSessionPolicy(policy string) error {
+	if policy == "" {
+		return nil
+	}
+
+	if len(policy) > MaxSessionPolicySize {
+		return ErrSessionPolicyTooLarge
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+		return ErrSessionPolicyInvalid
+	}
+
+	return nil
+}
+
+// ValidatePolicyARNs checks the managed session policies can be passed to
+// AssumeRole. No policies are valid.
+func ValidatePolicyARNs(arns []string) error {
+	if len(arns) > MaxSessionPolicyARNs {
+		return ErrTooManyPolicyARNs
+	}
+	for _, arn := range arns {
+		if !policyARNPattern.MatchString(arn) {
+			return fmt.Errorf("invalid session policy arn %q", arn)
+		}
+	}
+	return nil
+}
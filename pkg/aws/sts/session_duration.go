@@ -0,0 +1,50 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sts
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AWSMaxSessionDuration is the longest session AssumeRole issues, roles
+// may permit less.
+const AWSMaxSessionDuration = 12 * time.Hour
+
+// ClampSessionDuration limits a requested session duration to at most max,
+// or AWSMaxSessionDuration when max is 0, and at least
+// AWSMinSessionDuration. A warning is logged when the duration is changed.
+func ClampSessionDuration(requested, max time.Duration) time.Duration {
+	if max <= 0 || max > AWSMaxSessionDuration {
+		max = AWSMaxSessionDuration
+	}
+
+	clamped := requested
+	if clamped > max {
+		clamped = max
+	}
+	if clamped < AWSMinSessionDuration {
+		clamped = AWSMinSessionDuration
+	}
+
+	if clamped != requested {
+		log.WithFields(logrus.Fields{
+			"session.requested": requested.String(),
+			"session.duration":  clamped.String(),
+		}).Warnf("requested session duration outside of permitted range, clamped")
+	}
+	return clamped
+}
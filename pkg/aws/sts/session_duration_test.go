@@ -0,0 +1,29 @@
+package sts
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClampSessionDuration(t *testing.T) {
+	cases := []struct {
+		name      string
+		requested time.Duration
+		max       time.Duration
+		expected  time.Duration
+	}{
+		{"above max is clamped down", 12 * time.Hour, time.Hour, time.Hour},
+		{"below aws minimum is raised", 5 * time.Minute, time.Hour, AWSMinSessionDuration},
+		{"within range is unchanged", 30 * time.Minute, time.Hour, 30 * time.Minute},
+		{"max defaults to aws maximum", 24 * time.Hour, 0, AWSMaxSessionDuration},
+		{"max beyond aws maximum is ignored", 24 * time.Hour, 48 * time.Hour, AWSMaxSessionDuration},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := ClampSessionDuration(c.requested, c.max); got != c.expected {
+				t.Errorf("expected %s, was %s", c.expected, got)
+			}
+		})
+	}
+}
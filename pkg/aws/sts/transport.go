@@ -0,0 +1,95 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sts
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// DefaultMaxIdleConns is the default number of idle connections kept
+	// open to STS, enough for a busy server to reuse connections rather
+	// than paying for a TLS handshake on most calls
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 100
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// newHTTPClient creates the HTTP client used to call STS. It returns nil when
+// no customisation is configured so that the SDK default client is used.
+func newHTTPClient(config *GatewayConfig) (*http.Client, error) {
+	if config.CABundle == "" && config.HTTPProxy == "" && config.HTTPTimeout == 0 && config.MaxIdleConns == 0 && config.MaxIdleConnsPerHost == 0 && config.IdleConnTimeout == 0 {
+		return nil, nil
+	}
+
+	// start from the default transport to keep its timeouts and connection pooling
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.CABundle != "" {
+		pool, err := loadCABundle(config.CABundle, config.CABundleReplacesSystemRoots)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	if config.MaxIdleConns != 0 {
+		transport.MaxIdleConns = config.MaxIdleConns
+	}
+	if config.MaxIdleConnsPerHost != 0 {
+		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	}
+	if config.IdleConnTimeout != 0 {
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+
+	if config.HTTPProxy != "" {
+		proxy, err := url.Parse(config.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing sts http proxy: %s", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return &http.Client{Transport: transport, Timeout: config.HTTPTimeout}, nil
+}
+
+// loadCABundle returns the system roots with the PEM encoded certificates
+// from path added, or only the certificates from path when replaceSystemRoots
+// is set.
+func loadCABundle(path string, replaceSystemRoots bool) (*x509.CertPool, error) {
+	bundle, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading sts ca bundle: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !replaceSystemRoots {
+		if system, err := x509.SystemCertPool(); err == nil {
+			pool = system
+		}
+	}
+
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("error parsing sts ca bundle %s: no certificates found", path)
+	}
+
+	return pool, nil
+}
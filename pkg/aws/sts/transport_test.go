@@ -0,0 +1,144 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeCABundle(t *testing.T) (*x509.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kiam test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "kiam-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	return cert, f.Name()
+}
+
+func TestUsesDefaultClientWithoutCustomisation(t *testing.T) {
+	client, err := newHTTPClient(&GatewayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client != nil {
+		t.Error("expected default client to be used")
+	}
+}
+
+func TestClientTimesOutRequests(t *testing.T) {
+	client, err := newHTTPClient(&GatewayConfig{HTTPTimeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client == nil || client.Timeout != 2*time.Second {
+		t.Error("expected client with timeout, was", client)
+	}
+}
+
+func TestTransportTrustsCABundle(t *testing.T) {
+	cert, path := writeCABundle(t)
+	defer os.Remove(path)
+
+	client, err := newHTTPClient(&GatewayConfig{CABundle: path, HTTPProxy: "http://proxy.local:3128"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := client.Transport.(*http.Transport)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: transport.TLSClientConfig.RootCAs})
+	if err != nil {
+		t.Error("expected ca bundle to be trusted:", err)
+	}
+
+	if transport.IdleConnTimeout == 0 || transport.TLSHandshakeTimeout == 0 {
+		t.Error("expected default transport timeouts to be retained")
+	}
+
+	req, _ := http.NewRequest("GET", "https://sts.amazonaws.com", nil)
+	proxy, err := transport.Proxy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy == nil || proxy.Host != "proxy.local:3128" {
+		t.Error("unexpected proxy:", proxy)
+	}
+}
+
+func TestCABundleReplacesSystemRoots(t *testing.T) {
+	cert, path := writeCABundle(t)
+	defer os.Remove(path)
+
+	pool, err := loadCABundle(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+		t.Error("expected ca bundle to be trusted:", err)
+	}
+	if subjects := pool.Subjects(); len(subjects) != 1 {
+		t.Error("expected only the bundle to be trusted, was", len(subjects))
+	}
+}
+
+func TestErrorsWithInvalidCABundle(t *testing.T) {
+	f, err := ioutil.TempFile("", "kiam-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate")
+	f.Close()
+
+	_, err = newHTTPClient(&GatewayConfig{CABundle: f.Name()})
+	if err == nil {
+		t.Error("expected error with invalid ca bundle")
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sts
+
+import (
+	"context"
+	"fmt"
+)
+
+// RoleValidation is the result of assuming a role to check it's trusted
+type RoleValidation struct {
+	Role    string
+	RoleARN string
+	Err     error
+}
+
+// ValidateRoles assumes each of the roles with the gateway, reporting whether
+// the gateway's identity is permitted to assume them. Credentials issued are
+// discarded.
+func ValidateRoles(ctx context.Context, gateway STSGateway, resolver ARNResolver, sessionName string, roles []string) []*RoleValidation {
+	results := make([]*RoleValidation, 0, len(roles))
+	for _, role := range roles {
+		result := &RoleValidation{Role: role, RoleARN: resolver.Resolve(role)}
+		_, result.Err = gateway.Issue(ctx, &AssumeRoleRequest{
+			RoleARN:         result.RoleARN,
+			SessionName:     fmt.Sprintf("kiam-%s", sessionName),
+			SessionDuration: AWSMinSessionDuration,
+		})
+		results = append(results, result)
+	}
+	return results
+}
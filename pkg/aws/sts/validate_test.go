@@ -0,0 +1,43 @@
+package sts
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+type trustingGateway struct {
+	trusted map[string]bool
+}
+
+func (g *trustingGateway) Issue(ctx context.Context, request *AssumeRoleRequest) (*Credentials, error) {
+	if !g.trusted[request.RoleARN] {
+		return nil, fmt.Errorf("not authorized to assume %s", request.RoleARN)
+	}
+	return &Credentials{Code: "Success"}, nil
+}
+
+func TestValidateRolesReportsEachRole(t *testing.T) {
+	gateway := &trustingGateway{trusted: map[string]bool{
+		"arn:aws:iam::123456789012:role/trusted":     true,
+		"arn:aws:iam::210987654321:role/other-trust": true,
+	}}
+	resolver := DefaultResolver("arn:aws:iam::123456789012:role/")
+
+	roles := []string{"trusted", "untrusted", "arn:aws:iam::210987654321:role/other-trust"}
+	results := ValidateRoles(context.Background(), gateway, resolver, "validate", roles)
+
+	if len(results) != len(roles) {
+		t.Fatal("expected a result for each role, was", len(results))
+	}
+
+	if results[0].Err != nil || results[0].RoleARN != "arn:aws:iam::123456789012:role/trusted" {
+		t.Error("expected trusted role to be assumed:", results[0].RoleARN, results[0].Err)
+	}
+	if results[1].Err == nil {
+		t.Error("expected untrusted role to fail")
+	}
+	if results[2].Err != nil {
+		t.Error("expected absolute arn to be assumed:", results[2].Err)
+	}
+}
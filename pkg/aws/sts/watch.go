@@ -0,0 +1,72 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package sts
+
+import (
+	"context"
+	"sync"
+)
+
+// credentialsWatchers tracks subscribers to be notified when credentials are
+// issued for a cache key.
+type credentialsWatchers struct {
+	mu       sync.Mutex
+	watchers map[string]map[chan *Credentials]struct{}
+}
+
+func newCredentialsWatchers() *credentialsWatchers {
+	return &credentialsWatchers{watchers: make(map[string]map[chan *Credentials]struct{})}
+}
+
+// watch returns a channel that receives credentials issued for key. The
+// channel is closed once ctx is done.
+func (w *credentialsWatchers) watch(ctx context.Context, key string) <-chan *Credentials {
+	ch := make(chan *Credentials, 1)
+
+	w.mu.Lock()
+	if w.watchers[key] == nil {
+		w.watchers[key] = make(map[chan *Credentials]struct{})
+	}
+	w.watchers[key][ch] = struct{}{}
+	w.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.watchers[key], ch)
+		if len(w.watchers[key]) == 0 {
+			delete(w.watchers, key)
+		}
+		close(ch)
+	}()
+
+	return ch
+}
+
+// notify sends credentials to all watchers of key. Watchers that haven't
+// received the previous credentials only receive the latest.
+func (w *credentialsWatchers) notify(key string, credentials *Credentials) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for ch := range w.watchers[key] {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- credentials
+	}
+}
@@ -34,6 +34,16 @@ func (f *Future) Get(ctx context.Context) (interface{}, error) {
 	}
 }
 
+// Done returns true once the value has been resolved
+func (f *Future) Done() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
 func New(f FutureFn) *Future {
 	future := &Future{
 		done: make(chan struct{}),
@@ -44,3 +54,13 @@ func New(f FutureFn) *Future {
 	}()
 	return future
 }
+
+// Resolved returns a Future that's already done with val.
+func Resolved(val interface{}) *Future {
+	future := &Future{
+		val:  val,
+		done: make(chan struct{}),
+	}
+	close(future.done)
+	return future
+}
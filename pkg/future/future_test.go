@@ -63,3 +63,14 @@ func BenchmarkFutureGet(b *testing.B) {
 		f.Get(context.Background())
 	}
 }
+
+func TestResolvedIsDone(t *testing.T) {
+	f := Resolved("hello")
+	if !f.Done() {
+		t.Error("expected resolved future to be done")
+	}
+	val, err := f.Get(context.Background())
+	if val != "hello" || err != nil {
+		t.Error("unexpected value", val, err)
+	}
+}
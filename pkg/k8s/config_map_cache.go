@@ -0,0 +1,70 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ConfigMapCache implements the ConfigMapFinder interface used to read the
+// session policies pods reference, without querying the api server for
+// every request
+type ConfigMapCache struct {
+	indexer    cache.Indexer
+	controller cache.Controller
+}
+
+// NewConfigMapCache creates the cache storing ConfigMaps
+func NewConfigMapCache(source cache.ListerWatcher, syncInterval time.Duration) *ConfigMapCache {
+	indexer, controller := cache.NewIndexerInformer(source, &v1.ConfigMap{}, syncInterval, cache.ResourceEventHandlerFuncs{}, cache.Indexers{})
+	return &ConfigMapCache{
+		indexer:    indexer,
+		controller: controller,
+	}
+}
+
+// Run starts the cache processing updates. Blocks until cache has synced
+func (c *ConfigMapCache) Run(ctx context.Context) error {
+	go c.controller.Run(ctx.Done())
+	log.Infof("started configmap cache controller")
+
+	ok := cache.WaitForCacheSync(ctx.Done(), c.controller.HasSynced)
+	if !ok {
+		return ErrWaitingForSync
+	}
+
+	return nil
+}
+
+// HasSynced returns whether the cache has synced with the api server
+func (c *ConfigMapCache) HasSynced() bool {
+	return c.controller.HasSynced()
+}
+
+// FindConfigMap finds the ConfigMap by its namespace and name
+func (c *ConfigMapCache) FindConfigMap(ctx context.Context, namespace, name string) (*v1.ConfigMap, error) {
+	obj, exists, err := c.indexer.GetByKey(fmt.Sprintf("%s/%s", namespace, name))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	return obj.(*v1.ConfigMap), nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"time"
+
+	gocache "github.com/patrickmn/go-cache"
+	"k8s.io/api/core/v1"
+)
+
+// deletedPods remembers recently deleted pods by IP for a grace period, so
+// requests from pods that are still terminating can be answered.
+type deletedPods struct {
+	pods *gocache.Cache
+}
+
+func newDeletedPods(grace time.Duration) *deletedPods {
+	// expired entries are removed as pods are added rather than by a
+	// cleanup goroutine
+	return &deletedPods{pods: gocache.New(grace, 0)}
+}
+
+func (d *deletedPods) add(pod *v1.Pod, ips []string) {
+	d.pods.DeleteExpired()
+	for _, ip := range ips {
+		d.pods.SetDefault(ip, pod)
+	}
+}
+
+// find returns the pod deleted within the grace period with the IP, or nil.
+func (d *deletedPods) find(ip string) *v1.Pod {
+	obj, found := d.pods.Get(ip)
+	if !found {
+		return nil
+	}
+	return obj.(*v1.Pod)
+}
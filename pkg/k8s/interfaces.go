@@ -22,13 +22,36 @@ type PodGetter interface {
 	GetPodByIP(ip string) (*v1.Pod, error)
 }
 
+// RoleFinder finds the Pod with an IP address and the role it's issued
+// credentials for. The default implementation, NewAnnotationRoleFinder,
+// uses the role the Pod is annotated with.
+type RoleFinder interface {
+	// FindPodRole returns the Pod with ip and its role. When the Pod is
+	// found but its role can't be, the Pod is returned with the error.
+	FindPodRole(ctx context.Context, ip string) (*v1.Pod, string, error)
+}
+
 type PodAnnouncer interface {
 	// Will receive a Pod whenever there's a change/addition for a Pod with a role.
 	Pods() <-chan *v1.Pod
 	// Return whether there are still uncompleted pods in the specified role
 	IsActivePodsForRole(role string) (bool, error)
+	// Return the role of the Pod
+	PodRole(pod *v1.Pod) string
 }
 
 type NamespaceFinder interface {
 	FindNamespace(ctx context.Context, name string) (*v1.Namespace, error)
 }
+
+type ServiceAccountFinder interface {
+	FindServiceAccount(ctx context.Context, namespace, name string) (*v1.ServiceAccount, error)
+}
+
+type ConfigMapFinder interface {
+	FindConfigMap(ctx context.Context, namespace, name string) (*v1.ConfigMap, error)
+}
+
+type SessionPolicyFinder interface {
+	FindSessionPolicy(ctx context.Context, pod *v1.Pod) (string, error)
+}
@@ -11,6 +11,10 @@ const (
 	ResourcePods = "pods"
 	// ResourceNamespaces are Namespace resources
 	ResourceNamespaces = "namespaces"
+	// ResourceServiceAccounts are ServiceAccount resources
+	ResourceServiceAccounts = "serviceaccounts"
+	// ResourceConfigMaps are ConfigMap resources
+	ResourceConfigMaps = "configmaps"
 )
 
 // NewListWatch creates a ListWatch for the specified Resource
@@ -15,9 +15,12 @@ package k8s
 
 import (
 	"github.com/sirupsen/logrus"
+	"github.com/uswitch/kiam/pkg/logging"
 	"k8s.io/api/core/v1"
 )
 
+var log = logging.Component("k8s")
+
 func PodFields(pod *v1.Pod) logrus.Fields {
 	return logrus.Fields{
 		"pod.status.phase":    pod.Status.Phase,
@@ -36,3 +39,11 @@ func namespaceFields(n *v1.Namespace) logrus.Fields {
 		"namespace.permitted": n.GetAnnotations()[AnnotationPermittedKey],
 	}
 }
+
+func serviceAccountFields(s *v1.ServiceAccount) logrus.Fields {
+	return logrus.Fields{
+		"serviceaccount.namespace": s.Namespace,
+		"serviceaccount.name":      s.Name,
+		"serviceaccount.iam.role":  s.GetAnnotations()[AnnotationIAMRoleKey],
+	}
+}
@@ -2,19 +2,107 @@ package k8s
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
+	telemetry "github.com/uswitch/kiam/pkg/prometheus"
 )
 
 var (
+	dropAnnounce       prometheus.Counter
+	podSyncLag         prometheus.GaugeFunc
+	namespaceSyncLag   prometheus.GaugeFunc
+	podCacheMisses     prometheus.Counter
+	deletedPodLookups  prometheus.Counter
+	podWatchReconnects prometheus.Counter
+	ambiguousPodIPs    prometheus.Counter
+	podWatchFailures   prometheus.Counter
+)
+
+func newMetrics(namespace string) []prometheus.Collector {
 	dropAnnounce = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Namespace: "kiam",
+			Namespace: namespace,
 			Subsystem: "k8s",
 			Name:      "dropped_pods_total",
 			Help:      "Number of dropped pods because of full buffer",
 		},
 	)
-)
+
+	podSyncLag = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "k8s",
+			Name:      "pod_cache_sync_lag_seconds",
+			Help:      "Seconds since the pod cache last successfully synced or resynced",
+		},
+		func() float64 { return podSync.age().Seconds() },
+	)
+
+	namespaceSyncLag = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "k8s",
+			Name:      "namespace_cache_sync_lag_seconds",
+			Help:      "Seconds since the namespace cache last successfully synced or resynced",
+		},
+		func() float64 { return namespaceSync.age().Seconds() },
+	)
+
+	podCacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "k8s",
+			Name:      "pod_cache_misses_total",
+			Help:      "Number of pod lookups by IP that found no running pod in the cache",
+		},
+	)
+
+	deletedPodLookups = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "k8s",
+			Name:      "pod_cache_deleted_pod_lookups_total",
+			Help:      "Number of pod lookups by IP answered by a pod deleted within the grace period",
+		},
+	)
+
+	podWatchReconnects = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "k8s",
+			Name:      "pod_watch_reconnects_total",
+			Help:      "Number of times the pod watch was re-established",
+		},
+	)
+
+	ambiguousPodIPs = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "k8s",
+			Name:      "ambiguous_pod_ip_total",
+			Help:      "Number of lookups denied because multiple running pods share the ip",
+		},
+	)
+
+	podWatchFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "k8s",
+			Name:      "pod_watch_failures_total",
+			Help:      "Number of failed attempts to list or watch pods, each delaying the next attempt when watch backoff is enabled",
+		},
+	)
+
+	return []prometheus.Collector{
+		dropAnnounce,
+		podSyncLag,
+		namespaceSyncLag,
+		podCacheMisses,
+		deletedPodLookups,
+		podWatchReconnects,
+		podWatchFailures,
+		ambiguousPodIPs,
+	}
+}
 
 func init() {
-	prometheus.MustRegister(dropAnnounce)
+	telemetry.MustRegister(newMetrics)
 }
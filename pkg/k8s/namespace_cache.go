@@ -17,7 +17,6 @@ import (
 	"context"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
@@ -26,6 +25,10 @@ const (
 	// AnnotationPermittedKey hold the name of the annotation for the regex expressing the
 	// roles that can be assumed by pods in that namespace.
 	AnnotationPermittedKey = "iam.amazonaws.com/permitted"
+	// AnnotationPermittedPatternsKey holds the name of the annotation for a
+	// comma separated list of glob patterns, such as app-foo-*, matching
+	// roles that can be assumed by pods in that namespace.
+	AnnotationPermittedPatternsKey = "iam.amazonaws.com/permitted-patterns"
 )
 
 // NamespaceCache implements NamespaceFinder interface used to determine which roles
@@ -38,7 +41,7 @@ type NamespaceCache struct {
 // NewNamespaceCache creates the cache storing Namespaces
 func NewNamespaceCache(source cache.ListerWatcher, syncInterval time.Duration) *NamespaceCache {
 	namespaceLogger := &namespaceLogger{}
-	indexer, controller := cache.NewIndexerInformer(source, &v1.Namespace{}, syncInterval, namespaceLogger, cache.Indexers{})
+	indexer, controller := cache.NewIndexerInformer(newSyncTrackingListerWatcher(source, namespaceSync, nil), &v1.Namespace{}, syncInterval, namespaceLogger, cache.Indexers{})
 	return &NamespaceCache{
 		indexer:    indexer,
 		controller: controller,
@@ -70,6 +73,16 @@ func (c *NamespaceCache) FindNamespace(ctx context.Context, name string) (*v1.Na
 	return obj.(*v1.Namespace), nil
 }
 
+// HasSynced returns whether the cache has synced with the api server
+func (c *NamespaceCache) HasSynced() bool {
+	return c.controller.HasSynced()
+}
+
+// Len returns the number of namespaces in the cache
+func (c *NamespaceCache) Len() int {
+	return len(c.indexer.ListKeys())
+}
+
 type namespaceLogger struct {
 }
 
@@ -110,5 +123,10 @@ func (o *namespaceLogger) OnUpdate(old, new interface{}) {
 		return
 	}
 
+	// resyncs deliver updates for unchanged namespaces
+	if oldNamespace, ok := old.(*v1.Namespace); ok && oldNamespace.ResourceVersion == namespace.ResourceVersion {
+		namespaceSync.record()
+	}
+
 	log.WithFields(namespaceFields(namespace)).Debugf("updated namespace")
 }
@@ -16,10 +16,15 @@ package k8s
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/cache"
 )
 
@@ -28,32 +33,104 @@ type PodCache struct {
 	pods       chan *v1.Pod
 	indexer    cache.Indexer
 	controller cache.Controller
+	handler    *podHandler
+	deleted    *deletedPods
+	source     *syncTrackingListerWatcher
+	roles      *PodRoles
+	indexed    *indexedRoles
+	// networkAttachments indexes pods by the IPs in their network status
+	// annotation as well as their status IP.
+	networkAttachments bool
 }
 
 // NewPodCache creates the cache object that uses a watcher to listen for Pod events. The cache indexes pods by their
 // IP address so that Kiam can identify which role a Pod should assume. It periodically syncs the list of
 // pods and can announce Pods. When announcing Pods via the channel it will drop events if the buffer
-// is full- bufferSize determines how many.
-func NewPodCache(source cache.ListerWatcher, syncInterval time.Duration, bufferSize int) *PodCache {
+// is full- bufferSize determines how many. syncJitter extends the sync interval by a random factor
+// of up to syncJitter so that replicas don't sync in lockstep; 0 disables jitter. Pods are indexed by the role roles finds
+// for them, nil reads roles only from pods' annotations.
+func NewPodCache(source cache.ListerWatcher, syncInterval time.Duration, syncJitter float64, bufferSize int, roles *PodRoles) *PodCache {
+	if roles == nil {
+		roles = &PodRoles{}
+	}
+	podCache := &PodCache{roles: roles, indexed: newIndexedRoles()}
 	indexers := cache.Indexers{
-		indexPodIP:   podIPIndex,
-		indexPodRole: podRoleIndex,
+		indexPodIP:             podCache.podIPIndex,
+		indexPodRole:           podCache.podRoleIndex,
+		indexPodServiceAccount: podServiceAccountIndex,
 	}
 	pods := make(chan *v1.Pod, bufferSize)
-	podHandler := &podHandler{pods}
-	indexer, controller := cache.NewIndexerInformer(source, &v1.Pod{}, syncInterval, podHandler, indexers)
-	podCache := &PodCache{
-		pods:       pods,
-		indexer:    indexer,
-		controller: controller,
-	}
+	podHandler := &podHandler{pods: pods, roles: roles, indexed: podCache.indexed}
+	syncInterval = jitterSyncInterval(syncInterval, syncJitter, replicaSeed())
+	tracking := newSyncTrackingListerWatcher(source, podSync, podWatchReconnects)
+	indexer, controller := cache.NewIndexerInformer(tracking, &v1.Pod{}, syncInterval, podHandler, indexers)
+	podCache.pods = pods
+	podCache.indexer = indexer
+	podCache.controller = controller
+	podCache.handler = podHandler
+	podCache.source = tracking
 
 	return podCache
 }
 
+// SetNetworkAttachmentIPs also finds pods by the IPs of additional network
+// attachments in their network status annotation. Pods' authors can write
+// the annotation, so a pod's status IP takes precedence over other pods
+// claiming it. It must be called before Run.
+func (s *PodCache) SetNetworkAttachmentIPs(enabled bool) {
+	s.networkAttachments = enabled
+	s.handler.networkAttachments = enabled
+}
+
+// SetDeletedPodGracePeriod keeps deleted pods resolvable by IP for grace,
+// so pods that are terminating can still request credentials. Pods running
+// with the same IP take precedence. It must be called before Run, 0
+// disables the grace period.
+func (s *PodCache) SetDeletedPodGracePeriod(grace time.Duration) {
+	if grace <= 0 {
+		s.deleted = nil
+	} else {
+		s.deleted = newDeletedPods(grace)
+	}
+	s.handler.deleted = s.deleted
+}
+
+// SetWatchBackoff delays listing and watching pods after consecutive
+// failures, as configured by backoff. It must be called before Run.
+func (s *PodCache) SetWatchBackoff(backoff WatchBackoff) {
+	if backoff.Initial <= 0 {
+		s.source.backoff = nil
+		return
+	}
+	s.source.backoff = &watchBackoff{config: backoff}
+}
+
+// jitterSyncInterval extends interval by a random amount of up to factor * interval. The
+// amount is derived from seed so the same replica consistently uses the same interval.
+func jitterSyncInterval(interval time.Duration, factor float64, seed int64) time.Duration {
+	if factor <= 0 {
+		return interval
+	}
+	r := rand.New(rand.NewSource(seed))
+	return interval + time.Duration(r.Float64()*factor*float64(interval))
+}
+
+// replicaSeed derives a seed from the hostname, which is unique to each replica's pod
+func replicaSeed() int64 {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return time.Now().UnixNano()
+	}
+	h := fnv.New64a()
+	h.Write([]byte(hostname))
+	return int64(h.Sum64())
+}
+
 // ErrMultipleRunningPods indicates that multiple pods were found. This is
-// an error as we expect IP addresses to not overlap
-var ErrMultipleRunningPods = fmt.Errorf("multiple running pods found")
+// an error as we expect IP addresses to not overlap.
+//
+// Deprecated: use ErrAmbiguousPodIP.
+var ErrMultipleRunningPods = ErrAmbiguousPodIP
 
 // IsPodCompleted returns true for Pods that are Pending or Running.
 func IsPodCompleted(pod *v1.Pod) bool {
@@ -66,6 +143,17 @@ func (s *PodCache) Pods() <-chan *v1.Pod {
 	return s.pods
 }
 
+// PodRole returns the role of the Pod, part of the PodAnnouncer interface
+func (s *PodCache) PodRole(pod *v1.Pod) string {
+	return s.roles.PodRole(pod)
+}
+
+// ResolvePodRole returns the role of the Pod, or ErrRoleConflict or
+// ErrInvalidRole when it's rejected.
+func (s *PodCache) ResolvePodRole(pod *v1.Pod) (string, error) {
+	return s.roles.ResolvePodRole(pod)
+}
+
 // IsActivePodsForRole returns whether there are any uncompleted pods
 // using the provided role. This is used to identify whether the
 // role credentials should be maintained. Part of the PodAnnouncer
@@ -87,12 +175,38 @@ func (s *PodCache) IsActivePodsForRole(role string) (bool, error) {
 	return false, nil
 }
 
+// IsSelectedPodsForRole returns whether there are any uncompleted pods
+// matching selector using the provided role.
+func (s *PodCache) IsSelectedPodsForRole(role string, selector labels.Selector) (bool, error) {
+	items, err := s.indexer.ByIndex(indexPodRole, role)
+	if err != nil {
+		return false, err
+	}
+
+	for _, obj := range items {
+		pod, _ := obj.(*v1.Pod)
+
+		if !IsPodCompleted(pod) && selector.Matches(labels.Set(pod.GetLabels())) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 var (
 	// ErrPodNotFound is returned when there's no matching Pod in the cache.
 	ErrPodNotFound = fmt.Errorf("pod not found")
 	// ErrWaitingForSync indicates there was an error while waiting for the cache
 	// to perform a sync with the api server.
 	ErrWaitingForSync = fmt.Errorf("error waiting for cache sync")
+	// ErrRoleConflict is returned when a Pod's role annotation and label
+	// specify different roles, and conflicts are rejected.
+	ErrRoleConflict = fmt.Errorf("role annotation and label conflict")
+	// ErrAmbiguousPodIP is returned when multiple active Pods share an IP,
+	// usually because of a CNI bug or stale pods, so the requesting Pod
+	// can't be identified.
+	ErrAmbiguousPodIP = fmt.Errorf("multiple running pods share the ip")
 )
 
 // findPodForIP returns the Pod identified by the provided IP address. The
@@ -105,6 +219,7 @@ func (s *PodCache) findPodForIP(ip string) (*v1.Pod, error) {
 		return nil, err
 	}
 
+	attached := make([]*v1.Pod, 0)
 	for _, obj := range items {
 		pod := obj.(*v1.Pod)
 
@@ -114,14 +229,32 @@ func (s *PodCache) findPodForIP(ip string) (*v1.Pod, error) {
 
 		if pod.Status.PodIP == ip {
 			found = append(found, pod)
+		} else if containsIP(podIPs(pod, s.networkAttachments), ip) {
+			attached = append(attached, pod)
 		}
 	}
 
+	// network attachment IPs are only trusted when no pod is assigned the
+	// IP, otherwise any pod could claim another's IP
+	if len(found) == 0 {
+		found = attached
+	} else if len(attached) > 0 {
+		log.WithField("pod.ip", ip).Debugf("ignoring %d pods claiming ip in their network status annotation", len(attached))
+	}
+
 	for idx, pod := range found {
 		log.WithFields(PodFields(pod)).Debugf("found %d/%d pods for ip %s", len(found), idx+1, ip)
 	}
 
 	if len(found) == 0 {
+		if s.deleted != nil {
+			if pod := s.deleted.find(ip); pod != nil {
+				deletedPodLookups.Inc()
+				log.WithFields(PodFields(pod)).Debugf("found pod deleted within grace period for ip %s", ip)
+				return pod, nil
+			}
+		}
+		podCacheMisses.Inc()
 		return nil, ErrPodNotFound
 	}
 
@@ -129,7 +262,13 @@ func (s *PodCache) findPodForIP(ip string) (*v1.Pod, error) {
 		return found[0], nil
 	}
 
-	return nil, ErrMultipleRunningPods
+	names := make([]string, 0, len(found))
+	for _, pod := range found {
+		names = append(names, fmt.Sprintf("%s/%s", pod.GetNamespace(), pod.GetName()))
+	}
+	log.WithField("pod.ip", ip).Warnf("ip is ambiguous, shared by %d running pods: %s", len(found), strings.Join(names, ", "))
+	ambiguousPodIPs.Inc()
+	return nil, ErrAmbiguousPodIP
 }
 
 // GetPodByIP returns the Pod with the provided IP address
@@ -138,32 +277,103 @@ func (s *PodCache) GetPodByIP(ip string) (*v1.Pod, error) {
 }
 
 const (
-	indexPodIP   = "byIP"
-	indexPodRole = "byRole"
+	indexPodIP             = "byIP"
+	indexPodRole           = "byRole"
+	indexPodServiceAccount = "byServiceAccount"
 )
 
-func podIPIndex(obj interface{}) ([]string, error) {
+func (s *PodCache) podIPIndex(obj interface{}) ([]string, error) {
 	pod := obj.(*v1.Pod)
+	return podIPs(pod, s.networkAttachments), nil
+}
 
-	if pod.Status.PodIP == "" {
+func (s *PodCache) podRoleIndex(obj interface{}) ([]string, error) {
+	pod := obj.(*v1.Pod)
+	role := s.indexed.role(pod, s.roles.PodRole)
+	if role == "" {
 		return []string{}, nil
 	}
 
-	return []string{pod.Status.PodIP}, nil
+	return []string{role}, nil
 }
 
-func podRoleIndex(obj interface{}) ([]string, error) {
+func podServiceAccountIndex(obj interface{}) ([]string, error) {
 	pod := obj.(*v1.Pod)
-	role := PodRole(pod)
-	if role == "" {
+	if pod.Spec.ServiceAccountName == "" {
 		return []string{}, nil
 	}
 
-	return []string{role}, nil
+	return []string{fmt.Sprintf("%s/%s", pod.Namespace, pod.Spec.ServiceAccountName)}, nil
+}
+
+// ServiceAccountChanged reindexes the roles of the ServiceAccount's pods,
+// as they may be found from its annotation, and announces them so
+// credentials for their current roles are prefetched.
+func (s *PodCache) ServiceAccountChanged(namespace, name string) {
+	objs, err := s.indexer.ByIndex(indexPodServiceAccount, fmt.Sprintf("%s/%s", namespace, name))
+	if err != nil {
+		log.Errorf("error finding pods for service account %s/%s: %s", namespace, name, err.Error())
+		return
+	}
+
+	for _, obj := range objs {
+		pod := obj.(*v1.Pod)
+		// skip pods updated since they were listed, they've been
+		// reindexed already
+		current, exists, err := s.indexer.Get(pod)
+		if err != nil || !exists || current != obj {
+			continue
+		}
+		// the copy is indexed with its current role, replacing the pod
+		// removes it with the role it was indexed with
+		reindexed := pod.DeepCopy()
+		if err := s.indexer.Update(reindexed); err != nil {
+			log.WithFields(PodFields(pod)).Errorf("error reindexing pod: %s", err.Error())
+			continue
+		}
+		s.indexed.forget(pod)
+		log.WithFields(PodFields(pod)).Debugf("reindexed pod for service account change")
+		s.handler.announce(reindexed)
+	}
+}
+
+// indexedRoles records the role each cached pod was indexed with, as roles
+// found from ServiceAccounts can change without the pod changing. Pods are
+// then removed from the index with the role they were added with.
+type indexedRoles struct {
+	mu    sync.Mutex
+	roles map[*v1.Pod]string
+}
+
+func newIndexedRoles() *indexedRoles {
+	return &indexedRoles{roles: make(map[*v1.Pod]string)}
+}
+
+// role returns the role pod was indexed with, finding it with podRole when
+// it's first indexed.
+func (r *indexedRoles) role(pod *v1.Pod, podRole func(*v1.Pod) string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	role, ok := r.roles[pod]
+	if !ok {
+		role = podRole(pod)
+		r.roles[pod] = role
+	}
+	return role
+}
+
+// forget removes the role of a pod that's no longer cached.
+func (r *indexedRoles) forget(pod *v1.Pod) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.roles, pod)
 }
 
 // Run starts the controller processing updates. Blocks until the cache has synced
 func (s *PodCache) Run(ctx context.Context) error {
+	if s.source.backoff != nil {
+		s.source.backoff.stop = ctx.Done()
+	}
 	go s.controller.Run(ctx.Done())
 	log.Infof("started cache controller")
 
@@ -175,16 +385,34 @@ func (s *PodCache) Run(ctx context.Context) error {
 	return nil
 }
 
-// PodRole returns the IAM role specified in the annotation for the Pod
-func PodRole(pod *v1.Pod) string {
-	return pod.ObjectMeta.Annotations[AnnotationIAMRoleKey]
-}
-
 // AnnotationIAMRoleKey is the key for the annotation specifying the IAM Role
 const AnnotationIAMRoleKey = "iam.amazonaws.com/role"
 
 type podHandler struct {
-	pods chan<- *v1.Pod
+	pods               chan<- *v1.Pod
+	deleted            *deletedPods
+	networkAttachments bool
+	roles              *PodRoles
+	indexed            *indexedRoles
+}
+
+// remember keeps the deleted pod for the grace period, when there is one.
+func (o *podHandler) remember(pod *v1.Pod) {
+	if o.deleted == nil || IsPodCompleted(pod) {
+		return
+	}
+	o.deleted.add(pod, podIPs(pod, o.networkAttachments))
+}
+
+// checkNetworkStatus warns when the pod's network status annotation can't
+// be parsed, as the pod then can't be found by its attachments' IPs.
+func (o *podHandler) checkNetworkStatus(pod *v1.Pod) {
+	if !o.networkAttachments {
+		return
+	}
+	if _, err := NetworkAttachmentIPs(pod); err != nil {
+		log.WithFields(PodFields(pod)).Warnf("%s", err.Error())
+	}
 }
 
 func (o *podHandler) announce(pod *v1.Pod) {
@@ -192,7 +420,7 @@ func (o *podHandler) announce(pod *v1.Pod) {
 	if IsPodCompleted(pod) {
 		return
 	}
-	if PodRole(pod) == "" {
+	if o.roles.PodRole(pod) == "" {
 		return
 	}
 
@@ -212,6 +440,7 @@ func (o *podHandler) OnAdd(obj interface{}) {
 		return
 	}
 	log.WithFields(PodFields(pod)).Debugf("added pod")
+	o.checkNetworkStatus(pod)
 
 	o.announce(pod)
 }
@@ -228,12 +457,17 @@ func (o *podHandler) OnDelete(obj interface{}) {
 		pod, isPod = deletedObj.Obj.(*v1.Pod)
 		if !isPod {
 			log.Errorf("OnDelete unexpected DeletedFinalStateUnknown object: %+v", deletedObj.Obj)
+			return
 		}
 		log.WithFields(PodFields(pod)).Debugf("deleted pod")
+		o.indexed.forget(pod)
+		o.remember(pod)
 		return
 	}
 
 	log.WithFields(PodFields(pod)).Debugf("deleted pod")
+	o.indexed.forget(pod)
+	o.remember(pod)
 	return
 }
 
@@ -244,5 +478,37 @@ func (o *podHandler) OnUpdate(old, new interface{}) {
 		return
 	}
 
+	// resyncs deliver updates for unchanged pods
+	oldPod, ok := old.(*v1.Pod)
+	if ok && oldPod != pod {
+		o.indexed.forget(oldPod)
+	}
+	if ok && oldPod.ResourceVersion == pod.ResourceVersion {
+		podSync.record()
+	} else if !ok || networkStatusAnnotations(oldPod) != networkStatusAnnotations(pod) {
+		o.checkNetworkStatus(pod)
+	}
+
 	log.WithFields(PodFields(pod)).Debugf("updated pod")
 }
+
+// ActivePods returns the uncompleted pods in the cache.
+func (s *PodCache) ActivePods() []*v1.Pod {
+	var pods []*v1.Pod
+	for _, obj := range s.indexer.List() {
+		if pod, ok := obj.(*v1.Pod); ok && !IsPodCompleted(pod) {
+			pods = append(pods, pod)
+		}
+	}
+	return pods
+}
+
+// HasSynced returns whether the cache has synced with the api server
+func (s *PodCache) HasSynced() bool {
+	return s.controller.HasSynced()
+}
+
+// Len returns the number of pods in the cache
+func (s *PodCache) Len() int {
+	return len(s.indexer.ListKeys())
+}
@@ -17,8 +17,11 @@ import (
 	"context"
 	"fmt"
 	"github.com/fortytw2/leaktest"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/uswitch/kiam/pkg/statsd"
 	"github.com/uswitch/kiam/pkg/testutil"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	kt "k8s.io/client-go/tools/cache/testing"
 	"testing"
 	"time"
@@ -37,7 +40,7 @@ func TestFindsRunningPod(t *testing.T) {
 	defer cancel()
 
 	source := kt.NewFakeControllerSource()
-	c := NewPodCache(source, time.Second, bufferSize)
+	c := NewPodCache(source, time.Second, 0, bufferSize, nil)
 	source.Add(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Failed", "failed_role"))
 	source.Add(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "running_role"))
 	c.Run(ctx)
@@ -52,6 +55,278 @@ func TestFindsRunningPod(t *testing.T) {
 	}
 }
 
+func TestReturnsAmbiguousErrorForSharedIP(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	c := NewPodCache(source, time.Second, 0, bufferSize, nil)
+	source.Add(testutil.NewPodWithRole("ns", "first", "192.168.0.1", "Running", "first_role"))
+	source.Add(testutil.NewPodWithRole("ns", "second", "192.168.0.1", "Running", "second_role"))
+	c.Run(ctx)
+	defer source.Shutdown()
+
+	m := &dto.Metric{}
+	ambiguousPodIPs.Write(m)
+	before := m.GetCounter().GetValue()
+
+	found, err := c.GetPodByIP("192.168.0.1")
+	if err != ErrAmbiguousPodIP {
+		t.Error("expected ambiguous ip error, was", err)
+	}
+	if found != nil {
+		t.Error("expected no pod to be returned, was", found.Name)
+	}
+
+	ambiguousPodIPs.Write(m)
+	if ambiguous := m.GetCounter().GetValue() - before; ambiguous != 1 {
+		t.Error("expected ambiguous lookup to be counted, was", ambiguous)
+	}
+}
+
+func newPodWithAttachment(ip, attachmentIP string) *v1.Pod {
+	pod := testutil.NewPodWithRole("ns", "name", ip, "Running", "running_role")
+	pod.ObjectMeta.Annotations[AnnotationNetworkStatusKey] = fmt.Sprintf(`[{"name":"default","ips":["%s"]},{"name":"macvlan","ips":["%s"]}]`, ip, attachmentIP)
+	return pod
+}
+
+func TestFindsPodByAnyIP(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewPodCache(source, time.Second, 0, bufferSize, nil)
+	c.SetNetworkAttachmentIPs(true)
+	source.Add(newPodWithAttachment("192.168.0.1", "10.0.0.1"))
+	c.Run(ctx)
+
+	for _, ip := range []string{"192.168.0.1", "10.0.0.1"} {
+		found, err := c.GetPodByIP(ip)
+		if err != nil {
+			t.Fatal("error finding pod by", ip, err)
+		}
+		if found.ObjectMeta.Name != "name" {
+			t.Error("wrong pod found for", ip)
+		}
+	}
+
+	source.Modify(newPodWithAttachment("192.168.0.1", "10.0.0.2"))
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := c.GetPodByIP("10.0.0.1")
+		if err == ErrPodNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected stale ip to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := c.GetPodByIP("10.0.0.2"); err != nil {
+		t.Error("expected pod to be found by new ip:", err)
+	}
+}
+
+func TestIgnoresNetworkAttachmentsByDefault(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewPodCache(source, time.Second, 0, bufferSize, nil)
+	source.Add(newPodWithAttachment("192.168.0.1", "10.0.0.1"))
+	c.Run(ctx)
+
+	if _, err := c.GetPodByIP("10.0.0.1"); err != ErrPodNotFound {
+		t.Error("expected attachment ip to be ignored, was", err)
+	}
+}
+
+func TestStatusIPTakesPrecedenceOverNetworkAttachments(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewPodCache(source, time.Second, 0, bufferSize, nil)
+	c.SetNetworkAttachmentIPs(true)
+	source.Add(testutil.NewPodWithRole("ns", "victim", "192.168.0.2", "Running", "victim_role"))
+	source.Add(newPodWithAttachment("192.168.0.1", "192.168.0.2"))
+	c.Run(ctx)
+
+	found, err := c.GetPodByIP("192.168.0.2")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if found.ObjectMeta.Name != "victim" {
+		t.Error("expected pod assigned the ip, was", found.ObjectMeta.Name)
+	}
+}
+
+func TestNetworkAttachmentIPs(t *testing.T) {
+	pod := newPodWithAttachment("192.168.0.1", "10.0.0.1")
+	if ips := PodIPs(pod); len(ips) != 1 || ips[0] != "192.168.0.1" {
+		t.Error("expected only status ip:", ips)
+	}
+	if ips := podIPs(pod, true); len(ips) != 2 || ips[0] != "192.168.0.1" || ips[1] != "10.0.0.1" {
+		t.Error("unexpected ips:", ips)
+	}
+
+	pod.ObjectMeta.Annotations[AnnotationNetworkStatusKey] = "not json"
+	if _, err := NetworkAttachmentIPs(pod); err == nil {
+		t.Error("expected error parsing invalid annotation")
+	}
+	if ips := podIPs(pod, true); len(ips) != 1 || ips[0] != "192.168.0.1" {
+		t.Error("expected only primary ip with invalid annotation:", ips)
+	}
+}
+
+func TestPodRoleUsesNamespaceBaseARN(t *testing.T) {
+	roles := &PodRoles{
+		NamespaceBaseARNs: map[string]string{"team-a": "arn:aws:iam::111111111111:role/"},
+		DefaultRole:       "default_role",
+	}
+
+	mapped := testutil.NewPodWithRole("team-a", "name", "192.168.0.1", "Running", "app")
+	if role := roles.PodRole(mapped); role != "arn:aws:iam::111111111111:role/app" {
+		t.Error("expected role resolved with namespace base arn, was", role)
+	}
+
+	withPath := testutil.NewPodWithRole("team-a", "name", "192.168.0.1", "Running", "/path/app")
+	if role := roles.PodRole(withPath); role != "arn:aws:iam::111111111111:role/path/app" {
+		t.Error("expected role path resolved with namespace base arn, was", role)
+	}
+
+	absolute := testutil.NewPodWithRole("team-a", "name", "192.168.0.1", "Running", "arn:aws:iam::222222222222:role/app")
+	if role := roles.PodRole(absolute); role != "arn:aws:iam::222222222222:role/app" {
+		t.Error("expected absolute arn to be unchanged, was", role)
+	}
+
+	defaulted := testutil.NewPod("team-a", "name", "192.168.0.1", "Running")
+	if role := roles.PodRole(defaulted); role != "arn:aws:iam::111111111111:role/default_role" {
+		t.Error("expected default role resolved with namespace base arn, was", role)
+	}
+
+	unmapped := testutil.NewPodWithRole("team-b", "name", "192.168.0.1", "Running", "app")
+	if role := roles.PodRole(unmapped); role != "app" {
+		t.Error("expected role in unmapped namespace to be left for the server's base arn, was", role)
+	}
+}
+
+func TestPodRoleUsesDefaultRole(t *testing.T) {
+	roles := &PodRoles{}
+
+	annotated := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "annotated_role")
+	unannotated := testutil.NewPod("ns", "name", "192.168.0.1", "Running")
+
+	if role := roles.PodRole(unannotated); role != "" {
+		t.Error("expected no role without a default, was", role)
+	}
+
+	roles.DefaultRole = "default_role"
+
+	if role := roles.PodRole(annotated); role != "annotated_role" {
+		t.Error("expected annotation to override default, was", role)
+	}
+
+	if role := roles.PodRole(unannotated); role != "default_role" {
+		t.Error("expected default role, was", role)
+	}
+}
+
+func TestPodCachesUseTheirOwnRoles(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source.Add(testutil.NewPod("ns", "name", "192.168.0.1", "Running"))
+	first := NewPodCache(source, time.Second, 0, bufferSize, &PodRoles{DefaultRole: "first_role"})
+	second := NewPodCache(source, time.Second, 0, bufferSize, &PodRoles{DefaultRole: "second_role"})
+	first.Run(ctx)
+	second.Run(ctx)
+
+	if active, _ := first.IsActivePodsForRole("first_role"); !active {
+		t.Error("expected first cache to index pod by its default role")
+	}
+	if active, _ := second.IsActivePodsForRole("first_role"); active {
+		t.Error("expected second cache not to use the first's default role")
+	}
+	if active, _ := second.IsActivePodsForRole("second_role"); !active {
+		t.Error("expected second cache to index pod by its default role")
+	}
+}
+
+func labelledPod(annotatedRole, labelledRole string) *v1.Pod {
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", annotatedRole)
+	if annotatedRole == "" {
+		pod.ObjectMeta.Annotations = map[string]string{}
+	}
+	if labelledRole != "" {
+		pod.ObjectMeta.Labels = map[string]string{"kiam/role": labelledRole}
+	}
+	return pod
+}
+
+func TestPodRoleFromSource(t *testing.T) {
+	cases := []struct {
+		name      string
+		source    RoleSource
+		annotated string
+		labelled  string
+		expected  string
+		conflict  bool
+	}{
+		{"annotation by default", RoleSource{}, "annotated", "labelled", "annotated", false},
+		{"label ignored by default", RoleSource{}, "", "labelled", "", false},
+		{"label without annotation", RoleSource{Label: "kiam/role"}, "", "labelled", "labelled", false},
+		{"annotation without label", RoleSource{Label: "kiam/role"}, "annotated", "", "annotated", false},
+		{"annotation wins conflict", RoleSource{Label: "kiam/role"}, "annotated", "labelled", "annotated", false},
+		{"label wins conflict", RoleSource{Label: "kiam/role", PreferLabel: true}, "annotated", "labelled", "labelled", false},
+		{"annotation when label preferred but unset", RoleSource{Label: "kiam/role", PreferLabel: true}, "annotated", "", "annotated", false},
+		{"label only", RoleSource{Label: "kiam/role", IgnoreAnnotation: true}, "annotated", "", "", false},
+		{"label only ignores annotation conflict", RoleSource{Label: "kiam/role", IgnoreAnnotation: true, RejectConflicts: true}, "annotated", "labelled", "labelled", false},
+		{"conflict rejected", RoleSource{Label: "kiam/role", RejectConflicts: true}, "annotated", "labelled", "", true},
+		{"agreement not rejected", RoleSource{Label: "kiam/role", RejectConflicts: true}, "same", "same", "same", false},
+	}
+
+	for _, c := range cases {
+		roles := &PodRoles{Source: c.source}
+		pod := labelledPod(c.annotated, c.labelled)
+
+		role, err := roles.ResolvePodRole(pod)
+		if c.conflict && err != ErrRoleConflict {
+			t.Errorf("%s: expected conflict, was %v", c.name, err)
+		}
+		if !c.conflict && err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err)
+		}
+		if role != c.expected {
+			t.Errorf("%s: expected role %q, was %q", c.name, c.expected, role)
+		}
+		if role := roles.PodRole(pod); role != c.expected {
+			t.Errorf("%s: expected PodRole %q, was %q", c.name, c.expected, role)
+		}
+	}
+}
+
 func TestFindRoleActive(t *testing.T) {
 	defer leaktest.Check(t)()
 
@@ -59,7 +334,7 @@ func TestFindRoleActive(t *testing.T) {
 	defer cancel()
 
 	source := kt.NewFakeControllerSource()
-	c := NewPodCache(source, time.Second, bufferSize)
+	c := NewPodCache(source, time.Second, 0, bufferSize, nil)
 	source.Add(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Failed", "failed_role"))
 	source.Modify(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Failed", "running_role"))
 	source.Modify(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "running_role"))
@@ -84,7 +359,7 @@ func BenchmarkFindPodsByIP(b *testing.B) {
 	defer cancel()
 
 	source := kt.NewFakeControllerSource()
-	c := NewPodCache(source, time.Second, bufferSize)
+	c := NewPodCache(source, time.Second, 0, bufferSize, nil)
 	for i := 0; i < 1000; i++ {
 		source.Add(testutil.NewPodWithRole("ns", fmt.Sprintf("name-%d", i), fmt.Sprintf("ip-%d", i), "Running", "foo_role"))
 	}
@@ -111,7 +386,7 @@ func BenchmarkIsActiveRole(b *testing.B) {
 		role := i % 100
 		source.Add(testutil.NewPodWithRole("ns", fmt.Sprintf("name-%d", i), fmt.Sprintf("ip-%d", i), "Running", fmt.Sprintf("role-%d", role)))
 	}
-	c := NewPodCache(source, time.Second, bufferSize)
+	c := NewPodCache(source, time.Second, 0, bufferSize, nil)
 	c.Run(ctx)
 
 	b.StartTimer()
@@ -120,3 +395,148 @@ func BenchmarkIsActiveRole(b *testing.B) {
 		c.IsActivePodsForRole("role-0")
 	}
 }
+
+func TestJittersSyncInterval(t *testing.T) {
+	interval := time.Minute
+
+	if jitterSyncInterval(interval, 0, 1) != interval {
+		t.Error("expected no jitter with 0 factor")
+	}
+
+	jittered := jitterSyncInterval(interval, 0.5, 1)
+	if jittered < interval || jittered > interval+30*time.Second {
+		t.Error("jittered interval out of range:", jittered)
+	}
+
+	if jitterSyncInterval(interval, 0.5, 1) != jittered {
+		t.Error("expected same seed to produce the same interval")
+	}
+
+	if jitterSyncInterval(interval, 0.5, 2) == jittered {
+		t.Error("expected different seeds to produce different intervals")
+	}
+}
+
+// waitForPodLookup polls until looking up ip returns expected, or fails
+func waitForPodLookup(t *testing.T, c *PodCache, ip string, expected error) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := c.GetPodByIP(ip)
+		if err == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected lookup of %s to return %v, was %v", ip, expected, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFindsDeletedPodWithinGracePeriod(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewPodCache(source, time.Second, 0, 0, nil)
+	c.SetDeletedPodGracePeriod(500 * time.Millisecond)
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "running_role")
+	source.Add(pod)
+	c.Run(ctx)
+
+	source.Delete(pod)
+	deadline := time.Now().Add(time.Second)
+	for c.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the pod is remembered once the deletion has been handled
+	waitForPodLookup(t, c, "192.168.0.1", nil)
+
+	found, err := c.GetPodByIP("192.168.0.1")
+	if err != nil {
+		t.Fatal("expected deleted pod to be found within grace period:", err)
+	}
+	if c.PodRole(found) != "running_role" {
+		t.Error("wrong role found:", c.PodRole(found))
+	}
+
+	waitForPodLookup(t, c, "192.168.0.1", ErrPodNotFound)
+}
+
+func TestDoesntFindDeletedPodWithoutGracePeriod(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewPodCache(source, time.Second, 0, 0, nil)
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "running_role")
+	source.Add(pod)
+	c.Run(ctx)
+
+	source.Delete(pod)
+	waitForPodLookup(t, c, "192.168.0.1", ErrPodNotFound)
+}
+
+func TestRunningPodTakesPrecedenceOverDeletedPod(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewPodCache(source, time.Second, 0, 0, nil)
+	c.SetDeletedPodGracePeriod(time.Minute)
+	deleted := testutil.NewPodWithRole("ns", "deleted", "192.168.0.1", "Running", "deleted_role")
+	source.Add(deleted)
+	c.Run(ctx)
+
+	source.Delete(deleted)
+	source.Add(testutil.NewPodWithRole("ns", "replacement", "192.168.0.1", "Running", "replacement_role"))
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		found, err := c.GetPodByIP("192.168.0.1")
+		if err == nil && found.Name == "replacement" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the running pod to be found rather than the deleted pod")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFindSelectedPodsForRole(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewPodCache(source, time.Second, 0, 0, nil)
+	selected := testutil.NewPodWithRole("ns", "selected", "192.168.0.1", "Running", "selected_role")
+	selected.Labels = map[string]string{"kiam-prefetch": "true"}
+	source.Add(selected)
+	source.Add(testutil.NewPodWithRole("ns", "unselected", "192.168.0.2", "Running", "unselected_role"))
+	c.Run(ctx)
+
+	selector := labels.SelectorFromSet(labels.Set{"kiam-prefetch": "true"})
+	if active, _ := c.IsSelectedPodsForRole("selected_role", selector); !active {
+		t.Error("expected selected pod's role to be active")
+	}
+	if active, _ := c.IsSelectedPodsForRole("unselected_role", selector); active {
+		t.Error("expected unselected pod's role not to be active")
+	}
+}
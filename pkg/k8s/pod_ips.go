@@ -0,0 +1,98 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// AnnotationNetworkStatusKey is set by Multus (and other meta CNI
+	// plugins) with the IPs of each of the pod's network attachments.
+	AnnotationNetworkStatusKey = "k8s.v1.cni.cncf.io/network-status"
+	// AnnotationNetworksStatusKey is the deprecated name of the network
+	// status annotation used by older Multus releases.
+	AnnotationNetworksStatusKey = "k8s.v1.cni.cncf.io/networks-status"
+)
+
+type networkStatus struct {
+	Name string   `json:"name"`
+	IPs  []string `json:"ips"`
+}
+
+// PodIPs returns the IPs the pod is assigned in its status.
+func PodIPs(pod *v1.Pod) []string {
+	if pod.Status.PodIP == "" {
+		return []string{}
+	}
+	return []string{pod.Status.PodIP}
+}
+
+// NetworkAttachmentIPs returns the IPs of the pod's additional network
+// attachments reported in the network status annotation. The annotation
+// can be written by the pod's author, so the IPs aren't trustworthy.
+func NetworkAttachmentIPs(pod *v1.Pod) ([]string, error) {
+	var ips []string
+	for _, key := range []string{AnnotationNetworkStatusKey, AnnotationNetworksStatusKey} {
+		value, ok := pod.ObjectMeta.Annotations[key]
+		if !ok {
+			continue
+		}
+
+		var statuses []networkStatus
+		if err := json.Unmarshal([]byte(value), &statuses); err != nil {
+			return nil, fmt.Errorf("error parsing %s annotation: %s", key, err)
+		}
+
+		for _, status := range statuses {
+			ips = append(ips, status.IPs...)
+		}
+	}
+	return ips, nil
+}
+
+// podIPs returns the pod's IPs and, when networkAttachments is set, the
+// IPs of its network attachments. Unparseable annotations are ignored.
+func podIPs(pod *v1.Pod, networkAttachments bool) []string {
+	ips := PodIPs(pod)
+	if !networkAttachments {
+		return ips
+	}
+
+	attached, _ := NetworkAttachmentIPs(pod)
+	for _, ip := range attached {
+		if ip != "" && !containsIP(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// networkStatusAnnotations returns the pod's network status annotations, to detect
+// when they change.
+func networkStatusAnnotations(pod *v1.Pod) string {
+	return pod.ObjectMeta.Annotations[AnnotationNetworkStatusKey] + pod.ObjectMeta.Annotations[AnnotationNetworksStatusKey]
+}
+
+func containsIP(ips []string, ip string) bool {
+	for _, candidate := range ips {
+		if candidate == ip {
+			return true
+		}
+	}
+	return false
+}
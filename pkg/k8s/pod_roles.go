@@ -0,0 +1,166 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"context"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// RoleSource configures where PodRoles reads the role from a Pod.
+type RoleSource struct {
+	// Label is the key of the label specifying the role, labels are
+	// ignored when it's empty.
+	Label string
+	// IgnoreAnnotation reads the role only from the label.
+	IgnoreAnnotation bool
+	// PreferLabel uses the label rather than the annotation when both
+	// are set.
+	PreferLabel bool
+	// RejectConflicts treats pods whose annotation and label specify
+	// different roles as having no role, rather than using the preferred
+	// one.
+	RejectConflicts bool
+}
+
+// PodRoles finds the roles of pods from their annotations or labels, their
+// ServiceAccounts and the defaults it's configured with. The zero value
+// reads roles only from the pod's annotation.
+type PodRoles struct {
+	// Source configures where the role is read from a Pod.
+	Source RoleSource
+	// DefaultRole is used for pods without a role annotation. Empty
+	// disables the default.
+	DefaultRole string
+	// NamespaceBaseARNs are the base ARNs role names are resolved with for
+	// pods in each namespace, so they're cached and assumed as absolute
+	// ARNs. Pods in other namespaces use the server's base ARN.
+	NamespaceBaseARNs map[string]string
+	// ServiceAccounts finds the ServiceAccounts of pods without a role
+	// annotation. nil disables service account roles.
+	ServiceAccounts ServiceAccountFinder
+	// MaxRoleLength is the longest role, including any ARN prefix and
+	// path, accepted. 0 uses DefaultMaxRoleLength.
+	MaxRoleLength int
+}
+
+// PodRole returns the IAM role specified in the annotation or label for the
+// Pod, as configured by Source. Pods without either use the role annotated
+// on their ServiceAccount, when service account roles are enabled, and then
+// the default role. Pods whose annotation and label conflict have no role
+// when conflicts are rejected, as do pods with invalid roles. Role names
+// are resolved to ARNs for pods in namespaces with NamespaceBaseARNs.
+func (r *PodRoles) PodRole(pod *v1.Pod) string {
+	role, err := r.ResolvePodRole(pod)
+	if err != nil {
+		log.WithFields(PodFields(pod)).Warnf("pod has no role: %s", err.Error())
+		return ""
+	}
+	return role
+}
+
+// ResolvePodRole returns the role for the Pod as PodRole does, but returns
+// ErrRoleConflict when its annotation and label conflict and conflicts are
+// rejected, and ErrInvalidRole when the role isn't valid.
+func (r *PodRoles) ResolvePodRole(pod *v1.Pod) (string, error) {
+	role, err := r.unresolvedPodRole(pod)
+	if err != nil {
+		return "", err
+	}
+	if err := r.ValidateRole(role); err != nil {
+		return "", err
+	}
+	return r.namespaceRoleARN(pod, role), nil
+}
+
+// ValidateRole validates role as the package's ValidateRole does, with
+// the configured MaxRoleLength.
+func (r *PodRoles) ValidateRole(role string) error {
+	return validateRole(role, r.MaxRoleLength)
+}
+
+func (r *PodRoles) unresolvedPodRole(pod *v1.Pod) (string, error) {
+	role, err := r.podRoleFromSource(pod)
+	if err != nil || role != "" {
+		return role, err
+	}
+
+	if role := r.serviceAccountRole(pod); role != "" {
+		return role, nil
+	}
+
+	if r.DefaultRole != "" {
+		log.WithFields(PodFields(pod)).Debugf("pod has no role annotation, using default role %s", r.DefaultRole)
+	}
+	return r.DefaultRole, nil
+}
+
+// namespaceRoleARN prefixes role names with the base ARN of the pod's
+// namespace, when it has one. ARNs are returned unchanged.
+func (r *PodRoles) namespaceRoleARN(pod *v1.Pod, role string) string {
+	base, ok := r.NamespaceBaseARNs[pod.Namespace]
+	if !ok || role == "" || strings.HasPrefix(role, "arn:") {
+		return role
+	}
+	return base + strings.TrimPrefix(role, "/")
+}
+
+func (r *PodRoles) podRoleFromSource(pod *v1.Pod) (string, error) {
+	var annotated, labelled string
+	if !r.Source.IgnoreAnnotation {
+		annotated = pod.ObjectMeta.Annotations[AnnotationIAMRoleKey]
+	}
+	if r.Source.Label != "" {
+		labelled = pod.ObjectMeta.Labels[r.Source.Label]
+	}
+
+	if annotated != "" && labelled != "" && annotated != labelled {
+		if r.Source.RejectConflicts {
+			return "", ErrRoleConflict
+		}
+		log.WithFields(PodFields(pod)).Debugf("pod role annotation %s and label %s differ", annotated, labelled)
+	}
+
+	first, second := annotated, labelled
+	if r.Source.PreferLabel {
+		first, second = labelled, annotated
+	}
+	if first != "" {
+		return first, nil
+	}
+	return second, nil
+}
+
+func (r *PodRoles) serviceAccountRole(pod *v1.Pod) string {
+	if r.ServiceAccounts == nil || pod.Spec.ServiceAccountName == "" {
+		return ""
+	}
+
+	serviceAccount, err := r.ServiceAccounts.FindServiceAccount(context.Background(), pod.Namespace, pod.Spec.ServiceAccountName)
+	if err != nil {
+		log.WithFields(PodFields(pod)).Errorf("error finding service account: %s", err.Error())
+		return ""
+	}
+	if serviceAccount == nil {
+		return ""
+	}
+
+	role := serviceAccount.GetAnnotations()[AnnotationIAMRoleKey]
+	if role != "" {
+		log.WithFields(PodFields(pod)).Debugf("pod has no role annotation, using service account role %s", role)
+	}
+	return role
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// syncTracker records when a cache last listed from the api server or
+// resynced.
+type syncTracker struct {
+	// last is the time, in unix nanoseconds, of the last sync
+	last int64
+}
+
+var (
+	podSync       = &syncTracker{}
+	namespaceSync = &syncTracker{}
+)
+
+func (t *syncTracker) record() {
+	atomic.StoreInt64(&t.last, time.Now().UnixNano())
+}
+
+// age returns the time since the cache last synced, or 0 if it hasn't
+// synced yet.
+func (t *syncTracker) age() time.Duration {
+	last := atomic.LoadInt64(&t.last)
+	if last == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// syncTrackingListerWatcher records successful lists as syncs and counts
+// each watch after the first as a reconnect. When backoff is set, attempts
+// after failures are delayed.
+type syncTrackingListerWatcher struct {
+	cache.ListerWatcher
+	tracker    *syncTracker
+	reconnects prometheus.Counter
+	watches    int64
+	backoff    *watchBackoff
+}
+
+func newSyncTrackingListerWatcher(source cache.ListerWatcher, tracker *syncTracker, reconnects prometheus.Counter) *syncTrackingListerWatcher {
+	return &syncTrackingListerWatcher{ListerWatcher: source, tracker: tracker, reconnects: reconnects}
+}
+
+func (l *syncTrackingListerWatcher) List(options metav1.ListOptions) (runtime.Object, error) {
+	if l.backoff != nil {
+		l.backoff.wait()
+	}
+	obj, err := l.ListerWatcher.List(options)
+	if l.backoff != nil {
+		l.backoff.record(err)
+	}
+	if err == nil {
+		l.tracker.record()
+	}
+	return obj, err
+}
+
+func (l *syncTrackingListerWatcher) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	if atomic.AddInt64(&l.watches, 1) > 1 && l.reconnects != nil {
+		l.reconnects.Inc()
+	}
+	if l.backoff == nil {
+		return l.ListerWatcher.Watch(options)
+	}
+
+	l.backoff.wait()
+	w, err := l.ListerWatcher.Watch(options)
+	l.backoff.record(err)
+	return w, err
+}
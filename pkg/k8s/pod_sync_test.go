@@ -0,0 +1,116 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/uswitch/kiam/pkg/testutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kt "k8s.io/client-go/tools/cache/testing"
+)
+
+func TestRecordsPodSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	podSync.last = 0
+	if podSync.age() != 0 {
+		t.Error("expected no lag before first sync, was", podSync.age())
+	}
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "role"))
+
+	c := NewPodCache(source, time.Second, 0, 0, nil)
+	c.Run(ctx)
+
+	if podSync.last == 0 {
+		t.Error("expected sync to be recorded")
+	}
+	if age := podSync.age(); age <= 0 || age > time.Second {
+		t.Error("unexpected sync lag", age)
+	}
+}
+
+func TestCountsWatchReconnects(t *testing.T) {
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	lw := newSyncTrackingListerWatcher(source, &syncTracker{}, podWatchReconnects)
+
+	before := watchReconnects(t)
+	for i := 0; i < 3; i++ {
+		w, err := lw.Watch(metav1.ListOptions{ResourceVersion: "0"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		w.Stop()
+	}
+
+	if reconnects := watchReconnects(t) - before; reconnects != 2 {
+		t.Error("expected 2 reconnects, was", reconnects)
+	}
+}
+
+func TestRecordsNamespaceResync(t *testing.T) {
+	namespaceSync.last = 0
+	namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns", ResourceVersion: "1"}}
+	handler := &namespaceLogger{}
+
+	// a changed namespace isn't a resync
+	handler.OnUpdate(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns", ResourceVersion: "0"}}, namespace)
+	if namespaceSync.last != 0 {
+		t.Error("expected update not to be recorded as a sync")
+	}
+
+	handler.OnUpdate(namespace, namespace)
+	if age := namespaceSync.age(); age <= 0 || age > time.Second {
+		t.Error("unexpected sync lag", age)
+	}
+	if lag := gaugeValue(t, namespaceSyncLag); lag <= 0 || lag > 1 {
+		t.Error("unexpected sync lag gauge", lag)
+	}
+}
+
+func TestCountsPodCacheMisses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	c := NewPodCache(source, time.Second, 0, 0, nil)
+	c.Run(ctx)
+
+	before := counterValue(t, podCacheMisses)
+	if _, err := c.GetPodByIP("192.168.0.1"); err != ErrPodNotFound {
+		t.Error("unexpected error", err)
+	}
+
+	if misses := counterValue(t, podCacheMisses) - before; misses != 1 {
+		t.Error("expected 1 miss, was", misses)
+	}
+}
+
+func watchReconnects(t *testing.T) float64 {
+	return counterValue(t, podWatchReconnects)
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	if err := counter.Write(m); err != nil {
+		t.Fatal(err.Error())
+	}
+	return m.GetCounter().GetValue()
+}
+
+func gaugeValue(t *testing.T, gauge prometheus.Metric) float64 {
+	m := &dto.Metric{}
+	if err := gauge.Write(m); err != nil {
+		t.Fatal(err.Error())
+	}
+	return m.GetGauge().GetValue()
+}
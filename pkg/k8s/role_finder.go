@@ -0,0 +1,45 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"context"
+
+	"k8s.io/api/core/v1"
+)
+
+// annotationRoleFinder finds roles from the annotations, or labels, of the
+// Pods returned by a PodGetter.
+type annotationRoleFinder struct {
+	pods  PodGetter
+	roles *PodRoles
+}
+
+// NewAnnotationRoleFinder returns a RoleFinder that resolves the role of the
+// Pod with an IP with roles, or only from its annotation when roles is nil.
+func NewAnnotationRoleFinder(pods PodGetter, roles *PodRoles) RoleFinder {
+	if roles == nil {
+		roles = &PodRoles{}
+	}
+	return &annotationRoleFinder{pods: pods, roles: roles}
+}
+
+func (f *annotationRoleFinder) FindPodRole(ctx context.Context, ip string) (*v1.Pod, string, error) {
+	pod, err := f.pods.GetPodByIP(ip)
+	if err != nil {
+		return nil, "", err
+	}
+	role, err := f.roles.ResolvePodRole(pod)
+	return pod, role, err
+}
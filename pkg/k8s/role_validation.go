@@ -0,0 +1,75 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	// DefaultMaxRoleLength is the longest role ARN accepted by AssumeRole.
+	DefaultMaxRoleLength = 2048
+	// maxRoleNameLength is the longest role name IAM permits, excluding
+	// any path.
+	maxRoleNameLength = 64
+	// maxQuotedRoleLength is how much of an invalid role is quoted in
+	// errors.
+	maxQuotedRoleLength = 64
+)
+
+// ErrInvalidRole is returned when a pod's role is too long or contains
+// characters IAM doesn't permit.
+var ErrInvalidRole = fmt.Errorf("invalid role")
+
+// rolePattern matches role names, optionally with a path or as an ARN,
+// capturing the name.
+var rolePattern = regexp.MustCompile(`^(?:arn:[a-z-]+:iam::\d{12}:role)?/?(?:[\w+=,.@-]+/)*([\w+=,.@-]+)$`)
+
+// ValidateRole returns an error wrapping ErrInvalidRole if role is longer
+// than DefaultMaxRoleLength, its name is longer than IAM permits, or it
+// contains characters IAM doesn't permit. Empty roles are valid.
+func ValidateRole(role string) error {
+	return validateRole(role, DefaultMaxRoleLength)
+}
+
+// validateRole validates role as ValidateRole does, but with a maximum
+// length of maxRoleLength, or DefaultMaxRoleLength when it's 0.
+func validateRole(role string, maxRoleLength int) error {
+	if role == "" {
+		return nil
+	}
+	if maxRoleLength <= 0 {
+		maxRoleLength = DefaultMaxRoleLength
+	}
+	if len(role) > maxRoleLength {
+		return fmt.Errorf("%w: %d characters exceeds maximum of %d: %s", ErrInvalidRole, len(role), maxRoleLength, quoteRole(role))
+	}
+	match := rolePattern.FindStringSubmatch(role)
+	if match == nil {
+		return fmt.Errorf("%w: contains characters other than letters, digits and +=,.@_-: %s", ErrInvalidRole, quoteRole(role))
+	}
+	if len(match[1]) > maxRoleNameLength {
+		return fmt.Errorf("%w: name of %d characters exceeds maximum of %d: %s", ErrInvalidRole, len(match[1]), maxRoleNameLength, quoteRole(role))
+	}
+	return nil
+}
+
+// quoteRole quotes the start of role so it's safe to log.
+func quoteRole(role string) string {
+	if len(role) > maxQuotedRoleLength {
+		return fmt.Sprintf("%q...", role[:maxQuotedRoleLength])
+	}
+	return fmt.Sprintf("%q", role)
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/uswitch/kiam/pkg/testutil"
+)
+
+func TestValidatesRoles(t *testing.T) {
+	valid := []string{
+		"",
+		"role",
+		"team_role+=,.@-1",
+		"/path/role",
+		"path/to/role",
+		"arn:aws:iam::123456789012:role/role",
+		"arn:aws-cn:iam::123456789012:role/path/role",
+		strings.Repeat("a", 64),
+	}
+	for _, role := range valid {
+		if err := ValidateRole(role); err != nil {
+			t.Errorf("expected %q to be valid: %s", role, err)
+		}
+	}
+
+	invalid := []string{
+		"role\nlevel=error msg=injected",
+		"role\x00",
+		"role\x1b[31m",
+		"role name",
+		"róle",
+		"role;rm -rf",
+		"role/",
+		"//role",
+		"arn:aws:iam::123:role/role",
+		"arn:aws:s3:::bucket",
+		strings.Repeat("a", 65),
+		"path/" + strings.Repeat("a", 65),
+		strings.Repeat("path/", 500) + "role",
+	}
+	for _, role := range invalid {
+		err := ValidateRole(role)
+		if !errors.Is(err, ErrInvalidRole) {
+			t.Errorf("expected %q to be invalid, was %v", role, err)
+			continue
+		}
+		if strings.ContainsAny(err.Error(), "\n\x00\x1b") {
+			t.Errorf("expected control characters to be escaped in error, was %q", err.Error())
+		}
+		if len(err.Error()) > 256 {
+			t.Errorf("expected long role to be truncated in error, was %d characters", len(err.Error()))
+		}
+	}
+}
+
+func TestConfiguresMaxRoleLength(t *testing.T) {
+	role := "path/to/role"
+	roles := &PodRoles{MaxRoleLength: len(role) - 1}
+	if err := roles.ValidateRole(role); !errors.Is(err, ErrInvalidRole) {
+		t.Error("expected role over the configured length to be invalid, was", err)
+	}
+
+	roles.MaxRoleLength = 0
+	if err := roles.ValidateRole(role); err != nil {
+		t.Error("expected default maximum to be restored, was", err)
+	}
+}
+
+func TestPodRoleRejectsInvalidRoles(t *testing.T) {
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "role\nlevel=error")
+
+	roles := &PodRoles{}
+	if role := roles.PodRole(pod); role != "" {
+		t.Error("expected pod with invalid role to have no role, was", role)
+	}
+	if _, err := roles.ResolvePodRole(pod); !errors.Is(err, ErrInvalidRole) {
+		t.Error("expected invalid role error, was", err)
+	}
+}
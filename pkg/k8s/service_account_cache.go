@@ -0,0 +1,131 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ServiceAccountCache implements the ServiceAccountFinder interface used to
+// find roles for pods that aren't annotated themselves
+type ServiceAccountCache struct {
+	indexer    cache.Indexer
+	controller cache.Controller
+	handler    *serviceAccountHandler
+}
+
+// NewServiceAccountCache creates the cache storing ServiceAccounts
+func NewServiceAccountCache(source cache.ListerWatcher, syncInterval time.Duration) *ServiceAccountCache {
+	handler := &serviceAccountHandler{}
+	indexer, controller := cache.NewIndexerInformer(source, &v1.ServiceAccount{}, syncInterval, handler, cache.Indexers{})
+	return &ServiceAccountCache{
+		indexer:    indexer,
+		controller: controller,
+		handler:    handler,
+	}
+}
+
+// SetChangeHandler calls changed with the namespace and name of
+// ServiceAccounts that are added with a role annotation, whose annotation
+// changes or that are deleted, so
+// roles found from them can be updated. It must be called before Run.
+func (c *ServiceAccountCache) SetChangeHandler(changed func(namespace, name string)) {
+	c.handler.changed = changed
+}
+
+// Run starts the cache processing updates. Blocks until cache has synced
+func (c *ServiceAccountCache) Run(ctx context.Context) error {
+	go c.controller.Run(ctx.Done())
+	log.Infof("started service account cache controller")
+
+	ok := cache.WaitForCacheSync(ctx.Done(), c.controller.HasSynced)
+	if !ok {
+		return ErrWaitingForSync
+	}
+
+	return nil
+}
+
+// FindServiceAccount finds the ServiceAccount by its namespace and name
+func (c *ServiceAccountCache) FindServiceAccount(ctx context.Context, namespace, name string) (*v1.ServiceAccount, error) {
+	obj, exists, err := c.indexer.GetByKey(fmt.Sprintf("%s/%s", namespace, name))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	return obj.(*v1.ServiceAccount), nil
+}
+
+type serviceAccountHandler struct {
+	changed func(namespace, name string)
+}
+
+func (o *serviceAccountHandler) notify(serviceAccount *v1.ServiceAccount) {
+	if o.changed != nil {
+		o.changed(serviceAccount.Namespace, serviceAccount.Name)
+	}
+}
+
+func (o *serviceAccountHandler) OnAdd(obj interface{}) {
+	serviceAccount, isServiceAccount := obj.(*v1.ServiceAccount)
+	if !isServiceAccount {
+		log.Errorf("OnAdd unexpected object: %+v", obj)
+		return
+	}
+	log.WithFields(serviceAccountFields(serviceAccount)).Debugf("added service account")
+	if serviceAccount.GetAnnotations()[AnnotationIAMRoleKey] != "" {
+		o.notify(serviceAccount)
+	}
+}
+
+func (o *serviceAccountHandler) OnDelete(obj interface{}) {
+	serviceAccount, isServiceAccount := obj.(*v1.ServiceAccount)
+	if !isServiceAccount {
+		deletedObj, isDeleted := obj.(cache.DeletedFinalStateUnknown)
+		if !isDeleted {
+			log.Errorf("OnDelete unexpected object: %+v", obj)
+			return
+		}
+
+		serviceAccount, isServiceAccount = deletedObj.Obj.(*v1.ServiceAccount)
+		if !isServiceAccount {
+			log.Errorf("OnDelete unexpected DeletedFinalStateUnknown object: %+v", deletedObj.Obj)
+			return
+		}
+	}
+
+	log.WithFields(serviceAccountFields(serviceAccount)).Debugf("deleted service account")
+	o.notify(serviceAccount)
+}
+
+func (o *serviceAccountHandler) OnUpdate(old, new interface{}) {
+	serviceAccount, isServiceAccount := new.(*v1.ServiceAccount)
+	if !isServiceAccount {
+		log.Errorf("OnUpdate unexpected object: %+v", new)
+		return
+	}
+
+	log.WithFields(serviceAccountFields(serviceAccount)).Debugf("updated service account")
+	oldServiceAccount, ok := old.(*v1.ServiceAccount)
+	if !ok || oldServiceAccount.GetAnnotations()[AnnotationIAMRoleKey] != serviceAccount.GetAnnotations()[AnnotationIAMRoleKey] {
+		o.notify(serviceAccount)
+	}
+}
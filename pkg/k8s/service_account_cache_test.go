@@ -0,0 +1,125 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/uswitch/kiam/pkg/testutil"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kt "k8s.io/client-go/tools/cache/testing"
+)
+
+func newServiceAccount(namespace, name, role string) *v1.ServiceAccount {
+	return &v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Annotations: map[string]string{AnnotationIAMRoleKey: role},
+		},
+	}
+}
+
+func TestFindsServiceAccount(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(newServiceAccount("ns", "app", "sa_role"))
+
+	c := NewServiceAccountCache(source, time.Second)
+	c.Run(ctx)
+
+	found, err := c.FindServiceAccount(ctx, "ns", "app")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if found == nil || found.Annotations[AnnotationIAMRoleKey] != "sa_role" {
+		t.Error("expected to find service account, was", found)
+	}
+
+	found, _ = c.FindServiceAccount(ctx, "other", "app")
+	if found != nil {
+		t.Error("expected no service account in other namespace")
+	}
+}
+
+type stubServiceAccountFinder map[string]*v1.ServiceAccount
+
+func (f stubServiceAccountFinder) FindServiceAccount(ctx context.Context, namespace, name string) (*v1.ServiceAccount, error) {
+	return f[namespace+"/"+name], nil
+}
+
+func TestPodRolePrecedence(t *testing.T) {
+	roles := &PodRoles{
+		DefaultRole: "default_role",
+		ServiceAccounts: stubServiceAccountFinder{
+			"ns/app":      newServiceAccount("ns", "app", "sa_role"),
+			"ns/unrolled": newServiceAccount("ns", "unrolled", ""),
+		},
+	}
+
+	annotated := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "pod_role")
+	annotated.Spec.ServiceAccountName = "app"
+	if role := roles.PodRole(annotated); role != "pod_role" {
+		t.Error("expected pod annotation to take precedence, was", role)
+	}
+
+	withServiceAccount := testutil.NewPod("ns", "name", "192.168.0.1", "Running")
+	withServiceAccount.Spec.ServiceAccountName = "app"
+	if role := roles.PodRole(withServiceAccount); role != "sa_role" {
+		t.Error("expected service account role, was", role)
+	}
+
+	for _, name := range []string{"unrolled", "missing", ""} {
+		pod := testutil.NewPod("ns", "name", "192.168.0.1", "Running")
+		pod.Spec.ServiceAccountName = name
+		if role := roles.PodRole(pod); role != "default_role" {
+			t.Error("expected default role for service account", name, "was", role)
+		}
+	}
+}
+
+func TestReindexesPodsWhenServiceAccountRoleChanges(t *testing.T) {
+	serviceAccounts := kt.NewFakeControllerSource()
+	defer serviceAccounts.Shutdown()
+	pods := kt.NewFakeControllerSource()
+	defer pods.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serviceAccounts.Add(newServiceAccount("ns", "app", "sa_role"))
+	pod := testutil.NewPod("ns", "name", "192.168.0.1", "Running")
+	pod.Spec.ServiceAccountName = "app"
+	pods.Add(pod)
+
+	serviceAccountCache := NewServiceAccountCache(serviceAccounts, time.Minute)
+	podCache := NewPodCache(pods, time.Minute, 0, 10, &PodRoles{ServiceAccounts: serviceAccountCache})
+	serviceAccountCache.SetChangeHandler(podCache.ServiceAccountChanged)
+	serviceAccountCache.Run(ctx)
+	podCache.Run(ctx)
+	<-podCache.Pods()
+
+	serviceAccounts.Modify(newServiceAccount("ns", "app", "new_role"))
+	announced := <-podCache.Pods()
+	if role := podCache.PodRole(announced); role != "new_role" {
+		t.Error("expected pod to be announced with the new role, was", role)
+	}
+	if active, _ := podCache.IsActivePodsForRole("new_role"); !active {
+		t.Error("expected pod to be indexed by the new role")
+	}
+	if active, _ := podCache.IsActivePodsForRole("sa_role"); active {
+		t.Error("expected pod not to be indexed by the old role")
+	}
+
+	serviceAccounts.Delete(newServiceAccount("ns", "app", "new_role"))
+	for {
+		if active, _ := podCache.IsActivePodsForRole("new_role"); !active {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
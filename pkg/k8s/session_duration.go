@@ -0,0 +1,40 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+// AnnotationSessionDurationKey is the key for the annotation holding the
+// session duration, such as 1h, the Pod's credentials are requested for.
+const AnnotationSessionDurationKey = "iam.amazonaws.com/session-duration"
+
+// PodSessionDuration returns the session duration the Pod is annotated
+// with, or 0 if it doesn't request one.
+func PodSessionDuration(pod *v1.Pod) (time.Duration, error) {
+	value := pod.GetAnnotations()[AnnotationSessionDurationKey]
+	if value == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid session duration %q", value)
+	}
+	return duration, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// AnnotationSessionPolicyKey is the key for the annotation holding an inline
+	// JSON session policy used to restrict the Pod's credentials.
+	AnnotationSessionPolicyKey = "iam.amazonaws.com/session-policy"
+	// AnnotationSessionPolicyConfigMapKey is the key for the annotation referencing
+	// a session policy stored in a ConfigMap in the Pod's namespace. The value
+	// is of the form <configmap name>/<key>.
+	AnnotationSessionPolicyConfigMapKey = "iam.amazonaws.com/session-policy-configmap"
+	// AnnotationSessionPolicyARNsKey is the key for the annotation holding a
+	// comma separated list of managed policy ARNs used to restrict the Pod's
+	// credentials.
+	AnnotationSessionPolicyARNsKey = "iam.amazonaws.com/session-policy-arns"
+)
+
+// ErrMultipleSessionPolicies is returned when a Pod is annotated with both an
+// inline and a ConfigMap session policy.
+var ErrMultipleSessionPolicies = fmt.Errorf("pod specifies both inline and configmap session policies")
+
+// SessionPolicyResolver finds the session policy for a Pod from its annotations,
+// reading ConfigMaps as needed.
+type SessionPolicyResolver struct {
+	configMaps ConfigMapFinder
+}
+
+// NewSessionPolicyResolver creates a SessionPolicyResolver. configMaps may be
+// nil in which case only inline policies are supported.
+func NewSessionPolicyResolver(configMaps ConfigMapFinder) *SessionPolicyResolver {
+	return &SessionPolicyResolver{configMaps: configMaps}
+}
+
+// FindSessionPolicy returns the session policy for the Pod, or an empty string
+// if the Pod doesn't request one.
+func (r *SessionPolicyResolver) FindSessionPolicy(ctx context.Context, pod *v1.Pod) (string, error) {
+	inline := pod.GetAnnotations()[AnnotationSessionPolicyKey]
+	ref := pod.GetAnnotations()[AnnotationSessionPolicyConfigMapKey]
+
+	if inline != "" && ref != "" {
+		return "", ErrMultipleSessionPolicies
+	}
+
+	if ref == "" {
+		return inline, nil
+	}
+
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid session policy configmap reference %q, expected <name>/<key>", ref)
+	}
+	if r.configMaps == nil {
+		return "", fmt.Errorf("session policy configmaps are not enabled")
+	}
+
+	cm, err := r.configMaps.FindConfigMap(ctx, pod.GetNamespace(), parts[0])
+	if err != nil {
+		return "", fmt.Errorf("error reading session policy configmap %s/%s: %s", pod.GetNamespace(), parts[0], err)
+	}
+	if cm == nil {
+		return "", fmt.Errorf("session policy configmap %s/%s not found", pod.GetNamespace(), parts[0])
+	}
+
+	policy, ok := cm.Data[parts[1]]
+	if !ok {
+		return "", fmt.Errorf("session policy configmap %s/%s has no key %q", pod.GetNamespace(), parts[0], parts[1])
+	}
+
+	return policy, nil
+}
+
+// PodSessionPolicyARNs returns the managed session policy ARNs the Pod is
+// annotated with, or nil if it doesn't request any.
+func PodSessionPolicyARNs(pod *v1.Pod) []string {
+	var arns []string
+	for _, arn := range strings.Split(pod.GetAnnotations()[AnnotationSessionPolicyARNsKey], ",") {
+		if arn = strings.TrimSpace(arn); arn != "" {
+			arns = append(arns, arn)
+		}
+	}
+	return arns
+}
@@ -0,0 +1,118 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/uswitch/kiam/pkg/testutil"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kt "k8s.io/client-go/tools/cache/testing"
+)
+
+const testPolicy = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"*"}]}`
+
+func TestNoSessionPolicy(t *testing.T) {
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "role")
+	resolver := NewSessionPolicyResolver(nil)
+
+	policy, err := resolver.FindSessionPolicy(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if policy != "" {
+		t.Error("expected no policy, was", policy)
+	}
+}
+
+func TestInlineSessionPolicy(t *testing.T) {
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "role")
+	pod.Annotations[AnnotationSessionPolicyKey] = testPolicy
+	resolver := NewSessionPolicyResolver(nil)
+
+	policy, err := resolver.FindSessionPolicy(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if policy != testPolicy {
+		t.Error("unexpected policy, was", policy)
+	}
+}
+
+func TestConfigMapSessionPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "policies"},
+		Data:       map[string]string{"s3.json": testPolicy},
+	})
+
+	configMaps := NewConfigMapCache(source, time.Second)
+	configMaps.Run(ctx)
+	resolver := NewSessionPolicyResolver(configMaps)
+
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "role")
+	pod.Annotations[AnnotationSessionPolicyConfigMapKey] = "policies/s3.json"
+	policy, err := resolver.FindSessionPolicy(context.Background(), pod)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if policy != testPolicy {
+		t.Error("unexpected policy, was", policy)
+	}
+
+	pod.Annotations[AnnotationSessionPolicyConfigMapKey] = "policies/missing.json"
+	if _, err = resolver.FindSessionPolicy(context.Background(), pod); err == nil {
+		t.Error("expected error for missing configmap key")
+	}
+
+	pod.Annotations[AnnotationSessionPolicyConfigMapKey] = "policies"
+	if _, err = resolver.FindSessionPolicy(context.Background(), pod); err == nil {
+		t.Error("expected error for malformed configmap reference")
+	}
+
+	other := testutil.NewPodWithRole("other", "name", "192.168.0.2", "Running", "role")
+	other.Annotations[AnnotationSessionPolicyConfigMapKey] = "policies/s3.json"
+	if _, err = resolver.FindSessionPolicy(context.Background(), other); err == nil {
+		t.Error("expected error reading configmap from another namespace")
+	}
+}
+
+func TestRejectsInlineAndConfigMapSessionPolicy(t *testing.T) {
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "role")
+	pod.Annotations[AnnotationSessionPolicyKey] = testPolicy
+	pod.Annotations[AnnotationSessionPolicyConfigMapKey] = "policies/s3.json"
+	resolver := NewSessionPolicyResolver(nil)
+
+	_, err := resolver.FindSessionPolicy(context.Background(), pod)
+	if err != ErrMultipleSessionPolicies {
+		t.Error("unexpected error, was", err)
+	}
+}
+
+func TestRejectsConfigMapSessionPolicyWhenDisabled(t *testing.T) {
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "role")
+	pod.Annotations[AnnotationSessionPolicyConfigMapKey] = "policies/s3.json"
+	resolver := NewSessionPolicyResolver(nil)
+
+	if _, err := resolver.FindSessionPolicy(context.Background(), pod); err == nil {
+		t.Error("expected error reading configmap session policy without configmaps")
+	}
+}
@@ -55,6 +55,10 @@ func (f *stubAnnouncer) IsActivePodsForRole(role string) (bool, error) {
 	return true, nil
 }
 
+func (f *stubAnnouncer) PodRole(pod *v1.Pod) string {
+	return pod.GetAnnotations()[k8s.AnnotationIAMRoleKey]
+}
+
 type stubNSFinder struct {
 	n *v1.Namespace
 }
@@ -0,0 +1,112 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package k8s
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// WatchBackoff spaces out attempts to list and watch the api server after
+// consecutive failures, so a prolonged outage doesn't cause a tight
+// reconnect loop.
+type WatchBackoff struct {
+	// Initial is the delay after the first failure, it doubles with each
+	// consecutive failure up to Max. 0 disables backoff.
+	Initial time.Duration
+	Max     time.Duration
+	// Jitter extends each delay by a random amount of up to Jitter * delay
+	// so replicas don't reconnect in lockstep.
+	Jitter float64
+}
+
+// DefaultWatchBackoff waits 1s after the first failure, up to 1m between
+// attempts during extended outages.
+func DefaultWatchBackoff() WatchBackoff {
+	return WatchBackoff{
+		Initial: time.Second,
+		Max:     time.Minute,
+		Jitter:  0.5,
+	}
+}
+
+// Validate returns an error if the backoff settings are inconsistent.
+func (b WatchBackoff) Validate() error {
+	if b.Initial < 0 {
+		return fmt.Errorf("watch backoff must not be negative, was %s", b.Initial)
+	}
+	if b.Initial > 0 && b.Max < b.Initial {
+		return fmt.Errorf("watch backoff max (%s) must be at least the initial backoff (%s)", b.Max, b.Initial)
+	}
+	if b.Jitter < 0 {
+		return fmt.Errorf("watch backoff jitter must not be negative, was %f", b.Jitter)
+	}
+	return nil
+}
+
+// delay returns how long to wait after failures consecutive failures,
+// before jitter.
+func (b WatchBackoff) delay(failures int64) time.Duration {
+	if b.Initial <= 0 || failures <= 0 {
+		return 0
+	}
+	delay := b.Initial
+	for i := int64(1); i < failures && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	return delay
+}
+
+// watchBackoff tracks consecutive list and watch failures.
+type watchBackoff struct {
+	config   WatchBackoff
+	failures int64
+	// stop interrupts waiting, it's set before the cache runs
+	stop <-chan struct{}
+}
+
+// wait blocks for the backoff delay after any consecutive failures.
+func (b *watchBackoff) wait() {
+	failures := atomic.LoadInt64(&b.failures)
+	delay := b.config.delay(failures)
+	if delay <= 0 {
+		return
+	}
+	if b.config.Jitter > 0 {
+		delay += time.Duration(rand.Float64() * b.config.Jitter * float64(delay))
+	}
+
+	log.Warnf("waiting %s before reconnecting to the api server after %d failures", delay, failures)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-b.stop:
+	}
+}
+
+// record resets the failures after a success, or counts a failure.
+func (b *watchBackoff) record(err error) {
+	if err == nil {
+		atomic.StoreInt64(&b.failures, 0)
+		return
+	}
+	atomic.AddInt64(&b.failures, 1)
+	podWatchFailures.Inc()
+}
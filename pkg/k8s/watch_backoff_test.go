@@ -0,0 +1,127 @@
+package k8s
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	kt "k8s.io/client-go/tools/cache/testing"
+)
+
+func TestWatchBackoffDoublesUpToMax(t *testing.T) {
+	backoff := WatchBackoff{Initial: time.Second, Max: 10 * time.Second}
+	expected := map[int64]time.Duration{0: 0, 1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 5: 10 * time.Second, 1000: 10 * time.Second}
+	for failures, delay := range expected {
+		if d := backoff.delay(failures); d != delay {
+			t.Errorf("expected %s after %d failures, was %s", delay, failures, d)
+		}
+	}
+
+	if d := (WatchBackoff{}).delay(3); d != 0 {
+		t.Error("expected no delay when disabled, was", d)
+	}
+}
+
+func TestValidatesWatchBackoff(t *testing.T) {
+	if err := DefaultWatchBackoff().Validate(); err != nil {
+		t.Error("unexpected error", err)
+	}
+	if err := (WatchBackoff{}).Validate(); err != nil {
+		t.Error("expected disabled backoff to be valid, was", err)
+	}
+
+	invalid := []WatchBackoff{
+		{Initial: -time.Second},
+		{Initial: time.Minute, Max: time.Second},
+		{Initial: time.Second, Max: time.Minute, Jitter: -1},
+	}
+	for _, backoff := range invalid {
+		if err := backoff.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", backoff)
+		}
+	}
+}
+
+// failingListerWatcher fails the first failures calls to List and Watch.
+type failingListerWatcher struct {
+	*kt.FakeControllerSource
+	failures int
+	calls    []time.Time
+}
+
+func (l *failingListerWatcher) fail() error {
+	l.calls = append(l.calls, time.Now())
+	if len(l.calls) <= l.failures {
+		return fmt.Errorf("api server unavailable")
+	}
+	return nil
+}
+
+func (l *failingListerWatcher) List(options metav1.ListOptions) (runtime.Object, error) {
+	if err := l.fail(); err != nil {
+		return nil, err
+	}
+	return l.FakeControllerSource.List(options)
+}
+
+func (l *failingListerWatcher) Watch(options metav1.ListOptions) (watch.Interface, error) {
+	if err := l.fail(); err != nil {
+		return nil, err
+	}
+	return l.FakeControllerSource.Watch(options)
+}
+
+func watchFailures() float64 {
+	m := &dto.Metric{}
+	podWatchFailures.Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func TestBacksOffAfterWatchFailures(t *testing.T) {
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	failing := &failingListerWatcher{FakeControllerSource: source, failures: 2}
+	lw := newSyncTrackingListerWatcher(failing, &syncTracker{}, nil)
+	lw.backoff = &watchBackoff{config: WatchBackoff{Initial: 20 * time.Millisecond, Max: time.Second}}
+
+	before := watchFailures()
+	lw.List(metav1.ListOptions{})
+	lw.Watch(metav1.ListOptions{ResourceVersion: "0"})
+	if _, err := lw.List(metav1.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := lw.Watch(metav1.ListOptions{ResourceVersion: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Stop()
+
+	if failures := watchFailures() - before; failures != 2 {
+		t.Error("expected 2 failures to be counted, was", failures)
+	}
+	if d := failing.calls[1].Sub(failing.calls[0]); d < 20*time.Millisecond {
+		t.Error("expected backoff after the first failure, was", d)
+	}
+	if d := failing.calls[2].Sub(failing.calls[1]); d < 40*time.Millisecond {
+		t.Error("expected backoff to double after the second failure, was", d)
+	}
+	if d := failing.calls[3].Sub(failing.calls[2]); d >= 20*time.Millisecond {
+		t.Error("expected no backoff after success, was", d)
+	}
+}
+
+func TestStopInterruptsWatchBackoff(t *testing.T) {
+	stop := make(chan struct{})
+	close(stop)
+	backoff := &watchBackoff{config: WatchBackoff{Initial: time.Minute, Max: time.Minute}, failures: 1, stop: stop}
+
+	start := time.Now()
+	backoff.wait()
+	if d := time.Since(start); d > time.Second {
+		t.Error("expected stop to interrupt backoff, waited", d)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package logging provides loggers for kiam's components whose levels can be
+// configured independently of the standard logger.
+package logging
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	mu         sync.Mutex
+	components = make(map[string]*logrus.Logger)
+)
+
+// Component returns the logger for the named component. It writes with the
+// standard logger's formatter and output, at the standard logger's level
+// unless the component's level is set with Configure.
+func Component(name string) *logrus.Logger {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if logger, ok := components[name]; ok {
+		return logger
+	}
+	logger := logrus.New()
+	inherit(logger, logrus.GetLevel())
+	components[name] = logger
+	return logger
+}
+
+// Configure applies the standard logger's formatter and output to each
+// component, at the level in levels or the standard logger's level when the
+// component isn't in levels. It returns an error for unknown components. It
+// should be called once the standard logger is configured, before components
+// start logging.
+func Configure(levels map[string]logrus.Level) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for name := range levels {
+		if _, ok := components[name]; !ok {
+			return fmt.Errorf("unknown log component %q, expected one of: %s", name, strings.Join(names(), ", "))
+		}
+	}
+	for name, logger := range components {
+		level, ok := levels[name]
+		if !ok {
+			level = logrus.GetLevel()
+		}
+		inherit(logger, level)
+	}
+	return nil
+}
+
+// ParseLevels parses component levels, such as sts=debug.
+func ParseLevels(levels map[string]string) (map[string]logrus.Level, error) {
+	parsed := make(map[string]logrus.Level, len(levels))
+	for name, level := range levels {
+		l, err := logrus.ParseLevel(level)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level for %s: %w", name, err)
+		}
+		parsed[name] = l
+	}
+	return parsed, nil
+}
+
+func inherit(logger *logrus.Logger, level logrus.Level) {
+	std := logrus.StandardLogger()
+	logger.Out = std.Out
+	logger.Formatter = std.Formatter
+	logger.SetLevel(level)
+}
+
+func names() []string {
+	names := make([]string, 0, len(components))
+	for name := range components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package logging
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestConfiguresComponentLevels(t *testing.T) {
+	defer logrus.SetLevel(logrus.GetLevel())
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+
+	quiet := Component("quiet")
+	verbose := Component("verbose")
+	other := Component("other")
+	if Component("quiet") != quiet {
+		t.Error("expected component logger to be reused")
+	}
+
+	var out bytes.Buffer
+	logrus.SetOutput(&out)
+	logrus.SetLevel(logrus.InfoLevel)
+	if err := Configure(map[string]logrus.Level{"quiet": logrus.ErrorLevel, "verbose": logrus.DebugLevel}); err != nil {
+		t.Fatal(err)
+	}
+
+	quiet.Infof("quiet info")
+	verbose.Debugf("verbose debug")
+	other.Infof("other info")
+	other.Debugf("other debug")
+
+	logged := out.String()
+	for _, expected := range []string{"verbose debug", "other info"} {
+		if !bytes.Contains([]byte(logged), []byte(expected)) {
+			t.Errorf("expected %q to be logged, was %q", expected, logged)
+		}
+	}
+	for _, unexpected := range []string{"quiet info", "other debug"} {
+		if bytes.Contains([]byte(logged), []byte(unexpected)) {
+			t.Errorf("didn't expect %q to be logged, was %q", unexpected, logged)
+		}
+	}
+}
+
+func TestRejectsUnknownComponents(t *testing.T) {
+	if err := Configure(map[string]logrus.Level{"unknown": logrus.DebugLevel}); err == nil {
+		t.Error("expected error for unknown component")
+	}
+}
+
+func TestParsesLevels(t *testing.T) {
+	levels, err := ParseLevels(map[string]string{"sts": "debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if levels["sts"] != logrus.DebugLevel {
+		t.Error("unexpected level", levels["sts"])
+	}
+
+	if _, err := ParseLevels(map[string]string{"sts": "loud"}); err == nil {
+		t.Error("expected error for invalid level")
+	}
+}
@@ -4,11 +4,24 @@ import (
 	"context"
 	log "github.com/sirupsen/logrus"
 	"net/http"
-	_ "net/http/pprof"
+	httppprof "net/http/pprof"
 )
 
+// Handle registers the pprof handlers on mux, under /debug/pprof/
+func Handle(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", httppprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", httppprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", httppprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", httppprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", httppprof.Trace)
+}
+
+// NewServer returns a server for the pprof handlers alone, rather than
+// everything registered on http.DefaultServeMux
 func NewServer(listenAddr string) http.Server {
-	server := http.Server{Addr: listenAddr, Handler: http.DefaultServeMux}
+	mux := http.NewServeMux()
+	Handle(mux)
+	server := http.Server{Addr: listenAddr, Handler: mux}
 	return server
 }
 
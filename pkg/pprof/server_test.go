@@ -0,0 +1,20 @@
+package pprof
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServesOnlyPprof(t *testing.T) {
+	http.HandleFunc("/not-pprof", func(w http.ResponseWriter, r *http.Request) {})
+	server := NewServer("localhost:0")
+
+	for path, status := range map[string]int{"/debug/pprof/": http.StatusOK, "/not-pprof": http.StatusNotFound} {
+		rr := httptest.NewRecorder()
+		server.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != status {
+			t.Errorf("expected %d from %s, was %d", status, path, rr.Code)
+		}
+	}
+}
@@ -15,19 +15,54 @@ package prefetch
 
 import (
 	"context"
-	log "github.com/sirupsen/logrus"
 	"github.com/uswitch/kiam/pkg/aws/sts"
 	"github.com/uswitch/kiam/pkg/k8s"
+	"github.com/uswitch/kiam/pkg/logging"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sync"
+	"time"
 )
 
+var log = logging.Component("prefetch")
+
 type CredentialManager struct {
-	cache     sts.CredentialsCache
-	announcer k8s.PodAnnouncer
+	cache           sts.CredentialsCache
+	announcer       k8s.PodAnnouncer
+	sessionPolicies k8s.SessionPolicyFinder
+	sourceIdentity  bool
+	selector        labels.Selector
+
+	mu       sync.Mutex
+	inflight map[string]bool
+	warmed   bool
+}
+
+// NewManager creates the manager, sourceIdentity sets the pod's service
+// account as the source identity of prefetched credentials.
+func NewManager(cache sts.CredentialsCache, announcer k8s.PodAnnouncer, sessionPolicies k8s.SessionPolicyFinder, sourceIdentity bool) *CredentialManager {
+	return &CredentialManager{cache: cache, announcer: announcer, sessionPolicies: sessionPolicies, sourceIdentity: sourceIdentity, inflight: make(map[string]bool)}
+}
+
+// SetSelector restricts prefetching to pods matching selector, other pods
+// are issued credentials when they request them. It must be called before
+// Run or Warm.
+func (m *CredentialManager) SetSelector(selector labels.Selector) {
+	m.selector = selector
 }
 
-func NewManager(cache sts.CredentialsCache, announcer k8s.PodAnnouncer) *CredentialManager {
-	return &CredentialManager{cache: cache, announcer: announcer}
+// selected returns whether credentials are prefetched for the pod.
+func (m *CredentialManager) selected(pod *v1.Pod) bool {
+	if m.selector == nil {
+		return true
+	}
+	matches := m.selector.Matches(labels.Set(pod.GetLabels()))
+	if matches {
+		selectorPods.WithLabelValues("true").Inc()
+	} else {
+		selectorPods.WithLabelValues("false").Inc()
+	}
+	return matches
 }
 
 func (m *CredentialManager) fetchCredentials(ctx context.Context, pod *v1.Pod) {
@@ -36,18 +71,127 @@ func (m *CredentialManager) fetchCredentials(ctx context.Context, pod *v1.Pod) {
 		logger.Debugf("ignoring fetch credentials for completed pod")
 		return
 	}
+	if !m.selected(pod) {
+		logger.Debugf("ignoring fetch credentials for pod not matching prefetch selector")
+		return
+	}
+
+	role := m.announcer.PodRole(pod)
+	identity, err := m.podIdentity(ctx, pod, role)
+	if err != nil {
+		logger.Errorf("error finding session policy: %s", err.Error())
+		return
+	}
 
-	role := k8s.PodRole(pod)
-	issued, err := m.fetchCredentialsFromCache(ctx, role)
+	issued, fetched, err := m.fetchCredentialsFromCache(ctx, identity)
 	if err != nil {
 		logger.Errorf("error warming credentials: %s", err.Error())
+	} else if !fetched {
+		logger.Debugf("credentials already being fetched for another pod")
 	} else {
 		logger.WithFields(sts.CredentialsFields(issued, role)).Infof("fetched credentials")
 	}
 }
 
-func (m *CredentialManager) fetchCredentialsFromCache(ctx context.Context, role string) (*sts.Credentials, error) {
-	return m.cache.CredentialsForRole(ctx, role)
+// podIdentity returns the identity credentials are fetched for on behalf
+// of the pod.
+func (m *CredentialManager) podIdentity(ctx context.Context, pod *v1.Pod, role string) (*sts.RoleIdentity, error) {
+	duration, err := k8s.PodSessionDuration(pod)
+	if err != nil {
+		return nil, err
+	}
+	identity := sts.NewRoleIdentity(role)
+	identity.PolicyARNs = k8s.PodSessionPolicyARNs(pod)
+	identity.SessionDuration = duration
+	if m.sourceIdentity {
+		identity.SourceIdentity = sts.SourceIdentityForServiceAccount(pod.Namespace, pod.Spec.ServiceAccountName)
+	}
+	if m.sessionPolicies != nil {
+		policy, err := m.sessionPolicies.FindSessionPolicy(ctx, pod)
+		if err != nil {
+			return nil, err
+		}
+		identity.Policy = policy
+	}
+	return identity, nil
+}
+
+// Warm fetches credentials for the roles of pods known at startup with
+// parallelRoutines fetchers, returning once every role has been fetched
+// or failed. Failures don't prevent Warmed reporting true afterwards, so a
+// misconfigured role can't hold up the rest.
+func (m *CredentialManager) Warm(ctx context.Context, pods []*v1.Pod, parallelRoutines int) {
+	start := time.Now()
+	identities := make(chan *sts.RoleIdentity)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelRoutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for identity := range identities {
+				if _, err := m.cache.CredentialsForRole(ctx, identity); err != nil {
+					log.WithField("pod.iam.role", identity.Role).Errorf("error warming credentials: %s", err.Error())
+				}
+			}
+		}()
+	}
+
+	seen := make(map[string]bool)
+	for _, pod := range pods {
+		role := m.announcer.PodRole(pod)
+		if role == "" || k8s.IsPodCompleted(pod) || !m.selected(pod) {
+			continue
+		}
+		identity, err := m.podIdentity(ctx, pod, role)
+		if err != nil {
+			log.WithFields(k8s.PodFields(pod)).Errorf("error finding session policy: %s", err.Error())
+			continue
+		}
+		if seen[identity.Key()] {
+			continue
+		}
+		seen[identity.Key()] = true
+		identities <- identity
+	}
+	close(identities)
+	wg.Wait()
+
+	initialPrefetchDuration.Set(time.Since(start).Seconds())
+	log.Infof("prefetched credentials for %d roles in %s", len(seen), time.Since(start))
+	m.mu.Lock()
+	m.warmed = true
+	m.mu.Unlock()
+}
+
+// Warmed returns whether Warm has completed.
+func (m *CredentialManager) Warmed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.warmed
+}
+
+// fetchCredentialsFromCache fetches credentials unless they're already being
+// fetched for the identity, so that pods sharing a role only occupy a single
+// fetcher. fetched is false when the fetch was skipped.
+func (m *CredentialManager) fetchCredentialsFromCache(ctx context.Context, identity *sts.RoleIdentity) (_ *sts.Credentials, fetched bool, _ error) {
+	key := identity.Key()
+	m.mu.Lock()
+	if m.inflight[key] {
+		m.mu.Unlock()
+		deduplicatedFetches.Inc()
+		return nil, false, nil
+	}
+	m.inflight[key] = true
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.inflight, key)
+		m.mu.Unlock()
+	}()
+
+	credentials, err := m.cache.CredentialsForRole(ctx, identity)
+	return credentials, true, err
 }
 
 func (m *CredentialManager) Run(ctx context.Context, parallelRoutines int) {
@@ -84,12 +228,26 @@ func (m *CredentialManager) handleExpiring(ctx context.Context, credentials *sts
 	}
 
 	logger.Infof("expiring credentials, fetching updated")
-	_, err = m.fetchCredentialsFromCache(ctx, credentials.Role)
+	_, fetched, err := m.fetchCredentialsFromCache(ctx, credentials.Identity)
 	if err != nil {
 		logger.Errorf("error fetching updated credentials for expiring: %s", err.Error())
+	} else if fetched {
+		refreshes.WithLabelValues(credentials.Role).Inc()
 	}
 }
 
 func (m *CredentialManager) IsRoleActive(role string) (bool, error) {
+	if m.selector != nil {
+		if announcer, ok := m.announcer.(selectingAnnouncer); ok {
+			return announcer.IsSelectedPodsForRole(role, m.selector)
+		}
+	}
 	return m.announcer.IsActivePodsForRole(role)
 }
+
+// selectingAnnouncer is implemented by announcers that can check whether
+// pods matching a selector use a role, so credentials are only refreshed
+// for roles of selected pods.
+type selectingAnnouncer interface {
+	IsSelectedPodsForRole(role string, selector labels.Selector) (bool, error)
+}
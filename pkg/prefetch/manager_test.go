@@ -15,11 +15,15 @@ package prefetch
 
 import (
 	"context"
+	"fmt"
 	"github.com/fortytw2/leaktest"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/uswitch/kiam/pkg/aws/sts"
 	kt "github.com/uswitch/kiam/pkg/k8s/testing"
 	"github.com/uswitch/kiam/pkg/statsd"
 	"github.com/uswitch/kiam/pkg/testutil"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"testing"
 	"time"
 )
@@ -40,7 +44,7 @@ func TestPrefetchRunningPods(t *testing.T) {
 		requestedRoles <- role
 		return &sts.Credentials{}, nil
 	})
-	manager := NewManager(cache, announcer)
+	manager := NewManager(cache, announcer, nil, false)
 	go manager.Run(ctx, 1)
 
 	announcer.Announce(testutil.NewPodWithRole("ns", "name", "ip", "Running", "role"))
@@ -57,3 +61,150 @@ func TestPrefetchRunningPods(t *testing.T) {
 		return
 	}
 }
+
+func TestPrefetchesSharedRoleOnce(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requestedRoles := make(chan string, 2)
+	release := make(chan struct{})
+	announcer := kt.NewStubAnnouncer()
+	cache := testutil.NewStubCredentialsCache(func(role string) (*sts.Credentials, error) {
+		requestedRoles <- role
+		<-release
+		return &sts.Credentials{}, nil
+	})
+	manager := NewManager(cache, announcer, nil, false)
+	go manager.Run(ctx, 2)
+
+	announcer.Announce(testutil.NewPodWithRole("ns", "first", "ip1", "Running", "role"))
+	announcer.Announce(testutil.NewPodWithRole("ns", "second", "ip2", "Running", "role"))
+	<-requestedRoles
+
+	select {
+	case role := <-requestedRoles:
+		t.Error("expected role to be requested once, was requested again", role)
+	case <-time.After(time.Second):
+	}
+	close(release)
+}
+
+func TestRecordsRefreshesByRole(t *testing.T) {
+	cache := testutil.NewStubCredentialsCache(func(role string) (*sts.Credentials, error) {
+		return &sts.Credentials{}, nil
+	})
+	manager := NewManager(cache, kt.NewStubAnnouncer(), nil, false)
+
+	before := refreshCount("refreshed-role")
+	manager.handleExpiring(context.Background(), &sts.RoleCredentials{
+		Role:        "refreshed-role",
+		Identity:    sts.NewRoleIdentity("refreshed-role"),
+		Credentials: &sts.Credentials{},
+	})
+
+	if refreshed := refreshCount("refreshed-role") - before; refreshed != 1 {
+		t.Error("expected refresh to be recorded for role, was", refreshed)
+	}
+}
+
+func refreshCount(role string) float64 {
+	m := &dto.Metric{}
+	refreshes.WithLabelValues(role).Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func TestWarmFetchesEachRoleOnce(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	requested := make(chan string, 10)
+	cache := testutil.NewStubCredentialsCache(func(role string) (*sts.Credentials, error) {
+		requested <- role
+		return &sts.Credentials{}, nil
+	})
+	manager := NewManager(cache, kt.NewStubAnnouncer(), nil, false)
+	if manager.Warmed() {
+		t.Fatal("expected manager not to be warmed before Warm")
+	}
+
+	manager.Warm(context.Background(), []*v1.Pod{
+		testutil.NewPodWithRole("ns", "first", "ip1", "Running", "role"),
+		testutil.NewPodWithRole("ns", "second", "ip2", "Running", "role"),
+		testutil.NewPodWithRole("ns", "other", "ip3", "Pending", "other_role"),
+		testutil.NewPodWithRole("ns", "failed", "ip4", "Failed", "failed_role"),
+	}, 2)
+	close(requested)
+
+	if !manager.Warmed() {
+		t.Error("expected manager to be warmed after Warm")
+	}
+	roles := make(map[string]int)
+	for role := range requested {
+		roles[role]++
+	}
+	if len(roles) != 2 || roles["role"] != 1 || roles["other_role"] != 1 {
+		t.Error("expected each active role to be fetched once, was", roles)
+	}
+
+	m := &dto.Metric{}
+	initialPrefetchDuration.Write(m)
+	if m.GetGauge().GetValue() <= 0 {
+		t.Error("expected initial prefetch duration to be recorded")
+	}
+}
+
+func TestWarmCompletesDespiteFailures(t *testing.T) {
+	cache := testutil.NewStubCredentialsCache(func(role string) (*sts.Credentials, error) {
+		return nil, fmt.Errorf("access denied")
+	})
+	manager := NewManager(cache, kt.NewStubAnnouncer(), nil, false)
+
+	manager.Warm(context.Background(), []*v1.Pod{testutil.NewPodWithRole("ns", "name", "ip", "Running", "role")}, 1)
+	if !manager.Warmed() {
+		t.Error("expected manager to be warmed after failed fetches")
+	}
+}
+
+func selectorCount(selected bool) float64 {
+	m := &dto.Metric{}
+	selectorPods.WithLabelValues(fmt.Sprint(selected)).Write(m)
+	return m.Counter.GetValue()
+}
+
+func labelledPod(name, ip, role string, podLabels map[string]string) *v1.Pod {
+	pod := testutil.NewPodWithRole("ns", name, ip, "Running", role)
+	pod.Labels = podLabels
+	return pod
+}
+
+func TestPrefetchesOnlySelectedPods(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	requested := make(chan string, 10)
+	cache := testutil.NewStubCredentialsCache(func(role string) (*sts.Credentials, error) {
+		requested <- role
+		return &sts.Credentials{}, nil
+	})
+	manager := NewManager(cache, kt.NewStubAnnouncer(), nil, false)
+	manager.SetSelector(labels.SelectorFromSet(labels.Set{"kiam-prefetch": "true"}))
+	selected := selectorCount(true)
+
+	manager.Warm(context.Background(), []*v1.Pod{
+		labelledPod("selected", "ip1", "selected_role", map[string]string{"kiam-prefetch": "true"}),
+		labelledPod("unselected", "ip2", "unselected_role", map[string]string{"kiam-prefetch": "false"}),
+		labelledPod("unlabelled", "ip3", "unlabelled_role", nil),
+	}, 1)
+	close(requested)
+
+	roles := make(map[string]int)
+	for role := range requested {
+		roles[role]++
+	}
+	if len(roles) != 1 || roles["selected_role"] != 1 {
+		t.Error("expected only the selected pod's role to be fetched, was", roles)
+	}
+	if count := selectorCount(true); count != selected+1 {
+		t.Error("expected selected pod to be counted, was", count-selected)
+	}
+}
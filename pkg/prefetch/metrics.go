@@ -0,0 +1,64 @@
+package prefetch
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	telemetry "github.com/uswitch/kiam/pkg/prometheus"
+)
+
+var (
+	deduplicatedFetches     prometheus.Counter
+	refreshes               *prometheus.CounterVec
+	selectorPods            *prometheus.CounterVec
+	initialPrefetchDuration prometheus.Gauge
+)
+
+func newMetrics(namespace string) []prometheus.Collector {
+	deduplicatedFetches = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "prefetch",
+			Name:      "deduplicated_fetches_total",
+			Help:      "Number of credential prefetches skipped because the same role was already being fetched",
+		},
+	)
+
+	refreshes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "prefetch",
+			Name:      "refreshes_total",
+			Help:      "Number of expiring credentials refreshed, by role",
+		},
+		[]string{"role"},
+	)
+
+	selectorPods = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "prefetch",
+			Name:      "selector_pods_total",
+			Help:      "Number of pods checked against the prefetch selector, by whether they were selected",
+		},
+		[]string{"selected"},
+	)
+
+	initialPrefetchDuration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "prefetch",
+			Name:      "initial_duration_seconds",
+			Help:      "Time taken to prefetch credentials for the roles of pods known at startup",
+		},
+	)
+
+	return []prometheus.Collector{
+		deduplicatedFetches,
+		refreshes,
+		initialPrefetchDuration,
+		selectorPods,
+	}
+}
+
+func init() {
+	telemetry.MustRegister(newMetrics)
+}
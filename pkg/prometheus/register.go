@@ -0,0 +1,94 @@
+package prometheus
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultNamespace is the namespace kiam's metrics are registered with
+// until SetNamespace is called
+const DefaultNamespace = "kiam"
+
+var namespacePattern = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
+// Metrics creates a package's collectors under namespace, assigning them to
+// the variables the package records with.
+type Metrics func(namespace string) []prometheus.Collector
+
+type registration struct {
+	metrics    Metrics
+	collectors []prometheus.Collector
+}
+
+// metricsRegistry tracks the metrics it registers so they can be
+// recreated under a different namespace.
+type metricsRegistry struct {
+	mu            sync.Mutex
+	registerer    prometheus.Registerer
+	namespace     string
+	registrations []*registration
+}
+
+var defaultRegistry = newMetricsRegistry(prometheus.DefaultRegisterer)
+
+func newMetricsRegistry(registerer prometheus.Registerer) *metricsRegistry {
+	return &metricsRegistry{registerer: registerer, namespace: DefaultNamespace}
+}
+
+// MustRegister creates metrics under the current namespace and registers
+// them with the default registerer. It's intended to be called from package
+// init functions and panics if registration fails.
+func MustRegister(metrics Metrics) {
+	defaultRegistry.mustRegister(metrics)
+}
+
+// SetNamespace recreates and registers metrics added with MustRegister under
+// namespace, or without one when it's empty. It must be called at startup,
+// before any metrics are recorded, and fails if the namespace is invalid or
+// the renamed metrics collide with others already registered.
+func SetNamespace(namespace string) error {
+	return defaultRegistry.setNamespace(namespace)
+}
+
+func (m *metricsRegistry) mustRegister(metrics Metrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := &registration{metrics: metrics, collectors: metrics(m.namespace)}
+	m.registerer.MustRegister(r.collectors...)
+	m.registrations = append(m.registrations, r)
+}
+
+func (m *metricsRegistry) setNamespace(namespace string) error {
+	if namespace != "" && !namespacePattern.MatchString(namespace) {
+		return fmt.Errorf("invalid metrics namespace: %q", namespace)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if namespace == m.namespace {
+		return nil
+	}
+
+	for _, r := range m.registrations {
+		for _, c := range r.collectors {
+			m.registerer.Unregister(c)
+		}
+	}
+	m.namespace = namespace
+
+	for _, r := range m.registrations {
+		r.collectors = r.metrics(namespace)
+		for _, c := range r.collectors {
+			if err := m.registerer.Register(c); err != nil {
+				return fmt.Errorf("error registering metrics with namespace %q: %v", namespace, err)
+			}
+		}
+	}
+
+	return nil
+}
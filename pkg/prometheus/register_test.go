@@ -0,0 +1,84 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func gatheredNames(t *testing.T, gatherer prometheus.Gatherer) map[string]bool {
+	families, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	return names
+}
+
+func newTestRegistry() (*prometheus.Registry, *metricsRegistry) {
+	registry := prometheus.NewRegistry()
+	other := prometheus.NewCounter(prometheus.CounterOpts{Name: "other_requests_total", Help: "Other requests"})
+	registry.MustRegister(other)
+	other.Inc()
+	return registry, newMetricsRegistry(registry)
+}
+
+func TestRegistersMetricsWithNamespace(t *testing.T) {
+	registry, metrics := newTestRegistry()
+
+	var requests prometheus.Counter
+	metrics.mustRegister(func(namespace string) []prometheus.Collector {
+		requests = prometheus.NewCounter(prometheus.CounterOpts{Namespace: namespace, Name: "requests_total", Help: "Requests"})
+		return []prometheus.Collector{requests}
+	})
+
+	requests.Inc()
+	if names := gatheredNames(t, registry); !names["kiam_requests_total"] {
+		t.Error("expected default namespace, was", names)
+	}
+
+	if err := metrics.setNamespace("acme_kiam"); err != nil {
+		t.Fatal(err)
+	}
+	requests.Inc()
+	names := gatheredNames(t, registry)
+	if !names["acme_kiam_requests_total"] {
+		t.Error("expected configured namespace, was", names)
+	}
+	if names["kiam_requests_total"] {
+		t.Error("expected default namespace to be unregistered, was", names)
+	}
+	if !names["other_requests_total"] {
+		t.Error("expected other metrics to be unchanged, was", names)
+	}
+
+	if err := metrics.setNamespace(""); err != nil {
+		t.Fatal(err)
+	}
+	requests.Inc()
+	if names := gatheredNames(t, registry); !names["requests_total"] {
+		t.Error("expected no namespace, was", names)
+	}
+}
+
+func TestFailsWhenNamespacedMetricsCollide(t *testing.T) {
+	_, metrics := newTestRegistry()
+	metrics.mustRegister(func(namespace string) []prometheus.Collector {
+		return []prometheus.Collector{
+			prometheus.NewCounter(prometheus.CounterOpts{Namespace: namespace, Name: "other_requests_total", Help: "Other requests"}),
+		}
+	})
+
+	if err := metrics.setNamespace(""); err == nil {
+		t.Error("expected error registering metric that collides with another")
+	}
+}
+
+func TestRejectsInvalidNamespace(t *testing.T) {
+	if err := SetNamespace("kiam-agent"); err == nil {
+		t.Error("expected error for invalid namespace")
+	}
+}
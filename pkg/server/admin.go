@@ -0,0 +1,123 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/uswitch/kiam/pkg/aws/sts"
+)
+
+// adminServer serves read-only diagnostics of the server's caches. It only
+// listens on loopback addresses so it isn't reachable from other pods.
+type adminServer struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+type cachedRole struct {
+	Role           string `json:"role"`
+	SessionPolicy  bool   `json:"sessionPolicy"`
+	SourceIdentity string `json:"sourceIdentity,omitempty"`
+	Pending        bool   `json:"pending"`
+	Expiration     string `json:"expiration,omitempty"`
+	LastUpdated    string `json:"lastUpdated,omitempty"`
+}
+
+type cacheStatus struct {
+	Roles      []*cachedRole `json:"roles"`
+	Pods       int           `json:"pods"`
+	Namespaces int           `json:"namespaces"`
+}
+
+func newAdminServer(address string, k *KiamServer, credentials sts.CredentialsInspector) (*adminServer, error) {
+	if err := ValidateLoopbackAddress(address); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	router := http.NewServeMux()
+	router.Handle("/cache", &cacheHandler{server: k, credentials: credentials})
+
+	return &adminServer{listener: listener, server: &http.Server{Handler: router}}, nil
+}
+
+// ValidateLoopbackAddress returns an error unless address is a host and
+// port on a loopback interface.
+func ValidateLoopbackAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address: %s", err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("address must be a loopback address, was %s", address)
+}
+
+func (a *adminServer) serve() {
+	log.Infof("serving admin endpoint on %s", a.listener.Addr())
+	if err := a.server.Serve(a.listener); err != nil && err != http.ErrServerClosed {
+		log.Errorf("error serving admin endpoint: %s", err)
+	}
+}
+
+func (a *adminServer) close() {
+	a.server.Close()
+}
+
+type cacheHandler struct {
+	server      *KiamServer
+	credentials sts.CredentialsInspector
+}
+
+func (h *cacheHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := &cacheStatus{
+		Roles:      []*cachedRole{},
+		Pods:       h.server.pods.Len(),
+		Namespaces: h.server.namespaces.Len(),
+	}
+	if h.credentials != nil {
+		for _, role := range h.credentials.CachedRoles() {
+			status.Roles = append(status.Roles, &cachedRole{
+				Role:           role.Role,
+				SessionPolicy:  role.SessionPolicy,
+				SourceIdentity: role.SourceIdentity,
+				Pending:        role.Pending,
+				Expiration:     role.Expiration,
+				LastUpdated:    role.LastUpdated,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Errorf("error encoding cache status: %s", err)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uswitch/kiam/pkg/aws/sts"
+	"github.com/uswitch/kiam/pkg/k8s"
+	"github.com/uswitch/kiam/pkg/testutil"
+	kt "k8s.io/client-go/tools/cache/testing"
+)
+
+type secretGateway struct{}
+
+func (g *secretGateway) Issue(ctx context.Context, request *sts.AssumeRoleRequest) (*sts.Credentials, error) {
+	return &sts.Credentials{
+		AccessKeyId:     "A1234",
+		SecretAccessKey: "SECRET-ACCESS-KEY",
+		Token:           "SECRET-SESSION-TOKEN",
+		Expiration:      "2099-01-01T12:00:00Z",
+		LastUpdated:     "2099-01-01T11:45:00Z",
+	}, nil
+}
+
+func TestCacheEndpointRedactsSecrets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pods := kt.NewFakeControllerSource()
+	defer pods.Shutdown()
+	pods.Add(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "role"))
+	podCache := k8s.NewPodCache(pods, time.Second, 0, 0, nil)
+	podCache.Run(ctx)
+
+	namespaces := kt.NewFakeControllerSource()
+	defer namespaces.Shutdown()
+	namespaceCache := k8s.NewNamespaceCache(namespaces, time.Second)
+	namespaceCache.Run(ctx)
+
+	cache := sts.DefaultCache(&secretGateway{}, "session", 15*time.Minute, 5*time.Minute, sts.DefaultResolver("arn:aws:iam::123456789012:role/"), 0, 0, 0)
+	if _, err := cache.CredentialsForRole(ctx, sts.NewRoleIdentity("role")); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	handler := &cacheHandler{server: &KiamServer{pods: podCache, namespaces: namespaceCache}, credentials: cache}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/cache", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatal("unexpected status", rr.Code)
+	}
+	body, _ := ioutil.ReadAll(rr.Body)
+	if strings.Contains(string(body), "SECRET") || strings.Contains(string(body), "A1234") {
+		t.Error("expected credentials to be redacted, was", string(body))
+	}
+
+	expected := `{"roles":[{"role":"role","sessionPolicy":false,"pending":false,"expiration":"2099-01-01T12:00:00Z","lastUpdated":"2099-01-01T11:45:00Z"}],"pods":1,"namespaces":0}`
+	if strings.TrimSpace(string(body)) != expected {
+		t.Error("unexpected body", string(body))
+	}
+}
+
+func TestAdminAddressMustBeLoopback(t *testing.T) {
+	for _, address := range []string{"localhost:9630", "127.0.0.1:9630", "[::1]:9630"} {
+		if err := ValidateLoopbackAddress(address); err != nil {
+			t.Errorf("expected %s to be permitted: %s", address, err)
+		}
+	}
+	for _, address := range []string{":9630", "0.0.0.0:9630", "10.0.0.1:9630", "localhost"} {
+		if err := ValidateLoopbackAddress(address); err == nil {
+			t.Errorf("expected %s to be rejected", address)
+		}
+	}
+}
+
+func TestAdminDoesntServePprof(t *testing.T) {
+	admin, err := newAdminServer("127.0.0.1:0", &KiamServer{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.listener.Close()
+
+	rr := httptest.NewRecorder()
+	admin.server.Handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Error("expected pprof to be served from --pprof-listen-addr only, was", rr.Code)
+	}
+}
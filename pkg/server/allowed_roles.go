@@ -0,0 +1,61 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"context"
+
+	"github.com/uswitch/kiam/pkg/aws/sts"
+)
+
+// allowedRolesProvider checks the server's allowed roles before credentials
+// are issued, so roles are never assumed outside them, whether they're
+// requested by agents, prefetched or refreshed.
+type allowedRolesProvider struct {
+	sts.CredentialsProvider
+	allowed *AllowedRolesPolicy
+}
+
+// allowedRolesCache is an allowedRolesProvider for a provider that is also a
+// sts.CredentialsCache, so prefetching credentials is restricted too.
+type allowedRolesCache struct {
+	*allowedRolesProvider
+	cache sts.CredentialsCache
+}
+
+// newAllowedRolesProvider restricts the credentials issued by provider to
+// the allowed roles. The returned provider is a sts.CredentialsCache when
+// provider is one.
+func newAllowedRolesProvider(provider sts.CredentialsProvider, allowed *AllowedRolesPolicy) sts.CredentialsProvider {
+	restricted := &allowedRolesProvider{CredentialsProvider: provider, allowed: allowed}
+	if cache, ok := provider.(sts.CredentialsCache); ok {
+		return &allowedRolesCache{allowedRolesProvider: restricted, cache: cache}
+	}
+	return restricted
+}
+
+func (p *allowedRolesProvider) CredentialsForRole(ctx context.Context, identity *sts.RoleIdentity) (*sts.Credentials, error) {
+	decision, err := p.allowed.IsAllowedAssumeRole(ctx, identity.Role, "")
+	if err != nil {
+		return nil, err
+	}
+	if !decision.IsAllowed() {
+		return nil, ErrPolicyForbidden
+	}
+	return p.CredentialsProvider.CredentialsForRole(ctx, identity)
+}
+
+func (c *allowedRolesCache) Expiring() chan *sts.RoleCredentials {
+	return c.cache.Expiring()
+}
@@ -2,12 +2,52 @@ package server
 
 import (
 	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// statusError is an error returned to agents with a gRPC status code, so
+// they can identify it without comparing messages.
+type statusError struct {
+	code    codes.Code
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// GRPCStatus is used by gRPC to set the status of responses
+func (e *statusError) GRPCStatus() *status.Status {
+	return status.New(e.code, e.message)
+}
+
 var (
-	// ErrPodNotFound returned when no pod found with a matching IP
-	ErrPodNotFound = fmt.Errorf("no pod found")
+	// ErrPodNotFound returned when no pod found with a matching IP, with
+	// the NotFound status code
+	ErrPodNotFound error = &statusError{codes.NotFound, "no pod found"}
 	// ErrPolicyForbidden returned when credentials can't be issued
-	// because of a policy
-	ErrPolicyForbidden = fmt.Errorf("forbidden by policy")
+	// because of a policy, with the PermissionDenied status code
+	ErrPolicyForbidden error = &statusError{codes.PermissionDenied, "forbidden by policy"}
+	// ErrNamespaceDenied returned when the pod's namespace is denied
+	// credentials by the server's configuration, with the PermissionDenied
+	// status code
+	ErrNamespaceDenied error = &statusError{codes.PermissionDenied, "namespace denied"}
+	// ErrAmbiguousPodIP returned when multiple running pods share the ip,
+	// so the requesting pod can't be identified, with the
+	// FailedPrecondition status code
+	ErrAmbiguousPodIP error = &statusError{codes.FailedPrecondition, "multiple pods share the ip"}
+	// ErrPodIdentityChanged ends a credentials watch when the ip no longer
+	// identifies the same pod and role, with the Aborted status code
+	ErrPodIdentityChanged error = &statusError{codes.Aborted, "pod identity changed"}
+	// ErrWatchUnsupported returned when the server can't notify of
+	// refreshed credentials
+	ErrWatchUnsupported = fmt.Errorf("watching credentials is not supported")
+	// ErrServerUnreachable returned by CheckServerTLS when a connection to
+	// the server can't be opened
+	ErrServerUnreachable = fmt.Errorf("server unreachable")
+	// ErrTLSMisconfigured returned by CheckServerTLS when the agent and
+	// server certificates aren't trusted by each other
+	ErrTLSMisconfigured = fmt.Errorf("tls misconfigured")
 )
@@ -19,6 +19,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"net"
 	"time"
 
@@ -27,9 +28,13 @@ import (
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/uswitch/kiam/pkg/aws/sts"
 	"github.com/uswitch/kiam/pkg/statsd"
+	"github.com/uswitch/kiam/pkg/tracing"
 	pb "github.com/uswitch/kiam/proto"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/security/advancedtls"
 
@@ -40,7 +45,9 @@ import (
 type Client interface {
 	GetRole(ctx context.Context, ip string) (string, error)
 	GetCredentials(ctx context.Context, ip, role string) (*sts.Credentials, error)
+	WatchCredentials(ctx context.Context, ip, role string, fn func(*sts.Credentials) error) error
 	Health(ctx context.Context) (string, error)
+	IsAllowedNodeRole(ctx context.Context, ip string) (bool, error)
 }
 
 // KiamGateway is the client to interact with KiamServer
@@ -55,7 +62,7 @@ const (
 )
 
 // NewGateway constructs a gRPC client to talk to the server
-func NewGateway(ctx context.Context, address string, caFile, certificateFile, keyFile string, keepaliveParams keepalive.ClientParameters) (_ *KiamGateway, err error) {
+func NewGateway(ctx context.Context, address string, caFile, certificateFile, keyFile string, keepaliveParams keepalive.ClientParameters, messages MessageConfig) (_ *KiamGateway, err error) {
 	host, _, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing hostname: %v", err)
@@ -86,7 +93,23 @@ func NewGateway(ctx context.Context, address string, caFile, certificateFile, ke
 		return nil, fmt.Errorf("error creating grpc credentials: %v", err)
 	}
 
+	return dialGateway(ctx, address, creds, keepaliveParams, messages, tlsConfig)
+}
+
+// NewInsecureGateway constructs a gRPC client that talks to the server
+// without TLS. It's unsafe outside of local development, credentials are sent
+// in plain text and the server isn't authenticated.
+func NewInsecureGateway(ctx context.Context, address string, keepaliveParams keepalive.ClientParameters, messages MessageConfig) (*KiamGateway, error) {
+	log.Warnf("INSECURE: connecting to the server without TLS, never use this in production")
+	return dialGateway(ctx, address, insecure.NewCredentials(), keepaliveParams, messages, nil)
+}
+
+func dialGateway(ctx context.Context, address string, creds credentials.TransportCredentials, keepaliveParams keepalive.ClientParameters, messages MessageConfig, tlsConfig *dynamicTLSConfig) (*KiamGateway, error) {
+	if err := messages.Validate(); err != nil {
+		return nil, err
+	}
 	conn, err := grpc.DialContext(ctx, "dns:///"+address,
+		grpc.WithDefaultCallOptions(messages.callOptions()...),
 		grpc.WithKeepaliveParams(keepaliveParams),
 		grpc.WithTransportCredentials(creds),
 		grpc.WithUnaryInterceptor(grpc_middleware.ChainUnaryClient(
@@ -94,11 +117,12 @@ func NewGateway(ctx context.Context, address string, caFile, certificateFile, ke
 				retry.WithBackoff(retry.BackoffLinear(RetryInterval)),
 			),
 			grpc_prometheus.UnaryClientInterceptor,
+			tracing.UnaryClientInterceptor,
 		)),
-		grpc.WithBalancerName(roundrobin.Name),
+		grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{%q:{}}]}`, roundrobin.Name)),
 		grpc.WithDisableServiceConfig(),
 		grpc.WithBlock(),
-		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor),
+		grpc.WithChainStreamInterceptor(grpc_prometheus.StreamClientInterceptor, tracing.StreamClientInterceptor),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("error dialing grpc server: %v", err)
@@ -114,7 +138,9 @@ func NewGateway(ctx context.Context, address string, caFile, certificateFile, ke
 // Close disconnects the connection
 func (g *KiamGateway) Close() {
 	g.conn.Close()
-	g.tlsConfig.Close()
+	if g.tlsConfig != nil {
+		g.tlsConfig.Close()
+	}
 }
 
 // GetRole returns the role for the identified Pod
@@ -124,7 +150,7 @@ func (g *KiamGateway) GetRole(ctx context.Context, ip string) (string, error) {
 	}
 	role, err := g.client.GetPodRole(ctx, &pb.GetPodRoleRequest{Ip: ip})
 	if err != nil {
-		return "", err
+		return "", translateError(err)
 	}
 	return role.GetName(), nil
 }
@@ -136,17 +162,76 @@ func (g *KiamGateway) GetCredentials(ctx context.Context, ip, role string) (*sts
 	}
 	credentials, err := g.client.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: ip, Role: role})
 	if err != nil {
-		if grpcStatus, ok := status.FromError(err); ok {
-			switch grpcStatus.Message() {
-			case ErrPolicyForbidden.Error():
-				return nil, ErrPolicyForbidden
-			case ErrPodNotFound.Error():
-				return nil, ErrPodNotFound
+		return nil, translateError(err)
+	}
+	return translateCredentialsFromProto(credentials), nil
+}
+
+// WatchCredentials calls fn with the credentials for the identified Pod and
+// again each time they're refreshed, until ctx is done or fn returns an error.
+func (g *KiamGateway) WatchCredentials(ctx context.Context, ip, role string, fn func(*sts.Credentials) error) error {
+	stream, err := g.client.WatchRoleCredentials(ctx, &pb.WatchRoleCredentialsRequest{Ip: ip, Role: role})
+	if err != nil {
+		return translateError(err)
+	}
+
+	for {
+		credentials, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
+			return translateError(err)
 		}
 
-		return nil, err
+		if err := fn(translateCredentialsFromProto(credentials)); err != nil {
+			return err
+		}
+	}
+}
+
+// IsAllowedNodeRole returns whether the identified Pod is permitted the
+// node's own instance role
+func (g *KiamGateway) IsAllowedNodeRole(ctx context.Context, ip string) (bool, error) {
+	if statsd.Enabled {
+		defer statsd.Client.NewTiming().Send("gateway.rpc.IsAllowedNodeRole")
+	}
+	decision, err := g.client.IsAllowedNodeRole(ctx, &pb.IsAllowedNodeRoleRequest{Ip: ip})
+	if err != nil {
+		return false, translateError(err)
+	}
+	return decision.GetIsAllowed(), nil
+}
+
+// translateError converts errors returned by the server back into the
+// package's errors. Servers that predate status codes are identified by
+// message.
+func translateError(err error) error {
+	if grpcStatus, ok := status.FromError(err); ok {
+		if grpcStatus.Code() == codes.NotFound {
+			return ErrPodNotFound
+		}
+		switch grpcStatus.Message() {
+		case ErrPolicyForbidden.Error():
+			return ErrPolicyForbidden
+		case ErrPodNotFound.Error():
+			return ErrPodNotFound
+		case ErrNamespaceDenied.Error():
+			return ErrNamespaceDenied
+		case ErrAmbiguousPodIP.Error():
+			return ErrAmbiguousPodIP
+		case ErrPodIdentityChanged.Error():
+			return ErrPodIdentityChanged
+		}
 	}
+
+	return err
+}
+
+func translateCredentialsFromProto(credentials *pb.Credentials) *sts.Credentials {
 	return &sts.Credentials{
 		Code:            credentials.Code,
 		Type:            credentials.Type,
@@ -155,7 +240,8 @@ func (g *KiamGateway) GetCredentials(ctx context.Context, ip, role string) (*sts
 		Token:           credentials.Token,
 		Expiration:      credentials.Expiration,
 		LastUpdated:     credentials.LastUpdated,
-	}, nil
+		RoleARN:         credentials.RoleArn,
+	}
 }
 
 // Health is used to check the gRPC client connection
@@ -0,0 +1,57 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/uswitch/kiam/pkg/aws/sts"
+)
+
+const (
+	// reachabilityTTL is how long the result of checking STS is reused,
+	// every agent checks the server's health
+	reachabilityTTL = 30 * time.Second
+)
+
+// cachedReachability reuses the result of checking STS is reachable for a
+// ttl, so health checks don't call STS on every request.
+type cachedReachability struct {
+	checker sts.ReachabilityChecker
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func newCachedReachability(checker sts.ReachabilityChecker, ttl time.Duration) *cachedReachability {
+	return &cachedReachability{checker: checker, ttl: ttl, now: time.Now}
+}
+
+func (c *cachedReachability) check(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checked.IsZero() && c.now().Sub(c.checked) < c.ttl {
+		return c.err
+	}
+
+	c.err = c.checker.CheckReachable(ctx)
+	c.checked = c.now()
+	return c.err
+}
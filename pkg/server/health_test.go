@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uswitch/kiam/pkg/aws/sts"
+	"github.com/uswitch/kiam/pkg/k8s"
+	"github.com/uswitch/kiam/pkg/prefetch"
+	"github.com/uswitch/kiam/pkg/testutil"
+	pb "github.com/uswitch/kiam/proto"
+	kt "k8s.io/client-go/tools/cache/testing"
+)
+
+type stubReachability struct {
+	err    error
+	checks int
+}
+
+func (s *stubReachability) CheckReachable(ctx context.Context) error {
+	s.checks++
+	return s.err
+}
+
+func TestHealthRequiresSyncedCaches(t *testing.T) {
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	namespaces := kt.NewFakeControllerSource()
+	defer namespaces.Shutdown()
+
+	server := &KiamServer{
+		pods:       k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil),
+		namespaces: k8s.NewNamespaceCache(namespaces, time.Second),
+	}
+
+	health, err := server.GetHealth(context.Background(), &pb.GetHealthRequest{})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if health.Message != "caches not synced" {
+		t.Error("expected unsynced caches to be reported, was", health.Message)
+	}
+}
+
+func TestHealthRequiresSyncedConfigMapsWhenEnabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	namespaces := kt.NewFakeControllerSource()
+	defer namespaces.Shutdown()
+	namespaceCache := k8s.NewNamespaceCache(namespaces, time.Second)
+	namespaceCache.Run(ctx)
+	configMaps := kt.NewFakeControllerSource()
+	defer configMaps.Shutdown()
+
+	server := &KiamServer{pods: podCache, namespaces: namespaceCache}
+	health, _ := server.GetHealth(ctx, &pb.GetHealthRequest{})
+	if health.Message != "ok" {
+		t.Error("expected ok without a configmap cache, was", health.Message)
+	}
+
+	server.configMaps = k8s.NewConfigMapCache(configMaps, time.Second)
+	health, _ = server.GetHealth(ctx, &pb.GetHealthRequest{})
+	if health.Message != "caches not synced" {
+		t.Error("expected unsynced configmap cache to be reported, was", health.Message)
+	}
+}
+
+func TestHealthChecksSTSReachability(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	namespaces := kt.NewFakeControllerSource()
+	defer namespaces.Shutdown()
+	namespaceCache := k8s.NewNamespaceCache(namespaces, time.Second)
+	namespaceCache.Run(ctx)
+
+	checker := &stubReachability{err: fmt.Errorf("connection refused")}
+	reachability := newCachedReachability(checker, time.Minute)
+	server := &KiamServer{pods: podCache, namespaces: namespaceCache, stsReachability: reachability}
+
+	health, _ := server.GetHealth(ctx, &pb.GetHealthRequest{})
+	if !strings.HasPrefix(health.Message, "sts unreachable") {
+		t.Error("expected sts to be reported unreachable, was", health.Message)
+	}
+
+	checker.err = nil
+	now := time.Now()
+	reachability.now = func() time.Time { return now.Add(2 * time.Minute) }
+
+	health, _ = server.GetHealth(ctx, &pb.GetHealthRequest{})
+	if health.Message != "ok" {
+		t.Error("expected ok once sts reachable, was", health.Message)
+	}
+}
+
+func TestHealthWaitsForInitialPrefetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "role"))
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	namespaces := kt.NewFakeControllerSource()
+	defer namespaces.Shutdown()
+	namespaceCache := k8s.NewNamespaceCache(namespaces, time.Second)
+	namespaceCache.Run(ctx)
+
+	release := make(chan struct{})
+	cache := testutil.NewStubCredentialsCache(func(role string) (*sts.Credentials, error) {
+		<-release
+		return &sts.Credentials{}, nil
+	})
+	manager := prefetch.NewManager(cache, podCache, nil, false)
+	server := &KiamServer{pods: podCache, namespaces: namespaceCache, manager: manager, waitForPrefetch: true}
+
+	warmed := make(chan struct{})
+	go func() {
+		manager.Warm(ctx, podCache.ActivePods(), 1)
+		close(warmed)
+	}()
+
+	health, _ := server.GetHealth(ctx, &pb.GetHealthRequest{})
+	if health.Message != "initial prefetch incomplete" {
+		t.Error("expected incomplete prefetch to be reported, was", health.Message)
+	}
+
+	close(release)
+	<-warmed
+	health, _ = server.GetHealth(ctx, &pb.GetHealthRequest{})
+	if health.Message != "ok" {
+		t.Error("expected ok once prefetched, was", health.Message)
+	}
+}
+
+func TestCachesReachability(t *testing.T) {
+	checker := &stubReachability{}
+	reachability := newCachedReachability(checker, time.Minute)
+	now := time.Now()
+	reachability.now = func() time.Time { return now }
+
+	reachability.check(context.Background())
+	reachability.check(context.Background())
+	if checker.checks != 1 {
+		t.Error("expected result to be reused within ttl, checks:", checker.checks)
+	}
+
+	now = now.Add(time.Minute)
+	reachability.check(context.Background())
+	if checker.checks != 2 {
+		t.Error("expected sts to be checked again after ttl, checks:", checker.checks)
+	}
+}
+
+func TestHealthReportsReloading(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	namespaces := kt.NewFakeControllerSource()
+	defer namespaces.Shutdown()
+	namespaceCache := k8s.NewNamespaceCache(namespaces, time.Second)
+	namespaceCache.Run(ctx)
+
+	server := &KiamServer{pods: podCache, namespaces: namespaceCache, reloads: newReloadState(0)}
+
+	err := server.Reload(func() error {
+		health, _ := server.GetHealth(ctx, &pb.GetHealthRequest{})
+		if health.Message != "reloading" {
+			t.Error("expected reloading to be reported during reload, was", health.Message)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	health, _ := server.GetHealth(ctx, &pb.GetHealthRequest{})
+	if health.Message != "ok" {
+		t.Error("expected ok once reloaded, was", health.Message)
+	}
+}
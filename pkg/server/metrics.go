@@ -0,0 +1,112 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	telemetry "github.com/uswitch/kiam/pkg/prometheus"
+)
+
+var (
+	allowedRolesDenied prometheus.Counter
+	policyDenied       prometheus.Counter
+	roleMismatch       prometheus.Counter
+	namespaceDenied    *prometheus.CounterVec
+	credentialsAge     prometheus.Histogram
+	reportedValidity   prometheus.Histogram
+)
+
+func newMetrics(namespace string) []prometheus.Collector {
+	allowedRolesDenied = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "allowed_roles_denied_total",
+			Help:      "Number of requests for roles that aren't in the allowed roles list",
+		},
+	)
+
+	policyDenied = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "policy_denied_total",
+			Help:      "Number of credential requests forbidden by policy",
+		},
+	)
+
+	roleMismatch = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "role_mismatch_total",
+			Help:      "Number of requests for a role other than the one the pod is annotated with",
+		},
+	)
+
+	namespaceDenied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "namespace_denied_total",
+			Help:      "Number of requests from pods in denied namespaces",
+		},
+		[]string{"namespace"},
+	)
+
+	credentialsAge = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "credentials_age_seconds",
+			Help:      "Bucketed histogram of how long ago credentials were issued by STS when they're returned",
+
+			// 1s to ~9h
+			Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+		},
+	)
+
+	reportedValidity = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "server",
+			Name:      "reported_validity_seconds",
+			Help:      "Bucketed histogram of how long credentials are reported valid for when they're returned, after expiration skew and jitter",
+
+			// 1s to ~9h
+			Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+		},
+	)
+
+	return []prometheus.Collector{
+		allowedRolesDenied,
+		policyDenied,
+		roleMismatch,
+		namespaceDenied,
+		credentialsAge,
+		reportedValidity,
+	}
+}
+
+func init() {
+	telemetry.MustRegister(newMetrics)
+
+	// the gRPC server interceptors record latency by method, in addition
+	// to the handled count by method and code
+	grpc_prometheus.EnableHandlingTimeHistogram(
+		// 1ms to 5min
+		grpc_prometheus.WithHistogramBuckets(prometheus.ExponentialBuckets(.001, 2, 13)),
+	)
+}
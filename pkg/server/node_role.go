@@ -0,0 +1,79 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/uswitch/kiam/pkg/k8s"
+	"github.com/uswitch/kiam/pkg/statsd"
+	pb "github.com/uswitch/kiam/proto"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// nodeRolePods selects a namespace's pods, by label, that are permitted the
+// node's instance role.
+type nodeRolePods struct {
+	namespace string
+	selector  labels.Selector
+}
+
+// parseNodeRolePods parses namespace/selector entries. Both are required so
+// the node's role is never permitted to a whole namespace by mistake.
+func parseNodeRolePods(entries []string) ([]*nodeRolePods, error) {
+	pods := make([]*nodeRolePods, 0, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid node role pods %q, expected namespace/selector", entry)
+		}
+		selector, err := labels.Parse(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid node role pods selector %q: %s", entry, err)
+		}
+		pods = append(pods, &nodeRolePods{namespace: parts[0], selector: selector})
+	}
+	return pods, nil
+}
+
+func (p *nodeRolePods) matches(pod *v1.Pod) bool {
+	return pod.GetNamespace() == p.namespace && p.selector.Matches(labels.Set(pod.GetLabels()))
+}
+
+// IsAllowedNodeRole decides whether the Pod is permitted the node's own
+// instance role, rather than having its requests for it blocked by the agent.
+func (k *KiamServer) IsAllowedNodeRole(ctx context.Context, req *pb.IsAllowedNodeRoleRequest) (*pb.Decision, error) {
+	if statsd.Enabled {
+		defer statsd.Client.NewTiming().Send("server.rpc.IsAllowedNodeRole")
+	}
+	logger := log.WithField("pod.ip", req.Ip)
+	pod, _, err := k.roles.FindPodRole(ctx, req.Ip)
+	if pod == nil {
+		err = podNotFound(err)
+		logger.Errorf("error finding pod: %s", err.Error())
+		return nil, translatePodError(err)
+	}
+
+	for _, pods := range k.nodeRolePods {
+		if pods.matches(pod) {
+			logger.WithFields(k8s.PodFields(pod)).Warnf("pod permitted node instance role")
+			return &pb.Decision{IsAllowed: true}, nil
+		}
+	}
+
+	return &pb.Decision{IsAllowed: false, Explanation: "pod isn't permitted the node's instance role"}, nil
+}
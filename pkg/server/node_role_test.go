@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/uswitch/kiam/pkg/k8s"
+	"github.com/uswitch/kiam/pkg/testutil"
+	pb "github.com/uswitch/kiam/proto"
+	kt "k8s.io/client-go/tools/cache/testing"
+)
+
+func TestParsesNodeRolePods(t *testing.T) {
+	pods, err := parseNodeRolePods([]string{"kube-system/app=node-exporter", "monitoring/app.kubernetes.io/name in (agent)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods) != 2 || pods[1].namespace != "monitoring" || pods[1].selector.String() != "app.kubernetes.io/name in (agent)" {
+		t.Error("unexpected node role pods", pods)
+	}
+
+	for _, invalid := range []string{"kube-system", "kube-system/", "/app=node-exporter", "kube-system/app==="} {
+		if _, err := parseNodeRolePods([]string{invalid}); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestAllowsNodeRoleForSelectedPods(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	exporter := testutil.NewPod("kube-system", "exporter", "192.168.0.1", "Running")
+	exporter.Labels = map[string]string{"app": "node-exporter"}
+	other := testutil.NewPod("kube-system", "other", "192.168.0.2", "Running")
+	elsewhere := testutil.NewPod("default", "exporter", "192.168.0.3", "Running")
+	elsewhere.Labels = map[string]string{"app": "node-exporter"}
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(exporter)
+	source.Add(other)
+	source.Add(elsewhere)
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+
+	nodeRolePods, err := parseNodeRolePods([]string{"kube-system/app=node-exporter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &KiamServer{pods: podCache, roles: k8s.NewAnnotationRoleFinder(podCache, nil), nodeRolePods: nodeRolePods}
+
+	for ip, expected := range map[string]bool{"192.168.0.1": true, "192.168.0.2": false, "192.168.0.3": false} {
+		decision, err := server.IsAllowedNodeRole(ctx, &pb.IsAllowedNodeRoleRequest{Ip: ip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.IsAllowed != expected {
+			t.Errorf("expected pod %s allowed to be %t", ip, expected)
+		}
+	}
+
+	if _, err := server.IsAllowedNodeRole(ctx, &pb.IsAllowedNodeRoleRequest{Ip: "192.168.0.4"}); err != ErrPodNotFound {
+		t.Error("expected pod not found, was", err)
+	}
+}
+
+func TestDeniesNodeRoleByDefault(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(testutil.NewPod("kube-system", "exporter", "192.168.0.1", "Running"))
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+
+	server := &KiamServer{pods: podCache, roles: k8s.NewAnnotationRoleFinder(podCache, nil)}
+	decision, err := server.IsAllowedNodeRole(ctx, &pb.IsAllowedNodeRoleRequest{Ip: "192.168.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.IsAllowed {
+		t.Error("expected node role to be denied without node role pods")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/uswitch/kiam/pkg/aws/sts"
+)
+
+// credentialsPersistence saves cached credentials when the server stops and
+// restores them when it starts, so a restarted server doesn't request
+// credentials for every role at once.
+type credentialsPersistence struct {
+	path      string
+	key       []byte
+	persister sts.CredentialsPersister
+}
+
+func newCredentialsPersistence(path, keyFile string, provider sts.CredentialsProvider) (*credentialsPersistence, error) {
+	persister, ok := provider.(sts.CredentialsPersister)
+	if !ok {
+		return nil, fmt.Errorf("credentials provider doesn't support persisting credentials")
+	}
+	key, err := sts.ReadPersistKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &credentialsPersistence{path: path, key: key, persister: persister}, nil
+}
+
+// restore loads previously saved credentials, it's not an error for none to
+// have been saved.
+func (p *credentialsPersistence) restore() {
+	restored, err := sts.LoadCredentials(p.path, p.key, p.persister)
+	if os.IsNotExist(err) {
+		log.Infof("no persisted credentials to restore from %s", p.path)
+		return
+	}
+	if err != nil {
+		log.Warnf("error restoring persisted credentials, cache will be cold: %s", err.Error())
+		return
+	}
+	log.Infof("restored %d persisted credentials from %s", restored, p.path)
+}
+
+func (p *credentialsPersistence) save() {
+	if err := sts.SaveCredentials(p.path, p.key, p.persister); err != nil {
+		log.Errorf("error persisting credentials: %s", err.Error())
+		return
+	}
+	log.Infof("persisted credentials to %s", p.path)
+}
@@ -16,8 +16,12 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"path"
+	"reflect"
 	"regexp"
+	"strings"
 
 	"github.com/uswitch/kiam/pkg/aws/sts"
 	"github.com/uswitch/kiam/pkg/k8s"
@@ -85,14 +89,56 @@ func Policies(p ...AssumeRolePolicy) *CompositeAssumeRolePolicy {
 }
 
 // RequestingAnnotatedRolePolicy ensures the pod is requesting the role that it's
-// currently annotated with.
+// currently annotated with, or that its RoleFinder finds for it.
 type RequestingAnnotatedRolePolicy struct {
-	pods     k8s.PodGetter
+	roles    k8s.RoleFinder
 	resolver sts.ARNResolver
 }
 
+// NewRequestingAnnotatedRolePolicy ensures the pod is requesting the role
+// it's annotated with, ignoring any label, default or service account role.
 func NewRequestingAnnotatedRolePolicy(p k8s.PodGetter, resolver sts.ARNResolver) *RequestingAnnotatedRolePolicy {
-	return &RequestingAnnotatedRolePolicy{pods: p, resolver: resolver}
+	return NewRequestingFoundRolePolicy(k8s.NewAnnotationRoleFinder(p, nil), resolver)
+}
+
+// NewRequestingFoundRolePolicy ensures the pod is requesting the role found
+// for its IP by roles.
+func NewRequestingFoundRolePolicy(roles k8s.RoleFinder, resolver sts.ARNResolver) *RequestingAnnotatedRolePolicy {
+	return &RequestingAnnotatedRolePolicy{roles: roles, resolver: resolver}
+}
+
+// foundRoleKey is the context key for the foundRole of the request being
+// served.
+type foundRoleKey struct{}
+
+// foundRole is the role a RoleFinder found for a pod IP, shared through
+// the request's context so policies don't find it again.
+type foundRole struct {
+	finder k8s.RoleFinder
+	ip     string
+	role   string
+	err    error
+}
+
+func withFoundRole(ctx context.Context, found *foundRole) context.Context {
+	return context.WithValue(ctx, foundRoleKey{}, found)
+}
+
+// findRole returns the role found for podIP, reusing the request's found
+// role when it was found by the same finder.
+func (p *RequestingAnnotatedRolePolicy) findRole(ctx context.Context, podIP string) (string, error) {
+	found, ok := ctx.Value(foundRoleKey{}).(*foundRole)
+	if ok && found.ip == podIP && sameRoleFinder(found.finder, p.roles) {
+		return found.role, found.err
+	}
+	_, role, err := p.roles.FindPodRole(ctx, podIP)
+	return role, err
+}
+
+// sameRoleFinder compares finders without panicking on types that can't be
+// compared, which are never considered the same.
+func sameRoleFinder(a, b k8s.RoleFinder) bool {
+	return a != nil && reflect.TypeOf(a).Comparable() && a == b
 }
 
 type forbidden struct {
@@ -108,32 +154,53 @@ func (f *forbidden) Explanation() string {
 }
 
 func (p *RequestingAnnotatedRolePolicy) IsAllowedAssumeRole(ctx context.Context, role, podIP string) (Decision, error) {
-	pod, err := p.pods.GetPodByIP(podIP)
-	if err != nil {
+	annotatedRole, err := p.findRole(ctx, podIP)
+	if errors.Is(err, k8s.ErrRoleConflict) || errors.Is(err, k8s.ErrInvalidRole) {
+		log.WithField("pod.ip", podIP).Warnf("pod has no role: %s", err.Error())
+		annotatedRole = ""
+	} else if err != nil {
 		return nil, err
 	}
 
-	annotatedRole := p.resolver.Resolve(k8s.PodRole(pod))
-	role = p.resolver.Resolve(role)
-
-	if annotatedRole != role {
-		return &forbidden{requested: role, annotated: annotatedRole}, nil
+	if !requestsAnnotatedRole(p.resolver, annotatedRole, role) {
+		roleMismatch.Inc()
+		return &forbidden{requested: p.resolver.Resolve(role), annotated: p.resolver.Resolve(annotatedRole)}, nil
 	}
 
 	return &allowed{}, nil
 }
 
+// requestsAnnotatedRole returns whether the requested role identifies the
+// annotated role. The agent lists roles by name, as the metadata API does,
+// so a role's name is accepted even when it's annotated with an ARN in
+// another account.
+func requestsAnnotatedRole(resolver sts.ARNResolver, annotated, requested string) bool {
+	if sts.SameRole(resolver.Resolve(annotated), resolver.Resolve(requested)) {
+		return true
+	}
+	return sts.IsRoleName(requested) && sts.RoleName(annotated) == requested
+}
+
 type NamespacePermittedRoleNamePolicy struct {
-	namespaces k8s.NamespaceFinder
-	pods       k8s.PodGetter
+	namespaces    k8s.NamespaceFinder
+	pods          k8s.PodGetter
+	allowWildcard bool
 }
 
 func NewNamespacePermittedRoleNamePolicy(n k8s.NamespaceFinder, p k8s.PodGetter) *NamespacePermittedRoleNamePolicy {
 	return &NamespacePermittedRoleNamePolicy{namespaces: n, pods: p}
 }
 
+// SetAllowWildcard permits namespaces to use permitted patterns without a
+// literal prefix, such as * or ?*, which can match every role. They're ignored otherwise so a single annotation
+// can't accidentally grant every role.
+func (p *NamespacePermittedRoleNamePolicy) SetAllowWildcard(allow bool) {
+	p.allowWildcard = allow
+}
+
 type namespacePolicyForbidden struct {
 	expression string
+	patterns   string
 	role       string
 }
 
@@ -142,6 +209,9 @@ func (f *namespacePolicyForbidden) IsAllowed() bool {
 }
 
 func (f *namespacePolicyForbidden) Explanation() string {
+	if f.patterns != "" {
+		return fmt.Sprintf("namespace policy expression '%s' and patterns '%s' forbid role '%s'", f.expression, f.patterns, f.role)
+	}
 	return fmt.Sprintf("namespace policy expression '%s' forbids role '%s'", f.expression, f.role)
 }
 
@@ -158,18 +228,117 @@ func (p *NamespacePermittedRoleNamePolicy) IsAllowedAssumeRole(ctx context.Conte
 	}
 
 	expression := ns.GetAnnotations()[k8s.AnnotationPermittedKey]
-	if expression == "" {
+	patterns := ns.GetAnnotations()[k8s.AnnotationPermittedPatternsKey]
+	if expression == "" && patterns == "" {
 		return &namespacePolicyForbidden{expression: "(empty)", role: role}, nil
 	}
 
-	re, err := regexp.Compile(expression)
-	if err != nil {
-		return nil, err
+	if expression != "" {
+		re, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, err
+		}
+		if re.MatchString(role) {
+			return &allowed{}, nil
+		}
 	}
 
-	if !re.MatchString(role) {
-		return &namespacePolicyForbidden{expression: expression, role: role}, nil
+	if patterns != "" {
+		matched, err := p.matchesPermittedPattern(patterns, role)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			return &allowed{}, nil
+		}
 	}
 
-	return &allowed{}, nil
+	if expression == "" {
+		expression = "(empty)"
+	}
+	return &namespacePolicyForbidden{expression: expression, patterns: patterns, role: role}, nil
+}
+
+// matchesPermittedPattern returns whether role matches one of the comma
+// separated glob patterns. Patterns use path.Match syntax so * doesn't
+// match the / in a role's path.
+func (p *NamespacePermittedRoleNamePolicy) matchesPermittedPattern(patterns, role string) (bool, error) {
+	role = strings.TrimPrefix(role, "/")
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimPrefix(strings.TrimSpace(pattern), "/")
+		if pattern == "" {
+			continue
+		}
+		if isWildcardPattern(pattern) && !p.allowWildcard {
+			log.WithField("namespace.pattern", pattern).Warnf("ignoring wildcard permitted pattern, it must be allowed by the server")
+			continue
+		}
+		matched, err := path.Match(pattern, role)
+		if err != nil {
+			return false, fmt.Errorf("invalid permitted pattern %q: %s", pattern, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isWildcardPattern returns whether pattern has no literal prefix, such
+// as * or ?*, so it can match any role name.
+func isWildcardPattern(pattern string) bool {
+	switch {
+	case pattern == "":
+		return true
+	case pattern[0] == '\\':
+		// an escaped metacharacter is a literal prefix
+		return len(pattern) < 2
+	default:
+		return strings.ContainsRune("*?[", rune(pattern[0]))
+	}
+}
+
+// AllowedRolesPolicy is a server-wide guardrail that forbids assuming any
+// role that doesn't match one of the allowed patterns, regardless of how
+// the pod is annotated.
+type AllowedRolesPolicy struct {
+	patterns []*regexp.Regexp
+}
+
+// NewAllowedRolesPolicy creates the policy from regular expressions which
+// must match the whole requested role.
+func NewAllowedRolesPolicy(patterns []string) (*AllowedRolesPolicy, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed role pattern %q: %s", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return &AllowedRolesPolicy{patterns: compiled}, nil
+}
+
+type roleNotAllowed struct {
+	role string
+}
+
+func (f *roleNotAllowed) IsAllowed() bool {
+	return false
+}
+
+func (f *roleNotAllowed) Explanation() string {
+	return fmt.Sprintf("role '%s' is not in the server's allowed roles", f.role)
+}
+
+func (p *AllowedRolesPolicy) IsAllowedAssumeRole(ctx context.Context, role, podIP string) (Decision, error) {
+	for _, re := range p.patterns {
+		if re.MatchString(role) {
+			return &allowed{}, nil
+		}
+	}
+
+	allowedRolesDenied.Inc()
+	log.WithField("pod.ip", podIP).WithField("pod.iam.requestedRole", role).Warnf("role is not in allowed roles")
+	return &roleNotAllowed{role: role}, nil
 }
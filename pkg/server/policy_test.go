@@ -20,7 +20,9 @@ import (
 	"github.com/uswitch/kiam/pkg/aws/sts"
 	"github.com/uswitch/kiam/pkg/k8s"
 	kt "github.com/uswitch/kiam/pkg/k8s/testing"
+	"github.com/uswitch/kiam/pkg/prefetch"
 	"github.com/uswitch/kiam/pkg/testutil"
+	"k8s.io/api/core/v1"
 )
 
 func TestRequestedRolePolicy(t *testing.T) {
@@ -95,6 +97,47 @@ func TestRequestedRolePolicyWithSlash(t *testing.T) {
 	}
 }
 
+func TestRequestedRolePolicyMatchesRoleNameToARN(t *testing.T) {
+	arnResolver := sts.DefaultResolver("arn:aws:iam::123456789012:role/")
+	p := testutil.NewPodWithRole("namespace", "name", "192.168.0.1", testutil.PhaseRunning, "arn:aws:iam::123456789012:role/team/myrole")
+	f := kt.NewStubFinder(p)
+
+	policy := NewRequestingAnnotatedRolePolicy(f, arnResolver)
+	decision, err := policy.IsAllowedAssumeRole(context.Background(), "myrole", "192.168.0.1")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if !decision.IsAllowed() {
+		t.Error("role name was same as annotated arn, should have been permitted:", decision.Explanation())
+	}
+
+	decision, _ = policy.IsAllowedAssumeRole(context.Background(), "arn:aws:iam::210987654321:role/myrole", "192.168.0.1")
+	if decision.IsAllowed() {
+		t.Error("role is in a different account, should be denied", decision.Explanation())
+	}
+}
+
+func TestRequestedRolePolicyMatchesRoleNameToARNInOtherAccount(t *testing.T) {
+	arnResolver := sts.DefaultResolver("arn:aws:iam::123456789012:role/")
+	p := testutil.NewPodWithRole("namespace", "name", "192.168.0.1", testutil.PhaseRunning, "arn:aws:iam::210987654321:role/team/myrole")
+	f := kt.NewStubFinder(p)
+
+	policy := NewRequestingAnnotatedRolePolicy(f, arnResolver)
+	decision, err := policy.IsAllowedAssumeRole(context.Background(), "myrole", "192.168.0.1")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !decision.IsAllowed() {
+		t.Error("role name was listed for annotated arn, should have been permitted:", decision.Explanation())
+	}
+
+	decision, _ = policy.IsAllowedAssumeRole(context.Background(), "other/myrole", "192.168.0.1")
+	if decision.IsAllowed() {
+		t.Error("role resolves to a different account, should be denied", decision.Explanation())
+	}
+}
+
 func TestErrorWhenPodNotFound(t *testing.T) {
 	arnResolver := sts.DefaultResolver("arn:aws:iam::123456789012:role/")
 	f := kt.NewStubFinder(nil)
@@ -235,3 +278,176 @@ func TestNotAllowedWithoutNamespaceAnnotationWithSlash(t *testing.T) {
 		t.Error("expected failure, empty namespace policy annotation")
 	}
 }
+
+func TestNamespacePermittedPatterns(t *testing.T) {
+	n := testutil.NewNamespace("red", "")
+	n.Annotations[k8s.AnnotationPermittedPatternsKey] = "app-foo-*, team/app-bar-?, ?*, [a-z]*"
+	nf := kt.NewNamespaceFinder(n)
+	pf := kt.NewStubFinder(testutil.NewPodWithRole("red", "foo", "192.168.0.1", testutil.PhaseRunning, "app-foo-1"))
+	policy := NewNamespacePermittedRoleNamePolicy(nf, pf)
+
+	tests := []struct {
+		role    string
+		allowed bool
+	}{
+		{"app-foo-1", true},
+		{"/app-foo-web", true},
+		{"team/app-bar-1", true},
+		{"app-foo", false},
+		{"app-bar-1", false},
+		{"team/app-bar-12", false},
+		{"app-foo-1/admin", false},
+		{"other-role", false},
+	}
+	for _, test := range tests {
+		decision, err := policy.IsAllowedAssumeRole(context.Background(), test.role, "192.168.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.IsAllowed() != test.allowed {
+			t.Errorf("expected %s allowed to be %v: %s", test.role, test.allowed, decision.Explanation())
+		}
+	}
+}
+
+func TestNamespacePermittedPatternsOrExpression(t *testing.T) {
+	n := testutil.NewNamespace("red", "^red_role$")
+	n.Annotations[k8s.AnnotationPermittedPatternsKey] = "app-*"
+	nf := kt.NewNamespaceFinder(n)
+	pf := kt.NewStubFinder(testutil.NewPodWithRole("red", "foo", "192.168.0.1", testutil.PhaseRunning, "red_role"))
+	policy := NewNamespacePermittedRoleNamePolicy(nf, pf)
+
+	for _, role := range []string{"red_role", "app-foo"} {
+		decision, _ := policy.IsAllowedAssumeRole(context.Background(), role, "192.168.0.1")
+		if !decision.IsAllowed() {
+			t.Errorf("expected %s to be allowed by the expression or a pattern", role)
+		}
+	}
+	decision, _ := policy.IsAllowedAssumeRole(context.Background(), "orange_role", "192.168.0.1")
+	if decision.IsAllowed() {
+		t.Error("expected role matching neither to be forbidden")
+	}
+}
+
+func TestNamespaceWildcardPatternMustBeAllowed(t *testing.T) {
+	for _, pattern := range []string{"*", "**", " * ", "?*", "*?", "[^a]*", "[a-z]*"} {
+		n := testutil.NewNamespace("red", "")
+		n.Annotations[k8s.AnnotationPermittedPatternsKey] = pattern
+		nf := kt.NewNamespaceFinder(n)
+		pf := kt.NewStubFinder(testutil.NewPodWithRole("red", "foo", "192.168.0.1", testutil.PhaseRunning, "red_role"))
+		policy := NewNamespacePermittedRoleNamePolicy(nf, pf)
+
+		decision, err := policy.IsAllowedAssumeRole(context.Background(), "red_role", "192.168.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.IsAllowed() {
+			t.Errorf("expected wildcard pattern %q to be ignored by default", pattern)
+		}
+
+		policy.SetAllowWildcard(true)
+		decision, _ = policy.IsAllowedAssumeRole(context.Background(), "red_role", "192.168.0.1")
+		if !decision.IsAllowed() {
+			t.Errorf("expected wildcard pattern %q to permit any role once allowed", pattern)
+		}
+	}
+}
+
+func TestNamespaceInvalidPermittedPattern(t *testing.T) {
+	n := testutil.NewNamespace("red", "")
+	n.Annotations[k8s.AnnotationPermittedPatternsKey] = "app-[foo"
+	nf := kt.NewNamespaceFinder(n)
+	pf := kt.NewStubFinder(testutil.NewPodWithRole("red", "foo", "192.168.0.1", testutil.PhaseRunning, "red_role"))
+
+	_, err := NewNamespacePermittedRoleNamePolicy(nf, pf).IsAllowedAssumeRole(context.Background(), "red_role", "192.168.0.1")
+	if err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
+
+func TestAllowedRolesPolicy(t *testing.T) {
+	policy, err := NewAllowedRolesPolicy([]string{"app-.*", "reporting"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, role := range []string{"app-foo", "reporting"} {
+		decision, _ := policy.IsAllowedAssumeRole(context.Background(), role, "192.168.0.1")
+		if !decision.IsAllowed() {
+			t.Error("role matches pattern, should have been permitted:", role, decision.Explanation())
+		}
+	}
+
+	for _, role := range []string{"admin", "reporting-admin", "my-app-foo"} {
+		decision, _ := policy.IsAllowedAssumeRole(context.Background(), role, "192.168.0.1")
+		if decision.IsAllowed() {
+			t.Error("role doesn't match whole pattern, should be denied:", role)
+		}
+	}
+}
+
+func TestAllowedRolesPolicyInvalidPattern(t *testing.T) {
+	_, err := NewAllowedRolesPolicy([]string{"app-("})
+	if err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
+
+func TestAllowedRolesRestrictPrefetching(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	allowed, err := NewAllowedRolesPolicy([]string{"app-.*"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	requested := make(chan string, 4)
+	cache := testutil.NewStubCredentialsCache(func(role string) (*sts.Credentials, error) {
+		requested <- role
+		return &sts.Credentials{}, nil
+	})
+	provider, ok := newAllowedRolesProvider(cache, allowed).(sts.CredentialsCache)
+	if !ok {
+		t.Fatal("expected restricted provider to be a credentials cache")
+	}
+
+	announcer := kt.NewStubAnnouncer()
+	manager := prefetch.NewManager(provider, announcer, nil, false)
+	manager.Warm(ctx, []*v1.Pod{
+		testutil.NewPodWithRole("ns", "admin", "192.168.0.1", testutil.PhaseRunning, "admin"),
+		testutil.NewPodWithRole("ns", "app", "192.168.0.2", testutil.PhaseRunning, "app-foo"),
+	}, 1)
+	if role := <-requested; role != "app-foo" {
+		t.Error("expected only the allowed role to be warmed, was", role)
+	}
+
+	go manager.Run(ctx, 1)
+	announcer.Announce(testutil.NewPodWithRole("ns", "admin", "192.168.0.1", testutil.PhaseRunning, "admin"))
+	announcer.Announce(testutil.NewPodWithRole("ns", "app", "192.168.0.2", testutil.PhaseRunning, "app-bar"))
+	if role := <-requested; role != "app-bar" {
+		t.Error("expected only the allowed role to be prefetched, was", role)
+	}
+}
+
+func TestAllowedRolesProviderForbidsRoles(t *testing.T) {
+	allowed, err := NewAllowedRolesPolicy([]string{"app-.*"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	provider := newAllowedRolesProvider(&stubCredentialsProvider{accessKey: "A1234"}, allowed)
+
+	if _, err := provider.CredentialsForRole(context.Background(), sts.NewRoleIdentity("admin")); err != ErrPolicyForbidden {
+		t.Error("expected role outside allowed roles to be forbidden, was", err)
+	}
+	if _, ok := provider.(sts.CredentialsCache); ok {
+		t.Error("expected provider that isn't a cache not to become one")
+	}
+
+	creds, err := provider.CredentialsForRole(context.Background(), sts.NewRoleIdentity("app-foo"))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if creds.AccessKeyId != "A1234" {
+		t.Error("expected credentials to be issued, was", creds.AccessKeyId)
+	}
+}
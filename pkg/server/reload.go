@@ -0,0 +1,129 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// MaxReloadPause is the longest requests can be held while the server
+// reloads.
+const MaxReloadPause = 5 * time.Second
+
+// reloadState coordinates reloading the server's configuration. While a
+// reload is in progress the server reports it isn't healthy and, when pause
+// is set, new requests are held until the reload completes or pause
+// elapses, so they aren't served with partially reloaded state.
+type reloadState struct {
+	pause time.Duration
+
+	// serializes reloads
+	reloadMu sync.Mutex
+
+	mu   sync.Mutex
+	done chan struct{} // closed when the reload in progress completes
+}
+
+func newReloadState(pause time.Duration) *reloadState {
+	return &reloadState{pause: pause}
+}
+
+// run calls reload in the reloading state, waiting for any other reload to
+// complete first.
+func (r *reloadState) run(reload func() error) error {
+	if r == nil {
+		return reload()
+	}
+
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	done := make(chan struct{})
+	r.mu.Lock()
+	r.done = done
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.done = nil
+		r.mu.Unlock()
+		close(done)
+	}()
+
+	return reload()
+}
+
+func (r *reloadState) reloading() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.done != nil
+}
+
+// wait holds the caller while a reload is in progress, for at most the
+// pause or until ctx is done.
+func (r *reloadState) wait(ctx context.Context) {
+	if r == nil || r.pause <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	done := r.done
+	r.mu.Unlock()
+	if done == nil {
+		return
+	}
+
+	timer := time.NewTimer(r.pause)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Warnf("reload still in progress after %s, serving request", r.pause)
+	case <-ctx.Done():
+	}
+}
+
+// Reload calls reload while the server reports it isn't healthy, holding
+// requests received meanwhile for up to the configured ReloadPause. Reloads
+// are serialized, reload should replace the state it changes atomically.
+func (k *KiamServer) Reload(reload func() error) error {
+	return k.reloads.run(reload)
+}
+
+// health checks aren't held so they can report the server is reloading
+func isHealthMethod(method string) bool {
+	return strings.HasSuffix(method, "/GetHealth")
+}
+
+func (r *reloadState) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !isHealthMethod(info.FullMethod) {
+		r.wait(ctx)
+	}
+	return handler(ctx, req)
+}
+
+func (r *reloadState) streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !isHealthMethod(info.FullMethod) {
+		r.wait(stream.Context())
+	}
+	return handler(srv, stream)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func TestReloadHoldsRequestsUntilComplete(t *testing.T) {
+	reloads := newReloadState(time.Second)
+	info := &grpc.UnaryServerInfo{FullMethod: "/kiam.KiamService/GetPodCredentials"}
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	reloaded := make(chan error)
+	go func() {
+		reloaded <- reloads.run(func() error {
+			close(started)
+			<-finish
+			return nil
+		})
+	}()
+	<-started
+
+	served := make(chan bool)
+	go func() {
+		reloads.unaryInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			served <- reloads.reloading()
+			return nil, nil
+		})
+	}()
+
+	select {
+	case <-served:
+		t.Fatal("expected request to be held while reloading")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(finish)
+	if err := <-reloaded; err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if duringReload := <-served; duringReload {
+		t.Error("expected request to be served once the reload completed")
+	}
+}
+
+func TestReloadPauseIsBounded(t *testing.T) {
+	reloads := newReloadState(50 * time.Millisecond)
+	info := &grpc.UnaryServerInfo{FullMethod: "/kiam.KiamService/GetPodCredentials"}
+
+	err := reloads.run(func() error {
+		start := time.Now()
+		reloads.unaryInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		if waited := time.Since(start); waited > time.Second {
+			t.Error("expected request to be served after the pause, waited", waited)
+		}
+		return fmt.Errorf("reload failed")
+	})
+	if err == nil {
+		t.Error("expected reload error to be returned")
+	}
+	if reloads.reloading() {
+		t.Error("expected reload to complete after failing")
+	}
+}
+
+func TestReloadDoesntHoldHealthChecks(t *testing.T) {
+	reloads := newReloadState(time.Minute)
+	info := &grpc.UnaryServerInfo{FullMethod: "/kiam.KiamService/GetHealth"}
+
+	reloads.run(func() error {
+		served := make(chan struct{})
+		go reloads.unaryInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			close(served)
+			return nil, nil
+		})
+		select {
+		case <-served:
+		case <-time.After(time.Second):
+			t.Error("expected health check to be served while reloading")
+		}
+		return nil
+	})
+}
+
+func TestRejectsReloadPauseAboveMaximum(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.ReloadPause = MaxReloadPause + time.Second
+
+	_, err := NewServerWithProviders(config, &Providers{Credentials: &stubCredentialsProvider{}})
+	if err == nil {
+		t.Error("expected error for reload pause above the maximum")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// selfTestReadTimeout is how long CheckServerTLS waits after the handshake
+// for the server to reject the client certificate. With TLS 1.3 the server
+// verifies it after the client considers the handshake complete.
+const selfTestReadTimeout = 1 * time.Second
+
+// CheckServerTLS performs a TLS handshake with the server using the agent's
+// certificates. It returns an error wrapping ErrServerUnreachable when the
+// server can't be connected to, or ErrTLSMisconfigured describing why the
+// handshake failed.
+func CheckServerTLS(ctx context.Context, address, caFile, certificateFile, keyFile string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("error parsing hostname: %v", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certificateFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("%w: error loading certificate %s: %v", ErrTLSMisconfigured, certificateFile, err)
+	}
+	caPEMBlock, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("%w: error reading ca %s: %v", ErrTLSMisconfigured, caFile, err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEMBlock) {
+		return fmt.Errorf("%w: no certificates found in ca %s", ErrTLSMisconfigured, caFile)
+	}
+
+	dialer := &net.Dialer{}
+	rawConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("%w: error connecting to %s: %v", ErrServerUnreachable, address, err)
+	}
+	defer rawConn.Close()
+
+	conn := tls.Client(rawConn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ServerName:   host,
+		NextProtos:   []string{"h2"},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := conn.Handshake(); err != nil {
+		return describeHandshakeError(err, address, caFile)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(selfTestReadTimeout))
+	if _, err := conn.Read(make([]byte, 1)); err != nil && isRemoteAlert(err) {
+		return describeHandshakeError(err, address, caFile)
+	}
+	return nil
+}
+
+// describeHandshakeError explains the common causes of a failed handshake.
+func describeHandshakeError(err error, address, caFile string) error {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		netErr           net.Error
+	)
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return fmt.Errorf("%w: server certificate isn't signed by the ca %s: %v", ErrTLSMisconfigured, caFile, err)
+	case errors.As(err, &hostname):
+		return fmt.Errorf("%w: server certificate isn't valid for %s, check its common name and subject alternative names: %v", ErrTLSMisconfigured, address, err)
+	case errors.As(err, &invalid):
+		return fmt.Errorf("%w: server certificate is invalid: %v", ErrTLSMisconfigured, err)
+	case isRemoteAlert(err):
+		return fmt.Errorf("%w: server rejected the agent certificate, check it's signed by the server's ca: %v", ErrTLSMisconfigured, err)
+	case errors.As(err, &netErr):
+		return fmt.Errorf("%w: error during handshake with %s: %v", ErrServerUnreachable, address, err)
+	default:
+		return fmt.Errorf("%w: handshake with %s failed: %v", ErrTLSMisconfigured, address, err)
+	}
+}
+
+// isRemoteAlert returns true when err is an alert sent by the server, the
+// crypto/tls alert type isn't exported.
+func isRemoteAlert(err error) bool {
+	return strings.Contains(err.Error(), "remote error: tls: ")
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfTestServer listens with certificates signed by ca, completing the
+// handshake with each connection before closing it.
+func selfTestServer(t *testing.T, dir string, ca *tls.Certificate, caPEMBlock []byte) string {
+	_, certPEMBlock, keyPEMBlock := generateCert(t, ca)
+	data := filepath.Join(dir, "server")
+	createDir(t, data, map[string][]byte{
+		"cert.pem":  certPEMBlock,
+		"key.pem":   keyPEMBlock,
+		"roots.pem": caPEMBlock,
+	})
+	certs, err := newDynamicTLSConfig(filepath.Join(data, "cert.pem"), filepath.Join(data, "key.pem"), filepath.Join(data, "roots.pem"), nil)
+	check(t, "Failed to load certs", err)
+	t.Cleanup(func() { certs.Close() })
+	config, err := newServerTLSConfig(certs, "", nil)
+	check(t, "Failed to create server config", err)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	check(t, "Failed to listen", err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// selfTestAgent writes the agent's certificate, signed by ca, and the ca it
+// trusts, returning the paths of the ca, certificate and key.
+func selfTestAgent(t *testing.T, dir string, ca *tls.Certificate, trustedPEMBlock []byte) (string, string, string) {
+	_, certPEMBlock, keyPEMBlock := generateCert(t, ca)
+	data := filepath.Join(dir, "agent")
+	createDir(t, data, map[string][]byte{
+		"cert.pem":  certPEMBlock,
+		"key.pem":   keyPEMBlock,
+		"roots.pem": trustedPEMBlock,
+	})
+	return filepath.Join(data, "roots.pem"), filepath.Join(data, "cert.pem"), filepath.Join(data, "key.pem")
+}
+
+func selfTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "")
+	check(t, "Failed to create directory", err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func checkServerTLS(address, caFile, certFile, keyFile string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return CheckServerTLS(ctx, address, caFile, certFile, keyFile)
+}
+
+func TestSelfTestPassesWithTrustedCertificates(t *testing.T) {
+	dir := selfTestDir(t)
+	ca, caPEMBlock, _ := generateCert(t, nil)
+	address := selfTestServer(t, dir, ca, caPEMBlock)
+	caFile, certFile, keyFile := selfTestAgent(t, dir, ca, caPEMBlock)
+
+	if err := checkServerTLS(address, caFile, certFile, keyFile); err != nil {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestSelfTestDescribesCAMismatch(t *testing.T) {
+	dir := selfTestDir(t)
+	ca, caPEMBlock, _ := generateCert(t, nil)
+	_, otherPEMBlock, _ := generateCert(t, nil)
+	address := selfTestServer(t, dir, ca, caPEMBlock)
+	caFile, certFile, keyFile := selfTestAgent(t, dir, ca, otherPEMBlock)
+
+	err := checkServerTLS(address, caFile, certFile, keyFile)
+	if !errors.Is(err, ErrTLSMisconfigured) {
+		t.Fatal("expected tls misconfigured, was", err)
+	}
+	if !strings.Contains(err.Error(), "server certificate isn't signed by the ca "+caFile) {
+		t.Error("expected ca mismatch to be described, was", err)
+	}
+}
+
+func TestSelfTestDescribesRejectedAgentCertificate(t *testing.T) {
+	dir := selfTestDir(t)
+	ca, caPEMBlock, _ := generateCert(t, nil)
+	other, _, _ := generateCert(t, nil)
+	address := selfTestServer(t, dir, ca, caPEMBlock)
+	caFile, certFile, keyFile := selfTestAgent(t, dir, other, caPEMBlock)
+
+	err := checkServerTLS(address, caFile, certFile, keyFile)
+	if !errors.Is(err, ErrTLSMisconfigured) {
+		t.Fatal("expected tls misconfigured, was", err)
+	}
+	if !strings.Contains(err.Error(), "server rejected the agent certificate") {
+		t.Error("expected rejected certificate to be described, was", err)
+	}
+}
+
+func TestSelfTestDescribesUnreachableServer(t *testing.T) {
+	dir := selfTestDir(t)
+	ca, caPEMBlock, _ := generateCert(t, nil)
+	caFile, certFile, keyFile := selfTestAgent(t, dir, ca, caPEMBlock)
+
+	err := checkServerTLS("127.0.0.1:1", caFile, certFile, keyFile)
+	if !errors.Is(err, ErrServerUnreachable) {
+		t.Error("expected server unreachable, was", err)
+	}
+}
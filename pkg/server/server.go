@@ -16,39 +16,49 @@ package server
 
 import (
 	"context"
-	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"hash/fnv"
 	"net"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 	"github.com/uswitch/k8sc/official"
 	"github.com/uswitch/kiam/pkg/aws/sts"
 	"github.com/uswitch/kiam/pkg/k8s"
+	"github.com/uswitch/kiam/pkg/logging"
 	"github.com/uswitch/kiam/pkg/prefetch"
 	"github.com/uswitch/kiam/pkg/statsd"
+	"github.com/uswitch/kiam/pkg/tracing"
 	pb "github.com/uswitch/kiam/proto"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/security/advancedtls"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/keepalive"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/record"
 )
 
+var log = logging.Component("server")
+
 // Config controls the setup of the gRPC server
 type Config struct {
 	BindAddress              string
 	KubeConfig               string
 	PodSyncInterval          time.Duration
+	PodSyncJitter            float64
 	SessionName              string
 	SessionDuration          time.Duration
 	SessionRefresh           time.Duration
+	SessionRefreshJitter     time.Duration
 	RoleBaseARN              string
 	AutoDetectBaseARN        bool
 	TLS                      TLSConfig
@@ -56,6 +66,242 @@ type Config struct {
 	PrefetchBufferSize       int
 	AssumeRoleArn            string
 	Region                   string
+	STSCABundle              string
+	STSCABundleReplace       bool
+	HTTPProxy                string
+	CacheMaxEntries          int
+	CacheMinTTL              time.Duration
+	Partition                string
+	STSBreakerFailures       int
+	STSBreakerCoolDown       time.Duration
+	Keepalive                KeepaliveConfig
+	DefaultRole              string
+	// AllowedRoles are regular expressions matching the only roles the
+	// server will assume, all roles are permitted when empty.
+	AllowedRoles []string
+	// DeniedNamespaces are namespaces whose pods are never issued
+	// credentials, regardless of annotations.
+	DeniedNamespaces []string
+	// RoleSource configures whether pod roles are read from the role
+	// annotation, a label, or both.
+	RoleSource k8s.RoleSource
+	// ServiceAccountRoles uses the role annotated on a pod's ServiceAccount
+	// when the pod itself isn't annotated.
+	ServiceAccountRoles bool
+	// SessionPolicyConfigMaps reads session policies referenced by pods'
+	// session policy configmap annotation from a cache of ConfigMaps.
+	// Pods referencing one are denied credentials when it's not set.
+	SessionPolicyConfigMaps bool
+	// SourceIdentity sets the pod's namespace and service account as the
+	// source identity of sessions, recorded by CloudTrail.
+	SourceIdentity bool
+	// Insecure serves gRPC without TLS, so agents aren't authenticated and
+	// credentials are sent in plain text. It's for local development only.
+	Insecure bool
+	// AdminAddress serves read-only diagnostics of cached credentials when
+	// set, it must be a loopback address.
+	AdminAddress string
+	// ExpirationSkew is subtracted from the Expiration reported to clients,
+	// so they refresh credentials early enough to tolerate clock skew.
+	ExpirationSkew time.Duration
+	// ExpirationJitter brings the reported Expiration forward by a further
+	// amount of up to ExpirationJitter, consistent for each pod and
+	// credentials, so clients sharing a role refresh at different times.
+	ExpirationJitter time.Duration
+	// STSHTTPTimeout limits each HTTP request to STS, 0 disables it.
+	STSHTTPTimeout time.Duration
+	// STSMaxRetries limits the AWS SDK's retries of failed STS calls, -1
+	// keeps the SDK default.
+	STSMaxRetries int
+	// STSMaxIdleConns, STSMaxIdleConnsPerHost and STSIdleConnTimeout size
+	// the pool of connections kept open to STS.
+	STSMaxIdleConns        int
+	STSMaxIdleConnsPerHost int
+	STSIdleConnTimeout     time.Duration
+	// AssumeRoleChain are roles assumed in turn after AssumeRoleArn, the
+	// last is used to assume pods' roles.
+	AssumeRoleChain []string
+	// STSFailoverRegion is a region whose STS endpoint is used when STS in
+	// Region is unavailable.
+	STSFailoverRegion string
+	// RoleSessionRefresh overrides SessionRefresh for roles, by role name
+	// or ARN.
+	RoleSessionRefresh map[string]time.Duration
+	// CachePersistPath is a file cached credentials are saved to when the
+	// server stops, and restored from when it starts, encrypted with the
+	// base64 encoded AES-256 key in CachePersistKeyFile. Disabled when empty.
+	CachePersistPath    string
+	CachePersistKeyFile string
+	// DisableStaleCredentials returns errors when refreshing credentials
+	// fails because STS is unavailable, rather than serving the previously
+	// issued credentials until they expire.
+	DisableStaleCredentials bool
+	// RequestLogLevel is the level successful requests are logged at:
+	// RequestLogInfo, RequestLogDebug or RequestLogOff. Errors are always
+	// logged. Defaults to RequestLogInfo.
+	RequestLogLevel string
+	// Messages limits the size of gRPC messages and enables compression.
+	Messages MessageConfig
+	// WaitForInitialPrefetch reports the server unhealthy until credentials
+	// for the roles of pods known at startup have been prefetched.
+	WaitForInitialPrefetch bool
+	// NamespaceRoleBaseARNs maps namespaces to the base ARN their pods'
+	// role names are resolved with, overriding RoleBaseARN.
+	NamespaceRoleBaseARNs map[string]string
+	// STSCredentials are the server's own credentials for calling STS,
+	// the SDK's default chain is used when it's empty.
+	STSCredentials sts.CredentialsSource
+	// MaxRoleLength is the longest role, including any ARN prefix and
+	// path, accepted from pods. Defaults to k8s.DefaultMaxRoleLength.
+	MaxRoleLength int
+	// MaxSessionDuration caps the session duration requested from STS,
+	// by SessionDuration or a Pod's session duration annotation. Longer
+	// durations are clamped to it. Defaults to sts.AWSMaxSessionDuration.
+	MaxSessionDuration time.Duration
+	// DeletedPodGracePeriod is how long deleted pods remain resolvable by
+	// IP, so pods that are terminating can still request credentials.
+	DeletedPodGracePeriod time.Duration
+	// ReloadPause is how long requests received while the server reloads
+	// are held until the reload completes, at most MaxReloadPause. They're
+	// served immediately when it's 0.
+	ReloadPause time.Duration
+	// PrefetchSelector is a label selector restricting the pods credentials
+	// are prefetched and refreshed for. Other pods are issued credentials
+	// when they request them. Credentials are prefetched for all pods when
+	// it's empty.
+	PrefetchSelector string
+	// AllowWildcardPermittedPatterns permits namespaces' permitted
+	// patterns to include ones without a literal prefix, such as * or ?*.
+	AllowWildcardPermittedPatterns bool
+	// NodeRolePods are namespace/selector pairs selecting the only pods
+	// the agent lets receive the node's own instance role. No pods are
+	// permitted it when empty.
+	NodeRolePods []string
+	// PodWatchBackoff spaces out attempts to list and watch pods while
+	// the api server is unavailable. Disabled when its Initial is 0.
+	PodWatchBackoff k8s.WatchBackoff
+	// NetworkAttachmentIPs also identifies pods by the IPs of additional
+	// network attachments in their network status annotation, such as
+	// those added by Multus. Pods' authors can write the annotation, so
+	// it's only trusted for IPs no pod is assigned.
+	NetworkAttachmentIPs bool
+}
+
+// Levels successful requests can be logged at.
+const (
+	RequestLogInfo  = "info"
+	RequestLogDebug = "debug"
+	RequestLogOff   = "off"
+)
+
+// KeepaliveConfig controls how the server detects and closes broken
+// client connections, and how frequently clients are permitted to ping.
+type KeepaliveConfig struct {
+	Time                time.Duration
+	Timeout             time.Duration
+	MinTime             time.Duration
+	PermitWithoutStream bool
+}
+
+// DefaultKeepaliveConfig pings idle clients every 30s and permits clients to
+// ping as frequently as every 5s.
+func DefaultKeepaliveConfig() KeepaliveConfig {
+	return KeepaliveConfig{
+		Time:                30 * time.Second,
+		Timeout:             10 * time.Second,
+		MinTime:             5 * time.Second,
+		PermitWithoutStream: true,
+	}
+}
+
+// Validate returns an error if the keepalive settings would prevent broken
+// connections from being detected.
+func (c KeepaliveConfig) Validate() error {
+	if c.Time <= 0 {
+		return fmt.Errorf("keepalive time must be positive, was %s", c.Time)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("keepalive timeout must be positive, was %s", c.Timeout)
+	}
+	if c.Timeout >= c.Time {
+		return fmt.Errorf("keepalive timeout (%s) must be less than keepalive time (%s)", c.Timeout, c.Time)
+	}
+	if c.MinTime < 0 {
+		return fmt.Errorf("keepalive min time must not be negative, was %s", c.MinTime)
+	}
+	return nil
+}
+
+// MessageConfig controls the size of gRPC messages and whether they're
+// compressed. It's shared by the server and gateway so both sides match.
+type MessageConfig struct {
+	// MaxRecvMsgSize and MaxSendMsgSize are in bytes, gRPC's default of
+	// 4MiB is used when they're 0.
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+	// Compression gzips messages when the other side supports it.
+	Compression bool
+}
+
+const (
+	minMessageSize = 16 * 1024
+	maxMessageSize = 256 * 1024 * 1024
+)
+
+// Validate returns an error if the message sizes are too small to carry
+// credentials, or so large a single message could exhaust memory.
+func (c MessageConfig) Validate() error {
+	if err := validateMessageSize("receive", c.MaxRecvMsgSize); err != nil {
+		return err
+	}
+	return validateMessageSize("send", c.MaxSendMsgSize)
+}
+
+func validateMessageSize(direction string, size int) error {
+	if size != 0 && (size < minMessageSize || size > maxMessageSize) {
+		return fmt.Errorf("max %s message size must be between %d and %d bytes, was %d", direction, minMessageSize, maxMessageSize, size)
+	}
+	return nil
+}
+
+// serverOptions returns the gRPC options applying the config to a server.
+func (c MessageConfig) serverOptions() []grpc.ServerOption {
+	var options []grpc.ServerOption
+	if c.MaxRecvMsgSize > 0 {
+		options = append(options, grpc.MaxRecvMsgSize(c.MaxRecvMsgSize))
+	}
+	if c.MaxSendMsgSize > 0 {
+		options = append(options, grpc.MaxSendMsgSize(c.MaxSendMsgSize))
+	}
+	return options
+}
+
+// callOptions returns the gRPC options applying the config to a client's
+// calls.
+func (c MessageConfig) callOptions() []grpc.CallOption {
+	var options []grpc.CallOption
+	if c.MaxRecvMsgSize > 0 {
+		options = append(options, grpc.MaxCallRecvMsgSize(c.MaxRecvMsgSize))
+	}
+	if c.MaxSendMsgSize > 0 {
+		options = append(options, grpc.MaxCallSendMsgSize(c.MaxSendMsgSize))
+	}
+	if c.Compression {
+		options = append(options, grpc.UseCompressor(gzip.Name))
+	}
+	return options
+}
+
+// compressUnary and compressStream gzip responses to clients that
+// accept it, regardless of whether their requests were compressed.
+func compressUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	grpc.SetSendCompressor(ctx, gzip.Name)
+	return handler(ctx, req)
+}
+
+func compressStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	grpc.SetSendCompressor(stream.Context(), gzip.Name)
+	return handler(srv, stream)
 }
 
 // TLSConfig controls TLS
@@ -63,20 +309,45 @@ type TLSConfig struct {
 	ServerCert string
 	ServerKey  string
 	CA         string
+	// MinVersion is the minimum TLS version accepted, 1.2 or 1.3. Defaults
+	// to 1.2.
+	MinVersion string
+	// CipherSuites optionally restricts the TLS 1.2 cipher suites, by name,
+	// that can be negotiated. TLS 1.3 suites aren't configurable.
+	CipherSuites []string
 }
 
 // KiamServer is the gRPC server. Construct with NewServer.
 type KiamServer struct {
 	tlsConfig           *dynamicTLSConfig
+	admin               *adminServer
 	listener            net.Listener
 	server              *grpc.Server
 	pods                *k8s.PodCache
+	roles               k8s.RoleFinder
+	podRoles            k8s.PodRoles
 	namespaces          *k8s.NamespaceCache
+	serviceAccounts     *k8s.ServiceAccountCache
+	configMaps          *k8s.ConfigMapCache
 	eventRecorder       record.EventRecorder
 	manager             *prefetch.CredentialManager
 	credentialsProvider sts.CredentialsProvider
+	credentialsWatcher  sts.CredentialsWatcher
+	arnResolver         sts.ARNResolver
+	stsReachability     *cachedReachability
+	sessionPolicies     k8s.SessionPolicyFinder
 	assumePolicy        AssumeRolePolicy
+	allowedRoles        AssumeRolePolicy
+	deniedNamespaces    map[string]bool
+	nodeRolePods        []*nodeRolePods
 	parallelFetchers    int
+	sourceIdentity      bool
+	expirationSkew      time.Duration
+	expirationJitter    time.Duration
+	persistence         *credentialsPersistence
+	requestLogLevel     string
+	waitForPrefetch     bool
+	reloads             *reloadState
 }
 
 func simplifyAWSErrorMessage(err error) string {
@@ -94,36 +365,232 @@ func (k *KiamServer) GetPodCredentials(ctx context.Context, req *pb.GetPodCreden
 	if statsd.Enabled {
 		defer statsd.Client.NewTiming().Send("server.rpc.GetRoleCredentials")
 	}
-	pod, err := k.pods.GetPodByIP(req.Ip)
+	pod, identity, err := k.podRoleIdentity(ctx, req.Ip, req.Role)
 	if err != nil {
-		if err == k8s.ErrPodNotFound {
-			return nil, ErrPodNotFound
-		}
+		return nil, err
+	}
 
+	creds, err := k.credentialsForPod(ctx, pod, identity)
+	if err != nil {
 		return nil, err
 	}
-	logger := log.WithFields(k8s.PodFields(pod)).WithField("pod.iam.requestedRole", req.Role)
 
-	decision, err := k.assumePolicy.IsAllowedAssumeRole(ctx, req.Role, req.Ip)
+	observeCredentialsAge(creds)
+	response := k.credentialsResponse(req.Ip, creds)
+	response.RoleArn = k.roleARN(identity.Role)
+	return response, nil
+}
+
+// roleARN resolves the role credentials were issued for, as reported to
+// clients.
+func (k *KiamServer) roleARN(role string) string {
+	if k.arnResolver == nil {
+		return role
+	}
+	return k.arnResolver.Resolve(role)
+}
+
+// WatchRoleCredentials streams credentials for the Pod, starting with the current
+// credentials and sending new credentials each time the role is refreshed. Policy
+// is checked as for GetPodCredentials, and again before each refresh is sent; the
+// stream ends if the ip no longer identifies the same pod and role.
+func (k *KiamServer) WatchRoleCredentials(req *pb.WatchRoleCredentialsRequest, stream pb.KiamService_WatchRoleCredentialsServer) error {
+	ctx := stream.Context()
+	if k.credentialsWatcher == nil {
+		return ErrWatchUnsupported
+	}
+
+	pod, identity, err := k.podRoleIdentity(ctx, req.Ip, req.Role)
+	if err != nil {
+		return err
+	}
+
+	// watch before fetching the current credentials so no refresh is missed
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	updates := k.credentialsWatcher.Watch(ctx, identity)
+
+	creds, err := k.credentialsForPod(ctx, pod, identity)
+	if err != nil {
+		return err
+	}
+
+	var sent string
+	for {
+		if creds.AccessKeyId != sent {
+			if sent != "" {
+				if err := k.checkWatchIdentity(ctx, req, pod, identity); err != nil {
+					return err
+				}
+			}
+			response := k.credentialsResponse(req.Ip, creds)
+			response.RoleArn = k.roleARN(identity.Role)
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+			sent = creds.AccessKeyId
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case update, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			creds = update
+		}
+	}
+}
+
+// checkWatchIdentity checks the watch request still identifies the pod and
+// role that credentials are being streamed for.
+func (k *KiamServer) checkWatchIdentity(ctx context.Context, req *pb.WatchRoleCredentialsRequest, pod *v1.Pod, identity *sts.RoleIdentity) error {
+	current, currentIdentity, err := k.podRoleIdentity(ctx, req.Ip, req.Role)
+	if err != nil {
+		return err
+	}
+	if current.UID != pod.UID || currentIdentity.Key() != identity.Key() {
+		log.WithFields(k8s.PodFields(pod)).WithField("pod.iam.requestedRole", req.Role).Infof("ending credentials watch, pod identity changed")
+		return ErrPodIdentityChanged
+	}
+	return nil
+}
+
+// podRoleIdentity finds the Pod with the ip and checks policy permits it to
+// assume role, returning the identity to request credentials for.
+func (k *KiamServer) podRoleIdentity(ctx context.Context, ip, role string) (*v1.Pod, *sts.RoleIdentity, error) {
+	pod, found, err := k.roles.FindPodRole(ctx, ip)
+	if pod == nil {
+		return nil, nil, translatePodError(podNotFound(err))
+	}
+	// policy checks the role found for the pod, without finding it again
+	ctx = withFoundRole(ctx, &foundRole{finder: k.roles, ip: ip, role: found, err: err})
+	if err != nil {
+		found = ""
+	}
+	logger := log.WithFields(k8s.PodFields(pod)).WithField("pod.iam.requestedRole", role)
+
+	if err := k.checkNamespaceDenied(ctx, pod); err != nil {
+		return nil, nil, err
+	}
+
+	decision, err := k.assumePolicy.IsAllowedAssumeRole(ctx, role, ip)
 	if err != nil {
 		logger.Errorf("error checking policy: %s", err.Error())
-		return nil, err
+		return nil, nil, err
 	}
 
 	if !decision.IsAllowed() {
 		logger.WithField("policy.explanation", decision.Explanation()).Errorf("pod denied by policy")
-		k.recordEvent(pod, v1.EventTypeWarning, "KiamRoleForbidden", fmt.Sprintf("failed assuming role %q: %s", req.Role, decision.Explanation()))
-		return nil, ErrPolicyForbidden
+		k.recordEvent(pod, v1.EventTypeWarning, "KiamRoleForbidden", fmt.Sprintf("failed assuming role %q: %s", role, decision.Explanation()))
+		policyDenied.Inc()
+		return nil, nil, ErrPolicyForbidden
 	}
 
-	creds, err := k.credentialsProvider.CredentialsForRole(ctx, req.Role)
+	identity, err := k.roleIdentity(ctx, pod, k.canonicalRole(found, role))
 	if err != nil {
-		logger.Errorf("error retrieving credentials: %s", err.Error())
+		logger.Errorf("error finding session policy: %s", err.Error())
+		k.recordEvent(pod, v1.EventTypeWarning, "KiamSessionPolicyError", fmt.Sprintf("failed finding session policy: %s", err.Error()))
+		return nil, nil, err
+	}
+
+	return pod, identity, nil
+}
+
+// translatePodError converts errors finding pods into the errors returned
+// to clients, with status codes they can act on.
+func translatePodError(err error) error {
+	switch err {
+	case k8s.ErrPodNotFound:
+		return ErrPodNotFound
+	case k8s.ErrAmbiguousPodIP:
+		return ErrAmbiguousPodIP
+	}
+	return err
+}
+
+// podNotFound returns err, or ErrPodNotFound when a RoleFinder found no Pod
+// without reporting an error.
+func podNotFound(err error) error {
+	if err == nil {
+		return k8s.ErrPodNotFound
+	}
+	return err
+}
+
+// canonicalRole returns the role found for the pod when the requested role
+// identifies the same role by a different name, e.g. a name rather than an
+// ARN, so credentials are requested for the annotated ARN.
+func (k *KiamServer) canonicalRole(annotated, role string) string {
+	if k.arnResolver == nil || annotated == "" || annotated == role {
+		return role
+	}
+	if requestsAnnotatedRole(k.arnResolver, annotated, role) {
+		return annotated
+	}
+	return role
+}
+
+// checkNamespaceDenied returns ErrNamespaceDenied when the pod's namespace
+// is in the deny-list.
+func (k *KiamServer) checkNamespaceDenied(ctx context.Context, pod *v1.Pod) error {
+	if len(k.deniedNamespaces) == 0 {
+		return nil
+	}
+
+	namespace := pod.GetNamespace()
+	ns, err := k.namespaces.FindNamespace(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	if ns != nil {
+		namespace = ns.GetName()
+	}
+
+	if !k.deniedNamespaces[namespace] {
+		return nil
+	}
+
+	log.WithFields(k8s.PodFields(pod)).Warnf("pod denied, namespace is in the deny-list")
+	namespaceDenied.WithLabelValues(namespace).Inc()
+	return ErrNamespaceDenied
+}
+
+func (k *KiamServer) credentialsForPod(ctx context.Context, pod *v1.Pod, identity *sts.RoleIdentity) (*sts.Credentials, error) {
+	creds, err := k.credentialsProvider.CredentialsForRole(ctx, identity)
+	if err != nil {
+		log.WithFields(k8s.PodFields(pod)).WithField("pod.iam.requestedRole", identity.Role).Errorf("error retrieving credentials: %s", err.Error())
 		k.recordEvent(pod, v1.EventTypeWarning, "KiamCredentialError", fmt.Sprintf("failed retrieving credentials: %s", simplifyAWSErrorMessage(err)))
 		return nil, err
 	}
+	return creds, nil
+}
 
-	return translateCredentialsToProto(creds), nil
+// roleIdentity builds the identity credentials are requested for, including
+// any session policies and session duration the Pod is annotated with.
+func (k *KiamServer) roleIdentity(ctx context.Context, pod *v1.Pod, role string) (*sts.RoleIdentity, error) {
+	duration, err := k8s.PodSessionDuration(pod)
+	if err != nil {
+		return nil, err
+	}
+	identity := sts.NewRoleIdentity(role)
+	identity.PolicyARNs = k8s.PodSessionPolicyARNs(pod)
+	identity.SessionDuration = duration
+	if k.sourceIdentity {
+		identity.SourceIdentity = sts.SourceIdentityForServiceAccount(pod.Namespace, pod.Spec.ServiceAccountName)
+	}
+	if k.sessionPolicies == nil {
+		return identity, nil
+	}
+
+	policy, err := k.sessionPolicies.FindSessionPolicy(ctx, pod)
+	if err != nil {
+		return nil, err
+	}
+	identity.Policy = policy
+
+	return identity, nil
 }
 
 // IsAllowedAssumeRole checks policy to ensure the role can be assumed. Deprecated and will
@@ -145,11 +612,28 @@ func (k *KiamServer) IsAllowedAssumeRole(ctx context.Context, req *pb.IsAllowedA
 	}, nil
 }
 
-// GetHealth returns ok to allow a command to ensure the sever is operating well
+// GetHealth returns ok once the server's caches have synced and STS is
+// reachable, otherwise the message describes why it isn't ready. Errors are
+// only returned when the server can't be reached.
 func (k *KiamServer) GetHealth(ctx context.Context, _ *pb.GetHealthRequest) (*pb.HealthStatus, error) {
 	if statsd.Enabled {
 		defer statsd.Client.NewTiming().Send("server.rpc.GetHealth")
 	}
+	if !k.pods.HasSynced() || !k.namespaces.HasSynced() || (k.configMaps != nil && !k.configMaps.HasSynced()) {
+		return &pb.HealthStatus{Message: "caches not synced"}, nil
+	}
+	if k.reloads.reloading() {
+		return &pb.HealthStatus{Message: "reloading"}, nil
+	}
+	if k.waitForPrefetch && k.manager != nil && !k.manager.Warmed() {
+		return &pb.HealthStatus{Message: "initial prefetch incomplete"}, nil
+	}
+	if k.stsReachability != nil {
+		if err := k.stsReachability.check(ctx); err != nil {
+			log.Warnf("sts unreachable: %s", err.Error())
+			return &pb.HealthStatus{Message: fmt.Sprintf("sts unreachable: %s", simplifyAWSErrorMessage(err))}, nil
+		}
+	}
 	return &pb.HealthStatus{Message: "ok"}, nil
 }
 
@@ -159,26 +643,86 @@ func (k *KiamServer) GetPodRole(ctx context.Context, req *pb.GetPodRoleRequest)
 		defer statsd.Client.NewTiming().Send("server.rpc.GetPodRole")
 	}
 	logger := log.WithField("pod.ip", req.Ip)
-	pod, err := k.pods.GetPodByIP(req.Ip)
-	if err != nil {
+	pod, role, err := k.roles.FindPodRole(ctx, req.Ip)
+	if pod == nil {
+		err = podNotFound(err)
 		logger.Errorf("error finding pod: %s", err.Error())
+		return nil, translatePodError(err)
+	}
+
+	if err := k.checkNamespaceDenied(ctx, pod); err != nil {
 		return nil, err
 	}
 
-	role := k8s.PodRole(pod)
+	if err != nil {
+		logger.Errorf("error finding role: %s", err.Error())
+		return nil, err
+	}
 
-	logger.WithField("pod.iam.role", role).Infof("found role")
+	k.logRequest(logger.WithField("pod.iam.role", role), "found role")
 	return &pb.Role{Name: role}, nil
 }
 
-func translateCredentialsToProto(credentials *sts.Credentials) *pb.Credentials {
+// logRequest logs a successful request at the configured level.
+func (k *KiamServer) logRequest(logger *logrus.Entry, msg string) {
+	switch k.requestLogLevel {
+	case RequestLogOff:
+	case RequestLogDebug:
+		logger.Debug(msg)
+	default:
+		logger.Info(msg)
+	}
+}
+
+// observeCredentialsAge records how old returned credentials are.
+func observeCredentialsAge(credentials *sts.Credentials) {
+	if age, err := credentials.Age(); err == nil {
+		credentialsAge.Observe(age.Seconds())
+	}
+}
+
+// credentialsResponse translates credentials for the client at ip,
+// recording how long the reported Expiration leaves them valid.
+func (k *KiamServer) credentialsResponse(ip string, credentials *sts.Credentials) *pb.Credentials {
+	response := translateCredentialsToProto(credentials, k.reportedSkew(ip, credentials))
+	if expiry, err := time.Parse(time.RFC3339, response.Expiration); err == nil {
+		reportedValidity.Observe(time.Until(expiry).Seconds())
+	}
+	return response
+}
+
+// reportedSkew returns how far the Expiration reported to the client at ip
+// is brought forward: the configured skew, plus a fraction of the jitter
+// derived from the ip and credentials so each client's refresh is spread
+// out but stays the same across its polls.
+func (k *KiamServer) reportedSkew(ip string, credentials *sts.Credentials) time.Duration {
+	if k.expirationJitter <= 0 {
+		return k.expirationSkew
+	}
+	h := fnv.New64a()
+	h.Write([]byte(ip))
+	h.Write([]byte(credentials.AccessKeyId))
+	fraction := float64(h.Sum64()%1000) / 1000
+	return k.expirationSkew + time.Duration(fraction*float64(k.expirationJitter))
+}
+
+// translateCredentialsToProto reports the credentials' Expiration brought
+// forward by skew, the session itself remains valid until its real expiry.
+func translateCredentialsToProto(credentials *sts.Credentials, skew time.Duration) *pb.Credentials {
+	expiration := credentials.Expiration
+	if skew > 0 {
+		if expiry, err := credentials.ExpiresAt(); err == nil {
+			expiration = expiry.Add(-skew).Format(time.RFC3339)
+		}
+	}
+
 	return &pb.Credentials{
 		Code:            credentials.Code,
 		Type:            credentials.Type,
 		AccessKeyId:     credentials.AccessKeyId,
 		SecretAccessKey: credentials.SecretAccessKey,
 		Token:           credentials.Token,
-		Expiration:      credentials.Expiration,
+		Expiration:      expiration,
 		LastUpdated:     credentials.LastUpdated,
 	}
 }
@@ -189,16 +733,75 @@ func (k *KiamServer) GetRoleCredentials(ctx context.Context, req *pb.GetRoleCred
 	if statsd.Enabled {
 		defer statsd.Client.NewTiming().Send("server.rpc.GetRoleCredentials")
 	}
+	if err := k.podRoles.ValidateRole(req.Role.Name); err != nil {
+		log.Errorf("error requesting credentials: %s", err.Error())
+		return nil, err
+	}
 	logger := log.WithField("pod.iam.role", req.Role.Name)
 
-	logger.Infof("requesting credentials")
-	credentials, err := k.credentialsProvider.CredentialsForRole(ctx, req.Role.Name)
+	if k.allowedRoles != nil {
+		decision, err := k.allowedRoles.IsAllowedAssumeRole(ctx, req.Role.Name, "")
+		if err != nil {
+			return nil, err
+		}
+		if !decision.IsAllowed() {
+			logger.WithField("policy.explanation", decision.Explanation()).Errorf("role denied by policy")
+			policyDenied.Inc()
+			return nil, ErrPolicyForbidden
+		}
+	}
+
+	k.logRequest(logger, "requesting credentials")
+	credentials, err := k.credentialsProvider.CredentialsForRole(ctx, sts.NewRoleIdentity(req.Role.Name))
 	if err != nil {
 		logger.Errorf("error requesting credentials: %s", err.Error())
 		return nil, err
 	}
 
-	return translateCredentialsToProto(credentials), nil
+	observeCredentialsAge(credentials)
+	return k.credentialsResponse("", credentials), nil
+}
+
+func newSTSGateway(config *Config, arnResolver sts.ARNResolver) (*sts.DefaultSTSGateway, error) {
+	chain := make([]string, 0, len(config.AssumeRoleChain))
+	for _, role := range config.AssumeRoleChain {
+		chain = append(chain, arnResolver.Resolve(role))
+	}
+	return sts.DefaultGateway(&sts.GatewayConfig{
+		AssumeRoleArn:               arnResolver.Resolve(config.AssumeRoleArn),
+		AssumeRoleChain:             chain,
+		Region:                      config.Region,
+		CABundle:                    config.STSCABundle,
+		CABundleReplacesSystemRoots: config.STSCABundleReplace,
+		HTTPProxy:                   config.HTTPProxy,
+		Partition:                   config.Partition,
+		RoleBaseARN:                 config.RoleBaseARN,
+		BreakerFailures:             config.STSBreakerFailures,
+		BreakerCoolDown:             config.STSBreakerCoolDown,
+		HTTPTimeout:                 config.STSHTTPTimeout,
+		MaxRetries:                  config.STSMaxRetries,
+		MaxIdleConns:                config.STSMaxIdleConns,
+		MaxIdleConnsPerHost:         config.STSMaxIdleConnsPerHost,
+		IdleConnTimeout:             config.STSIdleConnTimeout,
+		FailoverRegion:              config.STSFailoverRegion,
+		Credentials:                 config.STSCredentials,
+	})
+}
+
+// ValidateRoles checks the server's identity can assume each of the roles,
+// without starting the server.
+func ValidateRoles(ctx context.Context, config *Config, roles []string) ([]*sts.RoleValidation, error) {
+	arnResolver, err := newRoleARNResolver(config)
+	if err != nil {
+		return nil, err
+	}
+
+	stsGateway, err := newSTSGateway(config, arnResolver)
+	if err != nil {
+		return nil, err
+	}
+
+	return sts.ValidateRoles(ctx, stsGateway, arnResolver, config.SessionName, roles), nil
 }
 
 func newRoleARNResolver(config *Config) (sts.ARNResolver, error) {
@@ -209,85 +812,358 @@ func newRoleARNResolver(config *Config) (sts.ARNResolver, error) {
 			return nil, fmt.Errorf("error detecting arn prefix: %s", err)
 		}
 		log.Infof("using detected prefix: %s", prefix)
+		return newPartitionARNResolver(config, prefix)
+	}
+
+	return newPartitionARNResolver(config, config.RoleBaseARN)
+}
+
+// newPartitionARNResolver resolves roles with prefix, which must be in the
+// configured partition, or the one inferred from the region or base arn.
+func newPartitionARNResolver(config *Config, prefix string) (sts.ARNResolver, error) {
+	base := config.RoleBaseARN
+	if base == "" {
+		base = prefix
+	}
+	partition, err := sts.ResolvePartition(config.Partition, config.Region, base)
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix == "" {
 		return sts.DefaultResolver(prefix), nil
 	}
 
-	return sts.DefaultResolver(config.RoleBaseARN), nil
+	if err := sts.ValidateBaseARN(prefix); err != nil {
+		return nil, err
+	}
+
+	if err := partition.ValidateARN(prefix); err != nil {
+		return nil, fmt.Errorf("invalid role base arn: %s", err)
+	}
+
+	return sts.DefaultResolver(prefix), nil
+}
+
+// Providers are the components the server delegates to when issuing
+// credentials and resolving role ARNs.
+type Providers struct {
+	// Credentials issues credentials for roles. Credentials are prefetched
+	// for running pods when it also implements sts.CredentialsCache, and
+	// agents can watch for refreshed credentials when it implements
+	// sts.CredentialsWatcher.
+	Credentials sts.CredentialsProvider
+	// ARNResolver resolves the role names requested by pods into ARNs.
+	ARNResolver sts.ARNResolver
+	// STS is checked by the server's health check when set.
+	STS sts.ReachabilityChecker
+	// Roles finds pods and the roles they're issued credentials for. Roles
+	// are found from pod annotations when it's nil.
+	Roles k8s.RoleFinder
 }
 
-// NewServer constructs a new server.
-func NewServer(config *Config) (_ *KiamServer, err error) {
+// DefaultProviders returns providers that assume roles with STS, caching
+// and refreshing credentials before they expire.
+func DefaultProviders(config *Config) (*Providers, error) {
 	arnResolver, err := newRoleARNResolver(config)
 	if err != nil {
 		return nil, err
 	}
-	stsGateway, err := sts.DefaultGateway(arnResolver.Resolve(config.AssumeRoleArn), config.Region)
+
+	stsGateway, err := newSTSGateway(config, arnResolver)
 	if err != nil {
 		return nil, err
 	}
 	credentialsCache := sts.DefaultCache(
 		stsGateway,
 		config.SessionName,
-		config.SessionDuration,
+		sts.ClampSessionDuration(config.SessionDuration, config.MaxSessionDuration),
 		config.SessionRefresh,
 		arnResolver,
+		config.CacheMaxEntries,
+		config.CacheMinTTL,
+		config.SessionRefreshJitter,
 	)
+	for role, refresh := range config.RoleSessionRefresh {
+		credentialsCache.SetRoleRefresh(role, refresh)
+	}
+	credentialsCache.SetMaxSessionDuration(config.MaxSessionDuration)
+	credentialsCache.SetServeStale(!config.DisableStaleCredentials)
+
+	return &Providers{Credentials: credentialsCache, ARNResolver: arnResolver, STS: stsGateway}, nil
+}
+
+// Option configures the providers of a server constructed with NewServer.
+type Option func(*Providers)
+
+// WithCredentialsProvider issues credentials with provider rather than
+// assuming roles with STS.
+func WithCredentialsProvider(provider sts.CredentialsProvider) Option {
+	return func(p *Providers) {
+		p.Credentials = provider
+	}
+}
 
-	client, err := official.NewClient(config.KubeConfig)
+// WithRoleFinder finds the roles pods are issued credentials for with
+// finder rather than from their annotations. Prefetching doesn't use the
+// finder: credentials are still only prefetched for the roles pods are
+// annotated with, so others are fetched when they're first requested.
+func WithRoleFinder(finder k8s.RoleFinder) Option {
+	return func(p *Providers) {
+		p.Roles = finder
+	}
+}
+
+// newKubernetesClient uses the kubeconfig at path, or the mounted service
+// account when path is empty.
+func newKubernetesClient(path string) (*kubernetes.Clientset, error) {
+	if path != "" {
+		return official.NewClient(path)
+	}
+	config, err := rest.InClusterConfig()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("no kubeconfig set and in-cluster configuration unavailable: %s", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// NewServer constructs a new server using the default providers, unless
+// they're replaced with opts.
+func NewServer(config *Config, opts ...Option) (*KiamServer, error) {
+	providers := &Providers{}
+	for _, opt := range opts {
+		opt(providers)
+	}
+
+	if providers.Credentials == nil {
+		defaults, err := DefaultProviders(config)
+		if err != nil {
+			return nil, err
+		}
+		providers.Credentials = defaults.Credentials
+		providers.ARNResolver = defaults.ARNResolver
+		providers.STS = defaults.STS
+	} else {
+		arnResolver, err := newRoleARNResolver(config)
+		if err != nil {
+			return nil, err
+		}
+		providers.ARNResolver = arnResolver
 	}
-	podCache := k8s.NewPodCache(k8s.NewListWatch(client, k8s.ResourcePods), config.PodSyncInterval, config.PrefetchBufferSize)
-	namespaceCache := k8s.NewNamespaceCache(k8s.NewListWatch(client, k8s.ResourceNamespaces), time.Minute)
 
-	notifyFn := serverTLSMetrics.notifyFunc(x509.ExtKeyUsageServerAuth)
-	tlsConfig, err := newDynamicTLSConfig(config.TLS.ServerCert, config.TLS.ServerKey, config.TLS.CA, notifyFn)
+	return NewServerWithProviders(config, providers)
+}
+
+// NewServerWithProviders constructs a new server that issues credentials
+// with the supplied providers.
+func NewServerWithProviders(config *Config, providers *Providers) (_ *KiamServer, err error) {
+	if err := config.Keepalive.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Messages.Validate(); err != nil {
+		return nil, err
+	}
+	if config.MaxSessionDuration != 0 && config.MaxSessionDuration < sts.AWSMinSessionDuration {
+		return nil, fmt.Errorf("max session duration must be at least %s, was %s", sts.AWSMinSessionDuration, config.MaxSessionDuration)
+	}
+	prefetchSelector, err := labels.Parse(config.PrefetchSelector)
 	if err != nil {
+		return nil, fmt.Errorf("invalid prefetch selector: %s", err)
+	}
+	if err := config.PodWatchBackoff.Validate(); err != nil {
 		return nil, err
 	}
-	defer func() {
+	nodeRolePods, err := parseNodeRolePods(config.NodeRolePods)
+	if err != nil {
+		return nil, err
+	}
+	if config.ReloadPause < 0 || config.ReloadPause > MaxReloadPause {
+		return nil, fmt.Errorf("reload pause must be between 0 and %s, was %s", MaxReloadPause, config.ReloadPause)
+	}
+	if config.DeletedPodGracePeriod < 0 {
+		return nil, fmt.Errorf("deleted pod grace period must not be negative, was %s", config.DeletedPodGracePeriod)
+	}
+	if config.MaxRoleLength < 0 {
+		return nil, fmt.Errorf("max role length must not be negative, was %d", config.MaxRoleLength)
+	}
+	switch config.RequestLogLevel {
+	case "", RequestLogInfo, RequestLogDebug, RequestLogOff:
+	default:
+		return nil, fmt.Errorf("invalid request log level %q, expected info, debug or off", config.RequestLogLevel)
+	}
+	if providers.Credentials == nil || providers.ARNResolver == nil {
+		return nil, fmt.Errorf("credentials provider and arn resolver are required")
+	}
+	var persistence *credentialsPersistence
+	if config.CachePersistPath != "" {
+		persistence, err = newCredentialsPersistence(config.CachePersistPath, config.CachePersistKeyFile, providers.Credentials)
 		if err != nil {
-			tlsConfig.Close()
+			return nil, err
 		}
-	}()
-	creds, err := advancedtls.NewServerCreds(&advancedtls.ServerOptions{
-		GetCertificate: func(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			return tlsConfig.LoadCert(), nil
-		},
-		RootCertificateOptions: advancedtls.RootCertificateOptions{
-			GetRootCAs: func(_ *advancedtls.GetRootCAsParams) (*advancedtls.GetRootCAsResults, error) {
-				return &advancedtls.GetRootCAsResults{TrustCerts: tlsConfig.LoadCACerts()}, nil
-			},
-		},
-		RequireClientCert: true,
-	})
+	}
+	for namespace, base := range config.NamespaceRoleBaseARNs {
+		if err := sts.ValidateBaseARN(base); err != nil {
+			return nil, fmt.Errorf("invalid base arn for namespace %s: %s", namespace, err)
+		}
+		if _, err := newPartitionARNResolver(config, base); err != nil {
+			return nil, fmt.Errorf("invalid base arn for namespace %s: %s", namespace, err)
+		}
+	}
+
+	client, err := newKubernetesClient(config.KubeConfig)
 	if err != nil {
 		return nil, err
 	}
-	grpcServer := grpc.NewServer(
-		grpc.Creds(creds),
-		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
-		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
-	)
+	podRoles := k8s.PodRoles{
+		Source:            config.RoleSource,
+		DefaultRole:       config.DefaultRole,
+		NamespaceBaseARNs: config.NamespaceRoleBaseARNs,
+		MaxRoleLength:     config.MaxRoleLength,
+	}
+	var serviceAccountCache *k8s.ServiceAccountCache
+	if config.ServiceAccountRoles {
+		serviceAccountCache = k8s.NewServiceAccountCache(k8s.NewListWatch(client, k8s.ResourceServiceAccounts), time.Minute)
+		podRoles.ServiceAccounts = serviceAccountCache
+	}
+	podCache := k8s.NewPodCache(k8s.NewListWatch(client, k8s.ResourcePods), config.PodSyncInterval, config.PodSyncJitter, config.PrefetchBufferSize, &podRoles)
+	podCache.SetDeletedPodGracePeriod(config.DeletedPodGracePeriod)
+	podCache.SetWatchBackoff(config.PodWatchBackoff)
+	podCache.SetNetworkAttachmentIPs(config.NetworkAttachmentIPs)
+	if serviceAccountCache != nil {
+		serviceAccountCache.SetChangeHandler(podCache.ServiceAccountChanged)
+	}
+	namespaceCache := k8s.NewNamespaceCache(k8s.NewListWatch(client, k8s.ResourceNamespaces), time.Minute)
+	var configMapCache *k8s.ConfigMapCache
+	var configMapFinder k8s.ConfigMapFinder
+	if config.SessionPolicyConfigMaps {
+		configMapCache = k8s.NewConfigMapCache(k8s.NewListWatch(client, k8s.ResourceConfigMaps), time.Minute)
+		configMapFinder = configMapCache
+	}
+	sessionPolicies := k8s.NewSessionPolicyResolver(configMapFinder)
+
+	streamInterceptors := []grpc.StreamServerInterceptor{tracing.StreamServerInterceptor, grpc_prometheus.StreamServerInterceptor}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{tracing.UnaryServerInterceptor, grpc_prometheus.UnaryServerInterceptor}
+	reloads := newReloadState(config.ReloadPause)
+	if config.ReloadPause > 0 {
+		streamInterceptors = append(streamInterceptors, reloads.streamInterceptor)
+		unaryInterceptors = append(unaryInterceptors, reloads.unaryInterceptor)
+	}
+	if config.Messages.Compression {
+		streamInterceptors = append(streamInterceptors, compressStream)
+		unaryInterceptors = append(unaryInterceptors, compressUnary)
+	}
+	serverOptions := []grpc.ServerOption{
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    config.Keepalive.Time,
+			Timeout: config.Keepalive.Timeout,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             config.Keepalive.MinTime,
+			PermitWithoutStream: config.Keepalive.PermitWithoutStream,
+		}),
+	}
+
+	var tlsConfig *dynamicTLSConfig
+	if config.Insecure {
+		log.Warnf("INSECURE: serving without TLS, agents aren't authenticated and credentials are sent in plain text. Never use this in production")
+	} else {
+		notifyFn := serverTLSMetrics.notifyFunc(x509.ExtKeyUsageServerAuth)
+		tlsConfig, err = newDynamicTLSConfig(config.TLS.ServerCert, config.TLS.ServerKey, config.TLS.CA, notifyFn)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				tlsConfig.Close()
+			}
+		}()
+		serverTLS, err := newServerTLSConfig(tlsConfig, config.TLS.MinVersion, config.TLS.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(serverTLS)))
+	}
+	serverOptions = append(serverOptions, config.Messages.serverOptions()...)
+	grpcServer := grpc.NewServer(serverOptions...)
 
 	listener, err := net.Listen("tcp", config.BindAddress)
 	if err != nil {
 		return nil, err
 	}
+
+	roles := providers.Roles
+	if roles == nil {
+		roles = k8s.NewAnnotationRoleFinder(podCache, &podRoles)
+	}
+
+	namespacePolicy := NewNamespacePermittedRoleNamePolicy(namespaceCache, podCache)
+	namespacePolicy.SetAllowWildcard(config.AllowWildcardPermittedPatterns)
+
 	srv := &KiamServer{
 		tlsConfig:           tlsConfig,
 		listener:            listener,
 		server:              grpcServer,
 		pods:                podCache,
+		roles:               roles,
+		podRoles:            podRoles,
 		namespaces:          namespaceCache,
+		serviceAccounts:     serviceAccountCache,
+		configMaps:          configMapCache,
 		eventRecorder:       eventRecorder(client),
-		manager:             prefetch.NewManager(credentialsCache, podCache),
-		credentialsProvider: credentialsCache,
+		credentialsProvider: providers.Credentials,
+		arnResolver:         providers.ARNResolver,
+		sessionPolicies:     sessionPolicies,
 		assumePolicy: Policies(
-			NewRequestingAnnotatedRolePolicy(podCache, arnResolver),
-			NewNamespacePermittedRoleNamePolicy(namespaceCache, podCache),
+			NewRequestingFoundRolePolicy(roles, providers.ARNResolver),
+			namespacePolicy,
 		),
 		parallelFetchers: config.ParallelFetcherProcesses,
+		sourceIdentity:   config.SourceIdentity,
+		expirationSkew:   config.ExpirationSkew,
+		expirationJitter: config.ExpirationJitter,
+		deniedNamespaces: make(map[string]bool, len(config.DeniedNamespaces)),
+		nodeRolePods:     nodeRolePods,
+		persistence:      persistence,
+		requestLogLevel:  config.RequestLogLevel,
+		waitForPrefetch:  config.WaitForInitialPrefetch,
+		reloads:          reloads,
+	}
+	for _, namespace := range config.DeniedNamespaces {
+		srv.deniedNamespaces[namespace] = true
+	}
+	if len(config.AllowedRoles) > 0 {
+		allowedRoles, err := NewAllowedRolesPolicy(config.AllowedRoles)
+		if err != nil {
+			return nil, err
+		}
+		srv.allowedRoles = allowedRoles
+		srv.assumePolicy = Policies(allowedRoles, srv.assumePolicy)
+		srv.credentialsProvider = newAllowedRolesProvider(providers.Credentials, allowedRoles)
+	}
+	if config.AdminAddress != "" {
+		inspector, _ := providers.Credentials.(sts.CredentialsInspector)
+		srv.admin, err = newAdminServer(config.AdminAddress, srv, inspector)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if watcher, ok := providers.Credentials.(sts.CredentialsWatcher); ok {
+		srv.credentialsWatcher = watcher
+	}
+	if providers.STS != nil {
+		srv.stsReachability = newCachedReachability(providers.STS, reachabilityTTL)
+	}
+	if cache, ok := srv.credentialsProvider.(sts.CredentialsCache); ok {
+		srv.manager = prefetch.NewManager(cache, podCache, sessionPolicies, config.SourceIdentity)
+		if config.PrefetchSelector != "" {
+			srv.manager.SetSelector(prefetchSelector)
+		}
+	}
+	if persistence != nil {
+		persistence.restore()
 	}
 	pb.RegisterKiamServiceServer(grpcServer, srv)
 	return srv, nil
@@ -295,7 +1171,17 @@ func NewServer(config *Config) (_ *KiamServer, err error) {
 
 // Serve starts the server, starting all components and listening for gRPC
 func (k *KiamServer) Serve(ctx context.Context) {
-	k.manager.Run(ctx, k.parallelFetchers)
+	if k.manager != nil {
+		k.manager.Run(ctx, k.parallelFetchers)
+	} else {
+		log.Infof("credentials won't be prefetched")
+	}
+	// service accounts are synced first as they're used to index pod roles
+	if k.serviceAccounts != nil {
+		if err := k.serviceAccounts.Run(ctx); err != nil {
+			log.Fatalf("error starting service account cache: %s", err)
+		}
+	}
 	err := k.pods.Run(ctx)
 	if err != nil {
 		log.Fatalf("error starting pod cache: %s", err)
@@ -304,6 +1190,17 @@ func (k *KiamServer) Serve(ctx context.Context) {
 	if err != nil {
 		log.Fatalf("error starting namespace cache: %s", err)
 	}
+	if k.configMaps != nil {
+		if err := k.configMaps.Run(ctx); err != nil {
+			log.Fatalf("error starting configmap cache: %s", err)
+		}
+	}
+	if k.manager != nil {
+		go k.manager.Warm(ctx, k.pods.ActivePods(), k.parallelFetchers)
+	}
+	if k.admin != nil {
+		go k.admin.serve()
+	}
 	k.server.Serve(k.listener)
 }
 
@@ -311,7 +1208,15 @@ func (k *KiamServer) Serve(ctx context.Context) {
 func (k *KiamServer) Stop() {
 	k.server.GracefulStop()
 	k.listener.Close()
-	k.tlsConfig.Close()
+	if k.persistence != nil {
+		k.persistence.save()
+	}
+	if k.tlsConfig != nil {
+		k.tlsConfig.Close()
+	}
+	if k.admin != nil {
+		k.admin.close()
+	}
 }
 
 func eventRecorder(kubeClient *kubernetes.Clientset) record.EventRecorder {
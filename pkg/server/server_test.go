@@ -1,16 +1,30 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/fortytw2/leaktest"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
 	"github.com/uswitch/kiam/pkg/aws/sts"
 	"github.com/uswitch/kiam/pkg/k8s"
 	"github.com/uswitch/kiam/pkg/statsd"
 	"github.com/uswitch/kiam/pkg/testutil"
 	pb "github.com/uswitch/kiam/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"k8s.io/api/core/v1"
 	kt "k8s.io/client-go/tools/cache/testing"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -43,8 +57,8 @@ func TestReturnsErrorWhenPodNotFound(t *testing.T) {
 	source := kt.NewFakeControllerSource()
 	defer source.Shutdown()
 
-	podCache := k8s.NewPodCache(source, time.Second, defaultBuffer)
-	server := &KiamServer{pods: podCache}
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	server := &KiamServer{pods: podCache, roles: k8s.NewAnnotationRoleFinder(podCache, nil)}
 
 	_, err := server.GetPodCredentials(context.Background(), &pb.GetPodCredentialsRequest{})
 
@@ -63,9 +77,9 @@ func TestReturnsPolicyErrorWhenForbidden(t *testing.T) {
 	defer source.Shutdown()
 	source.Add(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "running_role"))
 
-	podCache := k8s.NewPodCache(source, time.Second, defaultBuffer)
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
 	podCache.Run(ctx)
-	server := &KiamServer{pods: podCache, assumePolicy: &forbidPolicy{}}
+	server := &KiamServer{pods: podCache, roles: k8s.NewAnnotationRoleFinder(podCache, nil), assumePolicy: &forbidPolicy{}}
 
 	_, err := server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: "192.168.0.1"})
 
@@ -84,9 +98,9 @@ func TestReturnsCredentials(t *testing.T) {
 	defer source.Shutdown()
 	source.Add(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "running_role"))
 
-	podCache := k8s.NewPodCache(source, time.Second, defaultBuffer)
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
 	podCache.Run(ctx)
-	server := &KiamServer{pods: podCache, assumePolicy: &allowPolicy{}, credentialsProvider: &stubCredentialsProvider{accessKey: "A1234"}}
+	server := &KiamServer{pods: podCache, roles: k8s.NewAnnotationRoleFinder(podCache, nil), assumePolicy: &allowPolicy{}, credentialsProvider: &stubCredentialsProvider{accessKey: "A1234"}}
 
 	creds, err := server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: "192.168.0.1"})
 	if err != nil {
@@ -102,16 +116,722 @@ func TestReturnsCredentials(t *testing.T) {
 	}
 }
 
+func TestReportsExpirationBroughtForwardBySkew(t *testing.T) {
+	credentials := &sts.Credentials{AccessKeyId: "A1234", Expiration: "2018-01-01T00:05:00Z"}
+
+	reported := translateCredentialsToProto(credentials, time.Minute)
+	if reported.Expiration != "2018-01-01T00:04:00Z" {
+		t.Error("unexpected expiration", reported.Expiration)
+	}
+	if credentials.Expiration != "2018-01-01T00:05:00Z" {
+		t.Error("credentials were modified", credentials.Expiration)
+	}
+
+	reported = translateCredentialsToProto(credentials, 0)
+	if reported.Expiration != "2018-01-01T00:05:00Z" {
+		t.Error("expected unchanged expiration without skew, was", reported.Expiration)
+	}
+}
+
+func TestSpreadsReportedExpirationWithJitter(t *testing.T) {
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	credentials := sts.NewCredentials("A1234", "S1", "T1", expiry)
+	server := &KiamServer{expirationSkew: time.Minute, expirationJitter: 10 * time.Minute}
+
+	m := &dto.Metric{}
+	reportedValidity.Write(m)
+	before := m.GetHistogram().GetSampleCount()
+
+	reported := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		ip := fmt.Sprintf("192.168.0.%d", i)
+		response := server.credentialsResponse(ip, credentials)
+		expiration, err := time.Parse(time.RFC3339, response.Expiration)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expiration.After(expiry.Add(-time.Minute)) || expiration.Before(expiry.Add(-11*time.Minute)) {
+			t.Error("expected expiration brought forward by skew and up to the jitter, was", expiration)
+		}
+		if again := server.credentialsResponse(ip, credentials); again.Expiration != response.Expiration {
+			t.Error("expected consistent expiration for the pod, was", response.Expiration, again.Expiration)
+		}
+		if response.LastUpdated != credentials.LastUpdated || response.AccessKeyId != credentials.AccessKeyId {
+			t.Error("expected credentials to be unchanged", response)
+		}
+		reported[response.Expiration] = true
+	}
+	if len(reported) < 2 {
+		t.Error("expected expirations to be spread across pods, was", reported)
+	}
+	if credentials.Expiration != expiry.Format("2006-01-02T15:04:05Z") {
+		t.Error("credentials were modified", credentials.Expiration)
+	}
+
+	reportedValidity.Write(m)
+	if observed := m.GetHistogram().GetSampleCount() - before; observed != 20 {
+		t.Error("expected reported validity to be observed, was", observed)
+	}
+
+	server.expirationJitter = 0
+	if response := server.credentialsResponse("192.168.0.1", credentials); response.Expiration != expiry.Add(-time.Minute).Format(time.RFC3339) {
+		t.Error("expected only skew without jitter, was", response.Expiration)
+	}
+}
+
+func TestRequestsCredentialsForListedRoleName(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "arn:aws:iam::210987654321:role/team/running_role"))
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	arnResolver := sts.DefaultResolver("arn:aws:iam::123456789012:role/")
+	provider := &stubCredentialsProvider{accessKey: "A1234"}
+	server := &KiamServer{
+		pods:                podCache,
+		roles:               k8s.NewAnnotationRoleFinder(podCache, nil),
+		assumePolicy:        NewRequestingAnnotatedRolePolicy(podCache, arnResolver),
+		credentialsProvider: provider,
+		arnResolver:         arnResolver,
+	}
+
+	creds, err := server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: "192.168.0.1", Role: "running_role"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if provider.requested.Role != "arn:aws:iam::210987654321:role/team/running_role" {
+		t.Error("expected credentials for the annotated role, was", provider.requested.Role)
+	}
+	if creds.RoleArn != "arn:aws:iam::210987654321:role/team/running_role" {
+		t.Error("expected the role's ARN to be reported, was", creds.RoleArn)
+	}
+}
+
+// externalRoleFinder is an example RoleFinder assigning roles from an
+// external system, cached by pod IP, rather than from pod annotations.
+type externalRoleFinder struct {
+	pods    k8s.PodGetter
+	roles   map[string]string
+	lookups int
+}
+
+func (f *externalRoleFinder) FindPodRole(ctx context.Context, ip string) (*v1.Pod, string, error) {
+	f.lookups++
+	pod, err := f.pods.GetPodByIP(ip)
+	if err != nil {
+		return nil, "", err
+	}
+	return pod, f.roles[ip], nil
+}
+
+func TestFindsRolesWithCustomRoleFinder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "annotated_role"))
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	arnResolver := sts.DefaultResolver("arn:aws:iam::123456789012:role/")
+	finder := &externalRoleFinder{pods: podCache, roles: map[string]string{"192.168.0.1": "external_role"}}
+	provider := &stubCredentialsProvider{accessKey: "A1234"}
+	server := &KiamServer{
+		pods:                podCache,
+		roles:               finder,
+		assumePolicy:        NewRequestingFoundRolePolicy(finder, arnResolver),
+		credentialsProvider: provider,
+		arnResolver:         arnResolver,
+	}
+
+	role, err := server.GetPodRole(ctx, &pb.GetPodRoleRequest{Ip: "192.168.0.1"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if role.Name != "external_role" {
+		t.Error("expected role from finder, was", role.Name)
+	}
+
+	_, err = server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: "192.168.0.1", Role: "external_role"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if provider.requested.Role != "external_role" {
+		t.Error("expected credentials for the found role, was", provider.requested.Role)
+	}
+
+	_, err = server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: "192.168.0.1", Role: "annotated_role"})
+	if err != ErrPolicyForbidden {
+		t.Error("expected annotated role to be forbidden, was", err)
+	}
+
+	_, err = server.GetPodRole(ctx, &pb.GetPodRoleRequest{Ip: "192.168.0.2"})
+	if err != ErrPodNotFound {
+		t.Error("expected pod not found, was", err)
+	}
+}
+
+func TestFindsPodRoleOncePerCredentialsRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "annotated_role"))
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	arnResolver := sts.DefaultResolver("arn:aws:iam::123456789012:role/")
+	finder := &externalRoleFinder{pods: podCache, roles: map[string]string{"192.168.0.1": "arn:aws:iam::123456789012:role/external_role"}}
+	provider := &stubCredentialsProvider{accessKey: "A1234"}
+	server := &KiamServer{
+		pods:                podCache,
+		roles:               finder,
+		assumePolicy:        NewRequestingFoundRolePolicy(finder, arnResolver),
+		credentialsProvider: provider,
+		arnResolver:         arnResolver,
+	}
+
+	_, err := server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: "192.168.0.1", Role: "external_role"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if provider.requested.Role != "arn:aws:iam::123456789012:role/external_role" {
+		t.Error("expected credentials for the found role's ARN, was", provider.requested.Role)
+	}
+	if finder.lookups != 1 {
+		t.Error("expected the pod's role to be found once, was", finder.lookups)
+	}
+}
+
+func TestDeniesPodsInDeniedNamespace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(testutil.NewPodWithRole("kube-system", "name", "192.168.0.1", "Running", "running_role"))
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	namespaces := kt.NewFakeControllerSource()
+	defer namespaces.Shutdown()
+	namespaceCache := k8s.NewNamespaceCache(namespaces, time.Second)
+	namespaceCache.Run(ctx)
+
+	provider := &stubCredentialsProvider{accessKey: "A1234"}
+	server := &KiamServer{
+		pods:                podCache,
+		roles:               k8s.NewAnnotationRoleFinder(podCache, nil),
+		namespaces:          namespaceCache,
+		assumePolicy:        &allowPolicy{},
+		credentialsProvider: provider,
+		deniedNamespaces:    map[string]bool{"kube-system": true},
+	}
+
+	_, err := server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: "192.168.0.1"})
+	if err != ErrNamespaceDenied {
+		t.Error("unexpected error:", err)
+	}
+	if provider.requested != nil {
+		t.Error("expected no credentials to be requested")
+	}
+
+	_, err = server.GetPodRole(ctx, &pb.GetPodRoleRequest{Ip: "192.168.0.1"})
+	if err != ErrNamespaceDenied {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestDeniesPodsSharingAnIP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(testutil.NewPodWithRole("ns", "first", "192.168.0.1", "Running", "first_role"))
+	source.Add(testutil.NewPodWithRole("ns", "second", "192.168.0.1", "Running", "second_role"))
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	provider := &stubCredentialsProvider{accessKey: "A1234"}
+	server := &KiamServer{pods: podCache, roles: k8s.NewAnnotationRoleFinder(podCache, nil), assumePolicy: &allowPolicy{}, credentialsProvider: provider}
+
+	_, err := server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: "192.168.0.1", Role: "first_role"})
+	if err != ErrAmbiguousPodIP {
+		t.Error("expected ambiguous ip error, was", err)
+	}
+	if provider.requested != nil {
+		t.Error("expected no credentials to be requested")
+	}
+
+	_, err = server.GetPodRole(ctx, &pb.GetPodRoleRequest{Ip: "192.168.0.1"})
+	if err != ErrAmbiguousPodIP {
+		t.Error("expected ambiguous ip error, was", err)
+	}
+}
+
+func TestRequestsCredentialsForAnnotatedRoleARN(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "arn:aws:iam::123456789012:role/team/running_role"))
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	arnResolver := sts.DefaultResolver("arn:aws:iam::123456789012:role/")
+	provider := &stubCredentialsProvider{accessKey: "A1234"}
+	server := &KiamServer{
+		pods:                podCache,
+		roles:               k8s.NewAnnotationRoleFinder(podCache, nil),
+		assumePolicy:        NewRequestingAnnotatedRolePolicy(podCache, arnResolver),
+		credentialsProvider: provider,
+		arnResolver:         arnResolver,
+	}
+
+	_, err := server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: "192.168.0.1", Role: "running_role"})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if provider.requested.Role != "arn:aws:iam::123456789012:role/team/running_role" {
+		t.Error("expected credentials for annotated role, was", provider.requested.Role)
+	}
+}
+
+func TestRequestsCredentialsForNamespaceBaseARN(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	podRoles := &k8s.PodRoles{NamespaceBaseARNs: map[string]string{"team-a": "arn:aws:iam::111111111111:role/"}}
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(testutil.NewPodWithRole("team-a", "mapped", "192.168.0.1", "Running", "app"))
+	source.Add(testutil.NewPodWithRole("team-b", "unmapped", "192.168.0.2", "Running", "app"))
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, podRoles)
+	podCache.Run(ctx)
+	arnResolver := sts.DefaultResolver("arn:aws:iam::123456789012:role/")
+	provider := &stubCredentialsProvider{accessKey: "A1234"}
+	roles := k8s.NewAnnotationRoleFinder(podCache, podRoles)
+	server := &KiamServer{
+		pods:                podCache,
+		roles:               roles,
+		assumePolicy:        NewRequestingFoundRolePolicy(roles, arnResolver),
+		credentialsProvider: provider,
+		arnResolver:         arnResolver,
+	}
+
+	// the requested identity's role is the cache key
+	_, err := server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: "192.168.0.1", Role: "app"})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if provider.requested.Role != "arn:aws:iam::111111111111:role/app" {
+		t.Error("expected credentials for role in namespace's account, was", provider.requested.Role)
+	}
+
+	_, err = server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: "192.168.0.2", Role: "app"})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if provider.requested.Role != "app" {
+		t.Error("expected unmapped namespace to fall back to the server's base arn, was", provider.requested.Role)
+	}
+}
+
+func TestRejectsInvalidNamespaceBaseARN(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.NamespaceRoleBaseARNs = map[string]string{"team-a": "arn:aws:iam::111111111111:role"}
+
+	_, err := NewServerWithProviders(config, &Providers{Credentials: &stubCredentialsProvider{}, ARNResolver: sts.DefaultResolver("")})
+	if err == nil {
+		t.Error("expected error for base arn without trailing slash")
+	}
+}
+
 type stubCredentialsProvider struct {
-	accessKey string
+	accessKey   string
+	lastUpdated string
+	requested   *sts.RoleIdentity
 }
 
-func (c *stubCredentialsProvider) CredentialsForRole(ctx context.Context, role string) (*sts.Credentials, error) {
+func (c *stubCredentialsProvider) CredentialsForRole(ctx context.Context, identity *sts.RoleIdentity) (*sts.Credentials, error) {
+	c.requested = identity
 	return &sts.Credentials{
 		AccessKeyId: c.accessKey,
+		LastUpdated: c.lastUpdated,
 	}, nil
 }
 
+func TestRecordsReturnedCredentialsAge(t *testing.T) {
+	histogram := func() (uint64, float64) {
+		m := &dto.Metric{}
+		credentialsAge.Write(m)
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+	count, sum := histogram()
+
+	lastUpdated := time.Now().UTC().Add(-90 * time.Second).Format("2006-01-02T15:04:05Z")
+	server := &KiamServer{credentialsProvider: &stubCredentialsProvider{lastUpdated: lastUpdated}}
+	_, err := server.GetRoleCredentials(context.Background(), &pb.GetRoleCredentialsRequest{Role: &pb.Role{Name: "role"}})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	newCount, newSum := histogram()
+	if newCount != count+1 {
+		t.Error("expected one age observation, was", newCount-count)
+	}
+	if age := newSum - sum; age < 90 || age > 120 {
+		t.Error("expected age of around 90s, was", age)
+	}
+}
+
+func TestLogsSuccessfulRequestsAtConfiguredLevel(t *testing.T) {
+	out, level := log.Out, log.Level
+	defer func() { log.Out, log.Level = out, level }()
+
+	for _, tc := range []struct {
+		requestLogLevel string
+		logLevel        logrus.Level
+		logged          bool
+	}{
+		{"", logrus.InfoLevel, true},
+		{RequestLogInfo, logrus.InfoLevel, true},
+		{RequestLogDebug, logrus.InfoLevel, false},
+		{RequestLogDebug, logrus.DebugLevel, true},
+		{RequestLogOff, logrus.DebugLevel, false},
+	} {
+		buf := &bytes.Buffer{}
+		log.Out, log.Level = buf, tc.logLevel
+
+		server := &KiamServer{credentialsProvider: &stubCredentialsProvider{}, requestLogLevel: tc.requestLogLevel}
+		_, err := server.GetRoleCredentials(context.Background(), &pb.GetRoleCredentialsRequest{Role: &pb.Role{Name: "role"}})
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+
+		if logged := strings.Contains(buf.String(), "requesting credentials"); logged != tc.logged {
+			t.Errorf("request log level %q at %s: expected logged=%t, was %t", tc.requestLogLevel, tc.logLevel, tc.logged, logged)
+		}
+	}
+}
+
+func TestRejectsInvalidRoleBeforeRequestingCredentials(t *testing.T) {
+	provider := &stubCredentialsProvider{}
+	server := &KiamServer{credentialsProvider: provider}
+
+	_, err := server.GetRoleCredentials(context.Background(), &pb.GetRoleCredentialsRequest{Role: &pb.Role{Name: "role\nlevel=error"}})
+	if !errors.Is(err, k8s.ErrInvalidRole) {
+		t.Error("expected invalid role error, was", err)
+	}
+	if provider.requested != nil {
+		t.Error("expected credentials not to be requested, requested", provider.requested.Role)
+	}
+}
+
+func TestRejectsUnknownRequestLogLevel(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.RequestLogLevel = "verbose"
+
+	_, err := NewServerWithProviders(config, &Providers{Credentials: &stubCredentialsProvider{}})
+	if err == nil {
+		t.Error("expected error for unknown request log level")
+	}
+}
+
+func TestRejectsInvalidPrefetchSelector(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.PrefetchSelector = "kiam-prefetch in (true"
+
+	_, err := NewServerWithProviders(config, &Providers{Credentials: &stubCredentialsProvider{}})
+	if err == nil {
+		t.Error("expected error for invalid prefetch selector")
+	}
+}
+
+func TestRejectsMaxSessionDurationBelowAWSMinimum(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.MaxSessionDuration = 5 * time.Minute
+
+	_, err := NewServerWithProviders(config, &Providers{Credentials: &stubCredentialsProvider{}})
+	if err == nil {
+		t.Error("expected error for max session duration below the aws minimum")
+	}
+}
+
+func TestRequestsCredentialsWithSessionPolicy(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	policy := `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"*"}]}`
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "running_role")
+	pod.Annotations[k8s.AnnotationSessionPolicyKey] = policy
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(pod)
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	provider := &stubCredentialsProvider{accessKey: "A1234"}
+	server := &KiamServer{pods: podCache, roles: k8s.NewAnnotationRoleFinder(podCache, nil), assumePolicy: &allowPolicy{}, credentialsProvider: provider, sessionPolicies: k8s.NewSessionPolicyResolver(nil)}
+
+	_, err := server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: "192.168.0.1", Role: "running_role"})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	if provider.requested.Role != "running_role" {
+		t.Error("unexpected role requested", provider.requested.Role)
+	}
+	if provider.requested.Policy != policy {
+		t.Error("expected session policy to be requested, was", provider.requested.Policy)
+	}
+}
+
+func TestRequestsCredentialsWithSessionPolicyARNs(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "running_role")
+	pod.Annotations[k8s.AnnotationSessionPolicyARNsKey] = "arn:aws:iam::123456789012:policy/read-only, arn:aws:iam::aws:policy/ReadOnlyAccess"
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(pod)
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	provider := &stubCredentialsProvider{accessKey: "A1234"}
+	server := &KiamServer{pods: podCache, roles: k8s.NewAnnotationRoleFinder(podCache, nil), assumePolicy: &allowPolicy{}, credentialsProvider: provider}
+
+	_, err := server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: "192.168.0.1", Role: "running_role"})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	arns := provider.requested.PolicyARNs
+	if len(arns) != 2 || arns[0] != "arn:aws:iam::123456789012:policy/read-only" || arns[1] != "arn:aws:iam::aws:policy/ReadOnlyAccess" {
+		t.Error("expected session policy arns to be requested, was", arns)
+	}
+}
+
+func TestRequestsCredentialsWithAnnotatedSessionDuration(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	long := testutil.NewPodWithRole("ns", "long", "192.168.0.1", "Running", "long_role")
+	long.Annotations[k8s.AnnotationSessionDurationKey] = "12h"
+	short := testutil.NewPodWithRole("ns", "short", "192.168.0.2", "Running", "short_role")
+	short.Annotations[k8s.AnnotationSessionDurationKey] = "5m"
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(long)
+	source.Add(short)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	provider := &stubCredentialsProvider{accessKey: "A1234"}
+	server := &KiamServer{pods: podCache, roles: k8s.NewAnnotationRoleFinder(podCache, nil), assumePolicy: &allowPolicy{}, credentialsProvider: provider}
+
+	// durations outside the permitted range are clamped by the credentials
+	// cache before they're requested from sts
+	tests := []struct {
+		ip, role string
+		expected time.Duration
+	}{
+		{"192.168.0.1", "long_role", 12 * time.Hour},
+		{"192.168.0.2", "short_role", 5 * time.Minute},
+	}
+	for _, test := range tests {
+		if _, err := server.GetPodCredentials(ctx, &pb.GetPodCredentialsRequest{Ip: test.ip, Role: test.role}); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		if provider.requested.SessionDuration != test.expected {
+			t.Errorf("expected %s requested for %s, was %s", test.expected, test.role, provider.requested.SessionDuration)
+		}
+	}
+}
+
+func TestRejectsInvalidAnnotatedSessionDuration(t *testing.T) {
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "running_role")
+	pod.Annotations[k8s.AnnotationSessionDurationKey] = "forever"
+
+	server := &KiamServer{}
+	if _, err := server.roleIdentity(context.Background(), pod, "running_role"); err == nil {
+		t.Error("expected error for invalid session duration annotation")
+	}
+}
+
+type stubCredentialsWatcher struct {
+	updates chan *sts.Credentials
+}
+
+func (w *stubCredentialsWatcher) Watch(ctx context.Context, identity *sts.RoleIdentity) <-chan *sts.Credentials {
+	return w.updates
+}
+
+type stubWatchStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent chan *pb.Credentials
+}
+
+func (s *stubWatchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *stubWatchStream) Send(credentials *pb.Credentials) error {
+	s.sent <- credentials
+	return nil
+}
+
+func TestWatchStreamsRefreshedCredentials(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+	source.Add(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "running_role"))
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	watcher := &stubCredentialsWatcher{updates: make(chan *sts.Credentials)}
+	server := &KiamServer{pods: podCache, roles: k8s.NewAnnotationRoleFinder(podCache, nil), assumePolicy: &allowPolicy{}, credentialsProvider: &stubCredentialsProvider{accessKey: "A1234"}, credentialsWatcher: watcher}
+
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	stream := &stubWatchStream{ctx: streamCtx, sent: make(chan *pb.Credentials, 1)}
+	done := make(chan error)
+	go func() {
+		done <- server.WatchRoleCredentials(&pb.WatchRoleCredentialsRequest{Ip: "192.168.0.1", Role: "running_role"}, stream)
+	}()
+
+	if creds := <-stream.sent; creds.AccessKeyId != "A1234" {
+		t.Error("expected current credentials first, was", creds.AccessKeyId)
+	}
+
+	watcher.updates <- &sts.Credentials{AccessKeyId: "B5678"}
+	if creds := <-stream.sent; creds.AccessKeyId != "B5678" {
+		t.Error("expected refreshed credentials, was", creds.AccessKeyId)
+	}
+
+	cancelStream()
+	if err := <-done; err != nil {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestWatchEndsWhenPodIdentityChanges(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "running_role")
+	pod.UID = "first"
+	source.Add(pod)
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	watcher := &stubCredentialsWatcher{updates: make(chan *sts.Credentials)}
+	server := &KiamServer{pods: podCache, roles: k8s.NewAnnotationRoleFinder(podCache, nil), assumePolicy: &allowPolicy{}, credentialsProvider: &stubCredentialsProvider{accessKey: "A1234"}, credentialsWatcher: watcher}
+
+	stream := &stubWatchStream{ctx: ctx, sent: make(chan *pb.Credentials, 1)}
+	done := make(chan error)
+	go func() {
+		done <- server.WatchRoleCredentials(&pb.WatchRoleCredentialsRequest{Ip: "192.168.0.1", Role: "running_role"}, stream)
+	}()
+	<-stream.sent
+
+	// the ip is reused by a different pod
+	source.Delete(pod)
+	replacement := testutil.NewPodWithRole("ns", "replacement", "192.168.0.1", "Running", "running_role")
+	replacement.UID = "second"
+	source.Add(replacement)
+	for {
+		found, _ := podCache.GetPodByIP("192.168.0.1")
+		if found != nil && found.UID == "second" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	watcher.updates <- &sts.Credentials{AccessKeyId: "B5678"}
+	if err := <-done; err != ErrPodIdentityChanged {
+		t.Error("expected watch to end as the pod changed, was", err)
+	}
+	select {
+	case creds := <-stream.sent:
+		t.Error("expected no credentials to be sent, was", creds.AccessKeyId)
+	default:
+	}
+}
+
+func TestWatchEndsWhenPolicyForbidsRefresh(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	source := kt.NewFakeControllerSource()
+	defer source.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pod := testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "running_role")
+	source.Add(pod)
+
+	podCache := k8s.NewPodCache(source, time.Second, 0, defaultBuffer, nil)
+	podCache.Run(ctx)
+	watcher := &stubCredentialsWatcher{updates: make(chan *sts.Credentials)}
+	roles := k8s.NewAnnotationRoleFinder(podCache, nil)
+	server := &KiamServer{pods: podCache, roles: roles, assumePolicy: NewRequestingFoundRolePolicy(roles, sts.DefaultResolver("arn:aws:iam::123456789012:role/")), credentialsProvider: &stubCredentialsProvider{accessKey: "A1234"}, credentialsWatcher: watcher}
+
+	stream := &stubWatchStream{ctx: ctx, sent: make(chan *pb.Credentials, 1)}
+	done := make(chan error)
+	go func() {
+		done <- server.WatchRoleCredentials(&pb.WatchRoleCredentialsRequest{Ip: "192.168.0.1", Role: "running_role"}, stream)
+	}()
+	<-stream.sent
+
+	source.Modify(testutil.NewPodWithRole("ns", "name", "192.168.0.1", "Running", "other_role"))
+	for {
+		found, _ := podCache.GetPodByIP("192.168.0.1")
+		if found != nil && podCache.PodRole(found) == "other_role" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	watcher.updates <- &sts.Credentials{AccessKeyId: "B5678"}
+	if err := <-done; err != ErrPolicyForbidden {
+		t.Error("expected watch to end as policy forbids the role, was", err)
+	}
+}
+
 type forbidPolicy struct {
 }
 
@@ -138,3 +858,411 @@ func (d *decision) IsAllowed() bool {
 func (d *decision) Explanation() string {
 	return d.explanation
 }
+
+func TestValidatesKeepaliveConfig(t *testing.T) {
+	if err := DefaultKeepaliveConfig().Validate(); err != nil {
+		t.Error("expected default keepalive config to be valid:", err)
+	}
+
+	invalid := []KeepaliveConfig{
+		{Time: 0, Timeout: time.Second},
+		{Time: 30 * time.Second, Timeout: 0},
+		{Time: 10 * time.Second, Timeout: 10 * time.Second},
+		{Time: 30 * time.Second, Timeout: 10 * time.Second, MinTime: -time.Second},
+	}
+	for _, config := range invalid {
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+}
+
+const testKubeConfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: test
+  context:
+    cluster: test
+current-context: test
+`
+
+func newTestConfig(t *testing.T) (*Config, func()) {
+	ca, caCertPEMBlock, _ := generateCert(t, nil)
+	_, certPEMBlock, keyPEMBlock := generateCert(t, ca)
+
+	dir, err := ioutil.TempDir("", "")
+	check(t, "Failed to create directory", err)
+	data := filepath.Join(dir, "data")
+	createDir(t, data, map[string][]byte{
+		"cert.pem":   certPEMBlock,
+		"key.pem":    keyPEMBlock,
+		"roots.pem":  caCertPEMBlock,
+		"kubeconfig": []byte(testKubeConfig),
+	})
+
+	config := &Config{
+		BindAddress: "127.0.0.1:0",
+		KubeConfig:  filepath.Join(data, "kubeconfig"),
+		TLS: TLSConfig{
+			ServerCert: filepath.Join(data, "cert.pem"),
+			ServerKey:  filepath.Join(data, "key.pem"),
+			CA:         filepath.Join(data, "roots.pem"),
+		},
+		Keepalive: DefaultKeepaliveConfig(),
+	}
+	return config, func() { os.RemoveAll(dir) }
+}
+
+func TestEmptyKubeConfigUsesInClusterConfig(t *testing.T) {
+	for _, name := range []string{"KUBERNETES_SERVICE_HOST", "KUBERNETES_SERVICE_PORT"} {
+		if value, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, value)
+		}
+		os.Unsetenv(name)
+	}
+
+	_, err := newKubernetesClient("")
+	if err == nil {
+		t.Fatal("expected error outside a cluster")
+	}
+	if !strings.Contains(err.Error(), "in-cluster") || !strings.Contains(err.Error(), "KUBERNETES_SERVICE_HOST") {
+		t.Error("expected in-cluster configuration error, was", err)
+	}
+
+	_, err = newKubernetesClient(filepath.Join(os.TempDir(), "missing-kubeconfig"))
+	if err == nil || strings.Contains(err.Error(), "in-cluster") {
+		t.Error("expected kubeconfig error, was", err)
+	}
+}
+
+func TestServerUsesInjectedProvider(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+
+	provider := &stubCredentialsProvider{accessKey: "A1234"}
+	server, err := NewServerWithProviders(config, &Providers{Credentials: provider, ARNResolver: sts.DefaultResolver("arn:aws:iam::123456789012:role/")})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	defer server.Stop()
+
+	creds, err := server.GetRoleCredentials(context.Background(), &pb.GetRoleCredentialsRequest{Role: &pb.Role{Name: "foo"}})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if creds.AccessKeyId != "A1234" {
+		t.Error("unexpected access key", creds.AccessKeyId)
+	}
+	if provider.requested == nil || provider.requested.Role != "foo" {
+		t.Error("expected credentials to be requested from injected provider, was", provider.requested)
+	}
+
+	// the stub provider can't be watched or prefetched from
+	if server.credentialsWatcher != nil {
+		t.Error("expected no credentials watcher")
+	}
+	if server.manager != nil {
+		t.Error("expected credentials not to be prefetched")
+	}
+}
+
+func TestNewServerWithCredentialsProvider(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+
+	provider := &stubCredentialsProvider{accessKey: "A1234"}
+	server, err := NewServer(config, WithCredentialsProvider(provider))
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	defer server.Stop()
+
+	creds, err := server.GetRoleCredentials(context.Background(), &pb.GetRoleCredentialsRequest{Role: &pb.Role{Name: "foo"}})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if creds.AccessKeyId != "A1234" {
+		t.Error("unexpected access key", creds.AccessKeyId)
+	}
+	if provider.requested == nil || provider.requested.Role != "foo" {
+		t.Error("expected credentials to be requested from option's provider, was", provider.requested)
+	}
+}
+
+func TestServerPrefetchesFromInjectedCache(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+
+	cache := testutil.NewStubCredentialsCache(func(role string) (*sts.Credentials, error) {
+		return &sts.Credentials{AccessKeyId: "A1234"}, nil
+	})
+	server, err := NewServerWithProviders(config, &Providers{Credentials: cache, ARNResolver: sts.DefaultResolver("")})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	defer server.Stop()
+
+	if server.manager == nil {
+		t.Error("expected credentials to be prefetched from injected cache")
+	}
+}
+
+func TestServerRequiresProviders(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+
+	if _, err := NewServerWithProviders(config, &Providers{ARNResolver: sts.DefaultResolver("")}); err == nil {
+		t.Error("expected error without credentials provider")
+	}
+}
+
+func TestInsecureServerAndGateway(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.Insecure = true
+	config.TLS = TLSConfig{}
+
+	server, err := NewServerWithProviders(config, &Providers{Credentials: &stubCredentialsProvider{}, ARNResolver: sts.DefaultResolver("")})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	defer server.Stop()
+	go server.server.Serve(server.listener)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	gateway, err := NewInsecureGateway(ctx, server.listener.Addr().String(), keepalive.ClientParameters{}, MessageConfig{})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	defer gateway.Close()
+
+	health, err := gateway.Health(ctx)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if health == "" {
+		t.Error("expected health message")
+	}
+}
+
+func TestCompressedServerAndGateway(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.Insecure = true
+	config.TLS = TLSConfig{}
+	config.Messages = MessageConfig{MaxRecvMsgSize: 1024 * 1024, MaxSendMsgSize: 1024 * 1024, Compression: true}
+
+	server, err := NewServerWithProviders(config, &Providers{Credentials: &stubCredentialsProvider{accessKey: "A1"}, ARNResolver: sts.DefaultResolver("")})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	defer server.Stop()
+	go server.server.Serve(server.listener)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	gateway, err := NewInsecureGateway(ctx, server.listener.Addr().String(), keepalive.ClientParameters{}, config.Messages)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	defer gateway.Close()
+
+	health, err := gateway.Health(ctx)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if health == "" {
+		t.Error("expected health message")
+	}
+}
+
+func TestGatewayReturnsPodNotFoundWithStatusCode(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.Insecure = true
+	config.TLS = TLSConfig{}
+
+	server, err := NewServerWithProviders(config, &Providers{Credentials: &stubCredentialsProvider{}, ARNResolver: sts.DefaultResolver("")})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	defer server.Stop()
+	go server.server.Serve(server.listener)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	gateway, err := NewInsecureGateway(ctx, server.listener.Addr().String(), keepalive.ClientParameters{}, config.Messages)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	defer gateway.Close()
+
+	_, err = gateway.client.GetPodRole(ctx, &pb.GetPodRoleRequest{Ip: "192.168.0.1"})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("expected %s status, was %s: %v", codes.NotFound, code, err)
+	}
+
+	_, err = gateway.GetRole(ctx, "192.168.0.1")
+	if err != ErrPodNotFound {
+		t.Error("expected pod not found, was", err)
+	}
+	_, err = gateway.GetCredentials(ctx, "192.168.0.1", "role")
+	if err != ErrPodNotFound {
+		t.Error("expected pod not found, was", err)
+	}
+}
+
+func TestTranslatesErrorsFromServer(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected error
+	}{
+		{status.Error(codes.NotFound, "no pod found"), ErrPodNotFound},
+		{status.Error(codes.Unknown, "no pod found"), ErrPodNotFound},
+		{status.Error(codes.PermissionDenied, "namespace denied"), ErrNamespaceDenied},
+		{status.Error(codes.Unknown, "forbidden by policy"), ErrPolicyForbidden},
+		{status.Error(codes.FailedPrecondition, "multiple pods share the ip"), ErrAmbiguousPodIP},
+	}
+	for _, c := range cases {
+		if err := translateError(c.err); err != c.expected {
+			t.Errorf("expected %v to translate to %v, was %v", c.err, c.expected, err)
+		}
+	}
+}
+
+func handlingTimeSamples(t *testing.T, method string) uint64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "grpc_server_handling_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "grpc_method" && label.GetValue() == method {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestRecordsRPCLatencyByMethod(t *testing.T) {
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.Insecure = true
+	config.TLS = TLSConfig{}
+
+	server, err := NewServerWithProviders(config, &Providers{Credentials: &stubCredentialsProvider{}, ARNResolver: sts.DefaultResolver("")})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	defer server.Stop()
+	go server.server.Serve(server.listener)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	gateway, err := NewInsecureGateway(ctx, server.listener.Addr().String(), keepalive.ClientParameters{}, MessageConfig{})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	defer gateway.Close()
+
+	before := handlingTimeSamples(t, "GetHealth")
+	if _, err := gateway.Health(ctx); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if recorded := handlingTimeSamples(t, "GetHealth") - before; recorded != 1 {
+		t.Error("expected GetHealth latency to be recorded once, was", recorded)
+	}
+}
+
+func TestValidatesMessageConfig(t *testing.T) {
+	valid := []MessageConfig{
+		{},
+		{MaxRecvMsgSize: 1024 * 1024, MaxSendMsgSize: 1024 * 1024, Compression: true},
+	}
+	for _, config := range valid {
+		if err := config.Validate(); err != nil {
+			t.Errorf("expected %+v to be valid: %s", config, err)
+		}
+	}
+
+	invalid := []MessageConfig{
+		{MaxRecvMsgSize: 1024},
+		{MaxSendMsgSize: -1},
+		{MaxRecvMsgSize: 1024 * 1024 * 1024},
+	}
+	for _, config := range invalid {
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected error for %+v", config)
+		}
+	}
+
+	config, cleanup := newTestConfig(t)
+	defer cleanup()
+	config.Messages = MessageConfig{MaxSendMsgSize: 1}
+	if _, err := NewServerWithProviders(config, &Providers{Credentials: &stubCredentialsProvider{}, ARNResolver: sts.DefaultResolver("")}); err == nil {
+		t.Error("expected server to reject invalid message config")
+	}
+}
+
+func TestPersistsCachedCredentialsAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kiam-persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	ioutil.WriteFile(keyFile, []byte("AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=\n"), 0600)
+	path := filepath.Join(dir, "credentials")
+
+	newCache := func() sts.CredentialsProvider {
+		return sts.DefaultCache(&secretGateway{}, "session", 15*time.Minute, 5*time.Minute, sts.DefaultResolver("arn:aws:iam::123456789012:role/"), 0, 0, 0)
+	}
+
+	stopped := newCache()
+	if _, err := stopped.CredentialsForRole(context.Background(), sts.NewRoleIdentity("role")); err != nil {
+		t.Fatal(err)
+	}
+	persistence, err := newCredentialsPersistence(path, keyFile, stopped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	persistence.save()
+
+	started := newCache()
+	persistence, err = newCredentialsPersistence(path, keyFile, started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	persistence.restore()
+
+	if roles := started.(sts.CredentialsInspector).CachedRoles(); len(roles) != 1 || roles[0].Role != "role" {
+		t.Error("expected persisted credentials to be restored, was", roles)
+	}
+
+	if _, err := newCredentialsPersistence(path, keyFile, &stubCredentialsProvider{}); err == nil {
+		t.Error("expected error for provider that can't persist credentials")
+	}
+}
+
+func TestInfersPartitionFromRoleBaseARN(t *testing.T) {
+	if _, err := newRoleARNResolver(&Config{RoleBaseARN: "arn:aws-cn:iam::123456789012:role/"}); err != nil {
+		t.Error("expected partition to be inferred from base arn:", err)
+	}
+	if _, err := newRoleARNResolver(&Config{RoleBaseARN: "arn:aws-cn:iam::123456789012:role/", Region: "cn-north-1"}); err != nil {
+		t.Error("expected partition to be inferred from region:", err)
+	}
+	if _, err := newRoleARNResolver(&Config{RoleBaseARN: "arn:aws-cn:iam::123456789012:role/", Partition: "aws"}); err == nil {
+		t.Error("expected error for base arn outside the configured partition")
+	}
+}
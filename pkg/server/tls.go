@@ -12,7 +12,6 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	log "github.com/sirupsen/logrus"
 	"gopkg.in/fsnotify.v1"
 )
 
@@ -259,3 +258,77 @@ func earliestExpiry(cert *tls.Certificate, pool *x509.CertPool, usage x509.ExtKe
 	}
 	return t, nil
 }
+
+// DefaultTLSMinVersion is the minimum TLS version accepted by the server
+const DefaultTLSMinVersion = "1.2"
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses the minimum TLS version, TLS 1.0 and 1.1 aren't
+// permitted.
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		version = DefaultTLSMinVersion
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unsupported tls version %q, expected 1.2 or 1.3", version)
+	}
+	return v, nil
+}
+
+// parseCipherSuites parses cipher suite names, only suites without known
+// security issues are permitted.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	secure := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+
+	suites := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported or insecure cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// newServerTLSConfig creates the server's TLS config, requiring clients
+// present a certificate signed by the CA. Certificates are loaded for each
+// handshake so that they can be rotated.
+func newServerTLSConfig(certs *dynamicTLSConfig, minVersion string, cipherSuites []string) (*tls.Config, error) {
+	version, err := parseTLSVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := parseCipherSuites(cipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:   version,
+		CipherSuites: suites,
+		GetConfigForClient: func(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := certs.Load()
+			return &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				MinVersion:   version,
+				CipherSuites: suites,
+				NextProtos:   []string{"h2"},
+			}, nil
+		},
+	}, nil
+}
@@ -11,6 +11,7 @@ import (
 	"encoding/pem"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -130,8 +131,9 @@ func generateCert(t *testing.T, ca *tls.Certificate) (_ *tls.Certificate, certPE
 		NotBefore:             now.Add(-time.Hour),
 		NotAfter:              now.Add(time.Hour),
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
 	}
 	var (
 		parent *x509.Certificate
@@ -162,6 +164,97 @@ func generateCert(t *testing.T, ca *tls.Certificate) (_ *tls.Certificate, certPE
 	return &cert, certPEMBlock, keyPEMBlock
 }
 
+func newTestServerTLS(t *testing.T, minVersion string) (*tls.Config, *tls.Certificate, *x509.CertPool, func()) {
+	ca, caCertPEMBlock, _ := generateCert(t, nil)
+	_, certPEMBlock, keyPEMBlock := generateCert(t, ca)
+	client, _, _ := generateCert(t, ca)
+
+	dir, err := ioutil.TempDir("", "")
+	check(t, "Failed to create directory", err)
+	data := filepath.Join(dir, "data")
+	createDir(t, data, map[string][]byte{
+		"cert.pem":  certPEMBlock,
+		"key.pem":   keyPEMBlock,
+		"roots.pem": caCertPEMBlock,
+	})
+
+	certs, err := newDynamicTLSConfig(filepath.Join(data, "cert.pem"), filepath.Join(data, "key.pem"), filepath.Join(data, "roots.pem"), nil)
+	check(t, "Failed to load certs", err)
+	config, err := newServerTLSConfig(certs, minVersion, nil)
+	check(t, "Failed to create server config", err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	return config, client, roots, func() {
+		certs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func handshake(t *testing.T, server *tls.Config, client *tls.Config) error {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	check(t, "Failed to listen", err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), client)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Handshake()
+}
+
+func TestServerRefusesLegacyTLS(t *testing.T) {
+	server, client, roots, cleanup := newTestServerTLS(t, "")
+	defer cleanup()
+
+	legacy := &tls.Config{RootCAs: roots, InsecureSkipVerify: true, Certificates: []tls.Certificate{*client}, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS10}
+	if err := handshake(t, server, legacy); err == nil {
+		t.Error("expected tls 1.0 handshake to be refused")
+	}
+
+	modern := &tls.Config{RootCAs: roots, InsecureSkipVerify: true, Certificates: []tls.Certificate{*client}, MaxVersion: tls.VersionTLS12}
+	if err := handshake(t, server, modern); err != nil {
+		t.Error("expected tls 1.2 handshake to succeed:", err)
+	}
+}
+
+func TestServerRequiresTLS13(t *testing.T) {
+	server, client, roots, cleanup := newTestServerTLS(t, "1.3")
+	defer cleanup()
+
+	tls12 := &tls.Config{RootCAs: roots, InsecureSkipVerify: true, Certificates: []tls.Certificate{*client}, MaxVersion: tls.VersionTLS12}
+	if err := handshake(t, server, tls12); err == nil {
+		t.Error("expected tls 1.2 handshake to be refused")
+	}
+}
+
+func TestParsesCipherSuites(t *testing.T) {
+	suites, err := parseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suites) != 1 || suites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Error("unexpected suites", suites)
+	}
+
+	if _, err := parseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"}); err == nil {
+		t.Error("expected insecure cipher suite to be rejected")
+	}
+	if _, err := parseTLSVersion("1.0"); err == nil {
+		t.Error("expected tls 1.0 to be rejected")
+	}
+}
+
 func createDir(t *testing.T, dir string, files map[string][]byte) {
 	t.Helper()
 	check(t, "Failed to make directory", os.Mkdir(dir, os.ModePerm))
@@ -0,0 +1,40 @@
+package statsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrefixesMetricNames(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := New(conn.LocalAddr().String(), "kiam.agent", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	defer New("", "", time.Millisecond)
+
+	Client.NewTiming().Send("handler.credentials")
+	Client.Flush()
+
+	// the client writes an empty packet when connecting
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	var metric string
+	for metric == "" {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metric = string(buf[:n])
+	}
+
+	if !strings.HasPrefix(metric, "kiam.agent.handler.credentials:") {
+		t.Error("expected metric name to be prefixed, was", metric)
+	}
+}
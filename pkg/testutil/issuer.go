@@ -22,8 +22,8 @@ type stubCache struct {
 	issue func(role string) (*sts.Credentials, error)
 }
 
-func (i *stubCache) CredentialsForRole(ctx context.Context, role string) (*sts.Credentials, error) {
-	return i.issue(role)
+func (i *stubCache) CredentialsForRole(ctx context.Context, identity *sts.RoleIdentity) (*sts.Credentials, error) {
+	return i.issue(identity.Role)
 }
 
 func (i *stubCache) Expiring() chan *sts.RoleCredentials {
@@ -9,9 +9,11 @@ import (
 type StubClient struct {
 	credentials          []GetCredentialsResult
 	credentialsCallCount int
+	requestedRoles       []string
 	roles                []GetRoleResult
 	rolesCallCount       int
 	health               string
+	nodeRoleAllowed      bool
 }
 
 // GetRoleResult is a return value from GetRole
@@ -21,6 +23,9 @@ type GetRoleResult struct {
 }
 
 func (c *StubClient) GetRole(ctx context.Context, ip string) (string, error) {
+	if len(c.roles) == 0 {
+		return "", nil
+	}
 	if c.rolesCallCount == len(c.roles) {
 		v := c.roles[len(c.roles)-1]
 		return v.Role, v.Error
@@ -32,6 +37,7 @@ func (c *StubClient) GetRole(ctx context.Context, ip string) (string, error) {
 	return currentVal.Role, currentVal.Error
 }
 func (c *StubClient) GetCredentials(ctx context.Context, ip, role string) (*sts.Credentials, error) {
+	c.requestedRoles = append(c.requestedRoles, role)
 	if c.credentialsCallCount == len(c.credentials) {
 		v := c.credentials[len(c.credentials)-1]
 		return v.Credentials, v.Error
@@ -42,10 +48,35 @@ func (c *StubClient) GetCredentials(ctx context.Context, ip, role string) (*sts.
 	return v.Credentials, v.Error
 }
 
+// WatchCredentials calls fn with each of the configured credentials results in
+// turn and then waits for ctx to be done
+func (c *StubClient) WatchCredentials(ctx context.Context, ip, role string, fn func(*sts.Credentials) error) error {
+	for _, v := range c.credentials {
+		if v.Error != nil {
+			return v.Error
+		}
+		if err := fn(v.Credentials); err != nil {
+			return err
+		}
+	}
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
 func (c *StubClient) Health(ctx context.Context) (string, error) {
 	return c.health, nil
 }
 
+func (c *StubClient) IsAllowedNodeRole(ctx context.Context, ip string) (bool, error) {
+	return c.nodeRoleAllowed, nil
+}
+
+// RequestedRoles returns the roles credentials were requested for
+func (c *StubClient) RequestedRoles() []string {
+	return c.requestedRoles
+}
+
 func (c *StubClient) WithRoles(roles ...GetRoleResult) *StubClient {
 	c.roles = roles
 	return c
@@ -56,6 +87,11 @@ func (c *StubClient) WithHealth(health string) *StubClient {
 	return c
 }
 
+func (c *StubClient) WithNodeRoleAllowed(allowed bool) *StubClient {
+	c.nodeRoleAllowed = allowed
+	return c
+}
+
 type GetCredentialsResult struct {
 	Credentials *sts.Credentials
 	Error       error
@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestPropagatesTraceToServer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	ctx, parent := Tracer().Start(context.Background(), "parent")
+	defer parent.End()
+
+	var serverSpan trace.SpanContext
+	server := func(ctx context.Context, req interface{}) (interface{}, error) {
+		serverSpan = trace.SpanContextFromContext(ctx)
+		return nil, nil
+	}
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		// the server receives the client's outgoing metadata
+		md, _ := metadata.FromOutgoingContext(ctx)
+		_, err := UnaryServerInterceptor(metadata.NewIncomingContext(context.Background(), md), req, &grpc.UnaryServerInfo{FullMethod: method}, server)
+		return err
+	}
+
+	if err := UnaryClientInterceptor(ctx, "/kiam.KiamService/GetPodCredentials", nil, nil, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+
+	if serverSpan.TraceID() != parent.SpanContext().TraceID() {
+		t.Error("expected server span to continue the client's trace")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatal("expected client and server spans, was", len(spans))
+	}
+	if spans[0].SpanKind() != trace.SpanKindServer || spans[1].SpanKind() != trace.SpanKindClient {
+		t.Error("unexpected span kinds", spans[0].SpanKind(), spans[1].SpanKind())
+	}
+	if spans[0].Parent().SpanID() != spans[1].SpanContext().SpanID() {
+		t.Error("expected server span to be a child of the client span")
+	}
+}
+
+func TestStartWithoutEndpointDoesntExport(t *testing.T) {
+	shutdown, err := Start(context.Background(), "kiam-test", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Error("unexpected error", err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 uSwitch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package tracing configures OpenTelemetry tracing of requests through the
+// agent and server, exporting spans over OTLP.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/uswitch/kiam"
+
+// Config controls how spans are exported.
+type Config struct {
+	// Endpoint is the host:port of the OTLP/HTTP collector spans are exported
+	// to. Spans aren't exported when empty.
+	Endpoint string
+	// Insecure exports spans over plain HTTP rather than HTTPS.
+	Insecure bool
+	// SampleRatio is the fraction of traces sampled when the caller hasn't
+	// already decided whether to sample.
+	SampleRatio float64
+}
+
+// Tracer returns the tracer used to create kiam's spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start configures trace context propagation and, when an endpoint is
+// configured, exporting spans for service. The returned function flushes
+// and stops the exporter.
+func Start(ctx context.Context, service string, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if config.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+	if config.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
@@ -3,13 +3,14 @@
 
 package kiam
 
-import proto "github.com/golang/protobuf/proto"
-import fmt "fmt"
-import math "math"
-
 import (
-	context "golang.org/x/net/context"
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
 	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
 )
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -21,7 +22,7 @@ var _ = math.Inf
 // is compatible with the proto package it is being compiled against.
 // A compilation error at this line likely means your copy of the
 // proto package needs to be updated.
-const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
 type GetPodCredentialsRequest struct {
 	Ip                   string   `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
@@ -35,16 +36,17 @@ func (m *GetPodCredentialsRequest) Reset()         { *m = GetPodCredentialsReque
 func (m *GetPodCredentialsRequest) String() string { return proto.CompactTextString(m) }
 func (*GetPodCredentialsRequest) ProtoMessage()    {}
 func (*GetPodCredentialsRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_service_e694ad96f92b8437, []int{0}
+	return fileDescriptor_a0b84a42fa06f626, []int{0}
 }
+
 func (m *GetPodCredentialsRequest) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_GetPodCredentialsRequest.Unmarshal(m, b)
 }
 func (m *GetPodCredentialsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_GetPodCredentialsRequest.Marshal(b, m, deterministic)
 }
-func (dst *GetPodCredentialsRequest) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_GetPodCredentialsRequest.Merge(dst, src)
+func (m *GetPodCredentialsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetPodCredentialsRequest.Merge(m, src)
 }
 func (m *GetPodCredentialsRequest) XXX_Size() int {
 	return xxx_messageInfo_GetPodCredentialsRequest.Size(m)
@@ -69,6 +71,53 @@ func (m *GetPodCredentialsRequest) GetRole() string {
 	return ""
 }
 
+type WatchRoleCredentialsRequest struct {
+	Ip                   string   `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
+	Role                 string   `protobuf:"bytes,2,opt,name=role,proto3" json:"role,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *WatchRoleCredentialsRequest) Reset()         { *m = WatchRoleCredentialsRequest{} }
+func (m *WatchRoleCredentialsRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchRoleCredentialsRequest) ProtoMessage()    {}
+func (*WatchRoleCredentialsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a0b84a42fa06f626, []int{1}
+}
+
+func (m *WatchRoleCredentialsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchRoleCredentialsRequest.Unmarshal(m, b)
+}
+func (m *WatchRoleCredentialsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchRoleCredentialsRequest.Marshal(b, m, deterministic)
+}
+func (m *WatchRoleCredentialsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchRoleCredentialsRequest.Merge(m, src)
+}
+func (m *WatchRoleCredentialsRequest) XXX_Size() int {
+	return xxx_messageInfo_WatchRoleCredentialsRequest.Size(m)
+}
+func (m *WatchRoleCredentialsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchRoleCredentialsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchRoleCredentialsRequest proto.InternalMessageInfo
+
+func (m *WatchRoleCredentialsRequest) GetIp() string {
+	if m != nil {
+		return m.Ip
+	}
+	return ""
+}
+
+func (m *WatchRoleCredentialsRequest) GetRole() string {
+	if m != nil {
+		return m.Role
+	}
+	return ""
+}
+
 type GetPodRoleRequest struct {
 	Ip                   string   `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -80,16 +129,17 @@ func (m *GetPodRoleRequest) Reset()         { *m = GetPodRoleRequest{} }
 func (m *GetPodRoleRequest) String() string { return proto.CompactTextString(m) }
 func (*GetPodRoleRequest) ProtoMessage()    {}
 func (*GetPodRoleRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_service_e694ad96f92b8437, []int{1}
+	return fileDescriptor_a0b84a42fa06f626, []int{2}
 }
+
 func (m *GetPodRoleRequest) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_GetPodRoleRequest.Unmarshal(m, b)
 }
 func (m *GetPodRoleRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_GetPodRoleRequest.Marshal(b, m, deterministic)
 }
-func (dst *GetPodRoleRequest) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_GetPodRoleRequest.Merge(dst, src)
+func (m *GetPodRoleRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetPodRoleRequest.Merge(m, src)
 }
 func (m *GetPodRoleRequest) XXX_Size() int {
 	return xxx_messageInfo_GetPodRoleRequest.Size(m)
@@ -118,16 +168,17 @@ func (m *Role) Reset()         { *m = Role{} }
 func (m *Role) String() string { return proto.CompactTextString(m) }
 func (*Role) ProtoMessage()    {}
 func (*Role) Descriptor() ([]byte, []int) {
-	return fileDescriptor_service_e694ad96f92b8437, []int{2}
+	return fileDescriptor_a0b84a42fa06f626, []int{3}
 }
+
 func (m *Role) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_Role.Unmarshal(m, b)
 }
 func (m *Role) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_Role.Marshal(b, m, deterministic)
 }
-func (dst *Role) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_Role.Merge(dst, src)
+func (m *Role) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Role.Merge(m, src)
 }
 func (m *Role) XXX_Size() int {
 	return xxx_messageInfo_Role.Size(m)
@@ -156,16 +207,17 @@ func (m *GetRoleCredentialsRequest) Reset()         { *m = GetRoleCredentialsReq
 func (m *GetRoleCredentialsRequest) String() string { return proto.CompactTextString(m) }
 func (*GetRoleCredentialsRequest) ProtoMessage()    {}
 func (*GetRoleCredentialsRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_service_e694ad96f92b8437, []int{3}
+	return fileDescriptor_a0b84a42fa06f626, []int{4}
 }
+
 func (m *GetRoleCredentialsRequest) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_GetRoleCredentialsRequest.Unmarshal(m, b)
 }
 func (m *GetRoleCredentialsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_GetRoleCredentialsRequest.Marshal(b, m, deterministic)
 }
-func (dst *GetRoleCredentialsRequest) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_GetRoleCredentialsRequest.Merge(dst, src)
+func (m *GetRoleCredentialsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetRoleCredentialsRequest.Merge(m, src)
 }
 func (m *GetRoleCredentialsRequest) XXX_Size() int {
 	return xxx_messageInfo_GetRoleCredentialsRequest.Size(m)
@@ -191,6 +243,7 @@ type Credentials struct {
 	Token                string   `protobuf:"bytes,5,opt,name=token,proto3" json:"token,omitempty"`
 	Expiration           string   `protobuf:"bytes,6,opt,name=expiration,proto3" json:"expiration,omitempty"`
 	LastUpdated          string   `protobuf:"bytes,7,opt,name=last_updated,json=lastUpdated,proto3" json:"last_updated,omitempty"`
+	RoleArn              string   `protobuf:"bytes,8,opt,name=role_arn,json=roleArn,proto3" json:"role_arn,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -200,16 +253,17 @@ func (m *Credentials) Reset()         { *m = Credentials{} }
 func (m *Credentials) String() string { return proto.CompactTextString(m) }
 func (*Credentials) ProtoMessage()    {}
 func (*Credentials) Descriptor() ([]byte, []int) {
-	return fileDescriptor_service_e694ad96f92b8437, []int{4}
+	return fileDescriptor_a0b84a42fa06f626, []int{5}
 }
+
 func (m *Credentials) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_Credentials.Unmarshal(m, b)
 }
 func (m *Credentials) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_Credentials.Marshal(b, m, deterministic)
 }
-func (dst *Credentials) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_Credentials.Merge(dst, src)
+func (m *Credentials) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Credentials.Merge(m, src)
 }
 func (m *Credentials) XXX_Size() int {
 	return xxx_messageInfo_Credentials.Size(m)
@@ -269,6 +323,13 @@ func (m *Credentials) GetLastUpdated() string {
 	return ""
 }
 
+func (m *Credentials) GetRoleArn() string {
+	if m != nil {
+		return m.RoleArn
+	}
+	return ""
+}
+
 type GetHealthRequest struct {
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
@@ -279,16 +340,17 @@ func (m *GetHealthRequest) Reset()         { *m = GetHealthRequest{} }
 func (m *GetHealthRequest) String() string { return proto.CompactTextString(m) }
 func (*GetHealthRequest) ProtoMessage()    {}
 func (*GetHealthRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_service_e694ad96f92b8437, []int{5}
+	return fileDescriptor_a0b84a42fa06f626, []int{6}
 }
+
 func (m *GetHealthRequest) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_GetHealthRequest.Unmarshal(m, b)
 }
 func (m *GetHealthRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_GetHealthRequest.Marshal(b, m, deterministic)
 }
-func (dst *GetHealthRequest) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_GetHealthRequest.Merge(dst, src)
+func (m *GetHealthRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetHealthRequest.Merge(m, src)
 }
 func (m *GetHealthRequest) XXX_Size() int {
 	return xxx_messageInfo_GetHealthRequest.Size(m)
@@ -310,16 +372,17 @@ func (m *HealthStatus) Reset()         { *m = HealthStatus{} }
 func (m *HealthStatus) String() string { return proto.CompactTextString(m) }
 func (*HealthStatus) ProtoMessage()    {}
 func (*HealthStatus) Descriptor() ([]byte, []int) {
-	return fileDescriptor_service_e694ad96f92b8437, []int{6}
+	return fileDescriptor_a0b84a42fa06f626, []int{7}
 }
+
 func (m *HealthStatus) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_HealthStatus.Unmarshal(m, b)
 }
 func (m *HealthStatus) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_HealthStatus.Marshal(b, m, deterministic)
 }
-func (dst *HealthStatus) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_HealthStatus.Merge(dst, src)
+func (m *HealthStatus) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_HealthStatus.Merge(m, src)
 }
 func (m *HealthStatus) XXX_Size() int {
 	return xxx_messageInfo_HealthStatus.Size(m)
@@ -349,16 +412,17 @@ func (m *IsAllowedAssumeRoleRequest) Reset()         { *m = IsAllowedAssumeRoleR
 func (m *IsAllowedAssumeRoleRequest) String() string { return proto.CompactTextString(m) }
 func (*IsAllowedAssumeRoleRequest) ProtoMessage()    {}
 func (*IsAllowedAssumeRoleRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_service_e694ad96f92b8437, []int{7}
+	return fileDescriptor_a0b84a42fa06f626, []int{8}
 }
+
 func (m *IsAllowedAssumeRoleRequest) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_IsAllowedAssumeRoleRequest.Unmarshal(m, b)
 }
 func (m *IsAllowedAssumeRoleRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_IsAllowedAssumeRoleRequest.Marshal(b, m, deterministic)
 }
-func (dst *IsAllowedAssumeRoleRequest) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_IsAllowedAssumeRoleRequest.Merge(dst, src)
+func (m *IsAllowedAssumeRoleRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_IsAllowedAssumeRoleRequest.Merge(m, src)
 }
 func (m *IsAllowedAssumeRoleRequest) XXX_Size() int {
 	return xxx_messageInfo_IsAllowedAssumeRoleRequest.Size(m)
@@ -394,16 +458,17 @@ func (m *IsAllowedAssumeRoleResponse) Reset()         { *m = IsAllowedAssumeRole
 func (m *IsAllowedAssumeRoleResponse) String() string { return proto.CompactTextString(m) }
 func (*IsAllowedAssumeRoleResponse) ProtoMessage()    {}
 func (*IsAllowedAssumeRoleResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_service_e694ad96f92b8437, []int{8}
+	return fileDescriptor_a0b84a42fa06f626, []int{9}
 }
+
 func (m *IsAllowedAssumeRoleResponse) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_IsAllowedAssumeRoleResponse.Unmarshal(m, b)
 }
 func (m *IsAllowedAssumeRoleResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_IsAllowedAssumeRoleResponse.Marshal(b, m, deterministic)
 }
-func (dst *IsAllowedAssumeRoleResponse) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_IsAllowedAssumeRoleResponse.Merge(dst, src)
+func (m *IsAllowedAssumeRoleResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_IsAllowedAssumeRoleResponse.Merge(m, src)
 }
 func (m *IsAllowedAssumeRoleResponse) XXX_Size() int {
 	return xxx_messageInfo_IsAllowedAssumeRoleResponse.Size(m)
@@ -433,16 +498,17 @@ func (m *Decision) Reset()         { *m = Decision{} }
 func (m *Decision) String() string { return proto.CompactTextString(m) }
 func (*Decision) ProtoMessage()    {}
 func (*Decision) Descriptor() ([]byte, []int) {
-	return fileDescriptor_service_e694ad96f92b8437, []int{9}
+	return fileDescriptor_a0b84a42fa06f626, []int{10}
 }
+
 func (m *Decision) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_Decision.Unmarshal(m, b)
 }
 func (m *Decision) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_Decision.Marshal(b, m, deterministic)
 }
-func (dst *Decision) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_Decision.Merge(dst, src)
+func (m *Decision) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Decision.Merge(m, src)
 }
 func (m *Decision) XXX_Size() int {
 	return xxx_messageInfo_Decision.Size(m)
@@ -467,8 +533,48 @@ func (m *Decision) GetExplanation() string {
 	return ""
 }
 
+type IsAllowedNodeRoleRequest struct {
+	Ip                   string   `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *IsAllowedNodeRoleRequest) Reset()         { *m = IsAllowedNodeRoleRequest{} }
+func (m *IsAllowedNodeRoleRequest) String() string { return proto.CompactTextString(m) }
+func (*IsAllowedNodeRoleRequest) ProtoMessage()    {}
+func (*IsAllowedNodeRoleRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a0b84a42fa06f626, []int{11}
+}
+
+func (m *IsAllowedNodeRoleRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_IsAllowedNodeRoleRequest.Unmarshal(m, b)
+}
+func (m *IsAllowedNodeRoleRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_IsAllowedNodeRoleRequest.Marshal(b, m, deterministic)
+}
+func (m *IsAllowedNodeRoleRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_IsAllowedNodeRoleRequest.Merge(m, src)
+}
+func (m *IsAllowedNodeRoleRequest) XXX_Size() int {
+	return xxx_messageInfo_IsAllowedNodeRoleRequest.Size(m)
+}
+func (m *IsAllowedNodeRoleRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_IsAllowedNodeRoleRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_IsAllowedNodeRoleRequest proto.InternalMessageInfo
+
+func (m *IsAllowedNodeRoleRequest) GetIp() string {
+	if m != nil {
+		return m.Ip
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterType((*GetPodCredentialsRequest)(nil), "kiam.GetPodCredentialsRequest")
+	proto.RegisterType((*WatchRoleCredentialsRequest)(nil), "kiam.WatchRoleCredentialsRequest")
 	proto.RegisterType((*GetPodRoleRequest)(nil), "kiam.GetPodRoleRequest")
 	proto.RegisterType((*Role)(nil), "kiam.Role")
 	proto.RegisterType((*GetRoleCredentialsRequest)(nil), "kiam.GetRoleCredentialsRequest")
@@ -478,15 +584,58 @@ func init() {
 	proto.RegisterType((*IsAllowedAssumeRoleRequest)(nil), "kiam.IsAllowedAssumeRoleRequest")
 	proto.RegisterType((*IsAllowedAssumeRoleResponse)(nil), "kiam.IsAllowedAssumeRoleResponse")
 	proto.RegisterType((*Decision)(nil), "kiam.Decision")
+	proto.RegisterType((*IsAllowedNodeRoleRequest)(nil), "kiam.IsAllowedNodeRoleRequest")
+}
+
+func init() { proto.RegisterFile("service.proto", fileDescriptor_a0b84a42fa06f626) }
+
+var fileDescriptor_a0b84a42fa06f626 = []byte{
+	// 566 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x54, 0x4d, 0x6f, 0xd3, 0x4c,
+	0x10, 0x4e, 0xf2, 0xa6, 0x6d, 0x3a, 0x69, 0xfb, 0x92, 0xa1, 0x02, 0xd7, 0x15, 0x21, 0x59, 0x2e,
+	0x55, 0x0e, 0x11, 0x6a, 0x4f, 0x08, 0x09, 0x29, 0x02, 0x94, 0x86, 0x20, 0x54, 0xa5, 0x42, 0x5c,
+	0x90, 0xac, 0xc5, 0x1e, 0xd1, 0x55, 0x1c, 0xaf, 0xf1, 0x6e, 0xa0, 0xf9, 0x0b, 0xfc, 0x63, 0x6e,
+	0x68, 0x77, 0x63, 0xd7, 0x34, 0x1f, 0x12, 0xdc, 0xd6, 0xcf, 0x33, 0xdf, 0xcf, 0x8c, 0xe1, 0x50,
+	0x51, 0xf6, 0x5d, 0x84, 0xd4, 0x4f, 0x33, 0xa9, 0x25, 0xd6, 0xa7, 0x82, 0xcf, 0xd8, 0x2b, 0xf0,
+	0x86, 0xa4, 0xaf, 0x64, 0xf4, 0x3a, 0xa3, 0x88, 0x12, 0x2d, 0x78, 0xac, 0x26, 0xf4, 0x6d, 0x4e,
+	0x4a, 0xe3, 0x11, 0xd4, 0x44, 0xea, 0x55, 0x3b, 0xd5, 0xb3, 0xfd, 0x49, 0x4d, 0xa4, 0x88, 0x50,
+	0xcf, 0x64, 0x4c, 0x5e, 0xcd, 0x22, 0xf6, 0xcd, 0x06, 0x70, 0xfa, 0x89, 0xeb, 0xf0, 0x66, 0x22,
+	0x63, 0xfa, 0xc7, 0x10, 0xcf, 0xa0, 0xe5, 0x4a, 0x30, 0x31, 0x36, 0x38, 0x32, 0x1f, 0xea, 0x86,
+	0x36, 0x01, 0x12, 0x3e, 0xa3, 0x25, 0x63, 0xdf, 0xec, 0x25, 0x9c, 0x0c, 0x49, 0x6f, 0xa8, 0xa0,
+	0xbd, 0xcc, 0x68, 0x1c, 0x9a, 0xe7, 0xd0, 0x37, 0x5d, 0xf7, 0x6d, 0x26, 0x97, 0xfd, 0x57, 0x15,
+	0x9a, 0x25, 0x37, 0x93, 0x20, 0x94, 0x51, 0x91, 0xc0, 0xbc, 0x0d, 0xa6, 0x17, 0x69, 0x51, 0xb5,
+	0x79, 0x23, 0x83, 0x43, 0x1e, 0x86, 0xa4, 0x54, 0x30, 0xa5, 0x45, 0x20, 0x22, 0xef, 0x3f, 0x4b,
+	0x36, 0x1d, 0x38, 0xa6, 0xc5, 0x28, 0xc2, 0x1e, 0xb4, 0x14, 0x85, 0x19, 0xe9, 0xe0, 0xce, 0xd4,
+	0xab, 0x5b, 0xbb, 0xff, 0x1d, 0x31, 0xc8, 0xad, 0xf1, 0x18, 0x76, 0xb4, 0x9c, 0x52, 0xe2, 0xed,
+	0x58, 0xde, 0x7d, 0x60, 0x1b, 0x80, 0x6e, 0x53, 0x91, 0x71, 0x2d, 0x64, 0xe2, 0xed, 0x5a, 0xaa,
+	0x84, 0x60, 0x17, 0x0e, 0x62, 0xae, 0x74, 0x30, 0x4f, 0x23, 0xae, 0x29, 0xf2, 0xf6, 0x5c, 0x11,
+	0x06, 0xfb, 0xe8, 0x20, 0x3c, 0x81, 0x86, 0x69, 0x34, 0xe0, 0x59, 0xe2, 0x35, 0x2c, 0xbd, 0x67,
+	0xbe, 0x07, 0x59, 0xc2, 0x10, 0x1e, 0x0c, 0x49, 0x5f, 0x12, 0x8f, 0xf5, 0xcd, 0x72, 0x5e, 0xec,
+	0x0c, 0x0e, 0x1c, 0x70, 0xad, 0xb9, 0x9e, 0x2b, 0xf4, 0x60, 0x6f, 0x46, 0x4a, 0xf1, 0xaf, 0xf9,
+	0x48, 0xf2, 0x4f, 0xf6, 0x1e, 0xfc, 0x91, 0x1a, 0xc4, 0xb1, 0xfc, 0x41, 0xd1, 0x40, 0xa9, 0xf9,
+	0x8c, 0xb6, 0x08, 0x58, 0xe8, 0x50, 0xdb, 0xa0, 0xc3, 0x08, 0x4e, 0xd7, 0x46, 0x53, 0xa9, 0x4c,
+	0x14, 0x61, 0x0f, 0x1a, 0x11, 0x85, 0x42, 0x99, 0x31, 0x38, 0x29, 0x8f, 0x5c, 0x88, 0x37, 0x4b,
+	0x74, 0x52, 0xf0, 0x6c, 0x0c, 0x8d, 0x1c, 0xc5, 0x27, 0x00, 0x42, 0x05, 0xdc, 0xc5, 0xb5, 0x9e,
+	0x8d, 0xc9, 0xbe, 0xc8, 0x13, 0x61, 0x07, 0x9a, 0x74, 0x9b, 0xc6, 0x3c, 0x71, 0x03, 0x76, 0x02,
+	0x97, 0x21, 0xd6, 0x03, 0xaf, 0xa8, 0xeb, 0x83, 0x8c, 0xb6, 0xf5, 0x78, 0xfe, 0xb3, 0x0e, 0xcd,
+	0xb1, 0xe0, 0xb3, 0x6b, 0x77, 0x68, 0x78, 0x01, 0x70, 0xb7, 0xd9, 0xf8, 0xd8, 0x15, 0xbc, 0xb2,
+	0xeb, 0x7e, 0x69, 0x18, 0xac, 0x82, 0x97, 0xf9, 0x39, 0x94, 0xb7, 0xb2, 0x5d, 0xf6, 0x5d, 0xdd,
+	0x72, 0xbf, 0xe5, 0xf8, 0x12, 0xc3, 0x2a, 0xf8, 0x02, 0xf6, 0x0b, 0x79, 0xf1, 0x51, 0x11, 0xe1,
+	0x0f, 0xbd, 0x7d, 0x74, 0x78, 0x59, 0x73, 0x56, 0xc1, 0x2b, 0x38, 0x5e, 0x77, 0xd6, 0xd8, 0x75,
+	0xd6, 0x5b, 0x4e, 0x7e, 0x6d, 0x29, 0xcf, 0xab, 0xf8, 0x16, 0x5a, 0x2b, 0x73, 0xcc, 0xdb, 0xda,
+	0x34, 0x60, 0xff, 0x9e, 0xc6, 0xac, 0x82, 0xef, 0x00, 0x57, 0x6f, 0x1d, 0x9f, 0x16, 0xcd, 0xfd,
+	0x45, 0x51, 0xf8, 0x19, 0x1e, 0xae, 0x59, 0x39, 0xec, 0xdc, 0x2b, 0x6a, 0x65, 0xb7, 0xfd, 0xee,
+	0x16, 0x0b, 0xb7, 0xaf, 0xac, 0xf2, 0x65, 0xd7, 0xfe, 0x66, 0x2f, 0x7e, 0x0f, 0x00, 0xc9, 0x09,
+	0x4d, 0xa5, 0x77, 0x05, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
 var _ context.Context
-var _ grpc.ClientConn
+var _ grpc.ClientConnInterface
 
 // This is a compile-time assertion to ensure that this generated file
 // is compatible with the grpc package it is being compiled against.
-const _ = grpc.SupportPackageIsVersion4
+const _ = grpc.SupportPackageIsVersion6
 
 // KiamServiceClient is the client API for KiamService service.
 //
@@ -495,16 +644,17 @@ type KiamServiceClient interface {
 	GetPodRole(ctx context.Context, in *GetPodRoleRequest, opts ...grpc.CallOption) (*Role, error)
 	GetPodCredentials(ctx context.Context, in *GetPodCredentialsRequest, opts ...grpc.CallOption) (*Credentials, error)
 	GetHealth(ctx context.Context, in *GetHealthRequest, opts ...grpc.CallOption) (*HealthStatus, error)
-	// DEPRECATE BELOW
+	WatchRoleCredentials(ctx context.Context, in *WatchRoleCredentialsRequest, opts ...grpc.CallOption) (KiamService_WatchRoleCredentialsClient, error)
+	IsAllowedNodeRole(ctx context.Context, in *IsAllowedNodeRoleRequest, opts ...grpc.CallOption) (*Decision, error)
 	GetRoleCredentials(ctx context.Context, in *GetRoleCredentialsRequest, opts ...grpc.CallOption) (*Credentials, error)
 	IsAllowedAssumeRole(ctx context.Context, in *IsAllowedAssumeRoleRequest, opts ...grpc.CallOption) (*IsAllowedAssumeRoleResponse, error)
 }
 
 type kiamServiceClient struct {
-	cc *grpc.ClientConn
+	cc grpc.ClientConnInterface
 }
 
-func NewKiamServiceClient(cc *grpc.ClientConn) KiamServiceClient {
+func NewKiamServiceClient(cc grpc.ClientConnInterface) KiamServiceClient {
 	return &kiamServiceClient{cc}
 }
 
@@ -535,6 +685,47 @@ func (c *kiamServiceClient) GetHealth(ctx context.Context, in *GetHealthRequest,
 	return out, nil
 }
 
+func (c *kiamServiceClient) WatchRoleCredentials(ctx context.Context, in *WatchRoleCredentialsRequest, opts ...grpc.CallOption) (KiamService_WatchRoleCredentialsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_KiamService_serviceDesc.Streams[0], "/kiam.KiamService/WatchRoleCredentials", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &kiamServiceWatchRoleCredentialsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type KiamService_WatchRoleCredentialsClient interface {
+	Recv() (*Credentials, error)
+	grpc.ClientStream
+}
+
+type kiamServiceWatchRoleCredentialsClient struct {
+	grpc.ClientStream
+}
+
+func (x *kiamServiceWatchRoleCredentialsClient) Recv() (*Credentials, error) {
+	m := new(Credentials)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *kiamServiceClient) IsAllowedNodeRole(ctx context.Context, in *IsAllowedNodeRoleRequest, opts ...grpc.CallOption) (*Decision, error) {
+	out := new(Decision)
+	err := c.cc.Invoke(ctx, "/kiam.KiamService/IsAllowedNodeRole", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *kiamServiceClient) GetRoleCredentials(ctx context.Context, in *GetRoleCredentialsRequest, opts ...grpc.CallOption) (*Credentials, error) {
 	out := new(Credentials)
 	err := c.cc.Invoke(ctx, "/kiam.KiamService/GetRoleCredentials", in, out, opts...)
@@ -558,11 +749,38 @@ type KiamServiceServer interface {
 	GetPodRole(context.Context, *GetPodRoleRequest) (*Role, error)
 	GetPodCredentials(context.Context, *GetPodCredentialsRequest) (*Credentials, error)
 	GetHealth(context.Context, *GetHealthRequest) (*HealthStatus, error)
-	// DEPRECATE BELOW
+	WatchRoleCredentials(*WatchRoleCredentialsRequest, KiamService_WatchRoleCredentialsServer) error
+	IsAllowedNodeRole(context.Context, *IsAllowedNodeRoleRequest) (*Decision, error)
 	GetRoleCredentials(context.Context, *GetRoleCredentialsRequest) (*Credentials, error)
 	IsAllowedAssumeRole(context.Context, *IsAllowedAssumeRoleRequest) (*IsAllowedAssumeRoleResponse, error)
 }
 
+// UnimplementedKiamServiceServer can be embedded to have forward compatible implementations.
+type UnimplementedKiamServiceServer struct {
+}
+
+func (*UnimplementedKiamServiceServer) GetPodRole(ctx context.Context, req *GetPodRoleRequest) (*Role, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPodRole not implemented")
+}
+func (*UnimplementedKiamServiceServer) GetPodCredentials(ctx context.Context, req *GetPodCredentialsRequest) (*Credentials, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPodCredentials not implemented")
+}
+func (*UnimplementedKiamServiceServer) GetHealth(ctx context.Context, req *GetHealthRequest) (*HealthStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetHealth not implemented")
+}
+func (*UnimplementedKiamServiceServer) WatchRoleCredentials(req *WatchRoleCredentialsRequest, srv KiamService_WatchRoleCredentialsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchRoleCredentials not implemented")
+}
+func (*UnimplementedKiamServiceServer) IsAllowedNodeRole(ctx context.Context, req *IsAllowedNodeRoleRequest) (*Decision, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method IsAllowedNodeRole not implemented")
+}
+func (*UnimplementedKiamServiceServer) GetRoleCredentials(ctx context.Context, req *GetRoleCredentialsRequest) (*Credentials, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRoleCredentials not implemented")
+}
+func (*UnimplementedKiamServiceServer) IsAllowedAssumeRole(ctx context.Context, req *IsAllowedAssumeRoleRequest) (*IsAllowedAssumeRoleResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method IsAllowedAssumeRole not implemented")
+}
+
 func RegisterKiamServiceServer(s *grpc.Server, srv KiamServiceServer) {
 	s.RegisterService(&_KiamService_serviceDesc, srv)
 }
@@ -621,6 +839,45 @@ func _KiamService_GetHealth_Handler(srv interface{}, ctx context.Context, dec fu
 	return interceptor(ctx, in, info, handler)
 }
 
+func _KiamService_WatchRoleCredentials_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRoleCredentialsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KiamServiceServer).WatchRoleCredentials(m, &kiamServiceWatchRoleCredentialsServer{stream})
+}
+
+type KiamService_WatchRoleCredentialsServer interface {
+	Send(*Credentials) error
+	grpc.ServerStream
+}
+
+type kiamServiceWatchRoleCredentialsServer struct {
+	grpc.ServerStream
+}
+
+func (x *kiamServiceWatchRoleCredentialsServer) Send(m *Credentials) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _KiamService_IsAllowedNodeRole_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IsAllowedNodeRoleRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KiamServiceServer).IsAllowedNodeRole(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/kiam.KiamService/IsAllowedNodeRole",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KiamServiceServer).IsAllowedNodeRole(ctx, req.(*IsAllowedNodeRoleRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _KiamService_GetRoleCredentials_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(GetRoleCredentialsRequest)
 	if err := dec(in); err != nil {
@@ -673,6 +930,10 @@ var _KiamService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "GetHealth",
 			Handler:    _KiamService_GetHealth_Handler,
 		},
+		{
+			MethodName: "IsAllowedNodeRole",
+			Handler:    _KiamService_IsAllowedNodeRole_Handler,
+		},
 		{
 			MethodName: "GetRoleCredentials",
 			Handler:    _KiamService_GetRoleCredentials_Handler,
@@ -682,44 +943,12 @@ var _KiamService_serviceDesc = grpc.ServiceDesc{
 			Handler:    _KiamService_IsAllowedAssumeRole_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchRoleCredentials",
+			Handler:       _KiamService_WatchRoleCredentials_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "service.proto",
 }
-
-func init() { proto.RegisterFile("service.proto", fileDescriptor_service_e694ad96f92b8437) }
-
-var fileDescriptor_service_e694ad96f92b8437 = []byte{
-	// 500 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0x5d, 0x6f, 0xd3, 0x30,
-	0x14, 0x6d, 0x4b, 0xb7, 0xb5, 0x37, 0xdb, 0xa0, 0x17, 0x04, 0x21, 0x88, 0xd2, 0x99, 0x97, 0x69,
-	0x0f, 0x7d, 0xd8, 0x9e, 0x10, 0x12, 0x52, 0x05, 0x52, 0x57, 0xca, 0x03, 0xca, 0xc4, 0x1b, 0x52,
-	0x64, 0x92, 0x2b, 0xb0, 0x9a, 0xc4, 0x21, 0x76, 0x61, 0xfd, 0xb3, 0xfc, 0x07, 0xfe, 0x01, 0xb2,
-	0xdd, 0x64, 0x41, 0x4d, 0xf7, 0xe6, 0x9c, 0x73, 0xbf, 0x7c, 0xcf, 0x71, 0xe0, 0x44, 0x51, 0xf9,
-	0x4b, 0xc4, 0x34, 0x2d, 0x4a, 0xa9, 0x25, 0xf6, 0x57, 0x82, 0x67, 0xec, 0x1d, 0xf8, 0x73, 0xd2,
-	0x9f, 0x65, 0xf2, 0xbe, 0xa4, 0x84, 0x72, 0x2d, 0x78, 0xaa, 0x42, 0xfa, 0xb9, 0x26, 0xa5, 0xf1,
-	0x14, 0x7a, 0xa2, 0xf0, 0xbb, 0x93, 0xee, 0xf9, 0x30, 0xec, 0x89, 0x02, 0x11, 0xfa, 0xa5, 0x4c,
-	0xc9, 0xef, 0x59, 0xc4, 0x9e, 0xd9, 0x6b, 0x18, 0xb9, 0xfc, 0x50, 0xa6, 0xb4, 0x27, 0x91, 0x05,
-	0xd0, 0x37, 0xb4, 0x29, 0x90, 0xf3, 0x8c, 0xb6, 0x8c, 0x3d, 0xb3, 0xb7, 0xf0, 0x7c, 0x4e, 0xda,
-	0xd0, 0x2d, 0x13, 0x8c, 0xb7, 0x1d, 0x4d, 0x82, 0x77, 0x09, 0x53, 0x33, 0xf2, 0xd4, 0x76, 0x72,
-	0xdd, 0xff, 0x74, 0xc1, 0x6b, 0xa4, 0x99, 0x06, 0xb1, 0x4c, 0xea, 0x06, 0xe6, 0x6c, 0x30, 0xbd,
-	0x29, 0xea, 0xa9, 0xcd, 0x19, 0x19, 0x9c, 0xf0, 0x38, 0x26, 0xa5, 0xa2, 0x15, 0x6d, 0x22, 0x91,
-	0xf8, 0x0f, 0x2c, 0xe9, 0x39, 0x70, 0x49, 0x9b, 0x45, 0x82, 0x17, 0x30, 0x52, 0x14, 0x97, 0xa4,
-	0xa3, 0xbb, 0x50, 0xbf, 0x6f, 0xe3, 0x1e, 0x3a, 0x62, 0x56, 0x45, 0xe3, 0x13, 0x38, 0xd0, 0x72,
-	0x45, 0xb9, 0x7f, 0x60, 0x79, 0xf7, 0x81, 0x63, 0x00, 0xba, 0x2d, 0x44, 0xc9, 0xb5, 0x90, 0xb9,
-	0x7f, 0x68, 0xa9, 0x06, 0x82, 0x67, 0x70, 0x9c, 0x72, 0xa5, 0xa3, 0x75, 0x91, 0x70, 0x4d, 0x89,
-	0x7f, 0xe4, 0x86, 0x30, 0xd8, 0x17, 0x07, 0x31, 0x84, 0x47, 0x73, 0xd2, 0xd7, 0xc4, 0x53, 0xfd,
-	0x63, 0xbb, 0x14, 0x76, 0x0e, 0xc7, 0x0e, 0xb8, 0xd1, 0x5c, 0xaf, 0x15, 0xfa, 0x70, 0x94, 0x91,
-	0x52, 0xfc, 0x7b, 0x75, 0xef, 0xea, 0x93, 0x7d, 0x82, 0x60, 0xa1, 0x66, 0x69, 0x2a, 0x7f, 0x53,
-	0x32, 0x53, 0x6a, 0x9d, 0xd1, 0x3d, 0x2a, 0xd5, 0xcb, 0xee, 0xed, 0x59, 0xf6, 0x02, 0x5e, 0xb4,
-	0x56, 0x53, 0x85, 0xcc, 0x15, 0xe1, 0x05, 0x0c, 0x12, 0x8a, 0x85, 0x32, 0x77, 0x75, 0x7a, 0x9d,
-	0xba, 0x12, 0x1f, 0xb6, 0x68, 0x58, 0xf3, 0x6c, 0x09, 0x83, 0x0a, 0xc5, 0x97, 0x00, 0x42, 0x45,
-	0xdc, 0xd5, 0xb5, 0x99, 0x83, 0x70, 0x28, 0xaa, 0x46, 0x38, 0x01, 0x8f, 0x6e, 0x8b, 0x94, 0xe7,
-	0x6e, 0x8b, 0x4e, 0xc5, 0x26, 0x74, 0xf9, 0xb7, 0x07, 0xde, 0x52, 0xf0, 0xec, 0xc6, 0xd9, 0x1b,
-	0xaf, 0x00, 0xee, 0x2c, 0x89, 0xcf, 0xdc, 0x10, 0x3b, 0x26, 0x0d, 0x1a, 0x17, 0x64, 0x1d, 0xbc,
-	0xae, 0x7c, 0xdc, 0xb4, 0xd3, 0xb8, 0x99, 0xbb, 0x6b, 0xcf, 0x60, 0xe4, 0xf8, 0x06, 0xc3, 0x3a,
-	0xf8, 0x06, 0x86, 0xb5, 0x64, 0xf8, 0xb4, 0xae, 0xf0, 0x9f, 0x86, 0x01, 0x3a, 0xbc, 0xa9, 0x23,
-	0xeb, 0xe0, 0x47, 0xc0, 0xdd, 0xb7, 0x80, 0xaf, 0xea, 0x1a, 0xed, 0xaf, 0xa4, 0x7d, 0x8c, 0xaf,
-	0xf0, 0xb8, 0x45, 0x2d, 0x9c, 0xb8, 0xd8, 0xfd, 0xb6, 0x08, 0xce, 0xee, 0x89, 0x70, 0x52, 0xb3,
-	0xce, 0xb7, 0x43, 0xfb, 0x0f, 0xb9, 0xfa, 0x17, 0x00, 0x00, 0xff, 0xff, 0xad, 0xbd, 0x47, 0x9c,
-	0x54, 0x04, 0x00, 0x00,
-}